@@ -0,0 +1,38 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data")
+	os.WriteFile(path, []byte("old"), 0640)
+
+	if err := WriteFile(path, []byte("new")); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	if string(content) != "new" {
+		t.Errorf("content = %q, expected new", content)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode = %v, expected 0640 to be preserved", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected no temp files to be left behind, found %d entries", len(entries))
+	}
+}
+
+func TestWriteFile_MissingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "data")
+
+	if err := WriteFile(path, []byte("new")); err == nil {
+		t.Errorf("expected WriteFile() into a missing directory to fail")
+	}
+}
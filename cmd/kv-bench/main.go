@@ -0,0 +1,286 @@
+// kv-bench measures a kv-store server the way redis-benchmark does: many
+// connections send a workload of commands, optionally pipelined, and the
+// throughput and latency percentiles of each command are reported.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+
+type options struct {
+	network  string
+	address  string
+	password string
+	clients  int
+	requests int
+	duration time.Duration
+	warmup   time.Duration
+	pipeline int
+	keyspace int
+	size     int
+}
+
+func main() {
+	host := flag.String("h", "127.0.0.1", "Server hostname")
+	port := flag.Int("p", 8000, "Server port")
+	unixSocket := flag.String("unixsocket", "", "Connect to this unix socket instead of -h and -p")
+	password := flag.String("a", "", "Password to AUTH with after connecting")
+	clients := flag.Int("c", 50, "Number of parallel connections")
+	requests := flag.Int("n", 100000, "Requests per test, unless -duration is set")
+	duration := flag.Duration("duration", 0, "Run each test for this long instead of for -n requests")
+	warmup := flag.Duration("warmup", 0, "Send the workload for this long before each test, unmeasured")
+	pipeline := flag.Int("P", 1, "Requests sent at once on a connection before reading the replies")
+	keyspace := flag.Int("r", 10000, "Number of distinct keys the requests pick from at random")
+	size := flag.Int("d", 3, "Size of SET values, in bytes")
+	tests := flag.String("t", "set,get,incr", "Comma-separated tests to run in turn: set, get, incr or mixed")
+	ratio := flag.String("ratio", "set=1,get=9", "Weights of the commands of the mixed test")
+	csvOutput := flag.Bool("csv", false, "Print the results as CSV")
+	flag.Parse()
+
+	opts := options{
+		network: "tcp", address: net.JoinHostPort(*host, strconv.Itoa(*port)), password: *password,
+		clients: *clients, requests: *requests, duration: *duration, warmup: *warmup,
+		pipeline: *pipeline, keyspace: *keyspace, size: *size,
+	}
+	if *unixSocket != "" {
+		opts.network, opts.address = "unix", *unixSocket
+	}
+	if opts.clients < 1 || opts.pipeline < 1 || opts.keyspace < 1 || opts.size < 0 || (opts.duration == 0 && opts.requests < 1) {
+		fmt.Fprintln(os.Stderr, "-c, -P, -r and -n must be at least 1, and -d not negative")
+		os.Exit(2)
+	}
+	workloads, err := parseWorkloads(*tests, *ratio)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var csvWriter *csv.Writer
+	if *csvOutput {
+		csvWriter = csv.NewWriter(os.Stdout)
+		csvWriter.Write(csvHeader)
+	} else {
+		fmt.Printf("%d clients, %d byte values, pipeline %d, %d keys\n", opts.clients, opts.size, opts.pipeline, opts.keyspace)
+	}
+	for _, w := range workloads {
+		results, err := runTest(opts, w)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", w.name, err)
+			os.Exit(1)
+		}
+		for _, r := range results {
+			if csvWriter != nil {
+				writeCSV(csvWriter, r)
+			} else {
+				writeText(os.Stdout, r)
+			}
+		}
+		if csvWriter != nil {
+			csvWriter.Flush()
+		}
+	}
+}
+
+// runTest drives w from opts.clients connections after the warmup, and
+// summarizes each of its commands, and all of them together for a mix.
+func runTest(opts options, w workload) ([]result, error) {
+	conns := make([]*benchConn, opts.clients)
+	for i := range conns {
+		conn, err := dial(opts)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.conn.Close()
+		conns[i] = conn
+	}
+	if opts.warmup > 0 {
+		if _, err := drive(conns, opts, w, 0, time.Now().Add(opts.warmup)); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	limit, deadline := opts.requests, time.Time{}
+	if opts.duration > 0 {
+		limit, deadline = 0, start.Add(opts.duration)
+	}
+	collected, err := drive(conns, opts, w, limit, deadline)
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+
+	var results []result
+	all := &stats{}
+	for _, command := range w.commands {
+		if s := collected[command]; s != nil {
+			all.merge(s)
+			results = append(results, summarize(w.name, command, s, elapsed))
+		}
+	}
+	if len(w.commands) > 1 {
+		results = append(results, summarize(w.name, "ALL", all, elapsed))
+	}
+	return results, nil
+}
+
+// drive sends w on every connection until limit requests were sent in all,
+// or until deadline when limit is 0, and merges what each measured.
+func drive(conns []*benchConn, opts options, w workload, limit int, deadline time.Time) (map[string]*stats, error) {
+	var remaining atomic.Int64
+	remaining.Store(int64(limit))
+	collected := make([]map[string]*stats, len(conns))
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(i), uint64(time.Now().UnixNano())))
+			collected[i], errs[i] = conn.run(opts, w, rng, limit > 0, &remaining, deadline)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]*stats)
+	for _, byCommand := range collected {
+		for command, s := range byCommand {
+			if merged[command] == nil {
+				merged[command] = &stats{}
+			}
+			merged[command].merge(s)
+		}
+	}
+	return merged, nil
+}
+
+type benchConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func dial(opts options) (*benchConn, error) {
+	conn, err := net.DialTimeout(opts.network, opts.address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &benchConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	if opts.password != "" {
+		writeRequest(c.writer, []string{"AUTH", opts.password})
+		if err := c.writer.Flush(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if failed, err := skipReply(c.reader); err != nil || failed {
+			conn.Close()
+			return nil, fmt.Errorf("AUTH failed")
+		}
+	}
+	return c, nil
+}
+
+// run sends batches of opts.pipeline requests, each batch once the previous
+// one's replies are in, claiming them from remaining when limited.
+func (c *benchConn) run(opts options, w workload, rng *rand.Rand, limited bool, remaining *atomic.Int64, deadline time.Time) (map[string]*stats, error) {
+	measured := make(map[string]*stats)
+	value := strings.Repeat("x", opts.size)
+	commands := make([]string, 0, opts.pipeline)
+	for {
+		n := opts.pipeline
+		if limited {
+			left := remaining.Add(-int64(n))
+			n = min(n, int(left)+n)
+		}
+		if n <= 0 || (!deadline.IsZero() && time.Now().After(deadline)) {
+			return measured, nil
+		}
+
+		sent := time.Now()
+		commands = commands[:0]
+		for range n {
+			command := w.pick(rng)
+			commands = append(commands, command)
+			writeRequest(c.writer, request(command, rng, opts.keyspace, value))
+		}
+		if err := c.writer.Flush(); err != nil {
+			return nil, err
+		}
+		for _, command := range commands {
+			failed, err := skipReply(c.reader)
+			if err != nil {
+				return nil, err
+			}
+			s := measured[command]
+			if s == nil {
+				s = &stats{}
+				measured[command] = s
+			}
+			s.latencies = append(s.latencies, time.Since(sent))
+			if failed {
+				s.errors++
+			}
+		}
+	}
+}
+
+// writeRequest buffers args as a RESP array of bulk strings.
+func writeRequest(writer *bufio.Writer, args []string) {
+	writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		writer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+}
+
+// skipReply reads one RESP2 reply, reporting whether it was an error.
+func skipReply(reader *bufio.Reader) (bool, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	if len(line) < 3 {
+		return false, fmt.Errorf("unexpected reply %q", line)
+	}
+	switch line[0] {
+	case '-':
+		return true, nil
+	case '+', ':':
+		return false, nil
+	case '$', '*':
+		n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil {
+			return false, fmt.Errorf("unexpected reply %q", line)
+		}
+		if line[0] == '$' {
+			if n >= 0 {
+				_, err = reader.Discard(n + 2)
+			}
+			return false, err
+		}
+		for range n {
+			if _, err := skipReply(reader); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"kv-store/server"
+	"kv-store/store"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) (*store.Store, string) {
+	t.Helper()
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	srv, err := server.New(server.WithAddress("127.0.0.1:0"), server.WithStore(s))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return s, srv.Addr().String()
+}
+
+func TestRunTest(t *testing.T) {
+	s, address := startServer(t)
+	opts := options{network: "tcp", address: address, clients: 4, requests: 1001, pipeline: 8, keyspace: 50, size: 16}
+
+	workloads, _ := parseWorkloads("set,incr,mixed", "set=1,get=1")
+	for _, w := range workloads {
+		results, err := runTest(opts, w)
+		if err != nil {
+			t.Fatalf("runTest(%s) failed: %v", w.name, err)
+		}
+		total := results[len(results)-1]
+		if total.requests != opts.requests || total.errors != 0 {
+			t.Errorf("runTest(%s) made %d requests with %d errors, expected %d without errors", w.name, total.requests, total.errors, opts.requests)
+		}
+		if len(w.commands) > 1 && (len(results) != 3 || total.command != "ALL") {
+			t.Errorf("runTest(%s) = %+v, expected a result per command and ALL", w.name, results)
+		}
+	}
+	if value, _, _ := s.Get(0, "key:0"); value != strings.Repeat("x", 16) {
+		t.Errorf("key:0 = %q, expected the benchmark's value", value)
+	}
+
+	opts.duration, opts.warmup = 50*time.Millisecond, 10*time.Millisecond
+	results, err := runTest(opts, workloads[0])
+	if err != nil || results[0].requests == 0 || results[0].elapsed < opts.duration {
+		t.Errorf("runTest for %v = %+v, %v, expected requests over at least that long", opts.duration, results, err)
+	}
+}
+
+func TestSkipReply(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nfoo\r\n$-1\r\n-ERR boom\r\n:1\r\n"))
+	for _, expected := range []bool{false, true, false} {
+		failed, err := skipReply(reader)
+		if err != nil || failed != expected {
+			t.Fatalf("skipReply = %v, %v, expected %v", failed, err, expected)
+		}
+	}
+	if _, err := skipReply(reader); err == nil {
+		t.Error("skipReply at the end of input succeeded")
+	}
+}
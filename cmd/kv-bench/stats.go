@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// stats collects the latencies of one command, each request's measured
+// from when its batch was sent to when its reply arrived.
+type stats struct {
+	latencies []time.Duration
+	errors    int
+}
+
+func (s *stats) merge(other *stats) {
+	s.latencies = append(s.latencies, other.latencies...)
+	s.errors += other.errors
+}
+
+// percentile returns the latency p percent of requests were at most, from
+// sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(float64(len(sorted))*p/100)) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// result is the summary of one command in one test.
+type result struct {
+	test     string
+	command  string
+	requests int
+	errors   int
+	elapsed  time.Duration
+	p50      time.Duration
+	p95      time.Duration
+	p99      time.Duration
+	max      time.Duration
+}
+
+func summarize(test, command string, s *stats, elapsed time.Duration) result {
+	slices.Sort(s.latencies)
+	r := result{test: test, command: command, requests: len(s.latencies), errors: s.errors, elapsed: elapsed}
+	if len(s.latencies) > 0 {
+		r.p50 = percentile(s.latencies, 50)
+		r.p95 = percentile(s.latencies, 95)
+		r.p99 = percentile(s.latencies, 99)
+		r.max = s.latencies[len(s.latencies)-1]
+	}
+	return r
+}
+
+func (r result) throughput() float64 {
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.requests) / r.elapsed.Seconds()
+}
+
+func milliseconds(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+func writeText(out io.Writer, r result) {
+	label := r.test
+	if r.command != r.test {
+		label += " " + r.command
+	}
+	fmt.Fprintf(out, "%s: %d requests in %.2f seconds, %.2f requests per second",
+		label, r.requests, r.elapsed.Seconds(), r.throughput())
+	if r.errors > 0 {
+		fmt.Fprintf(out, ", %d errors", r.errors)
+	}
+	fmt.Fprintf(out, "\n  latency (ms): p50=%s p95=%s p99=%s max=%s\n",
+		milliseconds(r.p50), milliseconds(r.p95), milliseconds(r.p99), milliseconds(r.max))
+}
+
+var csvHeader = []string{"test", "command", "requests", "errors", "seconds", "rps", "p50_ms", "p95_ms", "p99_ms", "max_ms"}
+
+func writeCSV(out *csv.Writer, r result) {
+	out.Write([]string{
+		r.test, r.command, strconv.Itoa(r.requests), strconv.Itoa(r.errors),
+		strconv.FormatFloat(r.elapsed.Seconds(), 'f', 3, 64),
+		strconv.FormatFloat(r.throughput(), 'f', 2, 64),
+		milliseconds(r.p50), milliseconds(r.p95), milliseconds(r.p99), milliseconds(r.max),
+	})
+}
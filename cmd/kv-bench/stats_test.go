@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	s := &stats{errors: 2}
+	for i := 100; i >= 1; i-- {
+		s.latencies = append(s.latencies, time.Duration(i)*time.Millisecond)
+	}
+	r := summarize("SET", "SET", s, 2*time.Second)
+
+	expected := result{
+		test: "SET", command: "SET", requests: 100, errors: 2, elapsed: 2 * time.Second,
+		p50: 50 * time.Millisecond, p95: 95 * time.Millisecond, p99: 99 * time.Millisecond, max: 100 * time.Millisecond,
+	}
+	if r != expected {
+		t.Errorf("summarize = %+v, expected %+v", r, expected)
+	}
+	if r.throughput() != 50 {
+		t.Errorf("throughput = %v, expected 50", r.throughput())
+	}
+
+	var out strings.Builder
+	writer := csv.NewWriter(&out)
+	writeCSV(writer, r)
+	writer.Flush()
+	if got := out.String(); got != "SET,SET,100,2,2.000,50.00,50.000,95.000,99.000,100.000\n" {
+		t.Errorf("writeCSV wrote %q", got)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3}
+	testCases := []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{0, 1}, {33, 1}, {34, 2}, {50, 2}, {99, 3}, {100, 3},
+	}
+	for _, tc := range testCases {
+		if got := percentile(sorted, tc.p); got != tc.expected {
+			t.Errorf("percentile(%v, %v) = %v, expected %v", sorted, tc.p, got, tc.expected)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of no latencies = %v, expected 0", got)
+	}
+}
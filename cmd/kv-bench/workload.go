@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// benchCommands are the commands a workload can send.
+var benchCommands = map[string]bool{"SET": true, "GET": true, "INCR": true}
+
+// workload is one test: the commands it sends, each picked with its weight.
+type workload struct {
+	name     string
+	commands []string
+	weights  []int
+	total    int
+}
+
+// parseWorkloads reads -t, a comma-separated list of tests run in turn.
+// Each is a command, or "mixed" for the weights of -ratio.
+func parseWorkloads(tests, ratio string) ([]workload, error) {
+	var workloads []workload
+	for _, test := range strings.Split(tests, ",") {
+		test = strings.ToUpper(strings.TrimSpace(test))
+		if test == "MIXED" {
+			mixed, err := parseRatio(ratio)
+			if err != nil {
+				return nil, err
+			}
+			workloads = append(workloads, mixed)
+			continue
+		}
+		if !benchCommands[test] {
+			return nil, fmt.Errorf("unknown test %q, expected set, get, incr or mixed", test)
+		}
+		workloads = append(workloads, workload{name: test, commands: []string{test}, weights: []int{1}, total: 1})
+	}
+	return workloads, nil
+}
+
+// parseRatio reads weights like "set=1,get=9" into the mixed workload.
+func parseRatio(ratio string) (workload, error) {
+	w := workload{name: "MIXED"}
+	for _, part := range strings.Split(ratio, ",") {
+		name, weight, found := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.ToUpper(name)
+		n, err := strconv.Atoi(weight)
+		if !found || !benchCommands[name] || err != nil || n < 0 {
+			return workload{}, fmt.Errorf("invalid ratio %q, expected command=weight pairs like set=1,get=9", part)
+		}
+		w.commands = append(w.commands, name)
+		w.weights = append(w.weights, n)
+		w.total += n
+	}
+	if w.total == 0 {
+		return workload{}, fmt.Errorf("invalid ratio %q, the weights add up to 0", ratio)
+	}
+	return w, nil
+}
+
+// pick chooses the next command by weight.
+func (w workload) pick(rng *rand.Rand) string {
+	n := rng.IntN(w.total)
+	for i, weight := range w.weights {
+		if n < weight {
+			return w.commands[i]
+		}
+		n -= weight
+	}
+	return w.commands[len(w.commands)-1]
+}
+
+// request builds command against a random key of the keyspace. Counters
+// have keys of their own, as INCR fails on the values SET writes.
+func request(command string, rng *rand.Rand, keyspace int, value string) []string {
+	n := strconv.Itoa(rng.IntN(keyspace))
+	switch command {
+	case "SET":
+		return []string{"SET", "key:" + n, value}
+	case "GET":
+		return []string{"GET", "key:" + n}
+	default:
+		return []string{"INCR", "counter:" + n}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+func TestParseWorkloads(t *testing.T) {
+	testCases := []struct {
+		name     string
+		tests    string
+		ratio    string
+		expected []workload
+		wantErr  bool
+	}{
+		{"commands", "set, GET", "", []workload{
+			{name: "SET", commands: []string{"SET"}, weights: []int{1}, total: 1},
+			{name: "GET", commands: []string{"GET"}, weights: []int{1}, total: 1},
+		}, false},
+		{"mixed", "mixed", "set=1,get=9,incr=0", []workload{
+			{name: "MIXED", commands: []string{"SET", "GET", "INCR"}, weights: []int{1, 9, 0}, total: 10},
+		}, false},
+		{"unknown test", "del", "", nil, true},
+		{"unknown ratio command", "mixed", "del=1", nil, true},
+		{"ratio without weight", "mixed", "set", nil, true},
+		{"negative weight", "mixed", "set=-1,get=2", nil, true},
+		{"zero weights", "mixed", "set=0", nil, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			workloads, err := parseWorkloads(tc.tests, tc.ratio)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseWorkloads(%q, %q) error = %v, wantErr %v", tc.tests, tc.ratio, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(workloads, tc.expected) {
+				t.Errorf("parseWorkloads(%q, %q) = %+v, expected %+v", tc.tests, tc.ratio, workloads, tc.expected)
+			}
+		})
+	}
+}
+
+func TestWorkloadPick(t *testing.T) {
+	w, _ := parseRatio("set=1,get=3,incr=0")
+	rng := rand.New(rand.NewPCG(1, 2))
+	counts := make(map[string]int)
+	for range 40000 {
+		counts[w.pick(rng)]++
+	}
+	if counts["INCR"] != 0 || counts["SET"] < 9000 || counts["SET"] > 11000 || counts["GET"] < 29000 || counts["GET"] > 31000 {
+		t.Errorf("picked %v of 40000, expected about 10000 SET and 30000 GET", counts)
+	}
+}
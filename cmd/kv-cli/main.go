@@ -0,0 +1,258 @@
+// kv-cli is a command line client for kv-store. It runs the command given as
+// arguments, the commands piped to it one per line, or else an interactive
+// prompt with history and completion of command names.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"kv-store/parser"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const dialTimeout = 5 * time.Second
+
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func dial(network, address string) (*client, error) {
+	conn, err := net.DialTimeout(network, address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &client{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}, nil
+}
+
+// do sends one command and waits for its reply.
+func (c *client) do(args []string) (reply, error) {
+	if err := writeRequest(c.writer, args); err != nil {
+		return reply{}, err
+	}
+	return readReply(c.reader)
+}
+
+func main() {
+	host := flag.String("h", "127.0.0.1", "Server hostname")
+	port := flag.Int("p", 8000, "Server port")
+	unixSocket := flag.String("unixsocket", "", "Connect to this unix socket instead of -h and -p")
+	password := flag.String("a", "", "Password to AUTH with after connecting")
+	raw := flag.Bool("raw", false, "Print replies bare, without types, quotes or numbering, for scripts")
+	flag.Parse()
+
+	network, address := "tcp", net.JoinHostPort(*host, strconv.Itoa(*port))
+	if *unixSocket != "" {
+		network, address = "unix", *unixSocket
+	}
+	c, err := dial(network, address)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to %s: %v\n", address, err)
+		os.Exit(1)
+	}
+	defer c.conn.Close()
+
+	print := format
+	if *raw {
+		print = formatRaw
+	}
+	if *password != "" {
+		if r, err := c.do([]string{"AUTH", *password}); err != nil || r.isError() {
+			fmt.Fprintln(os.Stderr, "AUTH failed:", errorText(r, err))
+			os.Exit(1)
+		}
+	}
+
+	var ok bool
+	switch {
+	case flag.NArg() > 0:
+		ok = c.runOnce(flag.Args(), os.Stdout, print)
+	case !term.IsTerminal(int(os.Stdin.Fd())):
+		ok = c.runPipe(os.Stdin, os.Stdout, print)
+	default:
+		ok = c.runPrompt(address, print)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func errorText(r reply, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return r.text
+}
+
+// runOnce runs one command, reporting false if it failed.
+func (c *client) runOnce(args []string, out io.Writer, print func(reply) string) bool {
+	r, err := c.do(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return false
+	}
+	fmt.Fprintln(out, print(r))
+	return !r.isError()
+}
+
+// runPipe runs each line of in as a command, reporting false if any failed.
+// The commands are sent without waiting for replies, so a bulk load costs
+// one round trip rather than one per line.
+func (c *client) runPipe(in io.Reader, out io.Writer, print func(reply) string) bool {
+	// Each line sent is announced with a nil error, and a line that does
+	// not parse with its error, so replies are matched up in order.
+	sent := make(chan error, 1024)
+	go func() {
+		defer close(sent)
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(nil, 512<<20)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			command, args, err := parser.ParseCommandLine(scanner.Text())
+			if err == nil {
+				err = writeRequest(c.writer, append([]string{command}, args...))
+				if err != nil {
+					return
+				}
+			}
+			sent <- err
+		}
+		if err := scanner.Err(); err != nil {
+			sent <- err
+		}
+	}()
+
+	ok := true
+	for parseErr := range sent {
+		if parseErr != nil {
+			fmt.Fprintln(out, print(reply{kind: '-', text: parseErr.Error()}))
+			ok = false
+			continue
+		}
+		r, err := readReply(c.reader)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return false
+		}
+		fmt.Fprintln(out, print(r))
+		ok = ok && !r.isError()
+	}
+	return ok
+}
+
+// runPrompt reads commands from the terminal until QUIT, EXIT or end of
+// input. Up and down recall earlier lines, and tab completes command names.
+func (c *client) runPrompt(address string, print func(reply) string) bool {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return false
+	}
+	defer term.Restore(fd, state)
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, address+"> ")
+	names := c.commandNames()
+	terminal.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return complete(names, line, pos)
+	}
+	for {
+		line, err := terminal.ReadLine()
+		if err == term.ErrPasteIndicator {
+			err = nil
+		}
+		if err != nil {
+			return true
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		command, args, err := parser.ParseCommandLine(line)
+		if err != nil {
+			fmt.Fprintln(terminal, print(reply{kind: '-', text: err.Error()}))
+			continue
+		}
+		if command == "QUIT" || command == "EXIT" {
+			return true
+		}
+		r, err := c.do(append([]string{command}, args...))
+		if err != nil {
+			fmt.Fprintln(terminal, "Error:", err)
+			return false
+		}
+		fmt.Fprintln(terminal, print(r))
+		if command == "SELECT" && !r.isError() {
+			prompt := address + "> "
+			if args[0] != "0" {
+				prompt = address + "[" + args[0] + "]> "
+			}
+			terminal.SetPrompt(prompt)
+		}
+	}
+}
+
+// commandNames asks the server for the names of its commands, sorted, or
+// returns none if it will not say.
+func (c *client) commandNames() []string {
+	r, err := c.do([]string{"COMMAND"})
+	if err != nil || r.kind != '$' {
+		return nil
+	}
+	var names []string
+	for _, line := range strings.Split(r.text, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			names = append(names, strings.ToUpper(fields[0]))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// complete extends the command name being typed at the start of line, as
+// far as the names it could be agree, and adds a space once only one fits.
+func complete(names []string, line string, pos int) (string, int, bool) {
+	prefix := line[:pos]
+	if strings.ContainsAny(prefix, " \t") {
+		return "", 0, false
+	}
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, strings.ToUpper(prefix)) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	completed := matches[0]
+	if len(matches) == 1 {
+		completed += " "
+	}
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, completed) {
+			completed = completed[:len(completed)-1]
+		}
+	}
+	if len(completed) < len(prefix) {
+		return "", 0, false
+	}
+	return completed + line[pos:], len(completed), true
+}
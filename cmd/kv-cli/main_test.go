@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"kv-store/server"
+	"strings"
+	"testing"
+)
+
+func TestComplete(t *testing.T) {
+	names := []string{"GET", "PFADD", "PFCOUNT", "PFMERGE", "SET", "SELECT"}
+	testCases := []struct {
+		line     string
+		pos      int
+		expected string
+		newPos   int
+		ok       bool
+	}{
+		{"ge", 2, "GET ", 4, true},
+		{"pf", 2, "PF", 2, true},
+		{"pfc", 3, "PFCOUNT ", 8, true},
+		{"s", 1, "SE", 2, true},
+		{"sel key", 3, "SELECT  key", 7, true},
+		{"nope", 4, "", 0, false},
+		{"get ke", 6, "", 0, false},
+	}
+	for _, tc := range testCases {
+		line, pos, ok := complete(names, tc.line, tc.pos)
+		if line != tc.expected || pos != tc.newPos || ok != tc.ok {
+			t.Errorf("complete(%q, %d) = %q, %d, %v, expected %q, %d, %v", tc.line, tc.pos, line, pos, ok, tc.expected, tc.newPos, tc.ok)
+		}
+	}
+}
+
+func dialServer(t *testing.T) *client {
+	t.Helper()
+	s, err := server.New(server.WithAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	c, err := dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("dial() failed: %v", err)
+	}
+	t.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+func TestRunOnce(t *testing.T) {
+	c := dialServer(t)
+	var out strings.Builder
+	if !c.runOnce([]string{"SET", "name", "batman"}, &out, format) {
+		t.Error("runOnce(SET) reported a failure")
+	}
+	if c.runOnce([]string{"INCR", "name"}, &out, format) {
+		t.Error("runOnce(INCR) of a string reported success")
+	}
+	if !c.runOnce([]string{"GET", "name"}, &out, formatRaw) {
+		t.Error("runOnce(GET) reported a failure")
+	}
+	expected := "OK\n(error) ERR value is not an integer or out of range\nbatman\n"
+	if out.String() != expected {
+		t.Errorf("runOnce printed %q, expected %q", out.String(), expected)
+	}
+}
+
+func TestRunPipe(t *testing.T) {
+	c := dialServer(t)
+	var input strings.Builder
+	for range 1000 {
+		input.WriteString("INCR counter\n")
+	}
+	input.WriteString("\nSET name \"bat man\"\nGET name\n")
+
+	var out strings.Builder
+	if !c.runPipe(strings.NewReader(input.String()), &out, formatRaw) {
+		t.Errorf("runPipe reported a failure:\n%s", out.String())
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 1002 || lines[999] != "1000" || lines[1001] != "bat man" {
+		t.Errorf("runPipe printed %d lines ending %q, expected 1002 ending with 1000, OK and \"bat man\"", len(lines), lines[len(lines)-3:])
+	}
+
+	out.Reset()
+	if c.runPipe(strings.NewReader("GET name\nGET \"open\nINCR name\n"), &out, format) {
+		t.Error("runPipe of failing commands reported success")
+	}
+	expected := "\"bat man\"\n(error) ERR syntax, mismatched quotes at position 4\n(error) ERR value is not an integer or out of range\n"
+	if out.String() != expected {
+		t.Errorf("runPipe printed %q, expected %q", out.String(), expected)
+	}
+}
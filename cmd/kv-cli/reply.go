@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// reply is one RESP2 reply. kind is its type byte: '+' for a status, '-' for
+// an error, ':' for an integer, '$' for a bulk string and '*' for an array.
+type reply struct {
+	kind     byte
+	text     string
+	elements []reply
+	null     bool
+}
+
+func (r reply) isError() bool {
+	return r.kind == '-'
+}
+
+// writeRequest sends args as a RESP array of bulk strings.
+func writeRequest(writer *bufio.Writer, args []string) error {
+	writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		writer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return writer.Flush()
+}
+
+func readReply(reader *bufio.Reader) (reply, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return reply{}, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return reply{}, fmt.Errorf("empty reply line")
+	}
+	r := reply{kind: line[0], text: line[1:]}
+	switch r.kind {
+	case '+', '-', ':':
+		return r, nil
+	case '$':
+		length, err := strconv.Atoi(r.text)
+		if err != nil {
+			return reply{}, fmt.Errorf("invalid bulk length %q", r.text)
+		}
+		if length < 0 {
+			return reply{kind: '$', null: true}, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return reply{}, err
+		}
+		return reply{kind: '$', text: string(data[:length])}, nil
+	case '*':
+		count, err := strconv.Atoi(r.text)
+		if err != nil {
+			return reply{}, fmt.Errorf("invalid array length %q", r.text)
+		}
+		if count < 0 {
+			return reply{kind: '*', null: true}, nil
+		}
+		r = reply{kind: '*', elements: make([]reply, count)}
+		for i := range r.elements {
+			if r.elements[i], err = readReply(reader); err != nil {
+				return reply{}, err
+			}
+		}
+		return r, nil
+	default:
+		return reply{}, fmt.Errorf("unexpected reply %q", line)
+	}
+}
+
+// format renders r for a person, as redis-cli does: types are labelled,
+// strings quoted and array elements numbered, nested ones indented under
+// their number. A string of several lines, such as INFO, is shown as is.
+func format(r reply) string {
+	switch {
+	case r.null:
+		return "(nil)"
+	case r.kind == '-':
+		return "(error) " + r.text
+	case r.kind == ':':
+		return "(integer) " + r.text
+	case r.kind == '$' && !strings.Contains(r.text, "\n"):
+		return strconv.Quote(r.text)
+	case r.kind == '*' && len(r.elements) == 0:
+		return "(empty array)"
+	case r.kind == '*':
+		var lines []string
+		width := len(strconv.Itoa(len(r.elements)))
+		for i, element := range r.elements {
+			label := fmt.Sprintf("%*d) ", width, i+1)
+			for j, line := range strings.Split(format(element), "\n") {
+				if j == 0 {
+					lines = append(lines, label+line)
+				} else {
+					lines = append(lines, strings.Repeat(" ", len(label))+line)
+				}
+			}
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return r.text
+	}
+}
+
+// formatRaw renders r for scripts: bare values, one per line, and nothing for
+// nil.
+func formatRaw(r reply) string {
+	if r.kind != '*' {
+		return r.text
+	}
+	lines := make([]string, len(r.elements))
+	for i, element := range r.elements {
+		lines[i] = formatRaw(element)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadReply_Format(t *testing.T) {
+	testCases := []struct {
+		name      string
+		wire      string
+		formatted string
+		raw       string
+	}{
+		{"status", "+OK\r\n", "OK", "OK"},
+		{"error", "-ERR unknown command: NOPE\r\n", "(error) ERR unknown command: NOPE", "ERR unknown command: NOPE"},
+		{"integer", ":42\r\n", "(integer) 42", "42"},
+		{"bulk", "$7\r\nbat\"man\r\n", `"bat\"man"`, `bat"man`},
+		{"nil", "$-1\r\n", "(nil)", ""},
+		{"multi-line bulk", "$13\r\nrole:master\nx\r\n", "role:master\nx", "role:master\nx"},
+		{"empty array", "*0\r\n", "(empty array)", ""},
+		{"aborted exec", "*-1\r\n", "(nil)", ""},
+		{"exec", "*2\r\n+OK\r\n:2\r\n", "1) OK\n2) (integer) 2", "OK\n2"},
+		{"nested", "*3\r\n$6\r\nmaster\r\n:0\r\n*1\r\n*2\r\n$9\r\n127.0.0.1\r\n$4\r\n6380\r\n",
+			"1) \"master\"\n2) (integer) 0\n3) 1) 1) \"127.0.0.1\"\n      2) \"6380\"",
+			"master\n0\n127.0.0.1\n6380"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := readReply(bufio.NewReader(strings.NewReader(tc.wire)))
+			if err != nil {
+				t.Fatalf("readReply(%q) failed: %v", tc.wire, err)
+			}
+			if got := format(r); got != tc.formatted {
+				t.Errorf("format = %q, expected %q", got, tc.formatted)
+			}
+			if got := formatRaw(r); got != tc.raw {
+				t.Errorf("formatRaw = %q, expected %q", got, tc.raw)
+			}
+		})
+	}
+}
+
+func TestFormat_WideArray(t *testing.T) {
+	r := reply{kind: '*'}
+	for range 10 {
+		r.elements = append(r.elements, reply{kind: ':', text: "1"})
+	}
+	lines := strings.Split(format(r), "\n")
+	if lines[0] != " 1) (integer) 1" || lines[9] != "10) (integer) 1" {
+		t.Errorf("format numbered %q and %q, expected the numbers aligned", lines[0], lines[9])
+	}
+}
@@ -0,0 +1,241 @@
+// kv-dump copies the data of a kv-store server to a file and back. It
+// exports every database with DUMPALL, one JSON line per key, and -restore
+// writes such a file back with SELECT and SET. Restoring is idempotent, so
+// an interrupted restore can be run again, or resumed with -skip.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"kv-store/persistence"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+
+// restoreBatchSize is how many requests a restore sends before reading
+// their replies.
+const restoreBatchSize = 1000
+
+type conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func main() {
+	host := flag.String("h", "127.0.0.1", "Server hostname")
+	port := flag.Int("p", 8000, "Server port")
+	unixSocket := flag.String("unixsocket", "", "Connect to this unix socket instead of -h and -p")
+	password := flag.String("a", "", "Password to AUTH with after connecting")
+	output := flag.String("o", "-", "File to export to, or - for standard output")
+	restorePath := flag.String("restore", "", "Restore this export file instead of exporting")
+	skip := flag.Int("skip", 0, "Lines of the -restore file to skip, to resume an interrupted restore")
+	progressEvery := flag.Int("progress", 100000, "Report progress every this many keys, or never when 0")
+	flag.Parse()
+
+	network, address := "tcp", net.JoinHostPort(*host, strconv.Itoa(*port))
+	if *unixSocket != "" {
+		network, address = "unix", *unixSocket
+	}
+	c, err := dial(network, address, *password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to %s: %v\n", address, err)
+		os.Exit(1)
+	}
+	defer c.conn.Close()
+
+	if *restorePath != "" {
+		file, err := os.Open(*restorePath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		restored, expiring, err := c.restore(file, *skip, os.Stderr, *progressEvery)
+		if expiring > 0 {
+			fmt.Fprintf(os.Stderr, "%d keys had a TTL, which the server cannot set yet; they were restored without one\n", expiring)
+		}
+		fmt.Fprintf(os.Stderr, "Restored %d keys from %s\n", restored, *restorePath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Restore failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	exported, err := c.export(out, os.Stderr, *progressEvery)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Export failed:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d keys\n", exported)
+}
+
+func dial(network, address, password string) (*conn, error) {
+	netConn, err := net.DialTimeout(network, address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{conn: netConn, reader: bufio.NewReader(netConn), writer: bufio.NewWriter(netConn)}
+	if password != "" {
+		writeRequest(c.writer, "AUTH", password)
+		if err := c.writer.Flush(); err == nil {
+			_, err = readReply(c.reader)
+		}
+		if err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("AUTH failed: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// export writes every line DUMPALL replies with to out, and returns how
+// many there were.
+func (c *conn) export(out io.Writer, progress io.Writer, every int) (int, error) {
+	writeRequest(c.writer, "DUMPALL")
+	if err := c.writer.Flush(); err != nil {
+		return 0, err
+	}
+	header, err := c.reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	header = strings.TrimSuffix(header, "\r\n")
+	if strings.HasPrefix(header, "-") {
+		return 0, errors.New(header[1:])
+	}
+	count, err := strconv.Atoi(strings.TrimPrefix(header, "*"))
+	if !strings.HasPrefix(header, "*") || err != nil {
+		return 0, fmt.Errorf("unexpected reply %q to DUMPALL", header)
+	}
+
+	buffered := bufio.NewWriter(out)
+	for i := range count {
+		line, err := readReply(c.reader)
+		if err != nil {
+			return i, err
+		}
+		buffered.WriteString(line + "\n")
+		if every > 0 && (i+1)%every == 0 {
+			fmt.Fprintf(progress, "Exported %d of %d keys\n", i+1, count)
+		}
+	}
+	return count, buffered.Flush()
+}
+
+// restore sets every key of an export read from in, after skipping its
+// first skip lines. Requests are sent in batches, and the first failure
+// stops the restore with the line it came from. It returns how many keys
+// were restored, and how many of them lost their TTL.
+func (c *conn) restore(in io.Reader, skip int, progress io.Writer, every int) (int, int, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<30)
+	now := time.Now()
+	// lines holds the line each request of the batch came from.
+	var lines []int
+	restored, expiring, db, lineNumber := 0, 0, -1, 0
+	send := func() error {
+		if err := c.writer.Flush(); err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if _, err := readReply(c.reader); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		lines = lines[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		lineNumber++
+		if lineNumber <= skip || len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e, err := persistence.DecodeExportLine(scanner.Bytes(), now)
+		if err != nil {
+			return restored, expiring, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if e.DB != db {
+			writeRequest(c.writer, "SELECT", strconv.Itoa(e.DB))
+			lines = append(lines, lineNumber)
+			db = e.DB
+		}
+		writeRequest(c.writer, "SET", e.Key, e.Value)
+		lines = append(lines, lineNumber)
+		if e.ExpireAt != 0 {
+			expiring++
+		}
+		if len(lines) >= restoreBatchSize {
+			if err := send(); err != nil {
+				return restored, expiring, err
+			}
+		}
+		restored++
+		if every > 0 && restored%every == 0 {
+			fmt.Fprintf(progress, "Restored %d keys, up to line %d\n", restored, lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return restored, expiring, err
+	}
+	return restored, expiring, send()
+}
+
+// writeRequest buffers args as a RESP array of bulk strings.
+func writeRequest(writer *bufio.Writer, args ...string) {
+	writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		writer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+}
+
+// readReply reads a status, integer or bulk string reply, returning an error
+// reply as an error.
+func readReply(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", errors.New(line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return "", fmt.Errorf("unexpected reply %q", line)
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return "", err
+		}
+		return string(data[:length]), nil
+	default:
+		return "", fmt.Errorf("unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"kv-store/server"
+	"kv-store/store"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func startServer(t *testing.T) (*store.Store, string) {
+	t.Helper()
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	srv, err := server.New(server.WithAddress("127.0.0.1:0"), server.WithStore(s))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop(context.Background()) })
+	return s, srv.Addr().String()
+}
+
+func connect(t *testing.T, address string) *conn {
+	t.Helper()
+	c, err := dial("tcp", address, "")
+	if err != nil {
+		t.Fatalf("dial(%s) failed: %v", address, err)
+	}
+	t.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+func TestExportRestore(t *testing.T) {
+	source, sourceAddress := startServer(t)
+	source.Set(0, "name", "batman")
+	source.Set(0, "quoted", "a \"b\"\r\n")
+	source.Set(3, "binary", "\x00\xff")
+	for i := range restoreBatchSize {
+		source.Set(5, "key:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	var export, progress strings.Builder
+	exported, err := connect(t, sourceAddress).export(&export, &progress, 500)
+	if err != nil || exported != restoreBatchSize+3 {
+		t.Fatalf("export() = %d, %v, expected %d keys", exported, err, restoreBatchSize+3)
+	}
+	if strings.Count(export.String(), "\n") != exported || !strings.Contains(progress.String(), "Exported 500 of") {
+		t.Errorf("export wrote %d lines and progress %q", strings.Count(export.String(), "\n"), progress.String())
+	}
+
+	target, targetAddress := startServer(t)
+	restored, expiring, err := connect(t, targetAddress).restore(strings.NewReader(export.String()), 0, io.Discard, 0)
+	if err != nil || restored != exported || expiring != 0 {
+		t.Fatalf("restore() = %d, %d, %v, expected %d keys", restored, expiring, err, exported)
+	}
+	for _, key := range []struct {
+		db       int
+		key      string
+		expected string
+	}{{0, "name", "batman"}, {0, "quoted", "a \"b\"\r\n"}, {3, "binary", "\x00\xff"}} {
+		if value, _, _ := target.Get(key.db, key.key); value != key.expected {
+			t.Errorf("restored %s in db %d = %q, expected %q", key.key, key.db, value, key.expected)
+		}
+	}
+	sourceLines, _ := source.Export()
+	targetLines, _ := target.Export()
+	if !reflect.DeepEqual(targetLines, sourceLines) {
+		t.Errorf("restored dataset differs from the exported one")
+	}
+}
+
+func TestRestore_Errors(t *testing.T) {
+	_, address := startServer(t)
+	tests := []struct {
+		name     string
+		input    string
+		skip     int
+		restored int
+		expected string
+	}{
+		{"invalid line", `{"db":0,"key":"a","type":"string","ttl":-1,"value":"1"}` + "\nSET b 2\n", 0, 1, "line 2: err invalid export line"},
+		{"database out of range", `{"db":99,"key":"a","type":"string","ttl":-1,"value":"1"}` + "\n", 0, 1, "line 1: "},
+		{"skipped invalid line", "SET b 2\n" + `{"db":0,"key":"a","type":"string","ttl":-1,"value":"1"}` + "\n", 1, 1, ""},
+		{"ttl", `{"db":0,"key":"a","type":"string","ttl":5000,"value":"1"}` + "\n", 0, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored, _, err := connect(t, address).restore(strings.NewReader(tt.input), tt.skip, io.Discard, 0)
+			if restored != tt.restored {
+				t.Errorf("restore() restored %d keys, expected %d", restored, tt.restored)
+			}
+			if tt.expected == "" && err != nil || tt.expected != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.expected)) {
+				t.Errorf("restore() = %v, expected %q", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("+OK\r\n:5\r\n$3\r\na\nb\r\n-ERR boom\r\n*1\r\n"))
+	for _, expected := range []string{"OK", "5", "a\nb"} {
+		if got, err := readReply(reader); err != nil || got != expected {
+			t.Fatalf("readReply = %q, %v, expected %q", got, err, expected)
+		}
+	}
+	if _, err := readReply(reader); err == nil || err.Error() != "ERR boom" {
+		t.Errorf("readReply of an error reply = %v, expected ERR boom", err)
+	}
+	if _, err := readReply(reader); err == nil {
+		t.Error("readReply of an array succeeded")
+	}
+}
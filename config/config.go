@@ -0,0 +1,699 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"kv-store/errcode"
+	"kv-store/glob"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrUnknownParameter = func(name string) error {
+		return errcode.Errorf(errcode.Err, "unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	ErrImmutableParameter = func(name string) error {
+		return errcode.Errorf(errcode.Err, "CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+	}
+	ErrInvalidValue = func(name, reason string) error {
+		return errcode.Errorf(errcode.Err, "CONFIG SET failed (possibly related to argument '%s') - %s", name, reason)
+	}
+	errNotInteger      = errors.New("argument couldn't be parsed into an integer")
+	errNotBool         = errors.New("argument must be 'yes' or 'no'")
+	errOutOfRange      = errors.New("argument must be a non-negative integer")
+	errInvalidSaveRule = errors.New("invalid save parameters")
+	errInvalidEvents   = errors.New("argument must be a combination of the K, E, g, $, x, e and A classes")
+	ErrNoConfigFile    = errcode.New(errcode.Err, "the server is running without a config file")
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
+)
+
+const (
+	PolicyNoEviction = "noeviction"
+	PolicyAllKeysLFU = "allkeys-lfu"
+)
+
+type Settings struct {
+	Databases       int
+	Dir             string
+	DBFilename      string
+	AppendFilename  string
+	MaxClients      int64
+	MaxMemory       int64
+	MaxMemoryPolicy string
+	DBMaxKeys       int64
+	DBMaxMemory     int64
+	MaxKeyLength    int64
+	MaxValueLength  int64
+	MaxLineLength   int64
+	MaxInlineLength int64
+	MaxArgs         int64
+	MaxArgLength    int64
+	TxRollback      bool
+	TxTimeout       int64
+	Save            string
+	RequirePass     string
+	AppendOnly      bool
+	AppendFsync     string
+	Timeout         int64
+	TCPKeepAlive    int64
+	TCPNoDelay      bool
+	TCPRecvBuffer   int64
+	TCPSendBuffer   int64
+	Trace           bool
+	TraceMaxLength  int64
+	// SlowlogSlowerThan is in microseconds; negative disables the slowlog.
+	SlowlogSlowerThan int64
+	SlowlogMaxLen     int64
+	// LatencyMonitorThreshold is in milliseconds; 0 disables the monitor.
+	LatencyMonitorThreshold int64
+	NotifyKeyspaceEvents    string
+	// MasterAuth is the password a replica sends its leader.
+	MasterAuth      string
+	ReplicaReadOnly bool
+	// ReplicaBufferLimit bounds the writes a leader buffers for a replica,
+	// in bytes; 0 means no limit.
+	ReplicaBufferLimit int64
+	// ReplBacklogSize is how many bytes of the latest writes a leader keeps
+	// for replicas that reconnect.
+	ReplBacklogSize int64
+}
+
+func Default() Settings {
+	return Settings{
+		Databases:         16,
+		Dir:               ".",
+		DBFilename:        "dump.kvs",
+		AppendFilename:    "appendonly.aof",
+		MaxClients:        10000,
+		MaxKeyLength:      512 << 20,
+		MaxValueLength:    512 << 20,
+		MaxLineLength:     1 << 30,
+		MaxInlineLength:   4 << 20,
+		MaxArgs:           1024 * 1024,
+		MaxArgLength:      512 << 20,
+		TxRollback:        true,
+		MaxMemoryPolicy:   PolicyNoEviction,
+		Save:              "3600 1 300 100 60 10000",
+		AppendFsync:       FsyncEverySec,
+		TCPKeepAlive:      300,
+		TCPNoDelay:        true,
+		TraceMaxLength:    256,
+		SlowlogSlowerThan: 10000,
+		SlowlogMaxLen:     128,
+		ReplicaReadOnly:   true,
+		// As Redis' client-output-buffer-limit for replicas.
+		ReplicaBufferLimit: 256 << 20,
+		ReplBacklogSize:    1 << 20,
+	}
+}
+
+type parameter struct {
+	get       func(s *Settings) string
+	set       func(s *Settings, value string) error
+	immutable bool
+}
+
+// MaxDatabases bounds the databases setting. Every database costs memory
+// up front, and a disk store a bucket, however few keys it holds.
+const MaxDatabases = 1024
+
+var parameters = map[string]parameter{
+	"databases": {
+		get: func(s *Settings) string { return strconv.Itoa(s.Databases) },
+		set: func(s *Settings, value string) error {
+			databases, err := strconv.Atoi(value)
+			if err != nil {
+				return errNotInteger
+			}
+			if databases < 1 || databases > MaxDatabases {
+				return fmt.Errorf("argument must be between 1 and %d", MaxDatabases)
+			}
+			s.Databases = databases
+			return nil
+		},
+		immutable: true,
+	},
+	"dir": {
+		get: func(s *Settings) string { return s.Dir },
+		set: func(s *Settings, value string) error {
+			info, err := os.Stat(value)
+			if err != nil || !info.IsDir() {
+				return errors.New("no such directory")
+			}
+			s.Dir = value
+			return nil
+		},
+	},
+	"dbfilename": {
+		get: func(s *Settings) string { return s.DBFilename },
+		set: func(s *Settings, value string) error {
+			if value == "" || filepath.Base(value) != value {
+				return errors.New("dbfilename can't be a path, just a filename")
+			}
+			s.DBFilename = value
+			return nil
+		},
+	},
+	"maxclients": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.MaxClients, 10) },
+		set: func(s *Settings, value string) error {
+			maxClients, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			if maxClients < 1 {
+				return errors.New("argument must be at least 1")
+			}
+			s.MaxClients = maxClients
+			return nil
+		},
+	},
+	"maxmemory": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.MaxMemory, 10) },
+		set: func(s *Settings, value string) error {
+			maxMemory, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.MaxMemory = maxMemory
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		get: func(s *Settings) string { return s.MaxMemoryPolicy },
+		set: func(s *Settings, value string) error {
+			switch policy := strings.ToLower(value); policy {
+			case PolicyNoEviction, PolicyAllKeysLFU:
+				s.MaxMemoryPolicy = policy
+				return nil
+			default:
+				return errors.New("argument must be one of noeviction or allkeys-lfu")
+			}
+		},
+	},
+	"db-max-keys": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.DBMaxKeys, 10) },
+		set: func(s *Settings, value string) error {
+			maxKeys, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || maxKeys < 0 {
+				return errOutOfRange
+			}
+			s.DBMaxKeys = maxKeys
+			return nil
+		},
+	},
+	"db-max-memory": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.DBMaxMemory, 10) },
+		set: func(s *Settings, value string) error {
+			maxMemory, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.DBMaxMemory = maxMemory
+			return nil
+		},
+	},
+	"max-key-length": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.MaxKeyLength, 10) },
+		set: func(s *Settings, value string) error {
+			length, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.MaxKeyLength = length
+			return nil
+		},
+	},
+	"max-value-length": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.MaxValueLength, 10) },
+		set: func(s *Settings, value string) error {
+			length, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.MaxValueLength = length
+			return nil
+		},
+	},
+	"max-line-length": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.MaxLineLength, 10) },
+		set: func(s *Settings, value string) error {
+			length, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.MaxLineLength = length
+			return nil
+		},
+	},
+	"max-inline-length": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.MaxInlineLength, 10) },
+		set: func(s *Settings, value string) error {
+			length, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.MaxInlineLength = length
+			return nil
+		},
+	},
+	"max-args": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.MaxArgs, 10) },
+		set: func(s *Settings, value string) error {
+			maxArgs, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || maxArgs < 0 {
+				return errOutOfRange
+			}
+			s.MaxArgs = maxArgs
+			return nil
+		},
+	},
+	"max-arg-length": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.MaxArgLength, 10) },
+		set: func(s *Settings, value string) error {
+			length, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.MaxArgLength = length
+			return nil
+		},
+	},
+	"transaction-rollback": {
+		get: func(s *Settings) string { return formatBool(s.TxRollback) },
+		set: func(s *Settings, value string) error {
+			rollback, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			s.TxRollback = rollback
+			return nil
+		},
+	},
+	"transaction-timeout": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.TxTimeout, 10) },
+		set: func(s *Settings, value string) error {
+			timeout, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || timeout < 0 {
+				return errOutOfRange
+			}
+			s.TxTimeout = timeout
+			return nil
+		},
+	},
+	"save": {
+		get: func(s *Settings) string { return s.Save },
+		set: func(s *Settings, value string) error {
+			fields := strings.Fields(value)
+			if len(fields)%2 != 0 {
+				return errInvalidSaveRule
+			}
+			for _, field := range fields {
+				if n, err := strconv.ParseInt(field, 10, 64); err != nil || n < 0 {
+					return errInvalidSaveRule
+				}
+			}
+			s.Save = strings.Join(fields, " ")
+			return nil
+		},
+	},
+	"requirepass": {
+		get: func(s *Settings) string { return s.RequirePass },
+		set: func(s *Settings, value string) error {
+			s.RequirePass = value
+			return nil
+		},
+	},
+	"appendonly": {
+		get: func(s *Settings) string { return formatBool(s.AppendOnly) },
+		set: func(s *Settings, value string) error {
+			appendOnly, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			s.AppendOnly = appendOnly
+			return nil
+		},
+		immutable: true,
+	},
+	"appendfsync": {
+		get: func(s *Settings) string { return s.AppendFsync },
+		set: func(s *Settings, value string) error {
+			switch policy := strings.ToLower(value); policy {
+			case FsyncAlways, FsyncEverySec, FsyncNo:
+				s.AppendFsync = policy
+				return nil
+			default:
+				return errors.New("argument must be one of always, everysec or no")
+			}
+		},
+	},
+	"appendfilename": {
+		get: func(s *Settings) string { return s.AppendFilename },
+		set: func(s *Settings, value string) error {
+			if value == "" || filepath.Base(value) != value {
+				return errors.New("appendfilename can't be a path, just a filename")
+			}
+			s.AppendFilename = value
+			return nil
+		},
+		immutable: true,
+	},
+	"timeout": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.Timeout, 10) },
+		set: func(s *Settings, value string) error {
+			timeout, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || timeout < 0 {
+				return errOutOfRange
+			}
+			s.Timeout = timeout
+			return nil
+		},
+	},
+	"trace": {
+		get: func(s *Settings) string { return formatBool(s.Trace) },
+		set: func(s *Settings, value string) error {
+			trace, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			s.Trace = trace
+			return nil
+		},
+	},
+	"trace-max-length": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.TraceMaxLength, 10) },
+		set: func(s *Settings, value string) error {
+			length, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.TraceMaxLength = length
+			return nil
+		},
+	},
+	"slowlog-log-slower-than": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.SlowlogSlowerThan, 10) },
+		set: func(s *Settings, value string) error {
+			threshold, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			s.SlowlogSlowerThan = threshold
+			return nil
+		},
+	},
+	"slowlog-max-len": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.SlowlogMaxLen, 10) },
+		set: func(s *Settings, value string) error {
+			length, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || length < 0 {
+				return errOutOfRange
+			}
+			s.SlowlogMaxLen = length
+			return nil
+		},
+	},
+	"latency-monitor-threshold": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.LatencyMonitorThreshold, 10) },
+		set: func(s *Settings, value string) error {
+			threshold, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || threshold < 0 {
+				return errOutOfRange
+			}
+			s.LatencyMonitorThreshold = threshold
+			return nil
+		},
+	},
+	"notify-keyspace-events": {
+		get: func(s *Settings) string { return s.NotifyKeyspaceEvents },
+		set: func(s *Settings, value string) error {
+			events, err := parseKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+			s.NotifyKeyspaceEvents = events
+			return nil
+		},
+	},
+	"masterauth": {
+		get: func(s *Settings) string { return s.MasterAuth },
+		set: func(s *Settings, value string) error {
+			s.MasterAuth = value
+			return nil
+		},
+	},
+	"replica-read-only": {
+		get: func(s *Settings) string { return formatBool(s.ReplicaReadOnly) },
+		set: func(s *Settings, value string) error {
+			readOnly, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			s.ReplicaReadOnly = readOnly
+			return nil
+		},
+	},
+	"replica-buffer-limit": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.ReplicaBufferLimit, 10) },
+		set: func(s *Settings, value string) error {
+			limit, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.ReplicaBufferLimit = limit
+			return nil
+		},
+	},
+	"repl-backlog-size": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.ReplBacklogSize, 10) },
+		set: func(s *Settings, value string) error {
+			size, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			if size < 1 {
+				return errors.New("argument must be at least 1")
+			}
+			s.ReplBacklogSize = size
+			return nil
+		},
+	},
+	"tcp-keepalive": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.TCPKeepAlive, 10) },
+		set: func(s *Settings, value string) error {
+			interval, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || interval < 0 {
+				return errOutOfRange
+			}
+			s.TCPKeepAlive = interval
+			return nil
+		},
+	},
+	"tcp-nodelay": {
+		get: func(s *Settings) string { return formatBool(s.TCPNoDelay) },
+		set: func(s *Settings, value string) error {
+			noDelay, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			s.TCPNoDelay = noDelay
+			return nil
+		},
+	},
+	"tcp-recv-buffer": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.TCPRecvBuffer, 10) },
+		set: func(s *Settings, value string) error {
+			size, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.TCPRecvBuffer = size
+			return nil
+		},
+	},
+	"tcp-send-buffer": {
+		get: func(s *Settings) string { return strconv.FormatInt(s.TCPSendBuffer, 10) },
+		set: func(s *Settings, value string) error {
+			size, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.TCPSendBuffer = size
+			return nil
+		},
+	},
+}
+
+// Config holds the current settings as an immutable snapshot that is swapped
+// atomically, so readers never need a lock.
+type Config struct {
+	settings atomic.Pointer[Settings]
+	mutex    sync.Mutex
+	path     string
+}
+
+func New(settings Settings) *Config {
+	c := &Config{}
+	c.settings.Store(&settings)
+	return c
+}
+
+func (c *Config) Get() Settings {
+	return *c.settings.Load()
+}
+
+func (s Settings) SnapshotPath() string {
+	return filepath.Join(s.Dir, s.DBFilename)
+}
+
+func (s Settings) AppendOnlyPath() string {
+	return filepath.Join(s.Dir, s.AppendFilename)
+}
+
+// Lookup returns name/value pairs, sorted by name, for every parameter
+// matching the glob pattern.
+func (c *Config) Lookup(pattern string) []string {
+	settings := c.settings.Load()
+
+	var names []string
+	for name := range parameters {
+		if glob.Match(strings.ToLower(pattern), name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		result = append(result, name, parameters[name].get(settings))
+	}
+	return result
+}
+
+func (c *Config) Set(name, value string) error {
+	name = strings.ToLower(name)
+	param, exists := parameters[name]
+	if !exists {
+		return ErrUnknownParameter(name)
+	}
+	if param.immutable {
+		return ErrImmutableParameter(name)
+	}
+	return c.apply(name, param, value)
+}
+
+// SetAtStartup is Set for use before the server starts, when immutable
+// parameters such as those given as command line flags may still change.
+func (c *Config) SetAtStartup(name, value string) error {
+	name = strings.ToLower(name)
+	param, exists := parameters[name]
+	if !exists {
+		return ErrUnknownParameter(name)
+	}
+	return c.apply(name, param, value)
+}
+
+func (c *Config) apply(name string, param parameter, value string) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	updated := *c.settings.Load()
+	if err := param.set(&updated, value); err != nil {
+		return ErrInvalidValue(name, err.Error())
+	}
+	c.settings.Store(&updated)
+	return nil
+}
+
+// ParseMemory parses sizes like "100", "1k", "1kb", "5mb" or "2gb", where the
+// b-suffixed units are powers of 1024 and the bare ones powers of 1000.
+func ParseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	lowered := strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lowered, unit.suffix) {
+			lowered = strings.TrimSuffix(lowered, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lowered, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errNotInteger
+	}
+	return n * multiplier, nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, errNotBool
+	}
+}
+
+func formatBool(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// keyspaceEventClasses are the notify-keyspace-events classes, in the order
+// the value is kept in.
+const keyspaceEventClasses = "KEg$xe"
+
+// parseKeyspaceEvents checks a notify-keyspace-events value and returns it
+// with A expanded and the classes in a fixed order. Without K or E no
+// channel would receive events, so the value is cleared.
+func parseKeyspaceEvents(value string) (string, error) {
+	enabled := map[rune]bool{}
+	for _, class := range value {
+		switch {
+		case class == 'A':
+			for _, c := range "g$xe" {
+				enabled[c] = true
+			}
+		case strings.ContainsRune(keyspaceEventClasses, class):
+			enabled[class] = true
+		default:
+			return "", errInvalidEvents
+		}
+	}
+	if !enabled['K'] && !enabled['E'] {
+		return "", nil
+	}
+	var events strings.Builder
+	for _, class := range keyspaceEventClasses {
+		if enabled[class] {
+			events.WriteRune(class)
+		}
+	}
+	return events.String(), nil
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestConfig_Set(t *testing.T) {
+	testCases := []struct {
+		name    string
+		param   string
+		value   string
+		wantErr error
+		want    func(s Settings) bool
+	}{
+		{"maxmemory bytes", "maxmemory", "1024", nil, func(s Settings) bool { return s.MaxMemory == 1024 }},
+		{"maxmemory units", "MAXMEMORY", "2mb", nil, func(s Settings) bool { return s.MaxMemory == 2<<20 }},
+		{"maxmemory invalid", "maxmemory", "lots", ErrInvalidValue("maxmemory", errNotInteger.Error()), nil},
+		{"maxmemory-policy", "maxmemory-policy", "ALLKEYS-LFU", nil, func(s Settings) bool { return s.MaxMemoryPolicy == PolicyAllKeysLFU }},
+		{"maxmemory-policy invalid", "maxmemory-policy", "allkeys-random", ErrInvalidValue("maxmemory-policy", "argument must be one of noeviction or allkeys-lfu"), nil},
+		{"db-max-keys", "db-max-keys", "100", nil, func(s Settings) bool { return s.DBMaxKeys == 100 }},
+		{"db-max-keys negative", "db-max-keys", "-1", ErrInvalidValue("db-max-keys", errOutOfRange.Error()), nil},
+		{"max-value-length units", "max-value-length", "1mb", nil, func(s Settings) bool { return s.MaxValueLength == 1<<20 }},
+		{"max-key-length disabled", "max-key-length", "0", nil, func(s Settings) bool { return s.MaxKeyLength == 0 }},
+		{"max-inline-length units", "max-inline-length", "64kb", nil, func(s Settings) bool { return s.MaxInlineLength == 64<<10 }},
+		{"max-args", "max-args", "100", nil, func(s Settings) bool { return s.MaxArgs == 100 }},
+		{"max-args negative", "max-args", "-1", ErrInvalidValue("max-args", errOutOfRange.Error()), nil},
+		{"max-arg-length units", "max-arg-length", "1mb", nil, func(s Settings) bool { return s.MaxArgLength == 1<<20 }},
+		{"max-line-length invalid", "max-line-length", "-1", ErrInvalidValue("max-line-length", errNotInteger.Error()), nil},
+		{"db-max-memory units", "DB-MAX-MEMORY", "1kb", nil, func(s Settings) bool { return s.DBMaxMemory == 1<<10 }},
+		{"transaction-rollback", "transaction-rollback", "no", nil, func(s Settings) bool { return !s.TxRollback }},
+		{"transaction-timeout", "transaction-timeout", "30", nil, func(s Settings) bool { return s.TxTimeout == 30 }},
+		{"transaction-timeout negative", "transaction-timeout", "-1", ErrInvalidValue("transaction-timeout", errOutOfRange.Error()), nil},
+		{"requirepass", "requirepass", "secret", nil, func(s Settings) bool { return s.RequirePass == "secret" }},
+		{"appendonly", "appendonly", "yes", ErrImmutableParameter("appendonly"), nil},
+		{"appendfsync", "appendfsync", "ALWAYS", nil, func(s Settings) bool { return s.AppendFsync == FsyncAlways }},
+		{"appendfsync invalid", "appendfsync", "sometimes", ErrInvalidValue("appendfsync", "argument must be one of always, everysec or no"), nil},
+		{"save", "save", "900 1  300 10", nil, func(s Settings) bool { return s.Save == "900 1 300 10" }},
+		{"save disabled", "save", "", nil, func(s Settings) bool { return s.Save == "" }},
+		{"save odd fields", "save", "900", ErrInvalidValue("save", errInvalidSaveRule.Error()), nil},
+		{"timeout negative", "timeout", "-1", ErrInvalidValue("timeout", errOutOfRange.Error()), nil},
+		{"tcp-keepalive disabled", "tcp-keepalive", "0", nil, func(s Settings) bool { return s.TCPKeepAlive == 0 }},
+		{"tcp-keepalive negative", "tcp-keepalive", "-1", ErrInvalidValue("tcp-keepalive", errOutOfRange.Error()), nil},
+		{"tcp-nodelay", "tcp-nodelay", "no", nil, func(s Settings) bool { return !s.TCPNoDelay }},
+		{"tcp-recv-buffer units", "tcp-recv-buffer", "256kb", nil, func(s Settings) bool { return s.TCPRecvBuffer == 256<<10 }},
+		{"slowlog-log-slower-than disabled", "slowlog-log-slower-than", "-1", nil, func(s Settings) bool { return s.SlowlogSlowerThan == -1 }},
+		{"slowlog-log-slower-than not integer", "slowlog-log-slower-than", "1ms", ErrInvalidValue("slowlog-log-slower-than", errNotInteger.Error()), nil},
+		{"slowlog-max-len", "slowlog-max-len", "16", nil, func(s Settings) bool { return s.SlowlogMaxLen == 16 }},
+		{"slowlog-max-len negative", "slowlog-max-len", "-1", ErrInvalidValue("slowlog-max-len", errOutOfRange.Error()), nil},
+		{"latency-monitor-threshold", "latency-monitor-threshold", "100", nil, func(s Settings) bool { return s.LatencyMonitorThreshold == 100 }},
+		{"latency-monitor-threshold negative", "latency-monitor-threshold", "-1", ErrInvalidValue("latency-monitor-threshold", errOutOfRange.Error()), nil},
+		{"notify-keyspace-events", "notify-keyspace-events", "$gK", nil, func(s Settings) bool { return s.NotifyKeyspaceEvents == "Kg$" }},
+		{"notify-keyspace-events all", "notify-keyspace-events", "AE", nil, func(s Settings) bool { return s.NotifyKeyspaceEvents == "Eg$xe" }},
+		{"notify-keyspace-events no channel", "notify-keyspace-events", "g$", nil, func(s Settings) bool { return s.NotifyKeyspaceEvents == "" }},
+		{"notify-keyspace-events invalid", "notify-keyspace-events", "Kz", ErrInvalidValue("notify-keyspace-events", errInvalidEvents.Error()), nil},
+		{"replica-read-only", "replica-read-only", "no", nil, func(s Settings) bool { return !s.ReplicaReadOnly }},
+		{"repl-backlog-size units", "repl-backlog-size", "16kb", nil, func(s Settings) bool { return s.ReplBacklogSize == 16<<10 }},
+		{"repl-backlog-size zero", "repl-backlog-size", "0", ErrInvalidValue("repl-backlog-size", "argument must be at least 1"), nil},
+		{"replica-buffer-limit units", "replica-buffer-limit", "64mb", nil, func(s Settings) bool { return s.ReplicaBufferLimit == 64<<20 }},
+		{"maxclients zero", "maxclients", "0", ErrInvalidValue("maxclients", "argument must be at least 1"), nil},
+		{"immutable", "databases", "32", ErrImmutableParameter("databases"), nil},
+		{"unknown", "nosuch", "1", ErrUnknownParameter("nosuch"), nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(Default())
+
+			err := c.Set(tc.param, tc.value)
+
+			if !reflect.DeepEqual(err, tc.wantErr) {
+				t.Fatalf("Set(%q, %q) error = %v, expected %v", tc.param, tc.value, err, tc.wantErr)
+			}
+			if err != nil && c.Get() != Default() {
+				t.Errorf("expected failed Set to leave settings unchanged, got %+v", c.Get())
+			}
+			if tc.want != nil && !tc.want(c.Get()) {
+				t.Errorf("Set(%q, %q) produced unexpected settings %+v", tc.param, tc.value, c.Get())
+			}
+		})
+	}
+}
+
+func TestConfig_Lookup(t *testing.T) {
+	c := New(Default())
+	c.Set("maxmemory", "100")
+
+	testCases := []struct {
+		pattern string
+		want    []string
+	}{
+		{"maxmemory", []string{"maxmemory", "100"}},
+		{"max*", []string{"max-arg-length", "536870912", "max-args", "1048576", "max-inline-length", "4194304", "max-key-length", "536870912", "max-line-length", "1073741824", "max-value-length", "536870912", "maxclients", "10000", "maxmemory", "100", "maxmemory-policy", "noeviction"}},
+		{"TIME?UT", []string{"timeout", "0"}},
+		{"nosuch", []string{}},
+	}
+
+	for _, tc := range testCases {
+		if got := c.Lookup(tc.pattern); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Lookup(%q) = %q, expected %q", tc.pattern, got, tc.want)
+		}
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"100", 100, false},
+		{"100b", 100, false},
+		{"1k", 1000, false},
+		{"1kb", 1024, false},
+		{"3MB", 3 << 20, false},
+		{"2g", 2000 * 1000 * 1000, false},
+		{"1gb", 1 << 30, false},
+		{"-1", 0, true},
+		{"kb", 0, true},
+		{"1tb", 0, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := ParseMemory(tc.value)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseMemory(%q) = %d, %v, expected %d, error %t", tc.value, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestConfig_ConcurrentGetAndSet(t *testing.T) {
+	c := New(Default())
+	var wg sync.WaitGroup
+
+	for i := range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.Set("maxmemory", "1mb")
+			c.Set("timeout", "30")
+		}()
+		go func(reader int) {
+			defer wg.Done()
+			for range 100 {
+				_ = c.Get().MaxMemory
+				_ = c.Lookup("*")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	settings := c.Get()
+	if settings.MaxMemory != 1<<20 || settings.Timeout != 30 {
+		t.Errorf("expected both updates to be applied, got %+v", settings)
+	}
+}
+
+func TestConfig_SetAtStartup(t *testing.T) {
+	c := New(Default())
+
+	if err := c.SetAtStartup("appendonly", "yes"); err != nil {
+		t.Fatalf("SetAtStartup(appendonly) failed: %v", err)
+	}
+	for _, databases := range []string{"0", "1025", "many"} {
+		if err := c.SetAtStartup("databases", databases); err == nil {
+			t.Errorf("SetAtStartup(databases, %s) succeeded, expected it to still validate values", databases)
+		}
+	}
+	if err := c.SetAtStartup("databases", "1024"); err != nil || c.Get().Databases != 1024 {
+		t.Errorf("SetAtStartup(databases, 1024) = %v, expected the largest allowed value to be set", err)
+	}
+	c.SetAtStartup("databases", "16")
+	if settings := c.Get(); !settings.AppendOnly || settings.Databases != 16 {
+		t.Errorf("SetAtStartup produced unexpected settings %+v", settings)
+	}
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"kv-store/atomicfile"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Load reads a config file of "name value" lines on top of the defaults.
+// Blank lines and lines starting with # are ignored. Immutable parameters may
+// be set here since the file is only read at startup.
+func Load(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := Default()
+	for i, line := range strings.Split(string(content), "\n") {
+		name, value, ok := parseLine(line)
+		if !ok {
+			continue
+		}
+		param, exists := parameters[name]
+		if !exists {
+			return nil, fmt.Errorf("config file %s, line %d: unknown directive '%s'", path, i+1, name)
+		}
+		if err := param.set(&settings, value); err != nil {
+			return nil, fmt.Errorf("config file %s, line %d: %s: %w", path, i+1, name, err)
+		}
+	}
+
+	c := New(settings)
+	c.path = path
+	return c, nil
+}
+
+func parseLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	name, value, _ := strings.Cut(line, " ")
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
+	}
+	return strings.ToLower(name), value, true
+}
+
+func formatLine(name, value string) string {
+	if value == "" || strings.TrimSpace(value) != value {
+		value = `"` + value + `"`
+	}
+	return name + " " + value
+}
+
+// Rewrite writes the current settings back to the file the config was loaded
+// from. Comments, blank lines and line order are kept; known parameters are
+// updated in place and any non-default parameters missing from the file are
+// appended. The file is replaced atomically.
+func (c *Config) Rewrite() error {
+	if c.path == "" {
+		return ErrNoConfigFile
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	content, err := os.ReadFile(c.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	settings := c.settings.Load()
+	defaults := Default()
+	written := make(map[string]bool)
+
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	}
+
+	var rewritten []string
+	for _, line := range lines {
+		name, _, ok := parseLine(line)
+		param, known := parameters[name]
+		switch {
+		case !ok || !known:
+			rewritten = append(rewritten, line)
+		case !written[name]:
+			rewritten = append(rewritten, formatLine(name, param.get(settings)))
+			written[name] = true
+		}
+	}
+
+	var missing []string
+	for name, param := range parameters {
+		if !written[name] && param.get(settings) != param.get(&defaults) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		rewritten = append(rewritten, formatLine(name, parameters[name].get(settings)))
+	}
+
+	return atomicfile.WriteFile(c.path, []byte(strings.Join(rewritten, "\n")+"\n"))
+}
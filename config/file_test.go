@@ -0,0 +1,120 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kv.conf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfigFile(t, strings.Join([]string{
+		"# kv-store config",
+		"",
+		"databases 4",
+		"maxmemory 10mb",
+		"  requirepass \"s3cret pass\"",
+		"save 900 1 300 10",
+		"appendonly yes",
+	}, "\n"))
+
+	c, err := Load(path)
+
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	expected := Default()
+	expected.Databases = 4
+	expected.MaxMemory = 10 << 20
+	expected.RequirePass = "s3cret pass"
+	expected.Save = "900 1 300 10"
+	expected.AppendOnly = true
+	if c.Get() != expected {
+		t.Errorf("Load() = %+v, expected %+v", c.Get(), expected)
+	}
+}
+
+func TestLoad_Malformed(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown directive", "maxmemory 1\nnosuch 1\n", "line 2: unknown directive 'nosuch'"},
+		{"bad value", "# comment\n\nmaxclients many\n", "line 3: maxclients: argument couldn't be parsed into an integer"},
+		{"bad bool", "appendonly sometimes", "line 1: appendonly: argument must be 'yes' or 'no'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Load(writeConfigFile(t, tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Load() error = %v, expected it to contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	path := writeConfigFile(t, strings.Join([]string{
+		"# kv-store config",
+		"maxmemory 10mb",
+		"",
+		"# auth",
+		"requirepass old",
+		"maxmemory 20mb",
+	}, "\n"))
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	c.Set("maxmemory", "1024")
+	c.Set("requirepass", "")
+	c.Set("timeout", "30")
+
+	if err := c.Rewrite(); err != nil {
+		t.Fatalf("Rewrite() failed: %v", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	expected := strings.Join([]string{
+		"# kv-store config",
+		"maxmemory 1024",
+		"",
+		"# auth",
+		`requirepass ""`,
+		"timeout 30",
+	}, "\n") + "\n"
+	if string(content) != expected {
+		t.Errorf("rewritten config =\n%s\nexpected\n%s", content, expected)
+	}
+
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() of rewritten config failed: %v", err)
+	}
+	if reloaded.Get() != c.Get() {
+		t.Errorf("reloaded settings = %+v, expected %+v", reloaded.Get(), c.Get())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected no temp files to be left behind, found %d entries", len(entries))
+	}
+}
+
+func TestRewrite_WithoutConfigFile(t *testing.T) {
+	c := New(Default())
+
+	if err := c.Rewrite(); err != ErrNoConfigFile {
+		t.Errorf("Rewrite() = %v, expected %v", err, ErrNoConfigFile)
+	}
+}
@@ -0,0 +1,63 @@
+// Package errcode defines the errors the server sends to clients. Each reply
+// starts with an upper-case code, which client libraries use to tell kinds of
+// error apart.
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Code string
+
+const (
+	Err       Code = "ERR"
+	WrongType Code = "WRONGTYPE"
+	ExecAbort Code = "EXECABORT"
+	NoAuth    Code = "NOAUTH"
+	NoPerm    Code = "NOPERM"
+	NoProto   Code = "NOPROTO"
+	OOM       Code = "OOM"
+	BusyKey   Code = "BUSYKEY"
+	Misconf   Code = "MISCONF"
+	ReadOnly  Code = "READONLY"
+)
+
+// Error is an error meant for a client.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func New(code Code, message string) error {
+	return &Error{Code: code, Message: message}
+}
+
+func Errorf(code Code, format string, args ...any) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + " " + e.Message
+}
+
+// Internal is what a client is sent in place of an error without a code.
+var Internal = New(Err, "internal error")
+
+// Reply returns the single line a client is sent for err. An error wrapping
+// an *Error keeps any detail added after its code, as in
+// fmt.Errorf("%w: detail", err). Any other error is internal: Reply returns
+// the text of Internal and false, and the caller should log err instead of
+// sending it.
+func Reply(err error) (string, bool) {
+	var coded *Error
+	if !errors.As(err, &coded) {
+		return Internal.Error(), false
+	}
+	message := err.Error()
+	if !strings.HasPrefix(message, string(coded.Code)+" ") {
+		message = coded.Error()
+	}
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(message), true
+}
@@ -0,0 +1,34 @@
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestReply(t *testing.T) {
+	syntax := New(Err, "syntax error")
+	testCases := []struct {
+		name     string
+		err      error
+		expected string
+		coded    bool
+	}{
+		{"coded", syntax, "ERR syntax error", true},
+		{"other code", New(WrongType, "not a number"), "WRONGTYPE not a number", true},
+		{"formatted", Errorf(Err, "unknown command: %s", "FOO"), "ERR unknown command: FOO", true},
+		{"detail after the code", fmt.Errorf("%w: bad length", syntax), "ERR syntax error: bad length", true},
+		{"context before the code", fmt.Errorf("loading: %w", syntax), "ERR syntax error", true},
+		{"newlines", New(Err, "a\r\nb"), "ERR a  b", true},
+		{"internal", errors.New("open dump.rdb: permission denied"), "ERR internal error", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, coded := Reply(tc.err)
+			if reply != tc.expected || coded != tc.coded {
+				t.Errorf("Reply(%q) = %q, %v, expected %q, %v", tc.err, reply, coded, tc.expected, tc.coded)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package glob
+
+// Match reports whether str matches the Redis-style glob pattern. It supports
+// '*', '?', character classes like [abc], [^abc] and [a-z], and backslash
+// escapes.
+func Match(pattern, str string) bool {
+	p, s := 0, 0
+	starP, starS := -1, 0
+
+	for s < len(str) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starS = p, s
+				p++
+				continue
+			case '?':
+				p++
+				s++
+				continue
+			case '[':
+				next, matched := matchClass(pattern, p, str[s])
+				if matched {
+					p = next
+					s++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == str[s] {
+					p += 2
+					s++
+					continue
+				}
+				if p+1 == len(pattern) && str[s] == '\\' {
+					p++
+					s++
+					continue
+				}
+			default:
+				if pattern[p] == str[s] {
+					p++
+					s++
+					continue
+				}
+			}
+		}
+
+		if starP < 0 {
+			return false
+		}
+		starS++
+		s = starS
+		p = starP + 1
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the class starting at pattern[start] == '['
+// and returns the index just past the closing ']'. An unterminated class runs
+// to the end of the pattern.
+func matchClass(pattern string, start int, c byte) (int, bool) {
+	p := start + 1
+	negate := false
+	if p < len(pattern) && pattern[p] == '^' {
+		negate = true
+		p++
+	}
+
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			if pattern[p] == c {
+				matched = true
+			}
+			p++
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			low, high := pattern[p], pattern[p+2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				matched = true
+			}
+			p += 3
+		default:
+			if pattern[p] == c {
+				matched = true
+			}
+			p++
+		}
+	}
+	if p < len(pattern) {
+		p++
+	}
+
+	return p, matched != negate
+}
@@ -1,3 +1,10 @@
 module kv-store
 
 go 1.24.2
+
+require (
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/term v0.28.0
+)
+
+require golang.org/x/sys v0.29.0 // indirect
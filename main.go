@@ -1,23 +1,238 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"kv-store/config"
 	"kv-store/server"
 	"kv-store/store"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-const defaultNumDatabases = 16
+// shutdownTimeout bounds how long a shutdown waits for client connections to
+// finish.
+const shutdownTimeout = 10 * time.Second
 
 func main() {
-	listenAddress := flag.String("address", ":8000", "Address and port to listen on (e.g. :8000, 127.0.0.1:8000)")
+	listenAddress := flag.String("address", ":8000", "Comma-separated addresses and ports to listen on (e.g. :8000, 127.0.0.1:8000,[::1]:8000), or empty to only use -unixsocket")
+	unixSocket := flag.String("unixsocket", "", "Also accept connections on a unix socket at this path (e.g. /tmp/kv.sock)")
+	unixSocketPerm := flag.String("unixsocketperm", "700", "Permissions of the -unixsocket file, in octal")
+	tlsCertFile := flag.String("tls-cert-file", "", "Serve -address over TLS with this certificate (PEM)")
+	tlsKeyFile := flag.String("tls-key-file", "", "Private key (PEM) of -tls-cert-file")
+	tlsCACert := flag.String("tls-ca-cert", "", "CA bundle (PEM) that client certificates are verified against")
+	tlsAuthClients := flag.String("tls-auth-clients", "yes", "Whether TLS clients need a certificate signed by -tls-ca-cert: yes, no or optional")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header from a load balancer on every -address connection, and report the client address it names")
+	requirePass := flag.String("requirepass", "", "Require clients to AUTH with this password before running commands (empty disables authentication)")
+	configFile := flag.String("config", "", "Path to a config file of 'name value' lines, rewritten by CONFIG REWRITE")
+	appendOnly := flag.Bool("appendonly", false, "Log every write to an append only file and replay it at startup")
+	databases := flag.Int("databases", 16, "Number of databases, SELECTed by index from 0, between 1 and 1024")
+	dir := flag.String("dir", "", "Directory holding the snapshot and append only files")
+	dbFilename := flag.String("dbfilename", "", "Snapshot file name inside -dir, loaded at startup when appendonly is off")
+	storageKind := flag.String("storage", "memory", "Where keys live: memory, or disk to keep them in an embedded database under -data-dir")
+	dataDir := flag.String("data-dir", "data", "Directory of the disk storage's database file, used with -storage=disk")
+	walFile := flag.String("wal", "", "Record every write to this write-ahead log and recover from it at startup (empty disables it)")
+	maxKeyLength := flag.String("max-key-length", "", "Longest key accepted, in bytes or with a unit like 1kb (0 disables the limit)")
+	maxValueLength := flag.String("max-value-length", "", "Longest value accepted, in bytes or with a unit like 512mb (0 disables the limit)")
+	maxLineLength := flag.String("max-line-length", "", "Longest command line read from a client, in bytes or with a unit like 1gb (0 disables the limit)")
+	maxInlineLength := flag.String("max-inline-length", "", "Longest inline command line, one not sent as RESP, in bytes or with a unit like 4mb (0 disables the limit)")
+	maxArgs := flag.String("max-args", "", "Most arguments one request may have, its command name included (0 disables the limit)")
+	maxArgLength := flag.String("max-arg-length", "", "Longest argument accepted, in bytes or with a unit like 512mb (0 disables the limit)")
+	replicaOf := flag.String("replicaof", "", "Start as a replica of the leader at this host:port (also REPLICAOF host port)")
+	debugAddress := flag.String("debug-address", "", "Serve pprof profiles and expvar variables over HTTP on this loopback address (e.g. 127.0.0.1:6060); off when empty")
+	trace := flag.Bool("trace", false, "Log every request and reply on the wire, for debugging clients (also CONFIG SET trace yes|no)")
+	logLevel := flag.String("loglevel", "info", "Least severe log records written: debug, info, warn or error")
+	logFormat := flag.String("logformat", "text", "Format of log records: text or json")
+	ignoreLoadErrors := flag.Bool("ignore-load-errors", false, "Start with whatever loaded instead of exiting when the snapshot or append only file is corrupt")
+	loadFile := flag.String("load-file", "", "Replay this file of commands, one per line like COMPACT output, before accepting connections")
+	loadSkipErrors := flag.Bool("load-skip-errors", false, "Log and skip the lines of -load-file that fail instead of exiting at the first one")
 	flag.Parse()
 
-	inMemoryStorage := store.NewMemoryStorage(defaultNumDatabases)
-	store := store.CreateNewStore(inMemoryStorage)
+	logHandler, err := newLogHandler(*logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("invalid logging flags: %v", err)
+	}
+	slog.SetDefault(slog.New(logHandler))
+
+	cfg := config.New(config.Default())
+	if *configFile != "" {
+		loaded, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatalf("failed to load config: %v", err)
+		}
+		cfg = loaded
+	}
+	flag.Visit(func(f *flag.Flag) {
+		var err error
+		switch f.Name {
+		case "requirepass":
+			err = cfg.SetAtStartup("requirepass", *requirePass)
+		case "appendonly":
+			value := "no"
+			if *appendOnly {
+				value = "yes"
+			}
+			err = cfg.SetAtStartup("appendonly", value)
+		case "databases":
+			err = cfg.SetAtStartup("databases", strconv.Itoa(*databases))
+		case "dir":
+			err = cfg.SetAtStartup("dir", *dir)
+		case "dbfilename":
+			err = cfg.SetAtStartup("dbfilename", *dbFilename)
+		case "max-key-length":
+			err = cfg.SetAtStartup("max-key-length", *maxKeyLength)
+		case "max-value-length":
+			err = cfg.SetAtStartup("max-value-length", *maxValueLength)
+		case "max-line-length":
+			err = cfg.SetAtStartup("max-line-length", *maxLineLength)
+		case "max-inline-length":
+			err = cfg.SetAtStartup("max-inline-length", *maxInlineLength)
+		case "max-args":
+			err = cfg.SetAtStartup("max-args", *maxArgs)
+		case "max-arg-length":
+			err = cfg.SetAtStartup("max-arg-length", *maxArgLength)
+		case "trace":
+			value := "no"
+			if *trace {
+				value = "yes"
+			}
+			err = cfg.SetAtStartup("trace", value)
+		}
+		if err != nil {
+			log.Fatalf("invalid configuration: %v", err)
+		}
+	})
 
-	err := server.Start(*listenAddress, store)
+	var storage store.Storage
+	switch *storageKind {
+	case "memory":
+		storage = store.NewMemoryStorage(cfg.Get().Databases)
+	case "disk":
+		diskStorage, err := store.OpenDiskStorage(*dataDir, cfg.Get().Databases)
+		if err != nil {
+			log.Fatalf("failed to open disk storage: %v", err)
+		}
+		storage = diskStorage
+	default:
+		log.Fatalf("invalid storage %q, expected memory or disk", *storageKind)
+	}
+	if *walFile != "" {
+		recovered, err := store.RecoverWAL(storage, *walFile)
+		if err != nil {
+			log.Fatalf("failed to recover write-ahead log: %v", err)
+		}
+		log.Printf("Recovered %d records from write-ahead log %s", recovered, *walFile)
+		walStorage, err := store.NewWALStorage(storage, *walFile)
+		if err != nil {
+			log.Fatalf("failed to open write-ahead log: %v", err)
+		}
+		storage = walStorage
+	}
+	store := store.CreateNewStoreWithConfig(storage, cfg)
+
+	// Disk storage and the write-ahead log already hold the dataset, and
+	// replaying on top of them would apply writes twice.
+	if *storageKind == "memory" && *walFile == "" {
+		if err := server.LoadData(store, *ignoreLoadErrors); err != nil {
+			log.Fatalf("failed to load data: %v", err)
+		}
+	}
+	if settings := cfg.Get(); settings.AppendOnly {
+		if err := store.EnableAppendOnly(settings.AppendOnlyPath()); err != nil {
+			log.Fatalf("failed to open append only file: %v", err)
+		}
+	}
+
+	if *loadFile != "" {
+		result, err := server.LoadCommandFile(store, *loadFile, *loadSkipErrors)
+		if err != nil {
+			log.Fatalf("failed to load %s: %v", *loadFile, err)
+		}
+		for _, err := range result.Skipped {
+			log.Printf("Skipped %v", err)
+		}
+		log.Printf("Loaded %d commands from %s, skipped %d", result.Executed, *loadFile, len(result.Skipped))
+	}
+
+	perm, err := strconv.ParseUint(*unixSocketPerm, 8, 32)
+	if err != nil || perm > 0o777 {
+		log.Fatalf("invalid unixsocketperm %q, expected octal permissions like 700", *unixSocketPerm)
+	}
+	options := []server.Option{server.WithStore(store), server.WithAddress(splitAddresses(*listenAddress)...)}
+	if *unixSocket != "" {
+		options = append(options, server.WithUnixSocket(*unixSocket, os.FileMode(perm)))
+	}
+	if *proxyProtocol {
+		options = append(options, server.WithProxyProtocol())
+	}
+	if *debugAddress != "" {
+		options = append(options, server.WithDebugAddress(*debugAddress))
+	}
+	if *replicaOf != "" {
+		options = append(options, server.WithReplicaOf(*replicaOf))
+	}
+	if *tlsCertFile != "" {
+		tlsConfig, err := server.NewTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsCACert, *tlsAuthClients)
+		if err != nil {
+			log.Fatalf("invalid TLS configuration: %v", err)
+		}
+		options = append(options, server.WithTLS(tlsConfig))
+	}
+	srv, err := server.New(options...)
 	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	// SIGINT and SIGTERM stop the server cleanly, so the unix socket file is
+	// removed.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	if err := srv.Start(); err != nil {
 		log.Fatalf("server error: %v", err)
 	}
+	sig := <-signals
+	log.Printf("Received %v, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Stop(ctx); err != nil {
+		log.Printf("Clients still connected after %v: %v", shutdownTimeout, err)
+	}
+}
+
+// splitAddresses splits a comma-separated -address into the addresses to
+// listen on, dropping empty entries.
+func splitAddresses(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// newLogHandler returns a handler writing records at level or above to
+// stderr, as text or as JSON.
+func newLogHandler(level, format string) (slog.Handler, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: minLevel}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.NewTextHandler(os.Stderr, options), nil
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, options), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
 }
@@ -1,45 +1,347 @@
 package parser
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"kv-store/errcode"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
-func ParseCommandLine(line string) (string, []string, error) {
-	var args []string
-	var curr strings.Builder
-	inQuotes := false
-	escaped := false
+var (
+	ErrLineTooLong   = errcode.New(errcode.Err, "value too large, line exceeds max-line-length")
+	ErrInlineTooLong = errcode.New(errcode.Err, "Protocol error: too big inline request")
+	ErrTooManyArgs   = errcode.New(errcode.Err, "too many arguments, more than max-args")
+	ErrArgTooLong    = errcode.New(errcode.Err, "argument too long, longer than max-arg-length")
+)
 
-	for _, char := range line {
-		switch {
-		case escaped:
-			curr.WriteRune(char)
-			escaped = false
-		case char == '\\':
-			escaped = true
-		case char == '"':
-			inQuotes = !inQuotes
-		case unicode.IsSpace(char) && !inQuotes:
-			if curr.Len() > 0 {
-				args = append(args, curr.String())
-				curr.Reset()
+// Limits bound what parsing one command may take, so a hostile request
+// fails before it costs more than the limits allow. MaxArgs counts the
+// command name along with its arguments, and MaxArgLength is in bytes. A
+// limit of 0 means none.
+type Limits struct {
+	MaxArgs      int64
+	MaxArgLength int64
+}
+
+// Options configure Parse beyond its limits. Comments makes a line whose
+// first token starts with '#', and a line of whitespace alone, parse as no
+// command, with an empty Name and no error, for command files that carry
+// notes. Commands from clients are parsed without it.
+type Options struct {
+	Limits
+	Comments bool
+}
+
+// ReadLine reads one command line, newline included. A line longer than
+// maxLength bytes, not counting the line ending, is read to its end and
+// dropped rather than buffered, and ErrLineTooLong returned in its place. A
+// maxLength of 0 means no limit.
+func ReadLine(reader *bufio.Reader, maxLength int64) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if maxLength > 0 && int64(len(bytes.TrimRight(line, "\r\n"))) > maxLength {
+				tooLong, line = true, nil
 			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong && err == nil {
+			return "", ErrLineTooLong
+		}
+		return string(line), err
+	}
+}
 
-		default:
-			curr.WriteRune(char)
+// ErrMismatchedQuotes reports a quote opened at byte offset position of the
+// line and never closed.
+var ErrMismatchedQuotes = func(position int) error {
+	return errcode.Errorf(errcode.Err, "syntax, mismatched quotes at position %d", position)
+}
+
+// ParsedCommand is one inline command split into its tokens.
+type ParsedCommand struct {
+	// Name is the command name upper-cased, and RawName as it was sent.
+	Name    string
+	RawName string
+	// Args holds the arguments after the name, unquoted and unescaped, and
+	// nil when there are none. Escapes may make them invalid UTF-8.
+	Args [][]byte
+	// Offsets holds the byte offset in the line where each token starts,
+	// the name's first.
+	Offsets []int
+}
+
+// StringArgs returns the arguments as strings, nil when there are none.
+func (c ParsedCommand) StringArgs() []string {
+	if len(c.Args) == 0 {
+		return nil
+	}
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = string(arg)
+	}
+	return args
+}
+
+// ParseCommandLine splits an inline command into its upper-cased name and its
+// arguments, as Parse does.
+func ParseCommandLine(line string) (string, []string, error) {
+	parsed, err := Limits{}.Parse(line)
+	if err != nil {
+		return "", nil, err
+	}
+	return parsed.Name, parsed.StringArgs(), nil
+}
+
+// Parse splits an inline command into its tokens, without limits.
+func Parse(line string) (ParsedCommand, error) {
+	return Limits{}.Parse(line)
+}
+
+// Parse splits an inline command into its tokens. The line may end in LF or
+// CRLF. Outside quotes, any whitespace, a lone '\r' included, separates
+// tokens, and a quoted empty string is a token of its own. A command without
+// arguments, such as PING, has nil Args; checking arity is up to the caller.
+//
+// A backslash makes the next character literal. Inside double quotes it also
+// starts the escapes \n, \r, \t, \a and \b, and \xHH for the byte with hex
+// value HH. Any other escape, a malformed \x included, is the escaped
+// character itself, so "\q" reads as q.
+//
+// Parsing stops with ErrTooManyArgs or ErrArgTooLong as soon as the line
+// breaks l, so it never holds more than the limits allow.
+func (l Limits) Parse(line string) (ParsedCommand, error) {
+	return Options{Limits: l}.Parse(line)
+}
+
+// Parse splits an inline command into its tokens as Limits.Parse does,
+// skipping comments and blank lines when o.Comments is set.
+func (o Options) Parse(line string) (ParsedCommand, error) {
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	t := newTokenizer(o)
+	for i := 0; i < len(line); {
+		char, size := utf8.DecodeRuneInString(line[i:])
+		if err := t.feed(i, char, line[i:i+size]); err != nil {
+			return ParsedCommand{}, err
+		}
+		i += size
+	}
+	return t.finish()
+}
+
+// tokenizer splits a line into tokens as its characters are fed one at a
+// time, for Parse and Reader alike.
+type tokenizer struct {
+	options Options
+	tokens  [][]byte
+	offsets []int
+	curr    []byte
+	// quoted is whether curr was quoted, so "" is an empty token rather
+	// than none. hex holds the digits of a \x escape read so far.
+	inQuotes, escaped, quoted, inHex bool
+	hex                              []byte
+	// comment is whether the line is a comment, whose rest is dropped.
+	comment bool
+	// start is where curr began, and quoteStart where the last quote
+	// opened.
+	start, quoteStart int
+}
+
+func newTokenizer(options Options) *tokenizer {
+	return &tokenizer{options: options, curr: []byte{}, start: -1}
+}
+
+// feed takes the character at byte offset position of the line, raw being
+// its bytes as sent.
+func (t *tokenizer) feed(position int, char rune, raw string) error {
+	if t.comment {
+		return nil
+	}
+	if t.inHex {
+		if len(t.hex) < 2 && isHexDigit(char) {
+			t.hex = append(t.hex, byte(char))
+			if len(t.hex) == 2 {
+				b, _ := strconv.ParseUint(string(t.hex), 16, 8)
+				t.addByte(byte(b))
+				t.inHex, t.hex = false, t.hex[:0]
+			}
+			return t.check()
+		}
+		// A malformed \x escape is the x itself.
+		t.flushHex()
+	}
+	// A '#' escaped or quoted starts a token before it, so is no comment.
+	if t.options.Comments && char == '#' && t.start < 0 && len(t.tokens) == 0 {
+		t.comment = true
+		return nil
+	}
+	if t.start < 0 && (t.inQuotes || t.escaped || !unicode.IsSpace(char)) {
+		t.start = position
+	}
+	switch {
+	case t.escaped && t.inQuotes:
+		if char == 'x' {
+			t.inHex = true
+		} else if b, ok := unescape(char); ok {
+			t.addByte(b)
+		} else {
+			t.add(raw)
 		}
+		t.escaped = false
+	case t.escaped:
+		t.add(raw)
+		t.escaped = false
+	case char == '\\':
+		t.escaped = true
+	case char == '"':
+		if !t.inQuotes {
+			t.quoteStart = position
+		}
+		t.inQuotes, t.quoted = !t.inQuotes, true
+	case unicode.IsSpace(char) && !t.inQuotes:
+		t.endToken()
+		t.start = -1
+
+	default:
+		t.add(raw)
+	}
+	return t.check()
+}
+
+// check fails as soon as the tokens break the limits, so the tokenizer
+// never holds more than they allow.
+func (t *tokenizer) check() error {
+	if t.options.MaxArgs > 0 && int64(len(t.tokens)) >= t.options.MaxArgs && (len(t.curr) > 0 || t.quoted) {
+		return ErrTooManyArgs
+	}
+	if t.options.MaxArgLength > 0 && int64(len(t.curr)) > t.options.MaxArgLength {
+		return ErrArgTooLong
+	}
+	return nil
+}
+
+// add appends raw to the current token.
+func (t *tokenizer) add(raw string) {
+	t.reserve(len(raw))
+	t.curr = append(t.curr, raw...)
+}
+
+func (t *tokenizer) addByte(b byte) {
+	t.reserve(1)
+	t.curr = append(t.curr, b)
+}
+
+// reserve makes room for n more bytes in the current token, doubling its
+// buffer as it fills, so a long token costs about twice its length in all
+// rather than the many copies append's gentler growth makes of a large
+// slice.
+func (t *tokenizer) reserve(n int) {
+	if len(t.curr)+n > cap(t.curr) {
+		grown := make([]byte, len(t.curr), max(2*cap(t.curr), len(t.curr)+n, 16))
+		copy(grown, t.curr)
+		t.curr = grown
+	}
+}
+
+func (t *tokenizer) flushHex() {
+	t.addByte('x')
+	t.add(string(t.hex))
+	t.inHex, t.hex = false, t.hex[:0]
+}
+
+func (t *tokenizer) endToken() {
+	if len(t.curr) > 0 || t.quoted {
+		t.tokens, t.offsets = append(t.tokens, t.curr), append(t.offsets, t.start)
+		t.curr, t.quoted = []byte{}, false
 	}
+}
 
-	if curr.Len() > 0 {
-		args = append(args, curr.String())
+// finish returns the command once the whole line has been fed.
+func (t *tokenizer) finish() (ParsedCommand, error) {
+	if t.inHex {
+		t.flushHex()
 	}
-	if inQuotes {
-		return "", nil, fmt.Errorf("ERR syntax, mismatched quotes")
+	t.endToken()
+	if t.inQuotes {
+		return ParsedCommand{}, ErrMismatchedQuotes(t.quoteStart)
 	}
-	if len(args) == 0{
-		return "", nil, fmt.Errorf("ERR empty command")
+	if len(t.tokens) == 0 && (t.comment || t.options.Comments) {
+		return ParsedCommand{}, nil
+	}
+	if len(t.tokens) == 0 {
+		return ParsedCommand{}, errcode.New(errcode.Err, "empty command")
+	}
+	parsed := ParsedCommand{
+		Name:    strings.ToUpper(string(t.tokens[0])),
+		RawName: string(t.tokens[0]),
+		Offsets: t.offsets,
+	}
+	if len(t.tokens) > 1 {
+		parsed.Args = t.tokens[1:]
+	}
+	return parsed, nil
+}
+
+// unescape returns the byte the escape of char, after its backslash, stands
+// for, and false if it is not one of the single-character escapes Quote
+// writes.
+func unescape(char rune) (byte, bool) {
+	switch char {
+	case 'n':
+		return '\n', true
+	case 'r':
+		return '\r', true
+	case 't':
+		return '\t', true
+	case 'a':
+		return '\a', true
+	case 'b':
+		return '\b', true
+	}
+	return 0, false
+}
+
+func isHexDigit(char rune) bool {
+	return '0' <= char && char <= '9' || 'a' <= char && char <= 'f' || 'A' <= char && char <= 'F'
+}
+
+// Quote returns s as a double-quoted argument ParseCommandLine reads back as
+// s. Line breaks, other control characters and invalid UTF-8 are escaped, so
+// the result always fits on one line.
+func Quote(s string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(s); {
+		char, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case char == '"' || char == '\\':
+			quoted.WriteString(`\` + string(char))
+		case char == '\n':
+			quoted.WriteString(`\n`)
+		case char == '\r':
+			quoted.WriteString(`\r`)
+		case char == '\t':
+			quoted.WriteString(`\t`)
+		case char == '\a':
+			quoted.WriteString(`\a`)
+		case char == '\b':
+			quoted.WriteString(`\b`)
+		case char == utf8.RuneError && size == 1, char < ' ', char == 0x7f:
+			fmt.Fprintf(&quoted, `\x%02x`, s[i])
+		default:
+			quoted.WriteString(s[i : i+size])
+		}
+		i += size
 	}
-	return strings.ToUpper(args[0]), args[1:], nil
+	quoted.WriteByte('"')
+	return quoted.String()
 }
@@ -1,8 +1,13 @@
 package parser
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -13,21 +18,244 @@ func TestParseCommandLine(t *testing.T) {
 		args  []string
 		err   error
 	}{
-		{``, "", nil, nil},
 		{`set name foo`, "SET", []string{"name", "foo"}, nil},
 		{`SET surname "foo bar"`, "SET", []string{"surname", "foo bar"}, nil},
 		{`SET name "foo bar baz"`, "SET", []string{"name", "foo bar baz"}, nil},
 		{`GET name`, "GET", []string{"name"}, nil},
 		{`SET key "val\"ue"`, "SET", []string{"key", `val"ue`}, nil},
 		{`SET key \"bad`, "SET", []string{`key`, `"bad`}, nil},
-		{`SET key "bad`, "", nil, fmt.Errorf("ERR syntax, mismatched quotes")},
+		{`SET key "bad`, "", nil, fmt.Errorf("ERR syntax, mismatched quotes at position 8")},
+		{`SET "a" "b" c"d`, "", nil, fmt.Errorf("ERR syntax, mismatched quotes at position 13")},
 		{``, "", nil, fmt.Errorf("ERR empty command")},
+		{"SET name foo\n", "SET", []string{"name", "foo"}, nil},
+		{"SET name foo\r\n", "SET", []string{"name", "foo"}, nil},
+		{"SET name \"foo bar\"\r\n", "SET", []string{"name", "foo bar"}, nil},
+		{"SET name foo\\\r\n", "SET", []string{"name", "foo"}, nil},
+		{"SET\rname foo", "SET", []string{"name", "foo"}, nil},
+		{"\r\n", "", nil, fmt.Errorf("ERR empty command")},
+		{`PING`, "PING", nil, nil},
+		{`multi`, "MULTI", nil, nil},
+		{"EXEC\r\n", "EXEC", nil, nil},
+		{`  DBSIZE  `, "DBSIZE", nil, nil},
+		{`SET key ""`, "SET", []string{"key", ""}, nil},
+		{`SET "" value`, "SET", []string{"", "value"}, nil},
+		{`SET key """"`, "SET", []string{"key", ""}, nil},
+		{`SET key a""b`, "SET", []string{"key", "ab"}, nil},
+		{"SET key \"\"\r\n", "SET", []string{"key", ""}, nil},
+		{`"" ""`, "", []string{""}, nil},
+		{`SET key "a\nb\r\tc\a\b"`, "SET", []string{"key", "a\nb\r\tc\a\b"}, nil},
+		{`SET key "\x00\xff\x41"`, "SET", []string{"key", "\x00\xffA"}, nil},
+		{`SET key "back\\slash"`, "SET", []string{"key", `back\slash`}, nil},
+		// Unknown and malformed escapes are the escaped character itself.
+		{`SET key "\q\xZZ\x4"`, "SET", []string{"key", "qxZZx4"}, nil},
+		// Outside quotes a backslash only makes the next character literal.
+		{`SET key a\nb`, "SET", []string{"key", "anb"}, nil},
 	}
 
 	for _, tt := range tests {
-		cmd, args, _ := ParseCommandLine(tt.input)
-		if cmd != tt.cmd || !reflect.DeepEqual(args, tt.args) {
-			t.Errorf("input=%q => got (%q, %v), expected (%q, %v)", tt.input, cmd, args, tt.cmd, tt.args)
+		cmd, args, err := ParseCommandLine(tt.input)
+		if cmd != tt.cmd || !reflect.DeepEqual(args, tt.args) || fmt.Sprint(err) != fmt.Sprint(tt.err) {
+			t.Errorf("input=%q => got (%q, %#v, %v), expected (%q, %#v, %v)", tt.input, cmd, args, err, tt.cmd, tt.args, tt.err)
 		}
 	}
 }
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input  string
+		parsed ParsedCommand
+	}{
+		{"ping", ParsedCommand{Name: "PING", RawName: "ping", Offsets: []int{0}}},
+		{"  Set  name \"bat man\"\r\n", ParsedCommand{
+			Name: "SET", RawName: "Set",
+			Args:    [][]byte{[]byte("name"), []byte("bat man")},
+			Offsets: []int{2, 7, 12},
+		}},
+		{`SET "" a"b c"\x "\xff\x00"`, ParsedCommand{
+			Name: "SET", RawName: "SET",
+			Args:    [][]byte{{}, []byte("ab cx"), {0xff, 0x00}},
+			Offsets: []int{0, 4, 7, 16},
+		}},
+		{`\"quoted\" name`, ParsedCommand{
+			Name: `"QUOTED"`, RawName: `"quoted"`,
+			Args:    [][]byte{[]byte("name")},
+			Offsets: []int{0, 11},
+		}},
+	}
+
+	for _, tt := range tests {
+		parsed, err := Parse(tt.input)
+		if err != nil || !reflect.DeepEqual(parsed, tt.parsed) {
+			t.Errorf("Parse(%q) = %+v, %v, expected %+v", tt.input, parsed, err, tt.parsed)
+		}
+	}
+}
+
+func TestLimits_Parse(t *testing.T) {
+	limits := Limits{MaxArgs: 3, MaxArgLength: 4}
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{"SET name bats", nil},
+		{`SET "" ""`, nil},
+		{"SET name bats  \r\n", nil},
+		{"DEL a b c", ErrTooManyArgs},
+		{`DEL a b ""`, ErrTooManyArgs},
+		{"GET batman", ErrArgTooLong},
+		{`GET "\x00\x00\x00\x00\x00"`, ErrArgTooLong},
+		{"LPUSHX k", ErrArgTooLong},
+	}
+
+	for _, tt := range tests {
+		if _, err := limits.Parse(tt.input); err != tt.err {
+			t.Errorf("Parse(%q) error = %v, expected %v", tt.input, err, tt.err)
+		}
+	}
+	if _, err := (Limits{}).Parse("DEL " + strings.Repeat("k ", 10000)); err != nil {
+		t.Errorf("Parse() without limits failed: %v", err)
+	}
+}
+
+func TestOptions_Parse(t *testing.T) {
+	tests := []struct {
+		input    string
+		comments bool
+		name     string
+		args     []string
+		err      error
+	}{
+		{"# a note", true, "", nil, nil},
+		{"  # an indented note \"", true, "", nil, nil},
+		{"#", true, "", nil, nil},
+		{" \t\r\n", true, "", nil, nil},
+		{"", true, "", nil, nil},
+		{`\#tag`, true, "#TAG", nil, nil},
+		{`"#" a`, true, "#", []string{"a"}, nil},
+		{"SET # #", true, "SET", []string{"#", "#"}, nil},
+		{"# a note", false, "#", []string{"a", "note"}, nil},
+		{"  ", false, "", nil, errors.New("ERR empty command")},
+	}
+
+	for _, tt := range tests {
+		parsed, err := Options{Comments: tt.comments}.Parse(tt.input)
+		if parsed.Name != tt.name || !reflect.DeepEqual(parsed.StringArgs(), tt.args) || fmt.Sprint(err) != fmt.Sprint(tt.err) {
+			t.Errorf("Parse(%q) with Comments %t = %+v, %v, expected %s %q, %v", tt.input, tt.comments, parsed, err, tt.name, tt.args, tt.err)
+		}
+	}
+}
+
+// TestLimits_ParseAllocations checks that a line far over the limits is
+// rejected having allocated about what the limits allow, not what the line
+// holds.
+func TestLimits_ParseAllocations(t *testing.T) {
+	limits := Limits{MaxArgs: 100, MaxArgLength: 1 << 10}
+	tests := []struct {
+		name string
+		line string
+		err  error
+	}{
+		{"many tiny arguments", "DEL" + strings.Repeat(" k", 1<<20), ErrTooManyArgs},
+		{"many empty arguments", "DEL" + strings.Repeat(` ""`, 1<<20), ErrTooManyArgs},
+		{"one huge argument", "SET k " + strings.Repeat("v", 4<<20), ErrArgTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			_, err := limits.Parse(tt.line)
+			runtime.ReadMemStats(&after)
+
+			if err != tt.err {
+				t.Errorf("Parse() error = %v, expected %v", err, tt.err)
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<10 {
+				t.Errorf("Parse() of a %d byte line allocated %d bytes, expected it to stay near the limits", len(tt.line), allocated)
+			}
+		})
+	}
+}
+
+// FuzzLimits_Parse checks that whatever the line, Parse either fails or
+// returns a command within the limits.
+func FuzzLimits_Parse(f *testing.F) {
+	for _, seed := range []string{"SET name batman", `SET "a b" "\x00\n"`, `DEL a b c d e`, `"" "" ""`, `GET "open`, `\"x\\`} {
+		f.Add(seed)
+	}
+	limits := Limits{MaxArgs: 4, MaxArgLength: 8}
+	f.Fuzz(func(t *testing.T, line string) {
+		parsed, err := limits.Parse(line)
+		if err != nil {
+			return
+		}
+		if int64(len(parsed.Args)+1) > limits.MaxArgs || int64(len(parsed.RawName)) > limits.MaxArgLength {
+			t.Fatalf("Parse(%q) = %d arguments, name %q, beyond the limits", line, len(parsed.Args), parsed.RawName)
+		}
+		for _, arg := range parsed.Args {
+			if int64(len(arg)) > limits.MaxArgLength {
+				t.Fatalf("Parse(%q) returned a %d byte argument, beyond the limit", line, len(arg))
+			}
+		}
+		if len(parsed.Offsets) != len(parsed.Args)+1 {
+			t.Fatalf("Parse(%q) returned %d offsets for %d tokens", line, len(parsed.Offsets), len(parsed.Args)+1)
+		}
+	})
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		input  string
+		quoted string
+	}{
+		{"", `""`},
+		{"batman", `"batman"`},
+		{"two words", `"two words"`},
+		{"line\r\nbreak", `"line\r\nbreak"`},
+		{"tab\tbell\abackspace\b", `"tab\tbell\abackspace\b"`},
+		{`say "hi" \o/`, `"say \"hi\" \\o/"`},
+		{"\x00\x1b\x7f", `"\x00\x1b\x7f"`},
+		{"caf\xc3\xa9 \xff", `"café \xff"`},
+	}
+
+	for _, tt := range tests {
+		quoted := Quote(tt.input)
+		if quoted != tt.quoted {
+			t.Errorf("Quote(%q) = %s, expected %s", tt.input, quoted, tt.quoted)
+		}
+		_, args, err := ParseCommandLine("SET " + quoted)
+		if err != nil || len(args) != 1 || args[0] != tt.input {
+			t.Errorf("ParseCommandLine(SET %s) = %q, %v, expected [%q]", quoted, args, err, tt.input)
+		}
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		maxLength int64
+		lines     []string
+		errs      []error
+	}{
+		{"below the limit", "1234\n", 5, []string{"1234\n"}, []error{nil}},
+		{"at the limit", "12345\r\n", 5, []string{"12345\r\n"}, []error{nil}},
+		{"above the limit", "123456\nGET a\n", 5, []string{"", "GET a\n"}, []error{ErrLineTooLong, nil}},
+		{"above the limit across buffer fills", strings.Repeat("x", 100) + "\nGET a\n", 50, []string{"", "GET a\n"}, []error{ErrLineTooLong, nil}},
+		{"across buffer fills without a limit", strings.Repeat("x", 100) + "\n", 0, []string{strings.Repeat("x", 100) + "\n"}, []error{nil}},
+		{"unterminated", "GET", 5, []string{"GET"}, []error{io.EOF}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+			for i := range tt.lines {
+				line, err := ReadLine(reader, tt.maxLength)
+				if line != tt.lines[i] || err != tt.errs[i] {
+					t.Errorf("ReadLine() #%d = %q, %v, expected %q, %v", i, line, err, tt.lines[i], tt.errs[i])
+				}
+			}
+		})
+	}
+}
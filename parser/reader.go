@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Reader reads commands off a stream, RESP or inline, tokenizing an inline
+// line as its bytes arrive rather than reading the whole line first. Its
+// limits are read before each command, so they may change between reads.
+type Reader struct {
+	reader *bufio.Reader
+	// Limits bound each command. MaxLineLength bounds each RESP bulk string
+	// and each inline line, and MaxInlineLength inline lines alone, in
+	// bytes; 0 means no limit.
+	Limits          Limits
+	MaxLineLength   int64
+	MaxInlineLength int64
+	// KeepLine keeps the bytes of each inline line for Line, as tracing
+	// needs them. Comments skips comments and blank lines, as
+	// Options.Comments does.
+	KeepLine bool
+	Comments bool
+
+	resp bool
+	line []byte
+}
+
+// NewReader returns a Reader reading from r. A *bufio.Reader is read
+// directly, so its buffered bytes stay shared with other readers of it.
+func NewReader(r io.Reader) *Reader {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return &Reader{reader: reader}
+}
+
+// RESP reports whether the last command read was sent as RESP.
+func (r *Reader) RESP() bool {
+	return r.resp
+}
+
+// Line returns the last inline line read, ending included, when KeepLine is
+// set.
+func (r *Reader) Line() string {
+	return string(r.line)
+}
+
+// ReadCommand reads the next command. An empty RESP array returns a
+// ParsedCommand with an empty Name, as do a comment and a blank line when
+// Comments is set. A command that breaks a limit, or an
+// inline line that does not parse, is dropped to its end and the error
+// returned, so the stream stays in step. An inline line cut off by the end of
+// the stream is still returned; the next read returns io.EOF. Malformed RESP
+// returns an error wrapping ErrProtocol, as ReadRESPCommand does.
+func (r *Reader) ReadCommand() (ParsedCommand, error) {
+	r.line = r.line[:0]
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return ParsedCommand{}, err
+	}
+	r.resp = first[0] == '*'
+	if !r.resp {
+		return r.readInline()
+	}
+
+	fields, err := r.Limits.readRESP(r.reader, r.MaxLineLength)
+	if err != nil || len(fields) == 0 {
+		return ParsedCommand{}, err
+	}
+	parsed := ParsedCommand{Name: strings.ToUpper(string(fields[0])), RawName: string(fields[0])}
+	if len(fields) > 1 {
+		parsed.Args = fields[1:]
+	}
+	return parsed, nil
+}
+
+// readInline tokenizes one line under the tighter of MaxInlineLength and
+// MaxLineLength.
+func (r *Reader) readInline() (ParsedCommand, error) {
+	maxLength, tooLong := r.MaxInlineLength, ErrInlineTooLong
+	if r.MaxLineLength > 0 && (maxLength == 0 || r.MaxLineLength < maxLength) {
+		maxLength, tooLong = r.MaxLineLength, ErrLineTooLong
+	}
+
+	t := newTokenizer(Options{Limits: r.Limits, Comments: r.Comments})
+	// length counts the bytes of the line so far, its ending excluded.
+	var length int64
+	blank := true
+	for {
+		char, size, err := r.reader.ReadRune()
+		if err == io.EOF && !blank {
+			return t.finish()
+		}
+		if err != nil {
+			return ParsedCommand{}, err
+		}
+		// ReadRune reads an invalid byte as utf8.RuneError, so the raw
+		// byte is read again.
+		raw := string(char)
+		if char == utf8.RuneError && size == 1 {
+			r.reader.UnreadRune()
+			b, _ := r.reader.ReadByte()
+			raw = string([]byte{b})
+		}
+		if r.KeepLine {
+			r.line = append(r.line, raw...)
+		}
+		if char == '\n' {
+			return t.finish()
+		}
+		if char == '\r' {
+			// A '\r' before the '\n', or the end of the stream, ends the
+			// line with it.
+			if next, err := r.reader.Peek(1); err != nil || next[0] == '\n' {
+				continue
+			}
+		}
+
+		length += int64(size)
+		if maxLength > 0 && length > maxLength {
+			r.line = r.line[:0]
+			return ParsedCommand{}, r.skipLine(tooLong)
+		}
+		blank = blank && unicode.IsSpace(char)
+		if err := t.feed(int(length)-size, char, raw); err != nil {
+			return ParsedCommand{}, r.skipLine(err)
+		}
+	}
+}
+
+// skipLine drops the rest of the line unread and returns err, or the error
+// that ended the stream first.
+func (r *Reader) skipLine(err error) error {
+	for {
+		_, readErr := r.reader.ReadSlice('\n')
+		if readErr == bufio.ErrBufferFull {
+			continue
+		}
+		if readErr != nil {
+			return readErr
+		}
+		return err
+	}
+}
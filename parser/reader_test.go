@@ -0,0 +1,156 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReader_ReadCommand(t *testing.T) {
+	input := "set name \"bat man\"\r\n" +
+		"*2\r\n$3\r\nget\r\n$4\r\nname\r\n" +
+		"\r\n" +
+		"SET k \"a\\x00\\xff\"\n" +
+		"*0\r\n" +
+		"PING"
+	expected := []struct {
+		parsed ParsedCommand
+		resp   bool
+		err    error
+	}{
+		{ParsedCommand{Name: "SET", RawName: "set", Args: [][]byte{[]byte("name"), []byte("bat man")}, Offsets: []int{0, 4, 9}}, false, nil},
+		{ParsedCommand{Name: "GET", RawName: "get", Args: [][]byte{[]byte("name")}}, true, nil},
+		{ParsedCommand{}, false, errors.New("ERR empty command")},
+		{ParsedCommand{Name: "SET", RawName: "SET", Args: [][]byte{[]byte("k"), {'a', 0, 0xff}}, Offsets: []int{0, 4, 6}}, false, nil},
+		{ParsedCommand{}, true, nil},
+		{ParsedCommand{Name: "PING", RawName: "PING", Offsets: []int{0}}, false, nil},
+		{ParsedCommand{}, false, io.EOF},
+	}
+
+	// One byte at a time, so every token arrives in pieces.
+	reader := NewReader(iotest.OneByteReader(strings.NewReader(input)))
+	for i, want := range expected {
+		parsed, err := reader.ReadCommand()
+		if !reflect.DeepEqual(parsed, want.parsed) || fmt.Sprint(err) != fmt.Sprint(want.err) {
+			t.Errorf("command %d: ReadCommand() = %+v, %v, expected %+v, %v", i, parsed, err, want.parsed, want.err)
+		}
+		if err == nil && reader.RESP() != want.resp {
+			t.Errorf("command %d: RESP() = %t, expected %t", i, reader.RESP(), want.resp)
+		}
+	}
+}
+
+func TestReader_KeepsStreamInStep(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		reader Reader
+		err    error
+	}{
+		{"inline line too long", "SET name batman\r\n", Reader{MaxInlineLength: 12}, ErrInlineTooLong},
+		{"max-line-length tighter", "SET name batman\r\n", Reader{MaxInlineLength: 12, MaxLineLength: 10}, ErrLineTooLong},
+		{"carriage return not counted", "SET name bat\r\n", Reader{MaxInlineLength: 12}, nil},
+		{"too many arguments", "DEL a b c\r\n", Reader{Limits: Limits{MaxArgs: 3}}, ErrTooManyArgs},
+		{"argument too long", "SET name \"bat man\"\r\n", Reader{Limits: Limits{MaxArgLength: 6}}, ErrArgTooLong},
+		{"mismatched quotes", "SET name \"bat\r\n", Reader{}, ErrMismatchedQuotes(9)},
+		{"RESP argument too long", "*2\r\n$3\r\nGET\r\n$6\r\nbatman\r\n", Reader{MaxLineLength: 5}, ErrLineTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewReader(strings.NewReader(tt.line + "PING\r\n"))
+			reader.Limits, reader.MaxLineLength, reader.MaxInlineLength = tt.reader.Limits, tt.reader.MaxLineLength, tt.reader.MaxInlineLength
+
+			if _, err := reader.ReadCommand(); fmt.Sprint(err) != fmt.Sprint(tt.err) {
+				t.Errorf("ReadCommand() error = %v, expected %v", err, tt.err)
+			}
+			if parsed, err := reader.ReadCommand(); parsed.Name != "PING" || err != nil {
+				t.Errorf("ReadCommand() after it = %+v, %v, expected PING; stream out of step", parsed, err)
+			}
+		})
+	}
+}
+
+func TestReader_KeepLine(t *testing.T) {
+	reader := NewReader(strings.NewReader("GET  name\r\n*1\r\n$4\r\nPING\r\nSET k v"))
+	reader.KeepLine = true
+
+	for _, expected := range []string{"GET  name\r\n", "", "SET k v"} {
+		if _, err := reader.ReadCommand(); err != nil {
+			t.Fatalf("ReadCommand() failed: %v", err)
+		}
+		if reader.Line() != expected {
+			t.Errorf("Line() = %q, expected %q", reader.Line(), expected)
+		}
+	}
+}
+
+func TestReader_Comments(t *testing.T) {
+	reader := NewReader(strings.NewReader("# a note\r\n\r\n  \nPING\r\n# last"))
+	reader.Comments = true
+
+	for _, expected := range []string{"", "", "", "PING", ""} {
+		if parsed, err := reader.ReadCommand(); parsed.Name != expected || err != nil {
+			t.Errorf("ReadCommand() = %+v, %v, expected %q", parsed, err, expected)
+		}
+	}
+	if _, err := reader.ReadCommand(); err != io.EOF {
+		t.Errorf("ReadCommand() at the end = %v, expected EOF", err)
+	}
+}
+
+func TestReader_SharesBufferedReader(t *testing.T) {
+	buffered := bufio.NewReader(strings.NewReader("PING\r\nrest"))
+	if _, err := NewReader(buffered).ReadCommand(); err != nil {
+		t.Fatalf("ReadCommand() failed: %v", err)
+	}
+	if rest, _ := io.ReadAll(buffered); string(rest) != "rest" {
+		t.Errorf("bufio.Reader left with %q, expected rest", rest)
+	}
+}
+
+// TestReader_LongQuotedValue checks that a value of several megabytes is
+// read with about one copy of it in memory, not the line and then its
+// tokens.
+func TestReader_LongQuotedValue(t *testing.T) {
+	value := strings.Repeat("bat man ", 1<<20)
+	line := `SET name "` + value + "\"\r\n"
+	reader := NewReader(strings.NewReader(line))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	parsed, err := reader.ReadCommand()
+	runtime.ReadMemStats(&after)
+
+	if err != nil || len(parsed.Args) != 2 || string(parsed.Args[1]) != value {
+		t.Fatalf("ReadCommand() = %d arguments, %v, expected the value back", len(parsed.Args), err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 3*uint64(len(value)) {
+		t.Errorf("ReadCommand() of a %d byte value allocated %d bytes", len(value), allocated)
+	}
+}
+
+// FuzzReader_MatchesParse checks that reading a line off a stream gives what
+// parsing it whole does.
+func FuzzReader_MatchesParse(f *testing.F) {
+	for _, seed := range []string{"SET name batman", `SET "a b" "\x00\n\xZ"`, `"" ""`, `GET "open`, "SET a\\\r", "  \t"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		if strings.ContainsAny(line, "\n") || strings.HasPrefix(line, "*") {
+			return
+		}
+		expected, expectedErr := Parse(line)
+		parsed, err := NewReader(strings.NewReader(line + "\n")).ReadCommand()
+		if !reflect.DeepEqual(parsed, expected) || fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+			t.Fatalf("ReadCommand() of %q = %+v, %v, expected %+v, %v", line, parsed, err, expected, expectedErr)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"kv-store/errcode"
+	"strconv"
+	"strings"
+)
+
+var ErrProtocol = errcode.New(errcode.Err, "Protocol error")
+
+// maxRESPArgs and maxRESPBulkLength bound the headers of one request, so a
+// bad header cannot make the server allocate an arbitrarily large buffer.
+const (
+	maxRESPArgs       = 1024 * 1024
+	maxRESPBulkLength = 1 << 30
+)
+
+// IsRESP reports whether the next request on reader is a RESP array rather
+// than an inline command line. It blocks until the first byte arrives.
+func IsRESP(reader *bufio.Reader) bool {
+	first, err := reader.Peek(1)
+	return err == nil && first[0] == '*'
+}
+
+// ReadRESPCommand reads one request sent as a RESP array of bulk strings,
+// without limits beyond maxLength.
+func ReadRESPCommand(reader *bufio.Reader, maxLength int64) (string, []string, error) {
+	return Limits{}.ReadRESPCommand(reader, maxLength)
+}
+
+// ReadRESPCommand reads one request sent as a RESP array of bulk strings.
+// It returns the upper-cased command and its arguments, or an empty command
+// for an empty array. A bulk string longer than maxLength bytes is skipped
+// and the rest of the request read, then ErrLineTooLong returned, so the
+// connection stays in step. A maxLength of 0 means no limit. A request that
+// breaks l is skipped the same way, returning ErrTooManyArgs or
+// ErrArgTooLong. Malformed input, including a request cut off by the end of
+// the stream, returns an error wrapping ErrProtocol, after which the stream
+// cannot be trusted.
+func (l Limits) ReadRESPCommand(reader *bufio.Reader, maxLength int64) (string, []string, error) {
+	fields, err := l.readRESP(reader, maxLength)
+	if err != nil || len(fields) == 0 {
+		return "", nil, err
+	}
+	parsed := ParsedCommand{RawName: string(fields[0]), Args: fields[1:]}
+	return strings.ToUpper(parsed.RawName), parsed.StringArgs(), nil
+}
+
+// readRESP reads the bulk strings of one request as ReadRESPCommand
+// describes.
+func (l Limits) readRESP(reader *bufio.Reader, maxLength int64) ([][]byte, error) {
+	fields, err := l.readRESPFields(reader, maxLength)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: unexpected end of request", ErrProtocol)
+	}
+	return fields, err
+}
+
+func (l Limits) readRESPFields(reader *bufio.Reader, maxLength int64) ([][]byte, error) {
+	count, err := readRESPHeader(reader, '*')
+	if err != nil {
+		return nil, err
+	}
+	if count > maxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+
+	var fields [][]byte
+	// skipped is the error of the first limit the request broke, after
+	// which the rest of it is read and dropped.
+	var skipped error
+	if l.MaxArgs > 0 && count > l.MaxArgs {
+		skipped = ErrTooManyArgs
+	}
+	for range count {
+		length, err := readRESPHeader(reader, '$')
+		if err != nil {
+			return nil, err
+		}
+		if length > maxRESPBulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+		if skipped == nil && maxLength > 0 && length > maxLength {
+			skipped = ErrLineTooLong
+		}
+		if skipped == nil && l.MaxArgLength > 0 && length > l.MaxArgLength {
+			skipped = ErrArgTooLong
+		}
+		if skipped != nil {
+			if _, err := reader.Discard(int(length) + 2); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		if string(data[length:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: expected CRLF after bulk string", ErrProtocol)
+		}
+		fields = append(fields, data[:length:length])
+	}
+	if skipped != nil {
+		return nil, skipped
+	}
+	return fields, nil
+}
+
+// readRESPHeader reads a line of the form <kind><non-negative integer>\r\n.
+func readRESPHeader(reader *bufio.Reader, kind byte) (int64, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return 0, fmt.Errorf("%w: too big header", ErrProtocol)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 4 || line[0] != kind || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("%w: expected '%c', got %q", ErrProtocol, kind, line)
+	}
+	value, err := strconv.ParseInt(string(line[1:len(line)-2]), 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, line[1:len(line)-2])
+	}
+	return value, nil
+}
@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		maxLength int64
+		cmd       string
+		args      []string
+		err       error
+	}{
+		{"command with arguments", "*3\r\n$3\r\nset\r\n$4\r\nname\r\n$6\r\nbatman\r\n", 0, "SET", []string{"name", "batman"}, nil},
+		{"binary safe argument", "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$6\r\na b\r\nc\r\n", 0, "SET", []string{"k", "a b\r\nc"}, nil},
+		{"empty bulk string", "*2\r\n$4\r\nPING\r\n$0\r\n\r\n", 0, "PING", []string{""}, nil},
+		{"empty array", "*0\r\n", 0, "", nil, nil},
+		{"argument above the limit", "*2\r\n$3\r\nGET\r\n$6\r\nabcdef\r\n", 5, "", nil, ErrLineTooLong},
+		{"bulk header expected", "*1\r\n:3\r\n", 0, "", nil, ErrProtocol},
+		{"negative length", "*1\r\n$-1\r\n", 0, "", nil, ErrProtocol},
+		{"missing CRLF after bulk", "*1\r\n$3\r\nGETX\r\n", 0, "", nil, ErrProtocol},
+		{"too many arguments", "*99999999\r\n", 0, "", nil, ErrProtocol},
+		{"truncated bulk", "*1\r\n$3\r\nGE", 0, "", nil, ErrProtocol},
+		{"truncated header", "*2\r\n$3\r\nGET\r\n$", 0, "", nil, ErrProtocol},
+		{"truncated long argument", "*1\r\n$9\r\nab", 5, "", nil, ErrProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input))
+			cmd, args, err := ReadRESPCommand(reader, tt.maxLength)
+			if cmd != tt.cmd || !reflect.DeepEqual(args, tt.args) || !errors.Is(err, tt.err) {
+				t.Errorf("ReadRESPCommand() = %q, %q, %v, expected %q, %q, %v", cmd, args, err, tt.cmd, tt.args, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadRESPCommand_Limits(t *testing.T) {
+	limits := Limits{MaxArgs: 3, MaxArgLength: 4}
+	tests := []struct {
+		name  string
+		input string
+		err   error
+	}{
+		{"within the limits", "*3\r\n$3\r\nSET\r\n$4\r\nname\r\n$4\r\nbats\r\n", nil},
+		{"too many arguments", "*4\r\n$3\r\nDEL\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", ErrTooManyArgs},
+		{"argument too long", "*2\r\n$3\r\nGET\r\n$5\r\nbatma\r\n", ErrArgTooLong},
+		{"max-line-length first", "*2\r\n$3\r\nGET\r\n$9\r\nbatmobile\r\n", ErrLineTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input + "*1\r\n$4\r\nPING\r\n"))
+			if _, _, err := limits.ReadRESPCommand(reader, 8); err != tt.err {
+				t.Errorf("ReadRESPCommand() error = %v, expected %v", err, tt.err)
+			}
+			if cmd, _, err := limits.ReadRESPCommand(reader, 8); cmd != "PING" || err != nil {
+				t.Errorf("ReadRESPCommand() after it = %q, %v, expected PING; stream out of step", cmd, err)
+			}
+		})
+	}
+}
+
+func TestReadRESPCommand_KeepsStreamInStepAfterLongArgument(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$6\r\nabcdef\r\n*1\r\n$4\r\nPING\r\n"))
+
+	if _, _, err := ReadRESPCommand(reader, 5); err != ErrLineTooLong {
+		t.Fatalf("ReadRESPCommand() error = %v, expected %v", err, ErrLineTooLong)
+	}
+	if cmd, _, err := ReadRESPCommand(reader, 5); cmd != "PING" || err != nil {
+		t.Errorf("ReadRESPCommand() after the long argument = %q, %v, expected PING", cmd, err)
+	}
+}
+
+func TestIsRESP(t *testing.T) {
+	for input, expected := range map[string]bool{"*1\r\n$4\r\nPING\r\n": true, "PING\n": false, "": false} {
+		if got := IsRESP(bufio.NewReader(strings.NewReader(input))); got != expected {
+			t.Errorf("IsRESP(%q) = %v, expected %v", input, got, expected)
+		}
+	}
+}
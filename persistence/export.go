@@ -0,0 +1,87 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// An export has one JSON object per line, one line per key:
+//
+//	{"db":0,"key":"name","type":"string","ttl":-1,"value":"batman"}
+//
+// ttl is the time to live left in milliseconds, or -1 when the key does not
+// expire. A JSON string only holds valid UTF-8, so when the key or the value
+// is not, both are base64 encoded and the line adds "encoding":"base64".
+type exportRecord struct {
+	DB       int    `json:"db"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	TTL      int64  `json:"ttl"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+var typeNames = map[byte]string{TypeString: "string"}
+
+// EncodeExportLine renders e as a line of an export, without the newline,
+// with its expiry as a TTL counted from now.
+func EncodeExportLine(e Entry, now time.Time) ([]byte, error) {
+	typeName, ok := typeNames[e.Type]
+	if !ok {
+		return nil, ErrUnknownType(e.Type)
+	}
+	record := exportRecord{DB: e.DB, Key: e.Key, Type: typeName, TTL: -1, Value: e.Value}
+	if e.ExpireAt != 0 {
+		record.TTL = max(e.ExpireAt-now.UnixMilli(), 0)
+	}
+	if !utf8.ValidString(e.Key) || !utf8.ValidString(e.Value) {
+		record.Key = base64.StdEncoding.EncodeToString([]byte(e.Key))
+		record.Value = base64.StdEncoding.EncodeToString([]byte(e.Value))
+		record.Encoding = "base64"
+	}
+	return json.Marshal(record)
+}
+
+// DecodeExportLine reads a line of an export, turning its TTL back into an
+// expiry counted from now.
+func DecodeExportLine(line []byte, now time.Time) (Entry, error) {
+	var record exportRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return Entry{}, fmt.Errorf("err invalid export line: %v", err)
+	}
+	e := Entry{DB: record.DB, Key: record.Key, Value: record.Value}
+	if record.DB < 0 {
+		return Entry{}, fmt.Errorf("err invalid export line: negative db %d", record.DB)
+	}
+	found := false
+	for valueType, name := range typeNames {
+		if name == record.Type {
+			e.Type, found = valueType, true
+		}
+	}
+	if !found {
+		return Entry{}, fmt.Errorf("err invalid export line: unknown type %q", record.Type)
+	}
+	if record.TTL >= 0 {
+		e.ExpireAt = now.UnixMilli() + record.TTL
+	}
+	switch record.Encoding {
+	case "":
+	case "base64":
+		key, err := base64.StdEncoding.DecodeString(record.Key)
+		if err != nil {
+			return Entry{}, fmt.Errorf("err invalid export line: key: %v", err)
+		}
+		value, err := base64.StdEncoding.DecodeString(record.Value)
+		if err != nil {
+			return Entry{}, fmt.Errorf("err invalid export line: value: %v", err)
+		}
+		e.Key, e.Value = string(key), string(value)
+	default:
+		return Entry{}, fmt.Errorf("err invalid export line: unknown encoding %q", record.Encoding)
+	}
+	return e, nil
+}
@@ -0,0 +1,55 @@
+package persistence
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportLine_RoundTrip(t *testing.T) {
+	now := time.UnixMilli(1767225600000)
+	tests := []struct {
+		name     string
+		entry    Entry
+		expected string
+	}{
+		{"plain", Entry{DB: 0, Key: "name", Value: "batman"}, `{"db":0,"key":"name","type":"string","ttl":-1,"value":"batman"}`},
+		{"quoted", Entry{DB: 3, Key: "a b", Value: "line\r\n\"quoted\""}, `{"db":3,"key":"a b","type":"string","ttl":-1,"value":"line\r\n\"quoted\""}`},
+		{"binary", Entry{DB: 1, Key: "bin", Value: "\x00\xff"}, `{"db":1,"key":"Ymlu","type":"string","ttl":-1,"value":"AP8=","encoding":"base64"}`},
+		{"expiry", Entry{DB: 0, Key: "session", Value: "token", ExpireAt: now.UnixMilli() + 1500}, `{"db":0,"key":"session","type":"string","ttl":1500,"value":"token"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, err := EncodeExportLine(tt.entry, now)
+			if err != nil || string(line) != tt.expected {
+				t.Fatalf("EncodeExportLine() = %s, %v, expected %s", line, err, tt.expected)
+			}
+			got, err := DecodeExportLine(line, now)
+			if err != nil || !reflect.DeepEqual(got, tt.entry) {
+				t.Errorf("DecodeExportLine() = %v, %v, expected %v", got, err, tt.entry)
+			}
+		})
+	}
+}
+
+func TestDecodeExportLine_Rejects(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"not json", `SET name batman`},
+		{"negative db", `{"db":-1,"key":"k","type":"string","ttl":-1,"value":"v"}`},
+		{"unknown type", `{"db":0,"key":"k","type":"list","ttl":-1,"value":"v"}`},
+		{"unknown encoding", `{"db":0,"key":"k","type":"string","ttl":-1,"value":"v","encoding":"hex"}`},
+		{"bad base64", `{"db":0,"key":"!","type":"string","ttl":-1,"value":"AP8=","encoding":"base64"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if e, err := DecodeExportLine([]byte(tt.line), time.Now()); err == nil {
+				t.Errorf("DecodeExportLine(%s) = %v, expected an error", tt.line, e)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package persistence
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func encode(t *testing.T, entries []Entry) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer)
+	for _, e := range entries {
+		if err := writer.Write(e); err != nil {
+			t.Fatalf("Write(%v) failed: %v", e, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func decode(data []byte) ([]Entry, error) {
+	var entries []Entry
+	err := Read(data, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []Entry
+	}{
+		{"empty", nil},
+		{"single key", []Entry{{DB: 0, Key: "name", Value: "batman"}}},
+		{"binary safe", []Entry{{DB: 0, Key: "line\r\nbreak", Value: "\x00\xff \"quoted\""}}},
+		{"empty value", []Entry{{DB: 0, Key: "empty", Value: ""}}},
+		{"several databases", []Entry{
+			{DB: 0, Key: "a", Value: "1"},
+			{DB: 0, Key: "b", Value: "2"},
+			{DB: 3, Key: "c", Value: "3"},
+			{DB: 300, Key: "d", Value: "4"},
+		}},
+		{"expiry", []Entry{
+			{DB: 1, Key: "session", Value: "token", ExpireAt: 1767225600000},
+			{DB: 1, Key: "forever", Value: "value"},
+		}},
+		{"large value", []Entry{{DB: 0, Key: "big", Value: string(bytes.Repeat([]byte("x"), 1<<20))}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decode(encode(t, tt.entries))
+
+			if err != nil {
+				t.Fatalf("Read() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.entries) {
+				t.Errorf("Read() = %v, expected %v", got, tt.entries)
+			}
+		})
+	}
+}
+
+func TestWrite_OutOfOrderDatabase(t *testing.T) {
+	writer := NewWriter(&bytes.Buffer{})
+	writer.Write(Entry{DB: 2, Key: "a", Value: "1"})
+
+	if err := writer.Write(Entry{DB: 1, Key: "b", Value: "2"}); err != ErrEntryOutOfOrder {
+		t.Errorf("Write() = %v, expected %v", err, ErrEntryOutOfOrder)
+	}
+}
+
+func TestRead_Rejects(t *testing.T) {
+	valid := encode(t, []Entry{{DB: 0, Key: "name", Value: "batman"}})
+	modified := func(modify func(data []byte) []byte) []byte {
+		return modify(append([]byte(nil), valid...))
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{"empty file", nil, ErrBadMagic},
+		{"wrong magic", modified(func(data []byte) []byte { data[0] = 'X'; return data }), ErrBadMagic},
+		{"newer version", modified(func(data []byte) []byte { data[len(Magic)] = Version + 1; return data }), ErrNewerVersion(Version + 1)},
+		{"flipped value byte", modified(func(data []byte) []byte { data[len(data)-10] ^= 1; return data }), ErrBadChecksum},
+		{"flipped checksum byte", modified(func(data []byte) []byte { data[len(data)-1] ^= 1; return data }), ErrBadChecksum},
+		{"truncated", modified(func(data []byte) []byte { return data[:len(data)-3] }), ErrBadChecksum},
+		{"header only", []byte(Magic + "\x01"), ErrCorrupt("file is truncated")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := decode(tt.data)
+
+			if err == nil || err.Error() != tt.expected.Error() {
+				t.Errorf("Read() = %v, expected %v", err, tt.expected)
+			}
+			if len(entries) != 0 {
+				t.Errorf("expected a rejected file to yield no entries, got %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestAux(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewWriter(&buffer)
+	writer.WriteAux("wal-sequence", "42")
+	writer.WriteAux("created-by", "test")
+	writer.Write(Entry{DB: 0, Key: "name", Value: "batman"})
+	if err := writer.WriteAux("late", "field"); err != ErrAuxAfterEntries {
+		t.Errorf("WriteAux() after an entry = %v, expected %v", err, ErrAuxAfterEntries)
+	}
+	writer.Close()
+
+	aux, err := Aux(buffer.Bytes())
+	if expected := map[string]string{"wal-sequence": "42", "created-by": "test"}; err != nil || !reflect.DeepEqual(aux, expected) {
+		t.Errorf("Aux() = %v, %v, expected %v", aux, err, expected)
+	}
+	entries, err := decode(buffer.Bytes())
+	if expected := []Entry{{DB: 0, Key: "name", Value: "batman"}}; err != nil || !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Read() = %v, %v, expected aux fields to be skipped", entries, err)
+	}
+}
@@ -0,0 +1,171 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+	"os"
+)
+
+// ReadFile loads the snapshot at path and calls fn for every entry, in file
+// order. The checksum and version are verified before any entry is handed
+// out, so a damaged file never partially loads.
+func ReadFile(path string, fn func(Entry) error) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return Read(data, fn)
+}
+
+// verify checks the header and checksum and returns a reader positioned after
+// the header.
+func verify(data []byte) (*reader, error) {
+	header := len(Magic) + 1
+	if len(data) < header || string(data[:len(Magic)]) != Magic {
+		return nil, ErrBadMagic
+	}
+	if version := int(data[len(Magic)]); version > Version {
+		return nil, ErrNewerVersion(version)
+	}
+	if len(data) < header+1+checksumSize {
+		return nil, ErrCorrupt("file is truncated")
+	}
+	body := data[:len(data)-checksumSize]
+	if crc64.Checksum(body, crcTable) != binary.LittleEndian.Uint64(data[len(body):]) {
+		return nil, ErrBadChecksum
+	}
+	return &reader{data: body, offset: header}, nil
+}
+
+// Aux returns the aux fields of a snapshot without decoding its entries.
+func Aux(data []byte) (map[string]string, error) {
+	r, err := verify(data)
+	if err != nil {
+		return nil, err
+	}
+	aux := make(map[string]string)
+	for r.offset < len(r.data) && r.data[r.offset] == opAux {
+		r.offset++
+		key, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		if aux[key], err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+	return aux, nil
+}
+
+func Read(data []byte, fn func(Entry) error) error {
+	r, err := verify(data)
+	if err != nil {
+		return err
+	}
+
+	db := -1
+	for {
+		op, err := r.byte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opEOF:
+			if r.offset != len(r.data) {
+				return ErrCorrupt("data after end of file marker")
+			}
+			return nil
+		case opAux:
+			if db >= 0 {
+				return ErrCorrupt("aux field after the first database selector")
+			}
+			if _, err := r.string(); err != nil {
+				return err
+			}
+			if _, err := r.string(); err != nil {
+				return err
+			}
+			continue
+		case opSelectDB:
+			index, err := r.uvarint()
+			if err != nil {
+				return err
+			}
+			db = int(index)
+			continue
+		}
+
+		if db < 0 {
+			return ErrCorrupt("key before the first database selector")
+		}
+		entry := Entry{DB: db}
+		if op == opExpireAt {
+			expireAt, err := r.uint64()
+			if err != nil {
+				return err
+			}
+			entry.ExpireAt = int64(expireAt)
+			if op, err = r.byte(); err != nil {
+				return err
+			}
+		}
+		if op != TypeString {
+			return ErrUnknownType(op)
+		}
+		entry.Type = op
+		if entry.Key, err = r.string(); err != nil {
+			return err
+		}
+		if entry.Value, err = r.string(); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+type reader struct {
+	data   []byte
+	offset int
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.offset >= len(r.data) {
+		return 0, ErrCorrupt("unexpected end of file")
+	}
+	b := r.data[r.offset]
+	r.offset++
+	return b, nil
+}
+
+func (r *reader) uint64() (uint64, error) {
+	if len(r.data)-r.offset < 8 {
+		return 0, ErrCorrupt("unexpected end of file")
+	}
+	value := binary.LittleEndian.Uint64(r.data[r.offset:])
+	r.offset += 8
+	return value, nil
+}
+
+func (r *reader) uvarint() (uint64, error) {
+	value, n := binary.Uvarint(r.data[r.offset:])
+	if n <= 0 {
+		return 0, ErrCorrupt("invalid length")
+	}
+	r.offset += n
+	return value, nil
+}
+
+func (r *reader) string() (string, error) {
+	length, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(len(r.data)-r.offset) {
+		return "", ErrCorrupt("length exceeds file size")
+	}
+	value := string(r.data[r.offset : r.offset+int(length)])
+	r.offset += int(length)
+	return value, nil
+}
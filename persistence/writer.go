@@ -0,0 +1,142 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+)
+
+// A snapshot file is laid out as:
+//
+//	magic "KVSNAP", version byte
+//	aux fields:    opAux, uvarint key length, key, uvarint value length, value
+//	per database:  opSelectDB, uvarint database index
+//	per key:       [opExpireAt, 8 byte unix milliseconds] type byte,
+//	               uvarint key length, key, uvarint value length, value
+//	opEOF, 8 byte little endian CRC64 (ECMA) of everything before it
+const (
+	Magic   = "KVSNAP"
+	Version = 1
+
+	TypeString = 0
+
+	opAux      = 0xfa
+	opExpireAt = 0xfc
+	opSelectDB = 0xfe
+	opEOF      = 0xff
+
+	checksumSize = 8
+)
+
+var (
+	ErrBadMagic     = errors.New("err not a snapshot file")
+	ErrNewerVersion = func(version int) error {
+		return fmt.Errorf("err snapshot version %d is newer than the supported version %d", version, Version)
+	}
+	ErrBadChecksum = errors.New("err snapshot checksum mismatch")
+	ErrCorrupt     = func(reason string) error { return fmt.Errorf("err corrupt snapshot: %s", reason) }
+	ErrUnknownType = func(valueType byte) error {
+		return fmt.Errorf("err corrupt snapshot: unknown value type %d", valueType)
+	}
+	ErrEntryOutOfOrder = errors.New("err snapshot entries must be grouped by database")
+	ErrAuxAfterEntries = errors.New("err snapshot aux fields must come before the first entry")
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// Entry is one key of a snapshot. ExpireAt is a unix time in milliseconds,
+// zero when the key does not expire.
+type Entry struct {
+	DB       int
+	Key      string
+	Value    string
+	Type     byte
+	ExpireAt int64
+}
+
+type Writer struct {
+	out     *bufio.Writer
+	crc     hash.Hash64
+	db      int
+	scratch [binary.MaxVarintLen64]byte
+	err     error
+}
+
+// NewWriter writes the header to w. Entries must be written grouped by
+// database; Close appends the trailer and flushes.
+func NewWriter(w io.Writer) *Writer {
+	writer := &Writer{
+		out: bufio.NewWriterSize(w, 64*1024),
+		crc: crc64.New(crcTable),
+		db:  -1,
+	}
+	writer.write([]byte(Magic))
+	writer.write([]byte{Version})
+	return writer
+}
+
+func (w *Writer) write(data []byte) {
+	if w.err == nil {
+		w.crc.Write(data)
+		_, w.err = w.out.Write(data)
+	}
+}
+
+func (w *Writer) writeUvarint(value uint64) {
+	n := binary.PutUvarint(w.scratch[:], value)
+	w.write(w.scratch[:n])
+}
+
+func (w *Writer) writeString(value string) {
+	w.writeUvarint(uint64(len(value)))
+	if w.err == nil {
+		io.WriteString(w.crc, value)
+		_, w.err = w.out.WriteString(value)
+	}
+}
+
+// WriteAux records a metadata field, such as what the snapshot was taken
+// from. Aux fields go before any entry.
+func (w *Writer) WriteAux(key, value string) error {
+	if w.db >= 0 {
+		return ErrAuxAfterEntries
+	}
+	w.write([]byte{opAux})
+	w.writeString(key)
+	w.writeString(value)
+	return w.err
+}
+
+func (w *Writer) Write(e Entry) error {
+	if e.DB < w.db {
+		return ErrEntryOutOfOrder
+	}
+	if e.DB != w.db {
+		w.write([]byte{opSelectDB})
+		w.writeUvarint(uint64(e.DB))
+		w.db = e.DB
+	}
+	if e.ExpireAt != 0 {
+		w.write([]byte{opExpireAt})
+		w.write(binary.LittleEndian.AppendUint64(nil, uint64(e.ExpireAt)))
+	}
+	w.write([]byte{e.Type})
+	w.writeString(e.Key)
+	w.writeString(e.Value)
+	return w.err
+}
+
+func (w *Writer) Close() error {
+	w.write([]byte{opEOF})
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := w.out.Write(binary.LittleEndian.AppendUint64(nil, w.crc.Sum64())); err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
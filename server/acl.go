@@ -0,0 +1,368 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"kv-store/errcode"
+	"kv-store/glob"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultUser = "default"
+
+var (
+	ErrNoPermCommand = func(user, commandName string) error {
+		return errcode.Errorf(errcode.NoPerm, "User %s has no permissions to run the '%s' command", user, strings.ToLower(commandName))
+	}
+	ErrNoPermKey = errcode.New(errcode.NoPerm, "No permissions to access a key")
+	ErrACLSyntax = func(rule string) error {
+		return errcode.Errorf(errcode.Err, "error in ACL SETUSER modifier '%s': Syntax error", rule)
+	}
+	ErrDeleteDefaultACL = errcode.New(errcode.Err, "the 'default' user cannot be removed")
+)
+
+var aclHelp = []string{
+	"ACL <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"SETUSER <username> <rule> [<rule> ...]",
+	"    Create or modify a user with the specified rules.",
+	"GETUSER <username>",
+	"    Get the user's details.",
+	"DELUSER <username> [<username> ...]",
+	"    Delete a list of users.",
+	"LIST",
+	"    Show users and their rules.",
+	"WHOAMI",
+	"    Return the current connection username.",
+	"HELP",
+	"    Print this help.",
+}
+
+type user struct {
+	name        string
+	enabled     bool
+	noPass      bool
+	passwords   map[string]struct{}
+	allCommands bool
+	commands    map[string]bool
+	keyPatterns []string
+}
+
+type acl struct {
+	users map[string]*user
+	mutex sync.RWMutex
+}
+
+func newACL(requirePass string) *acl {
+	defaultACLUser := newUser(defaultUser)
+	defaultACLUser.enabled = true
+	defaultACLUser.allCommands = true
+	defaultACLUser.keyPatterns = []string{"*"}
+	if requirePass == "" {
+		defaultACLUser.noPass = true
+	} else {
+		defaultACLUser.passwords[hashPassword(requirePass)] = struct{}{}
+	}
+
+	return &acl{
+		users: map[string]*user{defaultUser: defaultACLUser},
+	}
+}
+
+func newUser(name string) *user {
+	return &user{
+		name:      name,
+		passwords: make(map[string]struct{}),
+		commands:  make(map[string]bool),
+	}
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// defaultUserRequiresAuth reports whether new connections start
+// unauthenticated.
+func (a *acl) defaultUserRequiresAuth() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	u := a.users[defaultUser]
+	return !u.enabled || !u.noPass
+}
+
+func (a *acl) userEnabled(username string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	u, exists := a.users[username]
+	return exists && u.enabled
+}
+
+func (a *acl) defaultUserHasNoPassword() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.users[defaultUser].noPass
+}
+
+// setRequirePass mirrors a requirepass change onto the default user, as the
+// option is just a shorthand for the default user's password.
+func (a *acl) setRequirePass(requirePass string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	u := a.users[defaultUser].clone()
+	u.passwords = make(map[string]struct{})
+	u.noPass = requirePass == ""
+	if requirePass != "" {
+		u.passwords[hashPassword(requirePass)] = struct{}{}
+	}
+	a.users[defaultUser] = u
+}
+
+func (a *acl) authenticate(username, password string) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	u, exists := a.users[username]
+	if !exists || !u.enabled {
+		return ErrInvalidPassword
+	}
+	if u.noPass {
+		return nil
+	}
+	hashed := hashPassword(password)
+	for stored := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1 {
+			return nil
+		}
+	}
+	return ErrInvalidPassword
+}
+
+// checkPermissions verifies the user may run command on keys. Commands that
+// read the whole keyspace, like COMPACT, pass allKeys and need the allkeys
+// pattern.
+func (a *acl) checkPermissions(username, command string, keys []string, allKeys bool) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	u, exists := a.users[username]
+	if !exists || !u.enabled {
+		return ErrNoAuth
+	}
+	if !u.canRun(command) {
+		return ErrNoPermCommand(username, command)
+	}
+	if allKeys && !slices.Contains(u.keyPatterns, "*") {
+		return ErrNoPermKey
+	}
+	for _, key := range keys {
+		if !u.canAccess(key) {
+			return ErrNoPermKey
+		}
+	}
+	return nil
+}
+
+func (u *user) canRun(command string) bool {
+	if allowed, ok := u.commands[command]; ok {
+		return allowed
+	}
+	return u.allCommands
+}
+
+func (u *user) canAccess(key string) bool {
+	for _, pattern := range u.keyPatterns {
+		if glob.Match(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *acl) setUser(name string, rules []string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	u, exists := a.users[name]
+	if exists {
+		u = u.clone()
+	} else {
+		u = newUser(name)
+	}
+
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return err
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+func (u *user) clone() *user {
+	copied := *u
+	copied.passwords = make(map[string]struct{}, len(u.passwords))
+	for password := range u.passwords {
+		copied.passwords[password] = struct{}{}
+	}
+	copied.commands = make(map[string]bool, len(u.commands))
+	for command, allowed := range u.commands {
+		copied.commands[command] = allowed
+	}
+	copied.keyPatterns = slices.Clone(u.keyPatterns)
+	return &copied
+}
+
+func (u *user) applyRule(rule string) error {
+	switch lowered := strings.ToLower(rule); {
+	case lowered == "on":
+		u.enabled = true
+	case lowered == "off":
+		u.enabled = false
+	case lowered == "nopass":
+		u.noPass = true
+		u.passwords = make(map[string]struct{})
+	case lowered == "resetpass":
+		u.noPass = false
+		u.passwords = make(map[string]struct{})
+	case lowered == "allkeys":
+		u.keyPatterns = []string{"*"}
+	case lowered == "resetkeys":
+		u.keyPatterns = nil
+	case lowered == "allcommands" || lowered == "+@all":
+		u.allCommands = true
+		u.commands = make(map[string]bool)
+	case lowered == "nocommands" || lowered == "-@all":
+		u.allCommands = false
+		u.commands = make(map[string]bool)
+	case lowered == "reset":
+		*u = *newUser(u.name)
+	case strings.HasPrefix(rule, ">"):
+		u.noPass = false
+		u.passwords[hashPassword(rule[1:])] = struct{}{}
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "~") && len(rule) > 1:
+		u.keyPatterns = append(u.keyPatterns, rule[1:])
+	case strings.HasPrefix(rule, "+") && len(rule) > 1 && !strings.HasPrefix(rule, "+@"):
+		u.commands[strings.ToUpper(rule[1:])] = true
+	case strings.HasPrefix(rule, "-") && len(rule) > 1 && !strings.HasPrefix(rule, "-@"):
+		u.commands[strings.ToUpper(rule[1:])] = false
+	default:
+		return ErrACLSyntax(rule)
+	}
+	return nil
+}
+
+func (a *acl) delUsers(names []string) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if slices.Contains(names, defaultUser) {
+		return 0, ErrDeleteDefaultACL
+	}
+	deleted := 0
+	for _, name := range names {
+		if _, exists := a.users[name]; exists {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (a *acl) list() []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, "user "+a.users[name].describe())
+	}
+	return lines
+}
+
+func (a *acl) getUser(name string) ([]string, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	u, exists := a.users[name]
+	if !exists {
+		return nil, false
+	}
+	return []string{
+		"flags: " + strings.Join(u.flags(), " "),
+		"passwords: " + strings.Join(u.sortedPasswords(), " "),
+		"commands: " + strings.Join(u.commandRules(), " "),
+		"keys: " + strings.Join(u.keyRules(), " "),
+	}, true
+}
+
+func (u *user) describe() string {
+	parts := []string{u.name}
+	parts = append(parts, u.flags()...)
+	for _, password := range u.sortedPasswords() {
+		parts = append(parts, "#"+password)
+	}
+	parts = append(parts, u.keyRules()...)
+	parts = append(parts, u.commandRules()...)
+	return strings.Join(parts, " ")
+}
+
+func (u *user) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.noPass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *user) sortedPasswords() []string {
+	passwords := make([]string, 0, len(u.passwords))
+	for password := range u.passwords {
+		passwords = append(passwords, password)
+	}
+	sort.Strings(passwords)
+	return passwords
+}
+
+func (u *user) keyRules() []string {
+	rules := make([]string, 0, len(u.keyPatterns))
+	for _, pattern := range u.keyPatterns {
+		rules = append(rules, "~"+pattern)
+	}
+	return rules
+}
+
+func (u *user) commandRules() []string {
+	rules := []string{"-@all"}
+	if u.allCommands {
+		rules[0] = "+@all"
+	}
+	commands := make([]string, 0, len(u.commands))
+	for command := range u.commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		prefix := "-"
+		if u.commands[command] {
+			prefix = "+"
+		}
+		rules = append(rules, prefix+strings.ToLower(command))
+	}
+	return rules
+}
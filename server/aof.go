@@ -0,0 +1,36 @@
+package server
+
+import (
+	"kv-store/store"
+	"os"
+	"strings"
+)
+
+// replayClientId is never handed out to a connection since client IDs start
+// at 1, so replay can track its own SELECTed database.
+const replayClientId = 0
+
+// LoadAppendOnlyFile replays the commands in path through the normal command
+// execution path. A final line without a trailing newline is what a crash in
+// the middle of a write leaves behind: it is logged, skipped and cut from the
+// file so later appends start on a fresh line.
+func LoadAppendOnlyFile(store *store.Store, path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	lines := strings.Split(string(content), "\n")
+	if truncated := lines[len(lines)-1]; truncated != "" {
+		store.Logger().Warn("Skipping truncated final line of append only file", "path", path, "line", truncated)
+		if err := os.Truncate(path, int64(len(content)-len(truncated))); err != nil {
+			return 0, err
+		}
+	}
+
+	defer store.RemoveClient(replayClientId)
+	result, err := replay("append only file "+path, lines[:len(lines)-1], func(command string, args []string) (any, error) {
+		return executeCommand(store, replayClientId, command, args)
+	}, false)
+	return result.Executed, err
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"kv-store/store"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeAppendOnlyFile(t *testing.T) (string, *store.Store) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	original := store.CreateNewStore(store.NewMemoryStorage(16))
+	if err := original.EnableAppendOnly(path); err != nil {
+		t.Fatalf("EnableAppendOnly() failed: %v", err)
+	}
+
+	original.Set(0, "wizard", `gandalf "the grey"`)
+	original.Incr(0, "counter")
+	original.IncrBy(0, "counter", 41)
+	original.Set(3, "name", "batman")
+	original.Set(3, "path", `C:\temp`)
+	original.Set(3, "poem", "line\r\nbreak\tand \xff")
+	original.Del(0, "wizard")
+
+	if err := original.CloseAppendOnly(); err != nil {
+		t.Fatalf("CloseAppendOnly() failed: %v", err)
+	}
+	return path, original
+}
+
+func TestLoadAppendOnlyFile(t *testing.T) {
+	path, original := writeAppendOnlyFile(t)
+	restored := store.CreateNewStore(store.NewMemoryStorage(16))
+
+	replayed, err := LoadAppendOnlyFile(restored, path)
+
+	if err != nil {
+		t.Fatalf("LoadAppendOnlyFile() failed: %v", err)
+	}
+	if replayed != 10 {
+		t.Errorf("LoadAppendOnlyFile() replayed %d commands, expected 10", replayed)
+	}
+	for _, key := range []struct {
+		dbIndex int
+		key     string
+	}{{0, "wizard"}, {0, "counter"}, {3, "name"}, {3, "path"}, {3, "poem"}} {
+		want, wantOk, _ := original.Get(key.dbIndex, key.key)
+		got, gotOk, _ := restored.Get(key.dbIndex, key.key)
+		if got != want || gotOk != wantOk {
+			t.Errorf("db %d key %s = %q, %t, expected %q, %t", key.dbIndex, key.key, got, gotOk, want, wantOk)
+		}
+	}
+}
+
+func TestLoadAppendOnlyFile_CrashMidWrite(t *testing.T) {
+	path, _ := writeAppendOnlyFile(t)
+	content, _ := os.ReadFile(path)
+
+	// Simulate the writer dying after every possible number of bytes.
+	for cut := range len(content) {
+		crashed := filepath.Join(t.TempDir(), "crashed.aof")
+		os.WriteFile(crashed, content[:cut], 0644)
+
+		replayed, err := LoadAppendOnlyFile(store.CreateNewStore(store.NewMemoryStorage(16)), crashed)
+
+		if err != nil {
+			t.Fatalf("cut at %d: LoadAppendOnlyFile() failed: %v", cut, err)
+		}
+		complete := strings.Count(string(content[:cut]), "\n")
+		if replayed != complete {
+			t.Errorf("cut at %d: replayed %d commands, expected %d", cut, replayed, complete)
+		}
+		recovered, _ := os.ReadFile(crashed)
+		if len(recovered) > 0 && !strings.HasSuffix(string(recovered), "\n") {
+			t.Errorf("cut at %d: expected the truncated final line to be removed, got %q", cut, recovered)
+		}
+	}
+}
+
+func TestLoadAppendOnlyFile_AppendAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	os.WriteFile(path, []byte("SELECT 0\nSET name batman\nSET name ro"), 0644)
+
+	first := store.CreateNewStore(store.NewMemoryStorage(16))
+	if _, err := LoadAppendOnlyFile(first, path); err != nil {
+		t.Fatalf("LoadAppendOnlyFile() failed: %v", err)
+	}
+	first.EnableAppendOnly(path)
+	first.Set(0, "other", "value")
+	first.CloseAppendOnly()
+
+	second := store.CreateNewStore(store.NewMemoryStorage(16))
+	if _, err := LoadAppendOnlyFile(second, path); err != nil {
+		t.Fatalf("LoadAppendOnlyFile() after appending failed: %v", err)
+	}
+	if name, _, _ := second.Get(0, "name"); name != "batman" {
+		t.Errorf("name = %q, expected batman", name)
+	}
+	if other, _, _ := second.Get(0, "other"); other != "value" {
+		t.Errorf("other = %q, expected value", other)
+	}
+}
+
+func TestLoadAppendOnlyFile_CorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	os.WriteFile(path, []byte("SET name batman\nSET name\n"), 0644)
+
+	_, err := LoadAppendOnlyFile(store.CreateNewStore(store.NewMemoryStorage(16)), path)
+
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("LoadAppendOnlyFile() = %v, expected an error for line 2", err)
+	}
+}
+
+func TestBackgroundRewriteAppendOnly_ReplaysIdentically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	original := store.CreateNewStore(store.NewMemoryStorage(16))
+	original.EnableAppendOnly(path)
+
+	for i := range 200 {
+		original.Set(i%3, fmt.Sprintf("key:%d", i%20), fmt.Sprintf("value %d", i))
+		original.Incr(5, "counter")
+		if i%7 == 0 {
+			original.Del(i%3, fmt.Sprintf("key:%d", i%20))
+		}
+	}
+
+	if err := original.BackgroundRewriteAppendOnly(); err != nil {
+		t.Fatalf("BackgroundRewriteAppendOnly() failed: %v", err)
+	}
+	// Keep writing while the rewrite runs so the buffered tail is exercised.
+	for i := range 50 {
+		original.Set(1, fmt.Sprintf("late:%d", i), "during rewrite")
+		original.Incr(5, "counter")
+	}
+	deadline := time.Now().Add(time.Second)
+	for original.PersistenceInfo()[1] != "aof_rewrite_in_progress:0" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	original.Set(2, "after", "rewrite")
+	original.CloseAppendOnly()
+
+	restored := store.CreateNewStore(store.NewMemoryStorage(16))
+	if _, err := LoadAppendOnlyFile(restored, path); err != nil {
+		t.Fatalf("LoadAppendOnlyFile() of the rewritten file failed: %v", err)
+	}
+
+	type dbKey struct {
+		dbIndex int
+		key     string
+	}
+	keys := []dbKey{{5, "counter"}, {2, "after"}}
+	for dbIndex := range 3 {
+		for i := range 20 {
+			keys = append(keys, dbKey{dbIndex, fmt.Sprintf("key:%d", i)})
+		}
+	}
+	for i := range 50 {
+		keys = append(keys, dbKey{1, fmt.Sprintf("late:%d", i)})
+	}
+
+	for _, key := range keys {
+		want, wantOk, _ := original.Get(key.dbIndex, key.key)
+		got, gotOk, _ := restored.Get(key.dbIndex, key.key)
+		if got != want || gotOk != wantOk {
+			t.Errorf("db %d key %s = %q, %t, expected %q, %t", key.dbIndex, key.key, got, gotOk, want, wantOk)
+		}
+	}
+	if original.UsedMemory() != restored.UsedMemory() {
+		t.Errorf("restored dataset uses %d bytes, expected %d", restored.UsedMemory(), original.UsedMemory())
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+// replicationBacklog keeps the latest bytes of the replication stream in a
+// ring, so a replica that reconnects can be sent what it missed instead of
+// the whole dataset.
+type replicationBacklog struct {
+	ring []byte
+	// offset counts every byte ever written, which is the replication
+	// offset of the stream's end.
+	offset int64
+	// length is how many bytes before offset the ring holds.
+	length int64
+}
+
+func newReplicationBacklog(size int64) *replicationBacklog {
+	return &replicationBacklog{ring: make([]byte, size)}
+}
+
+// firstOffset is the offset of the oldest byte held.
+func (b *replicationBacklog) firstOffset() int64 {
+	return b.offset - b.length
+}
+
+// write appends data, dropping the oldest bytes beyond size. A new size
+// keeps as much of the latest history as fits.
+func (b *replicationBacklog) write(data []byte, size int64) {
+	if size != int64(len(b.ring)) {
+		kept := min(b.length, size)
+		history, _ := b.since(b.offset - kept)
+		b.ring, b.length = make([]byte, size), 0
+		b.offset -= kept
+		b.write(history, size)
+	}
+	for len(data) > 0 {
+		n := copy(b.ring[b.offset%size:], data)
+		data = data[n:]
+		b.offset += int64(n)
+		b.length = min(b.length+int64(n), size)
+	}
+}
+
+// since returns a copy of the bytes from offset to the end of the stream,
+// or false when they are no longer, or not yet, all held.
+func (b *replicationBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.firstOffset() || offset > b.offset {
+		return nil, false
+	}
+	data := make([]byte, 0, b.offset-offset)
+	size := int64(len(b.ring))
+	for offset < b.offset {
+		start := offset % size
+		end := min(size, start+b.offset-offset)
+		data = append(data, b.ring[start:end]...)
+		offset += end - start
+	}
+	return data, true
+}
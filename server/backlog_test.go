@@ -0,0 +1,40 @@
+package server
+
+import "testing"
+
+func TestReplicationBacklog(t *testing.T) {
+	b := newReplicationBacklog(8)
+	b.write([]byte("abcde"), 8)
+	b.write([]byte("fghijk"), 8)
+
+	tests := []struct {
+		name     string
+		offset   int64
+		expected string
+		ok       bool
+	}{
+		{"all held", 3, "defghijk", true},
+		{"wrapped", 6, "ghijk", true},
+		{"end", 11, "", true},
+		{"aged out", 2, "", false},
+		{"ahead", 12, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, ok := b.since(tt.offset)
+			if ok != tt.ok || string(data) != tt.expected {
+				t.Errorf("since(%d) = %q, %v, expected %q, %v", tt.offset, data, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+
+	// Resizing keeps the latest history that fits.
+	b.write([]byte("l"), 4)
+	if data, ok := b.since(b.firstOffset()); !ok || string(data) != "ijkl" || b.firstOffset() != 8 {
+		t.Errorf("after shrinking, held %q from %d, expected \"ijkl\" from 8", data, b.firstOffset())
+	}
+	b.write([]byte("mn"), 16)
+	if data, ok := b.since(8); !ok || string(data) != "ijklmn" {
+		t.Errorf("after growing, since(8) = %q, %v, expected \"ijklmn\"", data, ok)
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"fmt"
+	"kv-store/errcode"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidClientName = errcode.New(errcode.Err, "client names cannot contain spaces, newlines or special characters")
+
+var clientHelp = []string{
+	"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"LIST",
+	"    Return information about client connections.",
+	"ID",
+	"    Return the ID of the current connection.",
+	"INFO",
+	"    Return information about the current connection.",
+	"KILL ID <id> | ADDR <ip:port>",
+	"    Kill the connections matching the filter.",
+	"PAUSE <timeout> [WRITE|ALL]",
+	"    Suspend commands (or only write commands) for <timeout> milliseconds.",
+	"UNPAUSE",
+	"    Stop the current client pause, resuming traffic.",
+	"SETNAME <name>",
+	"    Assign the name <name> to the current connection.",
+	"GETNAME",
+	"    Return the name of the current connection.",
+	"HELP",
+	"    Print this help.",
+}
+
+type client struct {
+	id           int64
+	conn         net.Conn
+	addr         string
+	createdAt    time.Time
+	lastActiveAt atomic.Int64
+	killed       atomic.Bool
+	// certCN is the common name of the client's verified TLS certificate.
+	certCN string
+	// listeningPort is the port a replica said it listens on, with REPLCONF.
+	listeningPort string
+	// queuedWrite is set once the open transaction queues a write command.
+	queuedWrite bool
+
+	mutex         sync.Mutex
+	name          string
+	authenticated bool
+	username      string
+}
+
+func newClient(id int64, conn net.Conn) *client {
+	c := &client{
+		id:        id,
+		conn:      conn,
+		addr:      conn.RemoteAddr().String(),
+		createdAt: time.Now(),
+		username:  defaultUser,
+	}
+	c.touch()
+	return c
+}
+
+func (c *client) touch() {
+	c.lastActiveAt.Store(time.Now().UnixNano())
+}
+
+// idleTimeoutUnit is the unit of the timeout setting, shortened by tests.
+var idleTimeoutUnit = time.Second
+
+// expectCommandWithin makes the next read fail once the client has sent
+// nothing for timeout units, or clears the deadline when timeout is 0. It is
+// called before every read, so the deadline restarts with each command.
+// Subscribers and monitors clear the deadline, as they wait on the server;
+// clients blocked in BLPOP must be too once that command exists.
+func (c *client) expectCommandWithin(timeout int64) error {
+	if timeout == 0 {
+		return c.conn.SetReadDeadline(time.Time{})
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * idleTimeoutUnit))
+}
+
+func (c *client) idleTime() time.Duration {
+	return time.Since(time.Unix(0, c.lastActiveAt.Load()))
+}
+
+func (c *client) user() (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.username, c.authenticated
+}
+
+func (c *client) kill() {
+	c.killed.Store(true)
+	c.conn.Close()
+}
+
+func (c *client) getName() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.name
+}
+
+func (c *client) setName(name string) error {
+	for _, char := range name {
+		if char <= ' ' || char > '~' {
+			return ErrInvalidClientName
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.name = name
+	return nil
+}
+
+func (c *client) setUser(username string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.username = username
+	c.authenticated = true
+}
+
+type clientRegistry struct {
+	clients map[int64]*client
+	mutex   sync.RWMutex
+	lastId  atomic.Int64
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{
+		clients: make(map[int64]*client),
+	}
+}
+
+func (r *clientRegistry) nextId() int64 {
+	return r.lastId.Add(1)
+}
+
+// register adds c unless maxClients clients are already registered, which it
+// reports by returning false.
+func (r *clientRegistry) register(c *client, maxClients int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if int64(len(r.clients)) >= maxClients {
+		return false
+	}
+	r.clients[c.id] = c
+	return true
+}
+
+func (r *clientRegistry) count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.clients)
+}
+
+func (r *clientRegistry) unregister(c *client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.clients, c.id)
+}
+
+func (r *clientRegistry) list() []*client {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	clients := make([]*client, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
+
+func (r *clientRegistry) kill(matches func(c *client) bool) int {
+	killed := 0
+	for _, c := range r.list() {
+		if matches(c) {
+			c.kill()
+			killed++
+		}
+	}
+	return killed
+}
+
+func (h *handler) clientInfo(c *client) string {
+	multi := -1
+	if queued, ok := h.store.TransactionLength(c.id); ok {
+		multi = queued
+	}
+	username, _ := c.user()
+
+	return fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d db=%d multi=%d user=%s cert-cn=%s",
+		c.id,
+		c.addr,
+		c.getName(),
+		int64(time.Since(c.createdAt)/time.Second),
+		int64(c.idleTime()/time.Second),
+		h.store.GetClientDBIndex(c.id),
+		multi,
+		username,
+		c.certCN,
+	)
+}
+
+func (h *handler) handleClient(c *client, args []string) (any, error) {
+	if len(args) < 1 {
+		return nil, ErrWrongNumberOfArgs("CLIENT")
+	}
+	subcommand := strings.ToUpper(args[0])
+	switch {
+	case subcommand == "LIST" && len(args) == 1:
+		var lines []string
+		for _, listed := range h.clients.list() {
+			lines = append(lines, h.clientInfo(listed))
+		}
+		return multiline(strings.Join(lines, "\n")), nil
+	case subcommand == "ID" && len(args) == 1:
+		return c.id, nil
+	case subcommand == "INFO" && len(args) == 1:
+		return h.clientInfo(c), nil
+	case subcommand == "KILL" && len(args) == 3:
+		filter, value := strings.ToUpper(args[1]), args[2]
+		switch filter {
+		case "ID":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+			return h.clients.kill(func(c *client) bool { return c.id == id }), nil
+		case "ADDR":
+			return h.clients.kill(func(c *client) bool { return c.addr == value }), nil
+		default:
+			return nil, ErrSyntax
+		}
+	case subcommand == "PAUSE" && (len(args) == 2 || len(args) == 3):
+		timeout, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || timeout < 0 {
+			return nil, ErrNotInteger
+		}
+		writesOnly := false
+		if len(args) == 3 {
+			switch strings.ToUpper(args[2]) {
+			case "WRITE":
+				writesOnly = true
+			case "ALL":
+			default:
+				return nil, ErrSyntax
+			}
+		}
+		h.pause.pause(time.Duration(timeout)*time.Millisecond, writesOnly)
+		return ResOk, nil
+	case subcommand == "UNPAUSE" && len(args) == 1:
+		h.pause.unpause()
+		return ResOk, nil
+	case subcommand == "SETNAME" && len(args) == 2:
+		if err := c.setName(args[1]); err != nil {
+			return nil, err
+		}
+		return ResOk, nil
+	case subcommand == "GETNAME" && len(args) == 1:
+		if name := c.getName(); name != "" {
+			return name, nil
+		}
+		return nil, nil
+	case subcommand == "HELP" && len(args) == 1:
+		return clientHelp, nil
+	default:
+		return nil, ErrUnknownSubcommand("CLIENT", args[0])
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"kv-store/store"
+	"sort"
+	"strings"
+)
+
+// commandSpec follows the Redis COMMAND conventions: arity counts the command
+// name itself and a negative arity means "at least", while firstKey, lastKey
+// and step locate the key arguments (lastKey -1 means the last argument).
+// maxArity caps a negative arity, and 0 leaves it open.
+//
+// validate checks the arguments further than arity does, when the command is
+// sent, so a bad one inside MULTI fails the transaction. run carries the
+// command out. The commands the connection loop serves itself, such as MULTI
+// or SUBSCRIBE, have no run. Those flagged no_multi cannot be queued in a
+// transaction, and are not run from command files. Those flagged allkeys
+// touch every key, so only a user who may access all keys can run them.
+// valueLength, when set, gives the length of the value the command stores,
+// which checkSizes holds to max-value-length.
+type commandSpec struct {
+	name        string
+	arity       int
+	maxArity    int
+	flags       []string
+	firstKey    int
+	lastKey     int
+	step        int
+	validate    func(args []string) error
+	valueLength func(args []string) int64
+	run         commandFunc
+}
+
+// commandFunc runs a command and returns a reply of one of the types
+// replyWriter.write takes.
+type commandFunc func(ctx *commandContext, args []string) (any, error)
+
+// commandContext is what a command runs with. keyspace is the store, or
+// while EXEC runs, the transaction. handler and client are nil when the
+// command comes from a command file or a transaction rather than a
+// connection.
+type commandContext struct {
+	handler  *handler
+	store    *store.Store
+	keyspace store.Keyspace
+	client   *client
+	clientId int64
+	dbIndex  int
+}
+
+var commandTable = map[string]commandSpec{}
+
+func init() {
+	for _, spec := range []commandSpec{
+		{name: "PING", arity: -1, maxArity: 2, flags: []string{"fast"}, run: runPing},
+		{name: "SET", arity: 3, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, valueLength: setValueLength, run: runSet},
+		{name: "GET", arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1, run: runGet},
+		{name: "DEL", arity: 2, flags: []string{"write"}, firstKey: 1, lastKey: 1, step: 1, run: runDel},
+		{name: "INCR", arity: 2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, run: runIncr},
+		{name: "INCRBY", arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, run: runIncrBy},
+		{name: "COMPACT", arity: 1, flags: []string{"readonly", "admin", "allkeys"}, run: runCompact},
+		{name: "FLUSHDB", arity: 1, flags: []string{"write", "allkeys"}, run: runFlushDB},
+		{name: "LOAD", arity: -2, flags: []string{"write", "denyoom", "admin", "allkeys", "no_multi"}, run: withClient((*handler).handleLoad)},
+		{name: "TOUCH", arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: -1, step: 1, run: runTouch},
+		{name: "OBJECT", arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1, validate: validateObject, run: runObject},
+		{name: "MEMORY", arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1, validate: validateMemory, run: runMemory},
+		{name: "DUMP", arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1, run: runDump},
+		{name: "DUMPALL", arity: 1, flags: []string{"readonly", "admin", "allkeys", "no_multi"}, run: runDumpAll},
+		{name: "RESTORE", arity: -4, maxArity: 5, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1, validate: validateRestore, valueLength: restoreValueLength, run: runRestore},
+		{name: "PFADD", arity: -2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1, run: runPFAdd},
+		{name: "PFCOUNT", arity: -2, flags: []string{"readonly"}, firstKey: 1, lastKey: -1, step: 1, run: runPFCount},
+		{name: "PFMERGE", arity: -2, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: -1, step: 1, run: runPFMerge},
+		{name: "SELECT", arity: 2, flags: []string{"fast"}, run: runSelect},
+		{name: "MULTI", arity: 1, flags: []string{"fast"}},
+		{name: "EXEC", arity: 1, flags: []string{"write"}},
+		{name: "DISCARD", arity: 1, flags: []string{"fast"}},
+		{name: "WATCH", arity: -2, flags: []string{"fast"}, firstKey: 1, lastKey: -1, step: 1, run: runWatch},
+		{name: "UNWATCH", arity: 1, flags: []string{"fast"}, run: runUnwatch},
+		{name: "QUIT", arity: -1, flags: []string{"fast"}},
+		{name: "AUTH", arity: -2, flags: []string{"fast"}},
+		{name: "HELLO", arity: -1, flags: []string{"fast", "no_multi"}},
+		{name: "ACL", arity: -2, flags: []string{"admin", "no_multi"}, run: runACL},
+		{name: "CLIENT", arity: -2, flags: []string{"admin", "no_multi"}, run: withClient((*handler).handleClient)},
+		{name: "COMMAND", arity: -1, flags: []string{"no_multi"}, run: func(_ *commandContext, args []string) (any, error) { return handleCommand(args) }},
+		{name: "CONFIG", arity: -2, flags: []string{"admin", "no_multi"}, run: withHandler((*handler).handleConfig)},
+		{name: "SAVE", arity: 1, flags: []string{"admin"}, run: runSave},
+		{name: "BGSAVE", arity: 1, flags: []string{"admin"}, run: runBackgroundSave},
+		{name: "LASTSAVE", arity: 1, flags: []string{"fast"}, run: runLastSave},
+		{name: "BGREWRITEAOF", arity: 1, flags: []string{"admin"}, run: runBackgroundRewriteAppendOnly},
+		{name: "INFO", arity: -1, flags: []string{"no_multi"}, run: withHandler((*handler).handleInfo)},
+		{name: "LATENCY", arity: -2, flags: []string{"admin", "no_multi"}, run: withHandler((*handler).handleLatency)},
+		{name: "SUBSCRIBE", arity: -2, flags: []string{"pubsub", "no_multi"}},
+		{name: "UNSUBSCRIBE", arity: -1, flags: []string{"pubsub", "no_multi"}},
+		{name: "PSUBSCRIBE", arity: -2, flags: []string{"pubsub", "no_multi"}},
+		{name: "PUNSUBSCRIBE", arity: -1, flags: []string{"pubsub", "no_multi"}},
+		{name: "PUBLISH", arity: 3, flags: []string{"pubsub", "fast", "no_multi"}, run: withHandler((*handler).handlePublish)},
+		{name: "PUBSUB", arity: -2, flags: []string{"pubsub", "no_multi"}, run: withHandler((*handler).handlePubsub)},
+		{name: "SLOWLOG", arity: -2, flags: []string{"admin", "no_multi"}, run: withHandler((*handler).handleSlowlog)},
+		{name: "MONITOR", arity: 1, flags: []string{"admin", "no_multi"}},
+		{name: "SYNC", arity: 1, flags: []string{"admin", "no_multi"}},
+		{name: "PSYNC", arity: -3, flags: []string{"admin", "no_multi"}},
+		{name: "FAILOVER", arity: -1, flags: []string{"admin", "no_multi"}, run: withHandler((*handler).handleFailover)},
+		{name: "REPLCONF", arity: -3, flags: []string{"admin", "no_multi"}, run: func(ctx *commandContext, args []string) (any, error) { return handleReplconf(ctx.client, args) }},
+		{name: "REPLICAOF", arity: 3, flags: []string{"admin", "no_multi"}, run: withHandler((*handler).handleReplicaOf)},
+		{name: "ROLE", arity: 1, flags: []string{"fast", "no_multi"}, run: withHandler((*handler).handleRole)},
+	} {
+		commandTable[spec.name] = spec
+	}
+}
+
+// withHandler and withClient adapt the handler methods that serve a
+// connection command.
+func withHandler(method func(*handler, []string) (any, error)) commandFunc {
+	return func(ctx *commandContext, args []string) (any, error) {
+		return method(ctx.handler, args)
+	}
+}
+
+func withClient(method func(*handler, *client, []string) (any, error)) commandFunc {
+	return func(ctx *commandContext, args []string) (any, error) {
+		return method(ctx.handler, ctx.client, args)
+	}
+}
+
+func (spec commandSpec) hasFlag(flag string) bool {
+	for _, f := range spec.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (spec commandSpec) checkArity(args []string) error {
+	count := len(args) + 1
+	if (spec.arity >= 0 && count != spec.arity) || (spec.arity < 0 && count < -spec.arity) || (spec.maxArity > 0 && count > spec.maxArity) {
+		return ErrWrongNumberOfArgs(spec.name)
+	}
+	return nil
+}
+
+func (spec commandSpec) describe() string {
+	flags := "-"
+	if len(spec.flags) > 0 {
+		flags = strings.Join(spec.flags, ",")
+	}
+	return fmt.Sprintf("%s %d %s %d %d %d",
+		strings.ToLower(spec.name), spec.arity, flags, spec.firstKey, spec.lastKey, spec.step)
+}
+
+func isWriteCommand(command string) bool {
+	return commandTable[command].hasFlag("write")
+}
+
+func commandKeys(command string, args []string) []string {
+	spec, exists := commandTable[command]
+	if !exists || spec.firstKey == 0 || len(args) < spec.firstKey {
+		return nil
+	}
+	last := spec.lastKey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	last = min(last, len(args))
+
+	var keys []string
+	for position := spec.firstKey; position <= last; position += spec.step {
+		keys = append(keys, args[position-1])
+	}
+	return keys
+}
+
+func handleCommand(args []string) (any, error) {
+	if len(args) == 0 {
+		names := make([]string, 0, len(commandTable))
+		for name := range commandTable {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		lines := make([]string, 0, len(names))
+		for _, name := range names {
+			lines = append(lines, commandTable[name].describe())
+		}
+		return multiline(strings.Join(lines, "\n")), nil
+	}
+
+	subcommand := strings.ToUpper(args[0])
+	switch {
+	case subcommand == "COUNT" && len(args) == 1:
+		return len(commandTable), nil
+	case subcommand == "INFO" && len(args) > 1:
+		lines := make([]string, 0, len(args)-1)
+		for _, name := range args[1:] {
+			spec, exists := commandTable[strings.ToUpper(name)]
+			if !exists {
+				lines = append(lines, nilText)
+				continue
+			}
+			lines = append(lines, spec.describe())
+		}
+		return multiline(strings.Join(lines, "\n")), nil
+	default:
+		return nil, ErrUnknownSubcommand("COMMAND", args[0])
+	}
+}
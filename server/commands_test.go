@@ -0,0 +1,132 @@
+package server
+
+import (
+	"kv-store/store"
+	"reflect"
+	"testing"
+)
+
+func TestCommandKeys(t *testing.T) {
+	testCases := []struct {
+		command string
+		args    []string
+		want    []string
+	}{
+		{"SET", []string{"name", "batman"}, []string{"name"}},
+		{"GET", []string{"name"}, []string{"name"}},
+		{"TOUCH", []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"PFMERGE", []string{"dest", "a", "b"}, []string{"dest", "a", "b"}},
+		{"OBJECT", []string{"ENCODING", "name"}, []string{"name"}},
+		{"OBJECT", []string{"HELP"}, nil},
+		{"MEMORY", []string{"USAGE", "name", "SAMPLES", "5"}, []string{"name"}},
+		{"RESTORE", []string{"name", "0", "payload"}, []string{"name"}},
+		{"SELECT", []string{"1"}, nil},
+		{"SET", nil, nil},
+		{"NOSUCH", []string{"name"}, nil},
+	}
+
+	for _, tc := range testCases {
+		if got := commandKeys(tc.command, tc.args); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("commandKeys(%s, %q) = %q, expected %q", tc.command, tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestHandleCommand(t *testing.T) {
+	testCases := []struct {
+		name    string
+		args    []string
+		want    any
+		wantErr error
+	}{
+		{"count", []string{"COUNT"}, len(commandTable), nil},
+		{"info", []string{"INFO", "get", "nosuch", "pfcount"}, multiline("get 2 readonly,fast 1 1 1\n(nil)\npfcount -2 readonly 1 -1 1"), nil},
+		{"info without names", []string{"INFO"}, nil, ErrUnknownSubcommand("COMMAND", "INFO")},
+		{"unknown subcommand", []string{"FOO"}, nil, ErrUnknownSubcommand("COMMAND", "FOO")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := handleCommand(tc.args)
+			if !reflect.DeepEqual(err, tc.wantErr) {
+				t.Fatalf("handleCommand(%q) error = %v, expected %v", tc.args, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("handleCommand(%q) = %v, expected %v", tc.args, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCommandSpec_CheckArity(t *testing.T) {
+	testCases := []struct {
+		command string
+		args    []string
+		wantErr bool
+	}{
+		{"GET", []string{"name"}, false},
+		{"GET", nil, true},
+		{"GET", []string{"a", "b"}, true},
+		{"TOUCH", []string{"a", "b", "c"}, false},
+		{"TOUCH", nil, true},
+		{"PING", nil, false},
+		{"PING", []string{"hello"}, false},
+		{"PING", []string{"hello", "world"}, true},
+		{"RESTORE", []string{"name", "0", "payload", "REPLACE"}, false},
+		{"RESTORE", []string{"name", "0", "payload", "REPLACE", "extra"}, true},
+	}
+
+	for _, tc := range testCases {
+		if err := commandTable[tc.command].checkArity(tc.args); (err != nil) != tc.wantErr {
+			t.Errorf("checkArity(%s, %q) = %v, expected error %t", tc.command, tc.args, err, tc.wantErr)
+		}
+	}
+}
+
+// TestCommandTable checks that every command either runs from the table or
+// is one the connection loop serves itself.
+func TestCommandTable(t *testing.T) {
+	servedByLoop := map[string]bool{
+		"QUIT": true, "AUTH": true, "HELLO": true, "MULTI": true, "EXEC": true, "DISCARD": true,
+		"MONITOR": true, "SYNC": true, "PSYNC": true,
+		"SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+	}
+	for name, spec := range commandTable {
+		if (spec.run == nil) != servedByLoop[name] {
+			t.Errorf("%s has run %t, expected %t", name, spec.run != nil, !servedByLoop[name])
+		}
+	}
+}
+
+func TestRunQueued(t *testing.T) {
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	s.StartTransaction(1)
+	for _, command := range [][]string{
+		{"SET", "name", "batman"},
+		{"PING", "hello"},
+		{"GET", "missing"},
+		{"INCRBY", "visits", "5"},
+		{"COMPACT"},
+		{"CONFIG", "GET", "dir"},
+	} {
+		s.QueueCommand(1, command[0], command[1:])
+	}
+	s.Config().Set("transaction-rollback", "no")
+
+	results, err := s.ExecuteTransaction(1, runQueued(s, 1))
+
+	if err != nil {
+		t.Fatalf("ExecuteTransaction() failed: %v", err)
+	}
+	expected := []store.Result{
+		{Kind: store.ResultStatus, Value: "OK"},
+		{Kind: store.ResultValue, Value: "hello"},
+		{Kind: store.ResultNil},
+		{Kind: store.ResultInteger, Integer: 5},
+		{Kind: store.ResultValue, Value: "SET name batman\nSET visits 5"},
+		{Kind: store.ResultError, Err: ErrUnknownCommand("CONFIG")},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("ExecuteTransaction() = %v, expected %v", results, expected)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"strings"
+)
+
+var configHelp = []string{
+	"CONFIG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"GET <pattern>",
+	"    Return parameters matching the glob-like <pattern> and their values.",
+	"SET <parameter> <value>",
+	"    Set the configuration <parameter> to <value>.",
+	"REWRITE",
+	"    Rewrite the configuration file.",
+	"HELP",
+	"    Print this help.",
+}
+
+func (h *handler) handleConfig(args []string) (any, error) {
+	subcommand := strings.ToUpper(args[0])
+	switch {
+	case subcommand == "GET" && len(args) == 2:
+		pairs := h.store.Config().Lookup(args[1])
+		reply := make(mapReply, len(pairs))
+		for i, field := range pairs {
+			reply[i] = field
+		}
+		return reply, nil
+	case subcommand == "SET" && len(args) == 3:
+		if err := h.store.Config().Set(args[1], args[2]); err != nil {
+			return nil, err
+		}
+		if strings.ToLower(args[1]) == "requirepass" {
+			h.users.setRequirePass(args[2])
+		}
+		return ResOk, nil
+	case subcommand == "REWRITE" && len(args) == 1:
+		if err := h.store.Config().Rewrite(); err != nil {
+			return nil, err
+		}
+		return ResOk, nil
+	case subcommand == "HELP" && len(args) == 1:
+		return configHelp, nil
+	default:
+		return nil, ErrUnknownSubcommand("CONFIG", args[0])
+	}
+}
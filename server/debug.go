@@ -0,0 +1,58 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"kv-store/store"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// newDebugHandler serves the pprof profiles under /debug/pprof/ and the
+// expvar variables, with the store's under "kvstore", at /debug/vars.
+func newDebugHandler(store *store.Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprint(w, "{\n")
+		expvar.Do(func(kv expvar.KeyValue) {
+			fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+		})
+		fmt.Fprintf(w, "%q: %s\n}\n", "kvstore", store.Vars())
+	})
+	return mux
+}
+
+// checkDebugAddress rejects an address that is not a loopback address, so
+// the debug endpoints are never exposed to the network.
+func checkDebugAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug address %s is not a loopback address", address)
+	}
+	return nil
+}
+
+// listenDebug binds the debug HTTP server to address, which must be a
+// loopback address: the profiles and variables are not meant to leave the
+// machine.
+func listenDebug(address string, store *store.Store) (*http.Server, net.Listener, error) {
+	if err := checkDebugAddress(address); err != nil {
+		return nil, nil, err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &http.Server{Handler: newDebugHandler(store), ReadHeaderTimeout: 10 * time.Second}, listener, nil
+}
@@ -0,0 +1,58 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"kv-store/server"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// Example embeds a server in the current process, on a port the system
+// picks, and runs a transaction on it.
+func Example() {
+	srv, err := server.New(
+		server.WithAddress("127.0.0.1:0"),
+		server.WithAuth("secret"),
+		server.WithNumDatabases(4),
+		server.WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
+	defer srv.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for _, command := range []string{"AUTH secret", "MULTI", "SET greeting hello", "INCR visits", "EXEC"} {
+		fmt.Fprintf(conn, "%s\n", command)
+		lines := 1
+		if command == "EXEC" {
+			lines = 2
+		}
+		for range lines {
+			reply, err := reader.ReadString('\n')
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(strings.TrimSuffix(reply, "\r\n"))
+		}
+	}
+	// Output:
+	// OK
+	// OK
+	// QUEUED
+	// QUEUED
+	// 1) OK
+	// 2) 1
+}
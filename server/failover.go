@@ -0,0 +1,226 @@
+package server
+
+import (
+	"kv-store/errcode"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrFailoverOnReplica       = errcode.New(errcode.Err, "FAILOVER is not valid when server is a replica.")
+	ErrFailoverNoReplicas      = errcode.New(errcode.Err, "FAILOVER requires connected replicas.")
+	ErrFailoverTargetNotFound  = errcode.New(errcode.Err, "FAILOVER target HOST and PORT is not a replica.")
+	ErrFailoverInProgress      = errcode.New(errcode.Err, "FAILOVER already in progress.")
+	ErrNoFailover              = errcode.New(errcode.Err, "No failover in progress.")
+	ErrFailoverForce           = errcode.New(errcode.Err, "FAILOVER with force option requires both a timeout and target HOST and IP.")
+	ErrFailoverTimeout         = errcode.New(errcode.Err, "FAILOVER timeout must be greater than 0")
+	ErrReplicaOfDuringFailover = errcode.New(errcode.Err, "REPLICAOF not allowed while failing over.")
+)
+
+// failoverPollInterval is how often a failover asks the replicas how far
+// they got. Tests shorten it.
+var failoverPollInterval = 100 * time.Millisecond
+
+// failoverPauseLimit bounds the write pause of a failover without a
+// timeout, which only ends once a replica catches up or it is aborted.
+const failoverPauseLimit = 24 * time.Hour
+
+// getAckCommand asks a replica for its offset outside the stream, so it does
+// not move the offset itself.
+var getAckCommand = appendRESPCommand(nil, "REPLCONF", "GETACK", "*")
+
+// failover is a FAILOVER waiting for a replica to catch up.
+type failover struct {
+	// target is the address of the replica to hand over to, or "" for
+	// whichever catches up first.
+	target string
+	// deadline is when the failover gives up, or hands over anyway if
+	// force is set. It is zero without a timeout.
+	deadline time.Time
+	force    bool
+	aborted  chan struct{}
+}
+
+func (h *handler) handleFailover(args []string) (any, error) {
+	f := &failover{aborted: make(chan struct{})}
+	abort := false
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); {
+		case option == "TO" && i+2 < len(args):
+			port, err := strconv.Atoi(args[i+2])
+			if err != nil || port < 1 || port > 65535 {
+				return nil, ErrInvalidLeaderPort
+			}
+			f.target = net.JoinHostPort(args[i+1], args[i+2])
+			i += 2
+		case option == "TIMEOUT" && i+1 < len(args):
+			timeout, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || timeout <= 0 {
+				return nil, ErrFailoverTimeout
+			}
+			f.deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+			i++
+		case option == "FORCE":
+			f.force = true
+		case option == "ABORT":
+			abort = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if abort {
+		if len(args) != 1 {
+			return nil, ErrSyntax
+		}
+		if err := h.replication.abortFailover(); err != nil {
+			return nil, err
+		}
+		return ResOk, nil
+	}
+	if f.force && (f.target == "" || f.deadline.IsZero()) {
+		return nil, ErrFailoverForce
+	}
+	if err := h.replication.startFailover(f); err != nil {
+		return nil, err
+	}
+	go h.runFailover(f)
+	return ResOk, nil
+}
+
+// startFailover records f as the failover in progress, if the server is a
+// leader with the replica it names.
+func (r *replication) startFailover(f *failover) error {
+	r.failoverMutex.Lock()
+	defer r.failoverMutex.Unlock()
+	if r.failover != nil {
+		return ErrFailoverInProgress
+	}
+	if r.currentLink() != nil {
+		return ErrFailoverOnReplica
+	}
+	replicas := r.connectedReplicas()
+	if len(replicas) == 0 {
+		return ErrFailoverNoReplicas
+	}
+	found := f.target == ""
+	for _, rep := range replicas {
+		found = found || net.JoinHostPort(rep.ip, rep.port) == f.target
+	}
+	if !found {
+		return ErrFailoverTargetNotFound
+	}
+	r.failover = f
+	return nil
+}
+
+func (r *replication) abortFailover() error {
+	r.failoverMutex.Lock()
+	defer r.failoverMutex.Unlock()
+	if r.failover == nil {
+		return ErrNoFailover
+	}
+	select {
+	case <-r.failover.aborted:
+	default:
+		close(r.failover.aborted)
+	}
+	return nil
+}
+
+func (r *replication) endFailover() {
+	r.failoverMutex.Lock()
+	defer r.failoverMutex.Unlock()
+	r.failover = nil
+}
+
+// failingOver reports whether a FAILOVER is in progress.
+func (r *replication) failingOver() bool {
+	r.failoverMutex.Lock()
+	defer r.failoverMutex.Unlock()
+	return r.failover != nil
+}
+
+// runFailover pauses client writes and polls the replicas until one has
+// applied the whole stream, then hands over to it. The failover ends without
+// a handover when it is aborted or times out, unless forced.
+func (h *handler) runFailover(f *failover) {
+	r := h.replication
+	defer r.endFailover()
+	pause := failoverPauseLimit
+	if !f.deadline.IsZero() {
+		pause = time.Until(f.deadline)
+	}
+	h.pause.pause(pause, true)
+	defer h.pause.unpause()
+
+	logger := h.store.Logger()
+	logger.Info("Failover started, waiting for a replica to catch up", "target", f.target)
+	ticker := time.NewTicker(failoverPollInterval)
+	defer ticker.Stop()
+	for {
+		r.requestAcks()
+		if address, ok := r.failoverTo(f.target, false); ok {
+			logger.Info("Failover handed over to the replica", "leader", address)
+			return
+		}
+		select {
+		case <-f.aborted:
+			logger.Info("Failover aborted")
+			return
+		case <-ticker.C:
+		}
+		if !f.deadline.IsZero() && time.Now().After(f.deadline) {
+			if f.force {
+				address, _ := r.failoverTo(f.target, true)
+				logger.Warn("Failover timed out, handing over anyway", "leader", address)
+			} else {
+				logger.Warn("Failover timed out before a replica caught up")
+			}
+			return
+		}
+	}
+}
+
+// requestAcks asks every replica for the offset it reached.
+func (r *replication) requestAcks() {
+	r.replicasMutex.Lock()
+	defer r.replicasMutex.Unlock()
+	for rep := range r.replicas {
+		rep.queue(getAckCommand, 0)
+	}
+}
+
+// failoverTo makes the server a replica of target, or of any replica when
+// target is empty, once that replica has applied the whole stream. The link
+// tells the new leader to promote itself. No client write lands in between,
+// as the role is locked throughout. force hands over to target whether it
+// caught up or not.
+func (r *replication) failoverTo(target string, force bool) (string, bool) {
+	r.roleMutex.Lock()
+	defer r.roleMutex.Unlock()
+	address := r.caughtUpReplica(target)
+	if address == "" && force {
+		address = target
+	}
+	if address == "" {
+		return "", false
+	}
+	r.setLink(address, true)
+	return address, true
+}
+
+// caughtUpReplica returns the address of target, or of the first replica
+// when target is empty, if it acknowledged the stream's current offset.
+func (r *replication) caughtUpReplica(target string) string {
+	offset, _, _ := r.streamInfo()
+	for _, rep := range r.connectedReplicas() {
+		address := net.JoinHostPort(rep.ip, rep.port)
+		if (target == "" || address == target) && rep.offset == offset {
+			return address
+		}
+	}
+	return ""
+}
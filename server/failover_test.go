@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"kv-store/store"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls until condition holds, failing with what after 5 seconds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	defer func(interval time.Duration) { failoverPollInterval = interval }(failoverPollInterval)
+	failoverPollInterval = 10 * time.Millisecond
+
+	leaderStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	leaderHandler := newHandler(leaderStore)
+	leader, leaderReader := dialTCP(t, leaderHandler)
+	replicaStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	replicaHandler := newHandler(replicaStore)
+	replica, replicaReader := dialTCP(t, replicaHandler)
+	_, leaderPort, _ := net.SplitHostPort(leader.RemoteAddr().String())
+	_, replicaPort, _ := net.SplitHostPort(replica.RemoteAddr().String())
+
+	sendCommand(t, replica, replicaReader, "REPLICAOF 127.0.0.1 "+leaderPort, 1)
+	waitFor(t, "the replica to connect", func() bool { return len(leaderHandler.replication.connectedReplicas()) == 1 })
+
+	// A client keeps writing through the failover until the old leader
+	// turns it away, and every write it was told succeeded must survive.
+	writer, err := net.Dial("tcp", leader.RemoteAddr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer writer.Close()
+	acknowledged := make(chan int)
+	go func() {
+		reader := bufio.NewReader(writer)
+		for i := 0; ; i++ {
+			writer.Write([]byte("SET key" + strconv.Itoa(i) + " " + strconv.Itoa(i) + "\n"))
+			if reply, _ := reader.ReadString('\n'); reply != "OK\r\n" {
+				acknowledged <- i
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if got := sendCommand(t, leader, leaderReader, "FAILOVER TO 127.0.0.1 "+replicaPort, 1)[0]; got != "OK" {
+		t.Fatalf("FAILOVER = %q, expected OK", got)
+	}
+
+	var writes int
+	select {
+	case writes = <-acknowledged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the old leader kept accepting writes")
+	}
+	waitFor(t, "the replica to be promoted", func() bool { return replicaHandler.replication.currentLink() == nil })
+	for i := range writes {
+		key := "key" + strconv.Itoa(i)
+		if got, _, _ := replicaStore.Get(0, key); got != strconv.Itoa(i) {
+			t.Fatalf("acknowledged write of %s is missing from the new leader", key)
+		}
+	}
+
+	info := replicationInfo(t, leader, leaderReader)
+	if info["role"] != "slave" || info["master_port"] != replicaPort {
+		t.Errorf("INFO replication on the old leader = %v, expected a replica of port %s", info, replicaPort)
+	}
+	if got := sendCommand(t, replica, replicaReader, "SET name batman", 1)[0]; got != "OK" {
+		t.Errorf("SET on the new leader = %q, expected OK", got)
+	}
+	waitForKeys(t, leaderStore, map[int]map[string]string{0: {"name": "batman"}})
+}
+
+func TestHandleFailover_Errors(t *testing.T) {
+	leaderHandler := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	replicaHandler := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	replicaHandler.replication.replicaOf("127.0.0.1:1")
+	defer replicaHandler.replication.stop()
+
+	testCases := []struct {
+		name     string
+		h        *handler
+		args     []string
+		expected error
+	}{
+		{"no replicas", leaderHandler, nil, ErrFailoverNoReplicas},
+		{"on a replica", replicaHandler, nil, ErrFailoverOnReplica},
+		{"abort without a failover", leaderHandler, []string{"ABORT"}, ErrNoFailover},
+		{"abort with options", leaderHandler, []string{"ABORT", "FORCE"}, ErrSyntax},
+		{"force without a timeout", leaderHandler, []string{"TO", "127.0.0.1", "6380", "FORCE"}, ErrFailoverForce},
+		{"force without a target", leaderHandler, []string{"TIMEOUT", "100", "FORCE"}, ErrFailoverForce},
+		{"zero timeout", leaderHandler, []string{"TIMEOUT", "0"}, ErrFailoverTimeout},
+		{"invalid port", leaderHandler, []string{"TO", "127.0.0.1", "port"}, ErrInvalidLeaderPort},
+		{"missing port", leaderHandler, []string{"TO", "127.0.0.1"}, ErrSyntax},
+		{"unknown option", leaderHandler, []string{"NOW"}, ErrSyntax},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := tc.h.handleFailover(tc.args); err != tc.expected {
+				t.Errorf("FAILOVER %q = %v, expected %v", tc.args, err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFailover_TimeoutAndAbort(t *testing.T) {
+	defer func(interval time.Duration) { failoverPollInterval = interval }(failoverPollInterval)
+	failoverPollInterval = 10 * time.Millisecond
+
+	leaderStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	h := newHandler(leaderStore)
+	leader, leaderReader := dialTCP(t, h)
+	// The replica never acknowledges anything, so it never catches up.
+	stuck, err := net.Dial("tcp", leader.RemoteAddr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer stuck.Close()
+	stuck.Write([]byte(respRequest("SYNC")))
+	if got := readRESPReply(t, bufio.NewReader(stuck)); !strings.HasPrefix(got, "+FULLRESYNC ") {
+		t.Fatalf("SYNC = %q, expected +FULLRESYNC", got)
+	}
+	leaderStore.Set(0, "name", "batman")
+	_, stuckPort, _ := net.SplitHostPort(stuck.LocalAddr().String())
+
+	failoverState := func() string {
+		return replicationInfo(t, leader, leaderReader)["master_failover_state"]
+	}
+	steps := []struct {
+		name    string
+		request string
+		end     func()
+	}{
+		{"timeout", "FAILOVER TO 127.0.0.1 " + stuckPort + " TIMEOUT 100", func() {}},
+		{"abort", "FAILOVER", func() {
+			if got := sendCommand(t, leader, leaderReader, "FAILOVER", 1)[0]; got != ErrFailoverInProgress.Error() {
+				t.Errorf("a second FAILOVER = %q, expected %q", got, ErrFailoverInProgress.Error())
+			}
+			if got := sendCommand(t, leader, leaderReader, "REPLICAOF NO ONE", 1)[0]; got != ErrReplicaOfDuringFailover.Error() {
+				t.Errorf("REPLICAOF during a failover = %q, expected %q", got, ErrReplicaOfDuringFailover.Error())
+			}
+			sendCommand(t, leader, leaderReader, "FAILOVER ABORT", 1)
+		}},
+	}
+	for _, step := range steps {
+		if got := sendCommand(t, leader, leaderReader, step.request, 1)[0]; got != "OK" {
+			t.Fatalf("%s: %s = %q, expected OK", step.name, step.request, got)
+		}
+		if state := failoverState(); state != "waiting-for-sync" {
+			t.Errorf("%s: master_failover_state = %s, expected waiting-for-sync", step.name, state)
+		}
+		step.end()
+		// Writes wait out the failover, then go through on the leader.
+		if got := sendCommand(t, leader, leaderReader, "SET name robin", 1)[0]; got != "OK" {
+			t.Errorf("%s: SET after the failover = %q, expected OK", step.name, got)
+		}
+		waitFor(t, "the failover to end", func() bool { return failoverState() == "no-failover" })
+		if h.replication.currentLink() != nil {
+			t.Errorf("%s: the leader handed over to a replica that never caught up", step.name)
+		}
+	}
+}
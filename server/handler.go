@@ -2,234 +2,628 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"kv-store/config"
+	"kv-store/errcode"
 	"kv-store/parser"
 	"kv-store/store"
-	"log"
 	"net"
-	"strconv"
+	"os"
 	"strings"
+	"time"
 )
 
 var (
-	ErrNotInteger        = errors.New("err value is not an integer or out of range")
+	ErrNotInteger        = errcode.New(errcode.Err, "value is not an integer or out of range")
 	ErrWrongNumberOfArgs = func(commandName string) error {
-		return fmt.Errorf("wrong number of arguments for %v command", commandName)
+		return errcode.Errorf(errcode.Err, "wrong number of arguments for %v command", commandName)
 	}
-	ErrUnknownCommand    = func(commandName string) error { return fmt.Errorf("err unknown command: %s", commandName) }
-	ErrDbIndexOutOfRange = errors.New("err DB index is out of range")
+	ErrUnknownCommand       = func(commandName string) error { return errcode.Errorf(errcode.Err, "unknown command: %s", commandName) }
+	ErrDbIndexOutOfRange    = store.ErrDBIndexOutOfRange
+	ErrSyntax               = errcode.New(errcode.Err, "syntax error")
+	ErrNoAuth               = errcode.New(errcode.NoAuth, "Authentication required")
+	ErrCommandInTransaction = func(commandName string) error {
+		return errcode.Errorf(errcode.Err, "%s is not allowed in transactions", commandName)
+	}
+	ErrInvalidPassword   = errcode.New(errcode.Err, "invalid password")
+	ErrNoPasswordSet     = errcode.New(errcode.Err, "AUTH called without any password configured")
+	ErrInvalidTTL        = errcode.New(errcode.Err, "invalid TTL value, must be 0 as key expiration is not supported")
+	ErrUnknownSubcommand = func(commandName, subcommand string) error {
+		return errcode.Errorf(errcode.Err, "unknown subcommand or wrong number of arguments for '%s'. Try %s HELP.", subcommand, commandName)
+	}
+	ErrWatchInMulti  = errcode.New(errcode.Err, "WATCH inside MULTI is not allowed")
+	ErrNestedMulti   = errcode.New(errcode.Err, "MULTI calls can not be nested")
+	ErrKeyTooLarge   = errcode.New(errcode.Err, "key too large, longer than max-key-length")
+	ErrValueTooLarge = errcode.New(errcode.Err, "value too large, longer than max-value-length")
+	ErrMaxClients    = errcode.New(errcode.Err, "max number of clients reached")
+	ErrEmptyKey      = errcode.New(errcode.Err, "empty key")
 )
 
 var (
-	ResQueued             = "QUEUED"
-	ResOk                 = "OK"
-	ResDiscardTransaction = "discarding transaction due to above errors"
+	ResQueued              = status("QUEUED")
+	ResOk                  = status("OK")
+	ResPong                = status("PONG")
+	ResDiscardTransaction  = status("discarding transaction due to above errors")
+	ResBackgroundSaving    = status("Background saving started")
+	ResBackgroundRewriting = status("Background append only file rewriting started")
 )
 
-func handleConnection(conn net.Conn, store *store.Store) {
-	clientId := fmt.Sprintf("%s-%p", conn.RemoteAddr(), conn)
-	log.Printf("Accepted connection from %s (ID: %s)", conn.RemoteAddr(), clientId)
+// nestingErrors are the replies to commands that cannot be used inside an
+// open transaction. They are rejected when sent, without marking the
+// transaction as failed.
+var nestingErrors = map[string]error{
+	"MULTI":  ErrNestedMulti,
+	"SELECT": store.ErrSelectInTransaction,
+	"WATCH":  ErrWatchInMulti,
+}
+
+type handler struct {
+	store    *store.Store
+	users    *acl
+	clients  *clientRegistry
+	pause    *pauseState
+	slowlog  *slowlog
+	monitors *monitorRegistry
+	pubsub   *pubsubRegistry
+	// replication is shared with the Server, which starts and stops the
+	// link to a leader.
+	replication *replication
+	// addrs lists the addresses the server is listening on, for INFO.
+	addrs func() []net.Addr
+}
+
+func newHandler(store *store.Store) *handler {
+	h := &handler{
+		store:       store,
+		users:       newACL(store.Config().Get().RequirePass),
+		clients:     newClientRegistry(),
+		pause:       newPauseState(),
+		slowlog:     &slowlog{},
+		monitors:    newMonitorRegistry(),
+		pubsub:      newPubsubRegistry(),
+		replication: newReplication(store),
+	}
+	h.replication.listeningPort = h.listeningPort
+	store.SetKeyspaceNotifier(func(channel, message string) { h.pubsub.publish(channel, message) })
+	store.SetWriteFeed(h.replication.propagate)
+	return h
+}
+
+func (h *handler) handleConnection(conn net.Conn) {
+	var certCN string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		var err error
+		if certCN, err = handshake(tlsConn); err != nil {
+			h.store.Logger().Info("TLS handshake failed", "addr", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return
+		}
+	}
+
+	store := h.store
+	c := newClient(h.clients.nextId(), conn)
+	c.certCN = certCN
+	clientId := c.id
+	logger := store.Logger().With("client", clientId)
+	logger.Debug("Accepted connection", "addr", conn.RemoteAddr().String())
 
 	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	commands := parser.NewReader(reader)
+	replies := newReplyWriter(bufio.NewWriter(conn))
+	replies.logger = logger
+	replies.dbIndex = func() int { return store.GetClientDBIndex(clientId) }
 
+	if !h.users.defaultUserRequiresAuth() {
+		c.setUser(defaultUser)
+	}
+	// A verified certificate named after an ACL user logs in as that user.
+	if certCN != "" && h.users.userEnabled(certCN) {
+		c.setUser(certCN)
+	}
+
+	maxClients := store.Config().Get().MaxClients
+	if !h.clients.register(c, maxClients) {
+		logger.Info("Rejected connection, max number of clients reached", "addr", conn.RemoteAddr().String(), "maxclients", maxClients)
+		replies.write(ErrMaxClients)
+		replies.flush()
+		conn.Close()
+		return
+	}
 	store.SetClientDBIndex(clientId, 0)
+	defer h.closeConnection(c)
+	defer replies.flush()
 
 	for {
-		line, err := reader.ReadString('\n')
+		// Replies to pipelined requests are buffered and sent together, once
+		// no more requests are waiting to be read.
+		if reader.Buffered() == 0 {
+			replies.flush()
+		}
+		// Each reply goes out in the protocol of the request it answers.
+		settings := store.Config().Get()
+		c.expectCommandWithin(settings.Timeout)
+		configureReader(commands, settings)
+		parsed, err := commands.ReadCommand()
+		replies.resp = commands.RESP()
+		command, args := parsed.Name, parsed.StringArgs()
+		// Tracing is checked here rather than left to the log level, so
+		// it costs nothing while off. Protocol errors are traced with the
+		// request, unlike the end of the connection.
+		replies.trace, replies.traceMaxLength = settings.Trace, settings.TraceMaxLength
+		if settings.Trace && (err == nil || errors.As(err, new(*errcode.Error))) {
+			traceRequest(logger, settings.TraceMaxLength, replies.resp, commands.Line(), command, args, err)
+		}
+		if err == parser.ErrLineTooLong || err == parser.ErrInlineTooLong || err == parser.ErrTooManyArgs || err == parser.ErrArgTooLong {
+			if store.InTransaction(clientId) {
+				store.ReportTransactionError(clientId)
+			}
+			replies.write(err)
+			continue
+		}
+		if errors.Is(err, parser.ErrProtocol) {
+			// The rest of the stream cannot be framed, so the connection is
+			// closed, as Redis does.
+			logger.Info("Closing connection after a protocol error", "error", err)
+			replies.write(err)
+			return
+		}
+		if errors.As(err, new(*errcode.Error)) {
+			// An inline line that does not parse, such as one with
+			// mismatched quotes, was read to its end.
+			c.touch()
+			replies.write(err)
+			continue
+		}
 		if err != nil {
-			if err.Error() == "EOF" {
-				log.Printf("Connection closed for client %s", clientId)
+			// Any other read error ends the connection too: a read that
+			// failed once would fail again on every pass of the loop.
+			switch {
+			case errors.Is(err, io.EOF):
+				logger.Debug("Connection closed")
+			case c.killed.Load():
+				logger.Debug("Connection killed")
+			case errors.Is(err, net.ErrClosed):
+				logger.Debug("Connection closed by the server")
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				logger.Debug("Closing idle connection")
+			default:
+				logger.Info("Closing connection after a read error", "error", err)
+			}
+			return
+		}
+		c.touch()
 
-				if store.InTransaction(clientId) {
-					store.DiscardTransaction(clientId)
-					log.Printf("Discarded transaction for client %s", clientId)
-				}
+		if command == "" && len(args) == 0 {
+			// A blank line or an empty array is skipped, but an empty
+			// command name with arguments is an unknown command.
+			continue
+		}
+		// Only known commands are counted, so clients cannot grow the
+		// totals without bound.
+		if _, known := commandTable[command]; known {
+			store.CountCommand(command)
+		}
+
+		if command == "QUIT" {
+			replies.write(ResOk)
+			logger.Debug("Client quit")
+			return
+		}
+
+		if command == "AUTH" {
+			name, err := authenticate(h.users, args)
+			if err != nil {
+				replies.write(err)
+				continue
+			}
+			c.setUser(name)
+			replies.write(ResOk)
+			continue
+		}
+
+		if command == "HELLO" {
+			if store.InTransaction(clientId) {
+				replies.write(ErrCommandInTransaction(command))
+				continue
+			}
+			result, err := h.handleHello(c, replies, args)
+			if err != nil {
+				replies.write(err)
+				continue
+			}
+			replies.write(result)
+			continue
+		}
+
+		username, authenticated := c.user()
+		if !authenticated {
+			replies.write(ErrNoAuth)
+			continue
+		}
+
+		if err := store.CheckTransactionTimeout(clientId); err != nil {
+			replies.write(err)
+			continue
+		}
+
+		err = h.users.checkPermissions(username, command, commandKeys(command, args), commandTable[command].hasFlag("allkeys"))
+		if err != nil {
+			if store.InTransaction(clientId) {
+				store.ReportTransactionError(clientId)
+			}
+			replies.write(err)
+			continue
+		}
+
+		// Admin commands are not shown to monitors, as they may carry
+		// passwords.
+		if spec, known := commandTable[command]; known && h.monitors.len() > 0 && !spec.hasFlag("admin") {
+			h.monitors.feed(store.GetClientDBIndex(clientId), c.addr, command, args)
+		}
+
+		if command == "MONITOR" {
+			if err := commandTable[command].checkArity(args); err != nil {
+				replies.write(err)
+				continue
+			}
+			if store.InTransaction(clientId) {
+				replies.write(ErrCommandInTransaction(command))
+				continue
+			}
+			replies.write(ResOk)
+			replies.flush()
+			h.runMonitor(c, reader, replies)
+			return
+		}
+
+		if command == "SYNC" || command == "PSYNC" {
+			if err := commandTable[command].checkArity(args); err != nil {
+				replies.write(err)
+				continue
+			}
+			if command == "PSYNC" && len(args) > 2 && (len(args) > 3 || !strings.EqualFold(args[2], "FAILOVER")) {
+				replies.write(ErrSyntax)
+				continue
+			}
+			if store.InTransaction(clientId) {
+				replies.write(ErrCommandInTransaction(command))
+				continue
+			}
+			h.serveReplica(c, reader, replies, command, args)
+			return
+		}
+
+		if subscriberCommands[command] && command != "PING" {
+			if err := commandTable[command].checkArity(args); err != nil {
+				replies.write(err)
+				continue
+			}
+			if store.InTransaction(clientId) {
+				replies.write(ErrCommandInTransaction(command))
+				continue
+			}
+			if !h.runSubscriber(c, reader, replies, command, args) {
 				return
 			}
-			log.Printf("Error reading from %s: %v", clientId, err)
-			writeResponse(writer, "Error reading from STDIN")
+			continue
 		}
 
-		command, args, parseErr := parser.ParseCommandLine(line)
-		if parseErr != nil {
-			writeResponse(writer, parseErr.Error())
+		// Connection commands are answered here, with the client at hand,
+		// so they cannot be queued in a transaction.
+		if spec := commandTable[command]; spec.hasFlag("no_multi") {
+			if store.InTransaction(clientId) {
+				replies.write(ErrCommandInTransaction(command))
+				continue
+			}
+			if err := validateCommand(command, args); err != nil {
+				replies.write(err)
+				continue
+			}
+			result, err := spec.run(&commandContext{
+				handler:  h,
+				store:    store,
+				keyspace: store,
+				client:   c,
+				clientId: clientId,
+				dbIndex:  store.GetClientDBIndex(clientId),
+			}, args)
+			if err != nil {
+				replies.write(err)
+				continue
+			}
+			replies.write(result)
+			continue
+		}
+
+		if err, nested := nestingErrors[command]; nested && store.InTransaction(clientId) {
+			replies.write(err)
 			continue
 		}
 
+		if command != "PING" && (!store.InTransaction(clientId) || command == "EXEC") {
+			if h.pause.paused(isWriteCommand(command)) {
+				// Replies already buffered are not held back by the pause.
+				replies.flush()
+				h.pause.wait(isWriteCommand(command))
+			}
+		}
+
 		if command == "MULTI" {
-			handleMulti(clientId, writer, store)
+			c.queuedWrite = false
+			handleMulti(clientId, replies, store)
 			continue
 		} else if command == "EXEC" {
-			handleExec(clientId, writer, store)
+			start := time.Now()
+			h.exec(c, replies)
+			h.observeCommand(c, command, args, time.Since(start))
 			continue
 		} else if command == "DISCARD" {
-			handleDiscard(clientId, writer, store)
+			handleDiscard(clientId, replies, store)
 			continue
 		}
 
+		if isWriteCommand(command) {
+			err := h.replication.checkWrite(store.Config().Get())
+			if err == nil {
+				err = store.CheckWrite()
+			}
+			if err != nil {
+				if store.InTransaction(clientId) {
+					store.ReportTransactionError(clientId)
+				}
+				replies.write(err)
+				continue
+			}
+		}
+		if commandTable[command].hasFlag("denyoom") {
+			if err := store.CheckMemory(); err != nil {
+				if store.InTransaction(clientId) {
+					store.ReportTransactionError(clientId)
+				}
+				replies.write(err)
+				continue
+			}
+		}
+
 		if store.InTransaction(clientId) {
 			validationErr := validateCommand(command, args)
+			if validationErr == nil {
+				validationErr = checkSizes(store.Config().Get(), command, args)
+			}
 			if validationErr != nil {
 				store.ReportTransactionError(clientId)
-				writeResponse(writer, validationErr.Error())
+				replies.write(validationErr)
 				continue
 			}
 			err := store.QueueCommand(clientId, command, args)
 			if err != nil {
-				writeResponse(writer, err.Error())
+				replies.write(err)
 				continue
 			}
-			writeResponse(writer, ResQueued)
+			if isWriteCommand(command) {
+				c.queuedWrite = true
+			}
+			replies.write(ResQueued)
 			continue
 		}
 
-		result, err := executeCommand(store, clientId, command, args)
+		start := time.Now()
+		result, err := h.executeClientCommand(clientId, command, args)
+		h.observeCommand(c, command, args, time.Since(start))
 		if err != nil {
-			writeResponse(writer, err.Error())
+			replies.write(err)
 			continue
 		}
 
-		writeResponse(writer, fmt.Sprint(result))
+		replies.write(result)
 	}
 }
 
-func writeResponse(writer *bufio.Writer, input string) {
-	_, err := writer.WriteString(input + "\n")
-	if err != nil {
-		log.Printf("Error writing response: %v", err)
+// configureReader sets the limits the next request is read under.
+func configureReader(commands *parser.Reader, settings config.Settings) {
+	commands.Limits = parser.Limits{MaxArgs: settings.MaxArgs, MaxArgLength: settings.MaxArgLength}
+	commands.MaxLineLength, commands.MaxInlineLength = settings.MaxLineLength, settings.MaxInlineLength
+	commands.KeepLine = settings.Trace
+}
+
+func authenticate(users *acl, args []string) (string, error) {
+	switch len(args) {
+	case 1:
+		if users.defaultUserHasNoPassword() {
+			return "", ErrNoPasswordSet
+		}
+		return defaultUser, users.authenticate(defaultUser, args[0])
+	case 2:
+		return args[0], users.authenticate(args[0], args[1])
+	default:
+		return "", ErrWrongNumberOfArgs("AUTH")
 	}
-	writer.Flush()
 }
 
-func handleMulti(transactionId string, writer *bufio.Writer, store *store.Store) {
-	err := store.StartTransaction(transactionId)
-	if err != nil {
-		writeResponse(writer, err.Error())
-		return
+func handleACL(users *acl, username string, args []string) (any, error) {
+	if len(args) < 1 {
+		return nil, ErrWrongNumberOfArgs("ACL")
+	}
+	subcommand := strings.ToUpper(args[0])
+	switch {
+	case subcommand == "SETUSER" && len(args) >= 2:
+		err := users.setUser(args[1], args[2:])
+		if err != nil {
+			return nil, err
+		}
+		return ResOk, nil
+	case subcommand == "GETUSER" && len(args) == 2:
+		lines, ok := users.getUser(args[1])
+		if !ok {
+			return nil, nil
+		}
+		return multiline(strings.Join(lines, "\n")), nil
+	case subcommand == "DELUSER" && len(args) >= 2:
+		return users.delUsers(args[1:])
+	case subcommand == "LIST" && len(args) == 1:
+		return multiline(strings.Join(users.list(), "\n")), nil
+	case subcommand == "WHOAMI" && len(args) == 1:
+		return username, nil
+	case subcommand == "HELP" && len(args) == 1:
+		return multiline(strings.Join(aclHelp, "\n")), nil
+	default:
+		return nil, ErrUnknownSubcommand("ACL", args[0])
 	}
-	writeResponse(writer, ResOk)
 }
 
-func handleExec(transactionId string, writer *bufio.Writer, store *store.Store) {
-	results, err := store.ExecuteTransaction(transactionId)
+func (h *handler) closeConnection(c *client) {
+	if h.store.InTransaction(c.id) {
+		h.store.DiscardTransaction(c.id)
+		h.store.Logger().Debug("Discarded transaction", "client", c.id)
+	}
+	h.clients.unregister(c)
+	h.store.RemoveClient(c.id)
+	c.conn.Close()
+}
+
+func handleMulti(transactionId int64, replies *replyWriter, store *store.Store) {
+	err := store.StartTransaction(transactionId)
 	if err != nil {
-		writeResponse(writer, err.Error())
+		replies.write(err)
 		return
 	}
+	replies.write(ResOk)
+}
 
-	var formattedResults []string
-	for i, result := range results {
-		formattedResults = append(formattedResults, fmt.Sprintf("%d) %s", i+1, result))
+// exec runs the client's transaction. One that queued writes runs like
+// executeClientCommand runs a write, and is discarded if the server has
+// become a read only replica since.
+func (h *handler) exec(c *client, replies *replyWriter) {
+	queuedWrite := c.queuedWrite
+	c.queuedWrite = false
+	if queuedWrite {
+		h.replication.roleMutex.RLock()
+		defer h.replication.roleMutex.RUnlock()
+		if err := h.replication.checkWrite(h.store.Config().Get()); err != nil && h.store.InTransaction(c.id) {
+			h.store.DiscardTransaction(c.id)
+			replies.write(err)
+			return
+		}
 	}
-	writeResponse(writer, strings.Join(formattedResults, "\n"))
+	handleExec(c.id, replies, h.store)
 }
 
-func handleDiscard(transactionId string, writer *bufio.Writer, store *store.Store) {
-	err := store.DiscardTransaction(transactionId)
+// handleExec replies with nil results, an aborted EXEC, when a watched key
+// changed and nothing ran.
+func handleExec(transactionId int64, replies *replyWriter, store *store.Store) {
+	results, err := store.ExecuteTransaction(transactionId, runQueued(store, transactionId))
 	if err != nil {
-		writeResponse(writer, err.Error())
+		replies.write(err)
 		return
 	}
-	writeResponse(writer, ResOk)
+	replies.write(results)
 }
 
-func executeCommand(store *store.Store, clientId string, command string, args []string) (any, error) {
-	err := validateCommand(command, args)
+func handleDiscard(transactionId int64, replies *replyWriter, store *store.Store) {
+	err := store.DiscardTransaction(transactionId)
 	if err != nil {
-		return nil, err
+		replies.write(err)
+		return
 	}
-	dbIndex := store.GetClientDBIndex(clientId)
-	switch command {
-	case "SET":
-		store.Set(dbIndex, args[0], args[1])
-		return ResOk, nil
+	replies.write(ResOk)
+}
 
-	case "GET":
-		value, ok := store.Get(dbIndex, args[0])
-		if !ok {
-			return nil, nil
+// executeClientCommand runs a command sent by a client. A write keeps the
+// server's role from changing until it is done, so it cannot land after the
+// server has become a read only replica.
+func (h *handler) executeClientCommand(clientId int64, command string, args []string) (any, error) {
+	if isWriteCommand(command) {
+		h.replication.roleMutex.RLock()
+		defer h.replication.roleMutex.RUnlock()
+		if err := h.replication.checkWrite(h.store.Config().Get()); err != nil {
+			return nil, err
 		}
-		return value, nil
-
-	case "DEL":
-		return store.Del(dbIndex, args[0]), nil
-
-	case "INCR":
-		return store.Incr(dbIndex, args[0])
+	}
+	return executeCommand(h.store, clientId, command, args)
+}
 
-	case "INCRBY":
-		increment, _ := strconv.ParseInt(args[1], 10, 64)
-		return store.IncrBy(dbIndex, args[0], increment)
-	case "COMPACT":
-		return store.Compact(dbIndex), nil
-	case "SELECT":
-		dbIndex, err := strconv.ParseInt(args[0], 10, 64)
-		if err != nil {
-			return nil, ErrNotInteger
-		}
-		if dbIndex < 0 || dbIndex >= int64(store.GetDatabasesCount()) {
-			return nil, errors.New("err DB index is out of range")
-		}
-		store.SetClientDBIndex(clientId, int(dbIndex))
-		return ResOk, nil
-	default:
+// executeCommand runs a command that is not sent inside MULTI, from a
+// client or a command file, after checking it.
+func executeCommand(store *store.Store, clientId int64, command string, args []string) (any, error) {
+	if err := validateCommand(command, args); err != nil {
+		return nil, err
+	}
+	if err := checkSizes(store.Config().Get(), command, args); err != nil {
+		return nil, err
+	}
+	spec := commandTable[command]
+	if spec.run == nil || spec.hasFlag("no_multi") {
 		return nil, ErrUnknownCommand(command)
 	}
+	return spec.run(&commandContext{store: store, keyspace: store, clientId: clientId, dbIndex: store.GetClientDBIndex(clientId)}, args)
 }
 
-func validateCommand(command string, args []string) error {
-	switch command {
-	case "SET":
-		if len(args) != 2 {
-			return ErrWrongNumberOfArgs("SET")
-		}
-		return nil
-
-	case "GET":
-		if len(args) != 1 {
-			return ErrWrongNumberOfArgs("GET")
+// runQueued returns the store.TransactionFunc EXEC runs the client's queued
+// commands with. Each reply is turned into the store.Result EXEC replies
+// with.
+func runQueued(s *store.Store, clientId int64) store.TransactionFunc {
+	return func(keyspace store.Keyspace, dbIndex int, name string, args []string) (store.Result, error) {
+		spec := commandTable[name]
+		if spec.run == nil || spec.hasFlag("no_multi") {
+			return store.Result{}, ErrUnknownCommand(name)
 		}
-		return nil
+		reply, err := spec.run(&commandContext{store: s, keyspace: keyspace, clientId: clientId, dbIndex: dbIndex}, args)
+		return transactionResult(reply), err
+	}
+}
 
-	case "DEL":
-		if len(args) != 1 {
-			return ErrWrongNumberOfArgs("DEL")
-		}
-		return nil
+func transactionResult(reply any) store.Result {
+	switch reply := reply.(type) {
+	case nil:
+		return store.Result{Kind: store.ResultNil}
+	case status:
+		return store.Result{Kind: store.ResultStatus, Value: string(reply)}
+	case string:
+		return store.Result{Kind: store.ResultValue, Value: reply}
+	case multiline:
+		return store.Result{Kind: store.ResultValue, Value: string(reply)}
+	case []string:
+		return store.Result{Kind: store.ResultValue, Value: strings.Join(reply, "\n")}
+	case int:
+		return store.Result{Kind: store.ResultInteger, Integer: int64(reply)}
+	case int64:
+		return store.Result{Kind: store.ResultInteger, Integer: reply}
+	default:
+		return store.Result{Kind: store.ResultValue, Value: fmt.Sprint(reply)}
+	}
+}
 
-	case "INCR":
-		if len(args) != 1 {
-			return ErrWrongNumberOfArgs("INCR")
+// checkSizes holds every key a command names to max-key-length, and the
+// value it stores to max-value-length, before anything reaches the store. A
+// key may not be empty, though a value may.
+func checkSizes(settings config.Settings, command string, args []string) error {
+	for _, key := range commandKeys(command, args) {
+		if key == "" {
+			return ErrEmptyKey
 		}
-		return nil
-
-	case "INCRBY":
-		if len(args) != 2 {
-			return ErrWrongNumberOfArgs("INCRBY")
+		if settings.MaxKeyLength > 0 && int64(len(key)) > settings.MaxKeyLength {
+			return ErrKeyTooLarge
 		}
+	}
+	if valueLength := commandTable[command].valueLength; valueLength != nil && settings.MaxValueLength > 0 && valueLength(args) > settings.MaxValueLength {
+		return ErrValueTooLarge
+	}
+	return nil
+}
 
-		_, err := strconv.ParseInt(args[1], 10, 64)
-		if err != nil {
-			return ErrNotInteger
-		}
-		return nil
-	case "COMPACT":
-		if len(args) != 0 {
-			return ErrWrongNumberOfArgs("COMPACT")
-		}
-		return nil
-	case "SELECT":
-		if len(args) != 1 {
-			return ErrWrongNumberOfArgs("SELECT")
-		}
-		_, err := strconv.ParseInt(args[0], 10, 64)
-		if err != nil {
-			return ErrNotInteger
-		}
-		return nil
-	default:
+func validateCommand(command string, args []string) error {
+	spec, exists := commandTable[command]
+	if !exists {
 		return ErrUnknownCommand(command)
 	}
+	if err := spec.checkArity(args); err != nil {
+		return err
+	}
+	if spec.validate != nil {
+		return spec.validate(args)
+	}
+	return nil
 }
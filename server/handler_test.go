@@ -2,9 +2,21 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"kv-store/config"
 	"kv-store/store"
+	"log"
 	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -15,6 +27,7 @@ func TestHandleConnection(t *testing.T) {
 		commands      []string
 		wantResponses []string
 		storeSetup    func(s *store.Store)
+		requirePass   string
 	}{
 		{
 			name: "Simple SET and GET",
@@ -23,8 +36,8 @@ func TestHandleConnection(t *testing.T) {
 				"GET name",
 			},
 			wantResponses: []string{
-				"OK\n",
-				"gandalf\n",
+				"OK\r\n",
+				"gandalf\r\n",
 			},
 		},
 		{
@@ -34,8 +47,8 @@ func TestHandleConnection(t *testing.T) {
 				"GET wizard",
 			},
 			wantResponses: []string{
-				"OK\n",
-				"gandalf the grey\n",
+				"OK\r\n",
+				"gandalf the grey\r\n",
 			},
 		},
 		{
@@ -44,7 +57,7 @@ func TestHandleConnection(t *testing.T) {
 				"GET missingkey",
 			},
 			wantResponses: []string{
-				"<nil>\n",
+				"(nil)\r\n",
 			},
 		},
 		{
@@ -56,10 +69,10 @@ func TestHandleConnection(t *testing.T) {
 				"GET fruit",
 			},
 			wantResponses: []string{
-				"OK\n",
-				"apple\n",
-				"OK\n",
-				"banana\n",
+				"OK\r\n",
+				"apple\r\n",
+				"OK\r\n",
+				"banana\r\n",
 			},
 		},
 		{
@@ -68,7 +81,7 @@ func TestHandleConnection(t *testing.T) {
 				"FOOBAR arg1 arg2",
 			},
 			wantResponses: []string{
-				"err unknown command: FOOBAR\n",
+				"ERR unknown command: FOOBAR\r\n",
 			},
 		},
 		{
@@ -78,8 +91,8 @@ func TestHandleConnection(t *testing.T) {
 				"SET one two three",
 			},
 			wantResponses: []string{
-				"wrong number of arguments for SET command\n",
-				"wrong number of arguments for SET command\n",
+				"ERR wrong number of arguments for SET command\r\n",
+				"ERR wrong number of arguments for SET command\r\n",
 			},
 		},
 		{
@@ -89,8 +102,8 @@ func TestHandleConnection(t *testing.T) {
 				"GET one two",
 			},
 			wantResponses: []string{
-				"wrong number of arguments for GET command\n",
-				"wrong number of arguments for GET command\n",
+				"ERR wrong number of arguments for GET command\r\n",
+				"ERR wrong number of arguments for GET command\r\n",
 			},
 		},
 		{
@@ -99,7 +112,7 @@ func TestHandleConnection(t *testing.T) {
 				"",
 			},
 			wantResponses: []string{
-				"ERR empty command\n",
+				"ERR empty command\r\n",
 			},
 		},
 		{
@@ -108,7 +121,7 @@ func TestHandleConnection(t *testing.T) {
 				`SET key "unterminated`,
 			},
 			wantResponses: []string{
-				"ERR syntax, mismatched quotes\n",
+				"ERR syntax, mismatched quotes at position 8\r\n",
 			},
 		},
 		{
@@ -117,7 +130,7 @@ func TestHandleConnection(t *testing.T) {
 				`DEL wizard`,
 			},
 			wantResponses: []string{
-				"1\n",
+				"1\r\n",
 			},
 			storeSetup: func(s *store.Store) { s.Set(0, "wizard", "gandalf the white") },
 		},
@@ -128,8 +141,8 @@ func TestHandleConnection(t *testing.T) {
 				`DEL a b`,
 			},
 			wantResponses: []string{
-				"0\n",
-				"wrong number of arguments for DEL command\n",
+				"0\r\n",
+				"ERR wrong number of arguments for DEL command\r\n",
 			},
 		},
 		{
@@ -138,7 +151,7 @@ func TestHandleConnection(t *testing.T) {
 				"INCR counter",
 			},
 			wantResponses: []string{
-				"1\n",
+				"1\r\n",
 			},
 		},
 		{
@@ -151,8 +164,8 @@ func TestHandleConnection(t *testing.T) {
 				"INCR counter",
 			},
 			wantResponses: []string{
-				"6\n",
-				"7\n",
+				"6\r\n",
+				"7\r\n",
 			},
 		},
 		{
@@ -164,7 +177,7 @@ func TestHandleConnection(t *testing.T) {
 				"INCR key",
 			},
 			wantResponses: []string{
-				"err value is not an integer or out of range\n",
+				"ERR value is not an integer or out of range\r\n",
 			},
 		},
 		{
@@ -174,8 +187,8 @@ func TestHandleConnection(t *testing.T) {
 				"INCR key1 key2",
 			},
 			wantResponses: []string{
-				"wrong number of arguments for INCR command\n",
-				"wrong number of arguments for INCR command\n",
+				"ERR wrong number of arguments for INCR command\r\n",
+				"ERR wrong number of arguments for INCR command\r\n",
 			},
 		},
 		{
@@ -184,7 +197,7 @@ func TestHandleConnection(t *testing.T) {
 				"INCRBY visits 10",
 			},
 			wantResponses: []string{
-				"10\n",
+				"10\r\n",
 			},
 		},
 		{
@@ -196,7 +209,7 @@ func TestHandleConnection(t *testing.T) {
 				"INCRBY visits 25",
 			},
 			wantResponses: []string{
-				"125\n",
+				"125\r\n",
 			},
 		},
 		{
@@ -208,7 +221,7 @@ func TestHandleConnection(t *testing.T) {
 				"INCRBY visits -10",
 			},
 			wantResponses: []string{
-				"40\n",
+				"40\r\n",
 			},
 		},
 		{
@@ -220,7 +233,7 @@ func TestHandleConnection(t *testing.T) {
 				"INCRBY key 5",
 			},
 			wantResponses: []string{
-				"err value is not an integer or out of range\n",
+				"ERR value is not an integer or out of range\r\n",
 			},
 		},
 		{
@@ -229,7 +242,7 @@ func TestHandleConnection(t *testing.T) {
 				"INCRBY key abc",
 			},
 			wantResponses: []string{
-				"err value is not an integer or out of range\n",
+				"ERR value is not an integer or out of range\r\n",
 			},
 		},
 		{
@@ -240,9 +253,26 @@ func TestHandleConnection(t *testing.T) {
 				"INCRBY key 10 extra",
 			},
 			wantResponses: []string{
-				"wrong number of arguments for INCRBY command\n",
-				"wrong number of arguments for INCRBY command\n",
-				"wrong number of arguments for INCRBY command\n",
+				"ERR wrong number of arguments for INCRBY command\r\n",
+				"ERR wrong number of arguments for INCRBY command\r\n",
+				"ERR wrong number of arguments for INCRBY command\r\n",
+			},
+		},
+		{
+			name: "INCRBY non-integer increment inside MULTI fails at EXEC",
+			commands: []string{
+				"MULTI",
+				"SET visits 5",
+				"INCRBY visits abc",
+				"EXEC",
+				"GET visits",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"QUEUED\r\n",
+				"QUEUED\r\n",
+				"ERR value is not an integer or out of range\r\n",
+				"(nil)\r\n",
 			},
 		},
 		{
@@ -254,10 +284,60 @@ func TestHandleConnection(t *testing.T) {
 				"EXEC",
 			},
 			wantResponses: []string{
-				"OK\n",
-				"QUEUED\n",
-				"QUEUED\n",
-				"1) OK\n",
+				"OK\r\n",
+				"QUEUED\r\n",
+				"QUEUED\r\n",
+				"1) OK\r\n",
+			},
+		},
+		{
+			name: "MULTI after a successful EXEC",
+			commands: []string{
+				"MULTI",
+				"SET counter 10",
+				"EXEC",
+				"MULTI",
+				"SET name batman",
+				"EXEC",
+				"GET name",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"QUEUED\r\n",
+				"1) OK\r\n",
+				"OK\r\n",
+				"QUEUED\r\n",
+				"1) OK\r\n",
+				"batman\r\n",
+			},
+		},
+		{
+			name: "Transaction control nesting is rejected without failing the transaction",
+			commands: []string{
+				"MULTI",
+				"SET a 1",
+				"MULTI",
+				"SELECT 1",
+				"WATCH a",
+				"EXEC",
+				"GET a",
+				"MULTI",
+				"MULTI",
+				"DISCARD",
+				"GET a",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"QUEUED\r\n",
+				"ERR MULTI calls can not be nested\r\n",
+				"ERR SELECT is not allowed in transactions\r\n",
+				"ERR WATCH inside MULTI is not allowed\r\n",
+				"1) OK\r\n",
+				"1\r\n",
+				"OK\r\n",
+				"ERR MULTI calls can not be nested\r\n",
+				"OK\r\n",
+				"1\r\n",
 			},
 		},
 		{
@@ -269,10 +349,10 @@ func TestHandleConnection(t *testing.T) {
 				"DISCARD",
 			},
 			wantResponses: []string{
-				"OK\n",
-				"QUEUED\n",
-				"QUEUED\n",
-				"OK\n",
+				"OK\r\n",
+				"QUEUED\r\n",
+				"QUEUED\r\n",
+				"OK\r\n",
 			},
 		},
 		{
@@ -282,8 +362,21 @@ func TestHandleConnection(t *testing.T) {
 				"COMPACT hello",
 			},
 			wantResponses: []string{
-				"\n",
-				"wrong number of arguments for COMPACT command\n",
+				"\r\n",
+				"ERR wrong number of arguments for COMPACT command\r\n",
+			},
+		},
+		{
+			name: "DUMPALL",
+			commands: []string{
+				"SET name batman",
+				"DUMPALL",
+				"DUMPALL now",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"{\"db\":0,\"key\":\"name\",\"type\":\"string\",\"ttl\":-1,\"value\":\"batman\"}\r\n",
+				"ERR wrong number of arguments for DUMPALL command\r\n",
 			},
 		},
 		{
@@ -292,7 +385,7 @@ func TestHandleConnection(t *testing.T) {
 				"UNKNOWN",
 			},
 			wantResponses: []string{
-				"err unknown command: UNKNOWN\n",
+				"ERR unknown command: UNKNOWN\r\n",
 			},
 		},
 		{
@@ -305,11 +398,11 @@ func TestHandleConnection(t *testing.T) {
 				"SELECT hi",
 			},
 			wantResponses: []string{
-				"err DB index is out of range\n",
-				"err DB index is out of range\n",
-				"err DB index is out of range\n",
-				"wrong number of arguments for SELECT command\n",
-				"err value is not an integer or out of range\n",
+				"ERR DB index is out of range\r\n",
+				"ERR DB index is out of range\r\n",
+				"ERR DB index is out of range\r\n",
+				"ERR wrong number of arguments for SELECT command\r\n",
+				"ERR value is not an integer or out of range\r\n",
 			},
 		}, {
 			name: "SELECT success",
@@ -320,54 +413,1925 @@ func TestHandleConnection(t *testing.T) {
 				"GET key1",
 			},
 			wantResponses: []string{
-				"OK\n",
-				"OK\n",
-				"OK\n",
-				"<nil>\n",
+				"OK\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"(nil)\r\n",
 			},
 		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-
-			store := store.CreateNewStore(store.NewMemoryStorage(16))
-
-			if tc.storeSetup != nil {
-				tc.storeSetup(store)
-			}
-
-			clientConn, serverConn := net.Pipe()
-			defer clientConn.Close()
-
-			go func() {
-				handleConnection(serverConn, store)
-			}()
-
-			clientReader := bufio.NewReader(clientConn)
-			clientWriter := bufio.NewWriter(clientConn)
-
-			for index, command := range tc.commands {
-				t.Logf("Client sending: %q", command)
-				clientWriter.WriteString(command + "\n")
-				clientWriter.Flush()
-
-				response, err := clientReader.ReadString('\n')
-				clientConn.SetReadDeadline(time.Time{})
-
-				if err != nil {
-					t.Fatalf("Error reading response for command %d %q: %v", index, command, err)
-				}
-
-				trimmedResponse := strings.TrimSuffix(response, "\r\n")
-				t.Logf("Client received: %q", trimmedResponse)
-
-				if trimmedResponse != tc.wantResponses[index] {
-					t.Errorf("Response mismatch for command %d (%q):\n got: %q\nwant: %q",
-						index, command, trimmedResponse, tc.wantResponses[index])
-				}
+		{
+			name: "PFADD, PFCOUNT and PFMERGE",
+			commands: []string{
+				"PFADD hll1 a b c",
+				"PFADD hll1 a",
+				"PFADD hll2 c d",
+				"PFCOUNT hll1 hll2",
+				"PFMERGE dest hll1 hll2",
+				"PFCOUNT dest",
+			},
+			wantResponses: []string{
+				"1\r\n",
+				"0\r\n",
+				"1\r\n",
+				"4\r\n",
+				"OK\r\n",
+				"4\r\n",
+			},
+		},
+		{
+			name: "PFADD wrong type and arguments",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "name", "batman")
+			},
+			commands: []string{
+				"PFADD name a",
+				"PFCOUNT",
+				"PFMERGE",
+			},
+			wantResponses: []string{
+				"WRONGTYPE key is not a valid HyperLogLog string value\r\n",
+				"ERR wrong number of arguments for PFCOUNT command\r\n",
+				"ERR wrong number of arguments for PFMERGE command\r\n",
+			},
+		},
+		{
+			name: "OBJECT and TOUCH",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "counter", "10")
+				s.Set(0, "name", "batman")
+			},
+			commands: []string{
+				"OBJECT ENCODING counter",
+				"OBJECT encoding name",
+				"OBJECT ENCODING missing",
+				"OBJECT IDLETIME name",
+				"OBJECT FOO name",
+				"OBJECT ENCODING",
+				"TOUCH counter name missing",
+				"TOUCH",
+			},
+			wantResponses: []string{
+				"int\r\n",
+				"embstr\r\n",
+				"(nil)\r\n",
+				"0\r\n",
+				"ERR unknown subcommand or wrong number of arguments for 'FOO'. Try OBJECT HELP.\r\n",
+				"ERR unknown subcommand or wrong number of arguments for 'ENCODING'. Try OBJECT HELP.\r\n",
+				"2\r\n",
+				"ERR wrong number of arguments for TOUCH command\r\n",
+			},
+		},
+		{
+			name: "OBJECT FREQ",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "name", "batman")
+			},
+			commands: []string{
+				"OBJECT FREQ name",
+				"CONFIG SET maxmemory-policy allkeys-lfu",
+				"OBJECT FREQ name",
+				"OBJECT FREQ missing",
+				"OBJECT FREQ",
+			},
+			wantResponses: []string{
+				"ERR An LFU maxmemory policy is not selected, access frequency not tracked\r\n",
+				"OK\r\n",
+				"5\r\n",
+				"(nil)\r\n",
+				"ERR unknown subcommand or wrong number of arguments for 'FREQ'. Try OBJECT HELP.\r\n",
+			},
+		},
+		{
+			name: "MEMORY USAGE",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "name", "batman")
+			},
+			commands: []string{
+				"MEMORY USAGE missing",
+				"MEMORY USAGE name SAMPLES x",
+				"MEMORY USAGE name COUNT 5",
+				"MEMORY FOO name",
+				"MEMORY STATS name",
+				"MEMORY",
+			},
+			wantResponses: []string{
+				"(nil)\r\n",
+				"ERR value is not an integer or out of range\r\n",
+				"ERR syntax error\r\n",
+				"ERR unknown subcommand or wrong number of arguments for 'FOO'. Try MEMORY HELP.\r\n",
+				"ERR unknown subcommand or wrong number of arguments for 'STATS'. Try MEMORY HELP.\r\n",
+				"ERR wrong number of arguments for MEMORY command\r\n",
+			},
+		},
+		{
+			name: "Database quotas",
+			commands: []string{
+				"CONFIG SET db-max-keys 1",
+				"SET name batman",
+				"SET other robin",
+				"SET name bruce",
+				"MULTI",
+				"DEL name",
+				"SET first 1",
+				"SET second 2",
+				"EXEC",
+				"GET name",
+				"SELECT 1",
+				"SET other robin",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"ERR quota exceeded for the selected database\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"QUEUED\r\n",
+				"QUEUED\r\n",
+				"QUEUED\r\n",
+				"ERR quota exceeded for the selected database\r\n",
+				"bruce\r\n",
+				"OK\r\n",
+				"OK\r\n",
+			},
+		},
+		{
+			name: "Key and value length limits",
+			commands: []string{
+				"CONFIG SET max-key-length 3",
+				"CONFIG SET max-value-length 5",
+				"SET abc 1234",
+				"SET abc 12345",
+				"SET abc 123456",
+				"SET abcd 1",
+				"GET abcd",
+				"GET abc",
+				"MULTI",
+				"SET ab 123456",
+				"EXEC",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"ERR value too large, longer than max-value-length\r\n",
+				"ERR key too large, longer than max-key-length\r\n",
+				"ERR key too large, longer than max-key-length\r\n",
+				"12345\r\n",
+				"OK\r\n",
+				"ERR value too large, longer than max-value-length\r\n",
+				"ERR Transaction discarded because of previous errors\r\n",
+			},
+		},
+		{
+			name: "Line length limit",
+			commands: []string{
+				"CONFIG SET max-line-length 12",
+				"SET name 123",
+				"SET name 1234",
+				"GET name",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"ERR value too large, line exceeds max-line-length\r\n",
+				"123\r\n",
+			},
+		},
+		{
+			name: "Inline length limit",
+			commands: []string{
+				"CONFIG SET max-inline-length 12",
+				"SET name 123",
+				"SET name 1234",
+				"GET name",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"ERR Protocol error: too big inline request\r\n",
+				"123\r\n",
+			},
+		},
+		{
+			name: "Argument limits",
+			commands: []string{
+				"CONFIG SET max-arg-length 8",
+				"CONFIG SET max-args 4",
+				"SET name batman",
+				"MSET a 1 b 2",
+				"SET name batmobile",
+				"*5\r\n$4\r\nMSET\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r",
+				"GET name",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"ERR too many arguments, more than max-args\r\n",
+				"ERR argument too long, longer than max-arg-length\r\n",
+				"-ERR too many arguments, more than max-args\r\n",
+				"batman\r\n",
+			},
+		},
+		{
+			name: "FLUSHDB",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "name", "batman")
+				s.Set(1, "name", "robin")
+			},
+			commands: []string{
+				"FLUSHDB now",
+				"FLUSHDB",
+				"GET name",
+				"SELECT 1",
+				"GET name",
+			},
+			wantResponses: []string{
+				"ERR wrong number of arguments for FLUSHDB command\r\n",
+				"OK\r\n",
+				"(nil)\r\n",
+				"OK\r\n",
+				"robin\r\n",
+			},
+		},
+		{
+			name: "DUMP and RESTORE",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "name", "batman")
+			},
+			commands: []string{
+				"DUMP missing",
+				"RESTORE name 0 00",
+				"RESTORE copy 10 00",
+				"RESTORE copy 0 00 KEEP",
+				"RESTORE copy",
+			},
+			wantResponses: []string{
+				"(nil)\r\n",
+				"ERR DUMP payload version or checksum are wrong\r\n",
+				"ERR invalid TTL value, must be 0 as key expiration is not supported\r\n",
+				"ERR syntax error\r\n",
+				"ERR wrong number of arguments for RESTORE command\r\n",
+			},
+		},
+		{
+			name: "QUIT",
+			commands: []string{
+				"QUIT",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+			},
+		},
+		{
+			name:        "AUTH required before commands",
+			requirePass: "secret",
+			commands: []string{
+				"SET key value",
+				"MULTI",
+				"EXEC",
+				"AUTH wrong",
+				"AUTH",
+				"AUTH secret",
+				"SET key value",
+				"AUTH wrong",
+				"GET key",
+				"AUTH secret",
+				"GET key",
+			},
+			wantResponses: []string{
+				"NOAUTH Authentication required\r\n",
+				"NOAUTH Authentication required\r\n",
+				"NOAUTH Authentication required\r\n",
+				"ERR invalid password\r\n",
+				"ERR wrong number of arguments for AUTH command\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"ERR invalid password\r\n",
+				"value\r\n",
+				"OK\r\n",
+				"value\r\n",
+			},
+		},
+		{
+			name:        "Transaction after AUTH",
+			requirePass: "secret",
+			commands: []string{
+				"MULTI",
+				"AUTH secret",
+				"MULTI",
+				"SET key value",
+				"EXEC",
+			},
+			wantResponses: []string{
+				"NOAUTH Authentication required\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"QUEUED\r\n",
+				"1) OK\r\n",
+			},
+		},
+		{
+			name: "AUTH without configured password",
+			commands: []string{
+				"AUTH secret",
+				"SET key value",
+			},
+			wantResponses: []string{
+				"ERR AUTH called without any password configured\r\n",
+				"OK\r\n",
+			},
+		},
+		{
+			name: "ACL users with command and key permissions",
+			commands: []string{
+				"ACL WHOAMI",
+				"ACL SETUSER cache on >pw +GET +SET ~cache:*",
+				"AUTH cache wrong",
+				"AUTH cache pw",
+				"ACL WHOAMI",
+				"SET cache:1 hello",
+				"GET cache:1",
+				"SET session:1 hello",
+				"DEL cache:1",
+				"AUTH default anything",
+				"ACL WHOAMI",
+			},
+			wantResponses: []string{
+				"default\r\n",
+				"OK\r\n",
+				"ERR invalid password\r\n",
+				"OK\r\n",
+				"NOPERM User cache has no permissions to run the 'acl' command\r\n",
+				"OK\r\n",
+				"hello\r\n",
+				"NOPERM No permissions to access a key\r\n",
+				"NOPERM User cache has no permissions to run the 'del' command\r\n",
+				"OK\r\n",
+				"default\r\n",
+			},
+		},
+		{
+			name: "ACL GETUSER and DELUSER",
+			commands: []string{
+				"ACL SETUSER alice on nopass allcommands -del allkeys",
+				"ACL GETUSER missing",
+				"ACL DELUSER alice missing",
+				"ACL DELUSER default",
+				"ACL SETUSER bob bogus",
+				"ACL FOO",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"(nil)\r\n",
+				"1\r\n",
+				"ERR the 'default' user cannot be removed\r\n",
+				"ERR error in ACL SETUSER modifier 'bogus': Syntax error\r\n",
+				"ERR unknown subcommand or wrong number of arguments for 'FOO'. Try ACL HELP.\r\n",
+			},
+		},
+		{
+			name: "ACL denied command inside transaction aborts EXEC",
+			commands: []string{
+				"ACL SETUSER reader on >pw +MULTI +EXEC +GET allkeys",
+				"AUTH reader pw",
+				"MULTI",
+				"SET key value",
+				"EXEC",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"NOPERM User reader has no permissions to run the 'set' command\r\n",
+				"ERR Transaction discarded because of previous errors\r\n",
+			},
+		},
+		{
+			name: "Stored value reading as nil is quoted",
+			commands: []string{
+				"SET key (nil)",
+				"GET key",
+				"MULTI",
+				"GET key",
+				"GET missing",
+				"EXEC",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"\"(nil)\"\r\n",
+				"OK\r\n",
+				"QUEUED\r\n",
+				"QUEUED\r\n",
+				"1) \"(nil)\"\r\n",
+				"2) (nil)\r\n",
+			},
+		},
+		{
+			name: "ACL is rejected inside a transaction",
+			commands: []string{
+				"MULTI",
+				"ACL SETUSER eve on nopass allcommands allkeys",
+				"SET key value",
+				"EXEC",
+				"AUTH eve anything",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"ERR ACL is not allowed in transactions\r\n",
+				"QUEUED\r\n",
+				"1) OK\r\n",
+				"ERR invalid password\r\n",
+			},
+		},
+		{
+			name: "COMPACT requires access to all keys",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "secret", "value")
+			},
+			commands: []string{
+				"ACL SETUSER cache on >pw +COMPACT ~cache:*",
+				"ACL SETUSER admin on >pw +COMPACT allkeys",
+				"AUTH cache pw",
+				"COMPACT",
+				"AUTH admin pw",
+				"COMPACT",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"OK\r\n",
+				"NOPERM No permissions to access a key\r\n",
+				"OK\r\n",
+				"SET secret value\r\n",
+			},
+		},
+		{
+			name: "DUMPALL requires access to all keys",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "secret", "value")
+			},
+			commands: []string{
+				"ACL SETUSER cache on >pw +DUMPALL ~cache:*",
+				"AUTH cache pw",
+				"DUMPALL",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"NOPERM No permissions to access a key\r\n",
+			},
+		},
+		{
+			name: "FLUSHDB requires access to all keys",
+			storeSetup: func(s *store.Store) {
+				s.Set(0, "secret", "value")
+			},
+			commands: []string{
+				"ACL SETUSER app on >pw +FLUSHDB ~app:*",
+				"AUTH app pw",
+				"FLUSHDB",
+				"AUTH default anything",
+				"GET secret",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"NOPERM No permissions to access a key\r\n",
+				"OK\r\n",
+				"value\r\n",
+			},
+		},
+		{
+			name:        "Disabled user cannot authenticate",
+			requirePass: "secret",
+			commands: []string{
+				"AUTH secret",
+				"ACL SETUSER eve off >pw allcommands allkeys",
+				"AUTH eve pw",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				"OK\r\n",
+				"ERR invalid password\r\n",
+			},
+		},
+		{
+			name: "PING",
+			commands: []string{
+				"PING",
+				"PING hello",
+				"PING a b",
+			},
+			wantResponses: []string{
+				"PONG\r\n",
+				"hello\r\n",
+				"ERR wrong number of arguments for PING command\r\n",
+			},
+		},
+		{
+			name: "empty quoted arguments",
+			commands: []string{
+				`SET name ""`,
+				"GET name",
+				"TOUCH name",
+				`SET "" value`,
+				`GET ""`,
+				`DEL ""`,
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				`""` + "\r\n",
+				"1\r\n",
+				"ERR empty key\r\n",
+				"ERR empty key\r\n",
+				"ERR empty key\r\n",
+			},
+		},
+		{
+			name: "empty command name",
+			commands: []string{
+				`"" foo`,
+				"PING",
+			},
+			wantResponses: []string{
+				"ERR unknown command: \r\n",
+				"PONG\r\n",
+			},
+		},
+		{
+			name: "escaped value",
+			commands: []string{
+				`SET poem "roses\r\n\tare \x72ed"`,
+				"GET poem",
+			},
+			wantResponses: []string{
+				"OK\r\n",
+				`"roses\r\n\tare red"` + "\r\n",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+
+			store := store.CreateNewStore(store.NewMemoryStorage(16))
+			store.Config().Set("requirepass", tc.requirePass)
+
+			if tc.storeSetup != nil {
+				tc.storeSetup(store)
+			}
+
+			clientConn, clientReader := dialTCP(t, newHandler(store))
+			clientWriter := bufio.NewWriter(clientConn)
+
+			for index, command := range tc.commands {
+				t.Logf("Client sending: %q", command)
+				clientWriter.WriteString(command + "\n")
+				clientWriter.Flush()
+
+				clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				response, err := clientReader.ReadString('\n')
+
+				if err != nil {
+					t.Fatalf("Error reading response for command %d %q: %v", index, command, err)
+				}
+
+				t.Logf("Client received: %q", response)
+
+				if response != tc.wantResponses[index] {
+					t.Errorf("Response mismatch for command %d (%q):\n got: %q\nwant: %q",
+						index, command, response, tc.wantResponses[index])
+				}
+			}
+		})
+	}
+}
+
+func TestHandleConnection_DumpRestore(t *testing.T) {
+	store := store.CreateNewStore(store.NewMemoryStorage(16))
+	store.Set(0, "name", "gandalf the grey")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store).handleConnection(serverConn)
+
+	reader := bufio.NewReader(clientConn)
+	send := func(command string) string {
+		t.Helper()
+		clientConn.Write([]byte(command + "\n"))
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading response for %q: %v", command, err)
+		}
+		return strings.TrimSuffix(response, "\r\n")
+	}
+
+	payload := send("DUMP name")
+	if got := send("RESTORE name 0 " + payload); got != "BUSYKEY target key name already exists" {
+		t.Errorf("RESTORE over existing key = %q", got)
+	}
+	if got := send("RESTORE copy 0 " + payload); got != "OK" {
+		t.Errorf("RESTORE = %q, expected OK", got)
+	}
+	if got := send("GET copy"); got != "gandalf the grey" {
+		t.Errorf("GET copy = %q, expected %q", got, "gandalf the grey")
+	}
+	if got := send("RESTORE name 0 " + payload + " REPLACE"); got != "OK" {
+		t.Errorf("RESTORE REPLACE = %q, expected OK", got)
+	}
+}
+
+func TestHandleConnection_QuitAfterMulti(t *testing.T) {
+	store := store.CreateNewStore(store.NewMemoryStorage(16))
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		newHandler(store).handleConnection(serverConn)
+		close(done)
+	}()
+
+	reader := bufio.NewReader(clientConn)
+	clientId, _ := strconv.ParseInt(sendCommand(t, clientConn, reader, "CLIENT ID", 1)[0], 10, 64)
+	for _, command := range []string{"SELECT 3", "MULTI", "SET key value", "QUIT"} {
+		clientConn.Write([]byte(command + "\n"))
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading response for %q: %v", command, err)
+		}
+	}
+
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("expected connection to be closed by the server after QUIT")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleConnection did not return after QUIT")
+	}
+
+	if store.InTransaction(clientId) {
+		t.Errorf("expected transaction to be discarded after QUIT")
+	}
+	if dbIndex := store.GetClientDBIndex(clientId); dbIndex != 0 {
+		t.Errorf("expected client DB index to be removed after QUIT, got %d", dbIndex)
+	}
+	if _, ok, _ := store.Get(3, "key"); ok {
+		t.Errorf("expected queued SET not to be executed")
+	}
+}
+
+func TestHandleConnection_MemoryHelpAndSamples(t *testing.T) {
+	store := store.CreateNewStore(store.NewMemoryStorage(16))
+	store.Set(0, "name", "batman")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store).handleConnection(serverConn)
+
+	reader := bufio.NewReader(clientConn)
+	send := func(command string, lines int) []string {
+		t.Helper()
+		clientConn.Write([]byte(command + "\n"))
+		var responses []string
+		for range lines {
+			response, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading response for %q: %v", command, err)
+			}
+			responses = append(responses, strings.TrimSuffix(response, "\r\n"))
+		}
+		return responses
+	}
+
+	help := send("MEMORY HELP", len(store.MemoryHelp()))
+	if !reflect.DeepEqual(help, store.MemoryHelp()) {
+		t.Errorf("MEMORY HELP = %q, expected %q", help, store.MemoryHelp())
+	}
+
+	usage := send("MEMORY USAGE name", 1)[0]
+	sampled := send("MEMORY USAGE name SAMPLES 5", 1)[0]
+	if usage != sampled {
+		t.Errorf("MEMORY USAGE with SAMPLES = %q, expected %q", sampled, usage)
+	}
+
+	expected := store.MemoryStats()
+	if stats := send("MEMORY STATS", len(expected)); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("MEMORY STATS = %q, expected %q", stats, expected)
+	}
+}
+
+func sendCommand(t *testing.T, conn net.Conn, reader *bufio.Reader, command string, lines int) []string {
+	t.Helper()
+	conn.Write([]byte(command + "\n"))
+	var responses []string
+	for range lines {
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading response for %q: %v", command, err)
+		}
+		responses = append(responses, strings.TrimSuffix(response, "\r\n"))
+	}
+	return responses
+}
+
+func TestHandleConnection_CompactLines(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store.CreateNewStore(store.NewMemoryStorage(16))).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+
+	sendCommand(t, clientConn, reader, "SET name batman", 1)
+	sendCommand(t, clientConn, reader, `SET poem "roses\nare red"`, 1)
+
+	compacted := sendCommand(t, clientConn, reader, "COMPACT", 2)
+	slices.Sort(compacted)
+	expected := []string{"SET name batman", `SET poem "roses\nare red"`}
+	if !reflect.DeepEqual(compacted, expected) {
+		t.Errorf("COMPACT = %q, expected %q", compacted, expected)
+	}
+	if got := sendCommand(t, clientConn, reader, "GET name", 1)[0]; got != "batman" {
+		t.Errorf("GET name = %q, expected batman; connection out of step", got)
+	}
+}
+
+func TestHandleConnection_ACLMultiLineReplies(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store.CreateNewStore(store.NewMemoryStorage(16))).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+
+	sendCommand(t, clientConn, reader, "ACL SETUSER alice on nopass allcommands -del allkeys", 1)
+
+	list := sendCommand(t, clientConn, reader, "ACL LIST", 2)
+	expectedList := []string{
+		"user alice on nopass ~* +@all -del",
+		"user default on nopass ~* +@all",
+	}
+	if !reflect.DeepEqual(list, expectedList) {
+		t.Errorf("ACL LIST = %q, expected %q", list, expectedList)
+	}
+
+	user := sendCommand(t, clientConn, reader, "ACL GETUSER alice", 4)
+	expectedUser := []string{
+		"flags: on nopass",
+		"passwords: ",
+		"commands: +@all -del",
+		"keys: ~*",
+	}
+	if !reflect.DeepEqual(user, expectedUser) {
+		t.Errorf("ACL GETUSER = %q, expected %q", user, expectedUser)
+	}
+
+	help := sendCommand(t, clientConn, reader, "ACL HELP", len(aclHelp))
+	if !reflect.DeepEqual(help, aclHelp) {
+		t.Errorf("ACL HELP = %q, expected %q", help, aclHelp)
+	}
+
+	if got := sendCommand(t, clientConn, reader, "ACL WHOAMI", 1)[0]; got != "default" {
+		t.Errorf("ACL WHOAMI = %q, expected default; connection out of step", got)
+	}
+}
+
+func TestHandleConnection_ClientList(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+
+	first, firstServer := net.Pipe()
+	defer first.Close()
+	go h.handleConnection(firstServer)
+	firstReader := bufio.NewReader(first)
+
+	second, secondServer := net.Pipe()
+	defer second.Close()
+	go h.handleConnection(secondServer)
+	secondReader := bufio.NewReader(second)
+
+	sendCommand(t, second, secondReader, "SELECT 3", 1)
+	sendCommand(t, second, secondReader, "MULTI", 1)
+	sendCommand(t, second, secondReader, "SET name batman", 1)
+
+	list := sendCommand(t, first, firstReader, "CLIENT LIST", 2)
+	var multis, dbs []string
+	for _, line := range list {
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, "multi=") {
+				multis = append(multis, field)
+			} else if strings.HasPrefix(field, "db=") {
+				dbs = append(dbs, field)
+			}
+		}
+	}
+	slices.Sort(multis)
+	slices.Sort(dbs)
+	if !reflect.DeepEqual(multis, []string{"multi=-1", "multi=1"}) {
+		t.Errorf("CLIENT LIST multi fields = %q, expected multi=-1 and multi=1", multis)
+	}
+	if !reflect.DeepEqual(dbs, []string{"db=0", "db=3"}) {
+		t.Errorf("CLIENT LIST db fields = %q, expected db=0 and db=3", dbs)
+	}
+
+	sendCommand(t, second, secondReader, "QUIT", 1)
+	if _, err := secondReader.ReadString('\n'); err == nil {
+		t.Fatalf("expected: connection to be closed after QUIT")
+	}
+	list = sendCommand(t, first, firstReader, "CLIENT LIST", 1)
+	if !strings.Contains(list[0], "db=0") {
+		t.Errorf("CLIENT LIST after QUIT = %q, expected only the first client", list)
+	}
+	if got := sendCommand(t, first, firstReader, "ACL WHOAMI", 1)[0]; got != "default" {
+		t.Errorf("ACL WHOAMI = %q, expected default; connection out of step", got)
+	}
+}
+
+func TestHandleConnection_ClientSetNameGetName(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store.CreateNewStore(store.NewMemoryStorage(16))).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+
+	steps := []struct {
+		command  string
+		response string
+	}{
+		{"CLIENT GETNAME", "(nil)"},
+		{"CLIENT SETNAME \"bad name\"", ErrInvalidClientName.Error()},
+		{"CLIENT SETNAME \"bad\tname\"", ErrInvalidClientName.Error()},
+		{"CLIENT SETNAME worker-1", "OK"},
+		{"SELECT 2", "OK"},
+		{"MULTI", "OK"},
+		{"SET name batman", "QUEUED"},
+		{"EXEC", "1) OK"},
+		{"CLIENT GETNAME", "worker-1"},
+		{"CLIENT SETNAME", ErrUnknownSubcommand("CLIENT", "SETNAME").Error()},
+	}
+	for _, step := range steps {
+		if got := sendCommand(t, clientConn, reader, step.command, 1)[0]; got != step.response {
+			t.Errorf("%s = %q, expected %q", step.command, got, step.response)
+		}
+	}
+
+	list := sendCommand(t, clientConn, reader, "CLIENT LIST", 1)
+	if !strings.Contains(list[0], " name=worker-1 ") {
+		t.Errorf("CLIENT LIST = %q, expected name=worker-1", list[0])
+	}
+}
+
+func TestHandleConnection_ClientKillDuringMulti(t *testing.T) {
+	store := store.CreateNewStore(store.NewMemoryStorage(16))
+	h := newHandler(store)
+
+	admin, adminServer := net.Pipe()
+	defer admin.Close()
+	go h.handleConnection(adminServer)
+	adminReader := bufio.NewReader(admin)
+
+	victim, victimServer := net.Pipe()
+	defer victim.Close()
+	done := make(chan struct{})
+	go func() {
+		h.handleConnection(victimServer)
+		close(done)
+	}()
+	victimReader := bufio.NewReader(victim)
+	victimId := sendCommand(t, victim, victimReader, "CLIENT ID", 1)[0]
+
+	sendCommand(t, victim, victimReader, "MULTI", 1)
+	sendCommand(t, victim, victimReader, "SET key value", 1)
+
+	if got := sendCommand(t, admin, adminReader, "CLIENT KILL ID "+victimId, 1)[0]; got != "1" {
+		t.Errorf("CLIENT KILL ID = %q, expected 1", got)
+	}
+	if _, err := victimReader.ReadString('\n'); err == nil {
+		t.Errorf("expected killed connection to be closed")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleConnection did not return after CLIENT KILL")
+	}
+
+	if id, _ := strconv.ParseInt(victimId, 10, 64); store.InTransaction(id) {
+		t.Errorf("expected transaction to be discarded after CLIENT KILL")
+	}
+	if _, ok, _ := store.Get(0, "key"); ok {
+		t.Errorf("expected queued SET not to be executed")
+	}
+	if list := sendCommand(t, admin, adminReader, "CLIENT LIST", 1); strings.Contains(list[0], "id="+victimId+" ") {
+		t.Errorf("CLIENT LIST = %q, expected killed client to be unregistered", list)
+	}
+	if got := sendCommand(t, admin, adminReader, "CLIENT KILL ADDR 10.0.0.1:6379", 1)[0]; got != "0" {
+		t.Errorf("CLIENT KILL ADDR = %q, expected 0", got)
+	}
+	if got := sendCommand(t, admin, adminReader, "CLIENT KILL NAME x", 1)[0]; got != ErrSyntax.Error() {
+		t.Errorf("CLIENT KILL NAME = %q, expected %q", got, ErrSyntax)
+	}
+}
+
+func TestHandleConnection_ClientIdAndInfo(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+
+	var ids []string
+	for range 3 {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go h.handleConnection(serverConn)
+		reader := bufio.NewReader(clientConn)
+
+		id := sendCommand(t, clientConn, reader, "CLIENT ID", 1)[0]
+		ids = append(ids, id)
+
+		sendCommand(t, clientConn, reader, "CLIENT SETNAME conn-"+id, 1)
+		info := sendCommand(t, clientConn, reader, "CLIENT INFO", 1)[0]
+		if !strings.HasPrefix(info, "id="+id+" ") || !strings.Contains(info, " name=conn-"+id+" ") {
+			t.Errorf("CLIENT INFO = %q, expected id=%s and name=conn-%s", info, id, id)
+		}
+	}
+
+	if !reflect.DeepEqual(ids, []string{"1", "2", "3"}) {
+		t.Errorf("CLIENT ID = %q, expected monotonically increasing ids starting at 1", ids)
+	}
+}
+
+func TestHandleConnection_ClientPause(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	connect := func() (net.Conn, *bufio.Reader) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { clientConn.Close() })
+		go h.handleConnection(serverConn)
+		return clientConn, bufio.NewReader(clientConn)
+	}
+	admin, adminReader := connect()
+	writer, writerReader := connect()
+	reader, readerReader := connect()
+
+	sendCommand(t, admin, adminReader, "CLIENT PAUSE 10000 WRITE", 1)
+
+	writer.Write([]byte("SET name batman\n"))
+	if got := sendCommand(t, reader, readerReader, "GET name", 1)[0]; got != "(nil)" {
+		t.Errorf("GET during WRITE pause = %q, expected (nil)", got)
+	}
+	if got := sendCommand(t, reader, readerReader, "PING", 1)[0]; got != "PONG" {
+		t.Errorf("PING during pause = %q, expected PONG", got)
+	}
+	sendCommand(t, reader, readerReader, "MULTI", 1)
+	if got := sendCommand(t, reader, readerReader, "INCR counter", 1)[0]; got != "QUEUED" {
+		t.Errorf("INCR inside MULTI during pause = %q, expected QUEUED", got)
+	}
+
+	writer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := writerReader.ReadString('\n'); err == nil {
+		t.Fatal("expected SET to be held while writes are paused")
+	}
+	writer.SetReadDeadline(time.Time{})
+
+	reader.Write([]byte("EXEC\n"))
+	unpausedAt := time.Now()
+	sendCommand(t, admin, adminReader, "CLIENT UNPAUSE", 1)
+
+	if got, _ := writerReader.ReadString('\n'); got != "OK\r\n" {
+		t.Errorf("SET after unpause = %q, expected OK", got)
+	}
+	if time.Since(unpausedAt) > time.Second {
+		t.Errorf("expected SET to complete promptly after unpause")
+	}
+	if got, _ := readerReader.ReadString('\n'); got != "1) 1\r\n" {
+		t.Errorf("EXEC after unpause = %q, expected 1) 1", got)
+	}
+	if got := sendCommand(t, writer, writerReader, "GET name", 1)[0]; got != "batman" {
+		t.Errorf("GET name = %q, expected batman", got)
+	}
+}
+
+func TestHandleConnection_ClientPauseTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store.CreateNewStore(store.NewMemoryStorage(16))).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+
+	steps := []struct {
+		command  string
+		response string
+	}{
+		{"CLIENT PAUSE abc", ErrNotInteger.Error()},
+		{"CLIENT PAUSE 100 READ", ErrSyntax.Error()},
+		{"CLIENT PAUSE 100 ALL", "OK"},
+	}
+	for _, step := range steps {
+		if got := sendCommand(t, clientConn, reader, step.command, 1)[0]; got != step.response {
+			t.Errorf("%s = %q, expected %q", step.command, got, step.response)
+		}
+	}
+
+	start := time.Now()
+	if got := sendCommand(t, clientConn, reader, "GET name", 1)[0]; got != "(nil)" {
+		t.Errorf("GET after pause timeout = %q, expected (nil)", got)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected GET to be held by an ALL pause, completed after %v", elapsed)
+	}
+}
+
+func TestHandleConnection_CommandListing(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store.CreateNewStore(store.NewMemoryStorage(16))).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+
+	listing := sendCommand(t, clientConn, reader, "COMMAND", len(commandTable))
+	if !slices.Contains(listing, "set 3 write,denyoom 1 1 1") {
+		t.Errorf("COMMAND = %q, expected an entry for set", listing)
+	}
+	if got := sendCommand(t, clientConn, reader, "MULTI", 1)[0]; got != "OK" {
+		t.Fatalf("MULTI = %q, expected OK", got)
+	}
+	if got := sendCommand(t, clientConn, reader, "COMMAND COUNT", 1)[0]; got != ErrCommandInTransaction("COMMAND").Error() {
+		t.Errorf("COMMAND inside MULTI = %q, expected %q", got, ErrCommandInTransaction("COMMAND"))
+	}
+}
+
+func TestHandleConnection_ConfigAtRuntime(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	connect := func() (net.Conn, *bufio.Reader) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { clientConn.Close() })
+		go h.handleConnection(serverConn)
+		return clientConn, bufio.NewReader(clientConn)
+	}
+	admin, adminReader := connect()
+
+	steps := []struct {
+		command  string
+		response []string
+	}{
+		{"CONFIG GET maxmemory", []string{"maxmemory", "0"}},
+		{"SET name batman", []string{"OK"}},
+		{"CONFIG SET maxmemory 1", []string{"OK"}},
+		{"CONFIG GET maxmem*", []string{"maxmemory", "1", "maxmemory-policy", "noeviction"}},
+		{"SET name robin", []string{store.ErrOOM.Error()}},
+		{"GET name", []string{"batman"}},
+		{"DEL name", []string{"1"}},
+		{"MULTI", []string{"OK"}},
+		{"INCR counter", []string{"QUEUED"}},
+		{"CONFIG SET maxmemory 0", []string{ErrCommandInTransaction("CONFIG").Error()}},
+		{"DISCARD", []string{"OK"}},
+		{"CONFIG SET maxmemory 0", []string{"OK"}},
+		{"SET name robin", []string{"OK"}},
+		{"CONFIG SET databases 32", []string{config.ErrImmutableParameter("databases").Error()}},
+		{"CONFIG SET nosuch 1", []string{config.ErrUnknownParameter("nosuch").Error()}},
+		{"CONFIG SET appendfsync always", []string{"OK"}},
+		{"CONFIG GET appendfsync", []string{"appendfsync", "always"}},
+		{"CONFIG SET appendfsync sometimes", []string{config.ErrInvalidValue("appendfsync", "argument must be one of always, everysec or no").Error()}},
+		{"CONFIG SET requirepass secret", []string{"OK"}},
+	}
+	for _, step := range steps {
+		if got := sendCommand(t, admin, adminReader, step.command, len(step.response)); !reflect.DeepEqual(got, step.response) {
+			t.Errorf("%s = %q, expected %q", step.command, got, step.response)
+		}
+	}
+
+	other, otherReader := connect()
+	if got := sendCommand(t, other, otherReader, "GET name", 1)[0]; got != ErrNoAuth.Error() {
+		t.Errorf("GET after CONFIG SET requirepass = %q, expected %q", got, ErrNoAuth)
+	}
+	if got := sendCommand(t, other, otherReader, "AUTH secret", 1)[0]; got != "OK" {
+		t.Errorf("AUTH with the new password = %q, expected OK", got)
+	}
+	if _, err := h.handleConfig([]string{"SET", "requirepass", ""}); err != nil {
+		t.Fatalf("CONFIG SET requirepass \"\" failed: %v", err)
+	}
+
+	third, thirdReader := connect()
+	if got := sendCommand(t, third, thirdReader, "GET name", 1)[0]; got != "robin" {
+		t.Errorf("GET after clearing requirepass = %q, expected robin", got)
+	}
+}
+
+func TestHandleConnection_SaveAndLastSave(t *testing.T) {
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	s.Config().Set("dir", t.TempDir())
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(s).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+
+	steps := []struct {
+		command  string
+		response string
+	}{
+		{"LASTSAVE", "0"},
+		{"SET name batman", "OK"},
+		{"SAVE", "OK"},
+		{"SAVE now", ErrWrongNumberOfArgs("SAVE").Error()},
+		{"BGSAVE", string(ResBackgroundSaving)},
+	}
+	for _, step := range steps {
+		if got := sendCommand(t, clientConn, reader, step.command, 1)[0]; got != step.response {
+			t.Errorf("%s = %q, expected %q", step.command, got, step.response)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for s.SaveInProgress() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	lastSave, err := strconv.ParseInt(sendCommand(t, clientConn, reader, "LASTSAVE", 1)[0], 10, 64)
+	if err != nil || time.Since(time.Unix(lastSave, 0)) > time.Minute {
+		t.Errorf("LASTSAVE = %d, %v, expected a recent unix time", lastSave, err)
+	}
+	if _, ok := s.SnapshotExists(); !ok {
+		t.Errorf("expected SAVE to write a snapshot file")
+	}
+}
+
+func TestHandleConnection_InfoKeyspace(t *testing.T) {
+	store := store.CreateNewStore(store.NewMemoryStorage(16))
+	store.Config().Set("db-max-keys", "100")
+	store.Set(3, "name", "batman")
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+
+	info := sendCommand(t, clientConn, reader, "INFO keyspace", 2)
+	expected := append([]string{"# Keyspace"}, store.KeyspaceInfo()...)
+	if !reflect.DeepEqual(info, expected) || !strings.HasPrefix(info[1], "db3:keys=1,") {
+		t.Errorf("INFO keyspace = %q, expected %q", info, expected)
+	}
+}
+
+func TestCheckSizes(t *testing.T) {
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	s.Set(0, "at", "12345")
+	s.Set(0, "above", "123456")
+	atLimit, _, _ := s.Dump(0, "at")
+	aboveLimit, _, _ := s.Dump(0, "above")
+	settings := config.Default()
+	settings.MaxKeyLength, settings.MaxValueLength = 5, 5
+
+	tests := []struct {
+		command string
+		args    []string
+		want    error
+	}{
+		{"RESTORE", []string{"key", "0", atLimit}, nil},
+		{"RESTORE", []string{"key", "0", aboveLimit}, ErrValueTooLarge},
+		{"RESTORE", []string{"toolong", "0", atLimit}, ErrKeyTooLarge},
+		{"TOUCH", []string{"a", "b", "toolong"}, ErrKeyTooLarge},
+		{"PFADD", []string{"hll", "elements-are-not-stored-values"}, nil},
+	}
+	for _, tt := range tests {
+		if err := checkSizes(settings, tt.command, tt.args); err != tt.want {
+			t.Errorf("checkSizes(%s %v) = %v, expected %v", tt.command, tt.args, err, tt.want)
+		}
+	}
+	settings.MaxKeyLength, settings.MaxValueLength = 0, 0
+	if err := checkSizes(settings, "RESTORE", []string{"toolong", "0", aboveLimit}); err != nil {
+		t.Errorf("checkSizes() without limits = %v, expected nil", err)
+	}
+}
+
+func TestHandleConnection_Watch(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	connect := func() (net.Conn, *bufio.Reader) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { clientConn.Close() })
+		go h.handleConnection(serverConn)
+		return clientConn, bufio.NewReader(clientConn)
+	}
+	conn, reader := connect()
+	other, otherReader := connect()
+	send := func(command string, lines int) []string {
+		return sendCommand(t, conn, reader, command, lines)
+	}
+
+	send("SET balance 100", 1)
+	send("WATCH balance", 1)
+	send("MULTI", 1)
+	if reply := send("WATCH other", 1)[0]; reply != ErrWatchInMulti.Error() {
+		t.Errorf("WATCH inside MULTI = %q, expected %q", reply, ErrWatchInMulti)
+	}
+	send("SET balance 50", 1)
+	sendCommand(t, other, otherReader, "INCRBY balance 10", 1)
+	if reply := send("EXEC", 1)[0]; reply != "(nil)" {
+		t.Errorf("EXEC after a watched key changed = %q, expected (nil)", reply)
+	}
+	if reply := send("GET balance", 1)[0]; reply != "110" {
+		t.Errorf("GET balance = %q, expected the aborted transaction not to run", reply)
+	}
+
+	// EXEC unwatched everything, so the next transaction runs.
+	sendCommand(t, other, otherReader, "SET balance 0", 1)
+	send("MULTI", 1)
+	send("SET balance 50", 1)
+	if reply := send("EXEC", 1)[0]; reply != "1) OK" {
+		t.Errorf("EXEC without watched keys = %q, expected 1) OK", reply)
+	}
+
+	send("WATCH balance", 1)
+	if reply := send("UNWATCH", 1)[0]; reply != "OK" {
+		t.Errorf("UNWATCH = %q, expected OK", reply)
+	}
+	sendCommand(t, other, otherReader, "SET balance 0", 1)
+	send("MULTI", 1)
+	send("GET balance", 1)
+	if reply := send("EXEC", 1)[0]; reply != "1) 0" {
+		t.Errorf("EXEC after UNWATCH = %q, expected 1) 0", reply)
+	}
+}
+
+func TestHandleConnection_TransactionWithoutRollback(t *testing.T) {
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	s.Config().Set("transaction-rollback", "no")
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(s).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+	send := func(command string, lines int) []string {
+		return sendCommand(t, clientConn, reader, command, lines)
+	}
+
+	send("SET counter 1", 1)
+	send("SET name batman", 1)
+	send("MULTI", 1)
+	send("INCR counter", 1)
+	send("INCR name", 1)
+	send("SET after error", 1)
+	exec := send("EXEC", 3)
+	expected := []string{"1) 2", "2) " + ErrNotInteger.Error(), "3) OK"}
+	if !reflect.DeepEqual(exec, expected) {
+		t.Errorf("EXEC = %q, expected %q", exec, expected)
+	}
+	if reply := send("GET counter", 1)[0]; reply != "2" {
+		t.Errorf("GET counter = %q, expected the INCR before the error to stay", reply)
+	}
+	if reply := send("GET after", 1)[0]; reply != "error" {
+		t.Errorf("GET after = %q, expected the SET after the error to run", reply)
+	}
+
+	send("MULTI", 1)
+	send("SET onlyonearg", 1)
+	send("SET never run", 1)
+	if reply := send("EXEC", 1)[0]; reply != store.ErrExecAbort.Error() {
+		t.Errorf("EXEC after a queueing error = %q, expected %q", reply, store.ErrExecAbort)
+	}
+	if _, ok, _ := s.Get(0, "never"); ok {
+		t.Errorf("expected EXECABORT to run nothing")
+	}
+}
+
+func TestHandleConnection_ExecAfterQueueErrorReleasesOtherClients(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	connect := func() (net.Conn, *bufio.Reader) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { clientConn.Close() })
+		// A client stuck behind a leaked lock fails the read instead of
+		// hanging the test.
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		go h.handleConnection(serverConn)
+		return clientConn, bufio.NewReader(clientConn)
+	}
+	conn, reader := connect()
+	other, otherReader := connect()
+
+	sendCommand(t, conn, reader, "MULTI", 1)
+	sendCommand(t, conn, reader, "SET onlyonearg", 1)
+	if reply := sendCommand(t, conn, reader, "EXEC", 1)[0]; reply != store.ErrTransactionDiscarded.Error() {
+		t.Errorf("EXEC after a queueing error = %q, expected %q", reply, store.ErrTransactionDiscarded)
+	}
+
+	sendCommand(t, other, otherReader, "MULTI", 1)
+	sendCommand(t, other, otherReader, "SET name batman", 1)
+	if reply := sendCommand(t, other, otherReader, "EXEC", 1)[0]; reply != "1) OK" {
+		t.Errorf("EXEC on another connection = %q, expected 1) OK", reply)
+	}
+
+	if reply := sendCommand(t, conn, reader, "MULTI", 1)[0]; reply != "OK" {
+		t.Errorf("MULTI after the discarded transaction = %q, expected OK", reply)
+	}
+	sendCommand(t, conn, reader, "GET name", 1)
+	if reply := sendCommand(t, conn, reader, "EXEC", 1)[0]; reply != "1) batman" {
+		t.Errorf("EXEC of the fresh transaction = %q, expected 1) batman", reply)
+	}
+}
+
+func TestHandleConnection_IdleTransactionTimeout(t *testing.T) {
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	s.Config().Set("transaction-timeout", "1")
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(s).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+	send := func(command string) string {
+		return sendCommand(t, clientConn, reader, command, 1)[0]
+	}
+
+	send("MULTI")
+	send("SET name batman")
+	s.DiscardIdleTransactions(time.Now().Add(2 * time.Second))
+
+	if reply := send("SET name robin"); reply != store.ErrTransactionTimeout.Error() {
+		t.Errorf("command after the timeout = %q, expected %q", reply, store.ErrTransactionTimeout)
+	}
+	if reply := send("GET name"); reply != "(nil)" {
+		t.Errorf("GET name = %q, expected nothing from the discarded transaction to run", reply)
+	}
+	if reply := send("EXEC"); reply != store.ErrNoTransactionInProgress.Error() {
+		t.Errorf("EXEC = %q, expected %q", reply, store.ErrNoTransactionInProgress)
+	}
+	if reply := send("MULTI"); reply != "OK" {
+		t.Errorf("MULTI after the timeout = %q, expected OK", reply)
+	}
+}
+
+func TestHandleConnection_ExecNilResults(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go newHandler(store.CreateNewStore(store.NewMemoryStorage(16))).handleConnection(serverConn)
+	reader := bufio.NewReader(clientConn)
+
+	sendCommand(t, clientConn, reader, "SET stored nil", 1)
+	single := sendCommand(t, clientConn, reader, "GET missing", 1)[0]
+	sendCommand(t, clientConn, reader, "MULTI", 1)
+	sendCommand(t, clientConn, reader, "GET stored", 1)
+	sendCommand(t, clientConn, reader, "GET missing", 1)
+	sendCommand(t, clientConn, reader, "INCR counter", 1)
+	exec := sendCommand(t, clientConn, reader, "EXEC", 3)
+
+	expected := []string{"1) nil", "2) " + single, "3) 1"}
+	if !reflect.DeepEqual(exec, expected) {
+		t.Errorf("EXEC = %q, expected %q", exec, expected)
+	}
+	if single == "nil" {
+		t.Errorf("GET of a missing key = %q, expected it to differ from a stored nil", single)
+	}
+}
+
+// respRequest encodes args the way RESP clients send commands.
+func respRequest(args ...string) string {
+	request := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		request += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return request
+}
+
+// readRESPReply returns one whole reply, nested arrays included, as sent.
+func readRESPReply(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading reply: %v", err)
+	}
+	count, _ := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	switch line[0] {
+	case '$':
+		if count >= 0 {
+			data := make([]byte, count+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				t.Fatalf("Error reading bulk reply: %v", err)
+			}
+			line += string(data)
+		}
+	case '*', '>':
+		for range count {
+			line += readRESPReply(t, reader)
+		}
+	case '%':
+		for range 2 * count {
+			line += readRESPReply(t, reader)
+		}
+	}
+	return line
+}
+
+// dialTCP serves h on a local TCP listener and connects to it, so replies
+// travel over a real socket as they do for client libraries.
+func dialTCP(t testing.TB, h *handler) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	s := newServer(listenConfig{Addresses: []string{"127.0.0.1:0"}}, h)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func TestHandleConnection_RESP(t *testing.T) {
+	conn, reader := dialTCP(t, newHandler(store.CreateNewStore(store.NewMemoryStorage(16))))
+
+	exchanges := []struct {
+		request string
+		reply   string
+	}{
+		{respRequest("PING"), "+PONG\r\n"},
+		{respRequest("SET", "name", "bat\r\nman"), "+OK\r\n"},
+		{respRequest("GET", "name"), "$8\r\nbat\r\nman\r\n"},
+		{respRequest("GET", "missing"), "$-1\r\n"},
+		{respRequest("SET", "stored", "OK"), "+OK\r\n"},
+		{respRequest("GET", "stored"), "$2\r\nOK\r\n"},
+		{respRequest("INCR", "counter"), ":1\r\n"},
+		{respRequest("DEL", "counter"), ":1\r\n"},
+		{respRequest("INCR", "name"), "-ERR value is not an integer or out of range\r\n"},
+		{respRequest("CONFIG", "GET", "maxmemory"), "*2\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n"},
+		{respRequest("MULTI"), "+OK\r\n"},
+		{respRequest("SET", "a", "1"), "+QUEUED\r\n"},
+		{respRequest("INCR", "a"), "+QUEUED\r\n"},
+		{respRequest("GET", "missing"), "+QUEUED\r\n"},
+		{respRequest("EXEC"), "*3\r\n+OK\r\n:2\r\n$-1\r\n"},
+		{respRequest("", "foo"), "-ERR unknown command: \r\n"},
+		{"*0\r\n" + respRequest("PING"), "+PONG\r\n"},
+		// Inline commands keep getting text replies on the same connection.
+		{"GET a\n", "2\r\n"},
+		{respRequest("GET", "a"), "$1\r\n2\r\n"},
+	}
+	for _, exchange := range exchanges {
+		conn.Write([]byte(exchange.request))
+		if reply := readRESPReply(t, reader); reply != exchange.reply {
+			t.Errorf("reply to %q = %q, expected %q", exchange.request, reply, exchange.reply)
+		}
+	}
+
+	// A malformed request cannot be framed, so the connection is closed.
+	conn.Write([]byte("*1\r\n:3\r\n"))
+	if reply := readRESPReply(t, reader); !strings.HasPrefix(reply, "-ERR Protocol error") {
+		t.Errorf("reply to a malformed request = %q, expected a protocol error", reply)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the connection to be closed after a protocol error, got %v", err)
+	}
+}
+
+func TestHandleConnection_Hello(t *testing.T) {
+	settings := config.Default()
+	settings.RequirePass = "secret"
+	s := store.CreateNewStoreWithConfig(store.NewMemoryStorage(16), config.New(settings))
+	conn, reader := dialTCP(t, newHandler(s))
+	send := func(args ...string) string {
+		conn.Write([]byte(respRequest(args...)))
+		return readRESPReply(t, reader)
+	}
+
+	exchanges := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"HELLO", "3"}, "-NOAUTH Authentication required\r\n"},
+		{[]string{"HELLO", "4"}, "-NOPROTO unsupported protocol version\r\n"},
+		{[]string{"HELLO", "3", "AUTH", "default", "wrong"}, "-" + ErrInvalidPassword.Error() + "\r\n"},
+		{[]string{"GET", "missing"}, "-NOAUTH Authentication required\r\n"},
+		{[]string{"HELLO", "3", "AUTH", "default", "secret", "SETNAME", "reporter"}, "%7\r\n" +
+			"$6\r\nserver\r\n$8\r\nkv-store\r\n" +
+			"$7\r\nversion\r\n$5\r\n1.0.0\r\n" +
+			"$5\r\nproto\r\n:3\r\n" +
+			"$2\r\nid\r\n:1\r\n" +
+			"$4\r\nmode\r\n$10\r\nstandalone\r\n" +
+			"$4\r\nrole\r\n$6\r\nmaster\r\n" +
+			"$7\r\nmodules\r\n*0\r\n"},
+		{[]string{"CLIENT", "GETNAME"}, "$8\r\nreporter\r\n"},
+		{[]string{"GET", "missing"}, "_\r\n"},
+		{[]string{"CONFIG", "GET", "maxmemory"}, "%1\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n"},
+		{[]string{"SET", "name", "batman"}, "+OK\r\n"},
+		{[]string{"INCR", "counter"}, ":1\r\n"},
+		{[]string{"HELLO", "2"}, "*14\r\n" +
+			"$6\r\nserver\r\n$8\r\nkv-store\r\n" +
+			"$7\r\nversion\r\n$5\r\n1.0.0\r\n" +
+			"$5\r\nproto\r\n:2\r\n" +
+			"$2\r\nid\r\n:1\r\n" +
+			"$4\r\nmode\r\n$10\r\nstandalone\r\n" +
+			"$4\r\nrole\r\n$6\r\nmaster\r\n" +
+			"$7\r\nmodules\r\n*0\r\n"},
+		{[]string{"GET", "missing"}, "$-1\r\n"},
+		{[]string{"CONFIG", "GET", "maxmemory"}, "*2\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n"},
+		{[]string{"HELLO", "3", "SETNAME"}, "-ERR syntax error\r\n"},
+		{[]string{"GET", "missing"}, "$-1\r\n"},
+	}
+	for _, exchange := range exchanges {
+		if reply := send(exchange.args...); reply != exchange.reply {
+			t.Errorf("reply to %q = %q, expected %q", exchange.args, reply, exchange.reply)
+		}
+	}
+
+	// Inline commands keep the text format whatever HELLO chose.
+	send("HELLO", "3")
+	conn.Write([]byte("GET missing\n"))
+	if reply, _ := reader.ReadString('\n'); reply != "(nil)\r\n" {
+		t.Errorf("inline GET after HELLO 3 = %q, expected (nil)", reply)
+	}
+}
+
+func TestHandleConnection_ProtocolDetection(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	conn, reader := dialTCP(t, h)
+
+	// Both formats in one write, so the handler has to find where each
+	// request ends.
+	conn.Write([]byte(respRequest("SET", "name", "bat man") + "GET name\n" + respRequest("GET", "name") + "SET \"quoted key\" 1\n" + respRequest("GET", "quoted key")))
+	replies := []string{
+		readRESPReply(t, reader),
+		readRESPReply(t, reader),
+		readRESPReply(t, reader),
+		readRESPReply(t, reader),
+		readRESPReply(t, reader),
+	}
+	expected := []string{"+OK\r\n", "bat man\r\n", "$7\r\nbat man\r\n", "OK\r\n", "$1\r\n1\r\n"}
+	if !reflect.DeepEqual(replies, expected) {
+		t.Errorf("replies = %q, expected %q", replies, expected)
+	}
+
+	misframed := []struct {
+		name    string
+		request string
+	}{
+		{"bad array length", "*x\r\n"},
+		{"bad bulk length", "*1\r\n$-5\r\n"},
+		{"bulk without a trailing CRLF", "*1\r\n$4\r\nPINGXX"},
+		{"premature EOF", "*2\r\n$3\r\nGET\r\n$4\r\nna"},
+	}
+	for _, tc := range misframed {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, reader := dialTCP(t, h)
+			conn.Write([]byte(tc.request))
+			conn.(*net.TCPConn).CloseWrite()
+
+			if reply := readRESPReply(t, reader); !strings.HasPrefix(reply, "-ERR Protocol error") {
+				t.Errorf("reply = %q, expected a protocol error", reply)
+			}
+			if _, err := reader.ReadByte(); err != io.EOF {
+				t.Errorf("expected the connection to be closed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHandleConnection_PipelinedTransactions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		requests []string
+		expected []string
+	}{
+		{
+			name:     "inline",
+			requests: []string{"SET a 1", "MULTI", "INCR a", "GET a", "EXEC", "GET a"},
+			expected: []string{"OK\r\n", "OK\r\n", "QUEUED\r\n", "QUEUED\r\n", "1) 2\r\n", "2) 2\r\n", "2\r\n"},
+		},
+		{
+			name:     "RESP",
+			requests: []string{respRequest("SET", "a", "1"), respRequest("MULTI"), respRequest("INCR", "a"), respRequest("GET", "a"), respRequest("EXEC"), respRequest("GET", "a")},
+			expected: []string{"+OK\r\n", "+OK\r\n", "+QUEUED\r\n", "+QUEUED\r\n", "*2\r\n:2\r\n$1\r\n2\r\n", "$1\r\n2\r\n"},
+		},
+		{
+			name:     "discarded between transactions",
+			requests: []string{"MULTI", "SET a 1", "DISCARD", "MULTI", "SET a 2", "EXEC", "GET a"},
+			expected: []string{"OK\r\n", "QUEUED\r\n", "OK\r\n", "OK\r\n", "QUEUED\r\n", "1) OK\r\n", "2\r\n"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, reader := dialTCP(t, newHandler(store.CreateNewStore(store.NewMemoryStorage(16))))
+
+			var pipeline string
+			for _, request := range tc.requests {
+				if !strings.HasPrefix(request, "*") {
+					request += "\n"
+				}
+				pipeline += request
+			}
+			if _, err := conn.Write([]byte(pipeline)); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for _, expected := range tc.expected {
+				if reply := readRESPReply(t, reader); reply != expected {
+					t.Errorf("reply = %q, expected %q", reply, expected)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHandleConnection_Pipeline sends 10,000 SETs before reading any
+// reply, as a pipelining client does.
+func BenchmarkHandleConnection_Pipeline(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	const commands = 10000
+	var pipeline strings.Builder
+	for i := range commands {
+		pipeline.WriteString(respRequest("SET", "key:"+strconv.Itoa(i%100), "value"))
+	}
+	conn, reader := dialTCP(b, newHandler(store.CreateNewStore(store.NewMemoryStorage(16))))
+
+	b.SetBytes(int64(pipeline.Len()))
+	for b.Loop() {
+		go conn.Write([]byte(pipeline.String()))
+		for range commands {
+			if line, err := reader.ReadString('\n'); err != nil || line != "+OK\r\n" {
+				b.Fatalf("ReadString() = %q, %v", line, err)
+			}
+		}
+	}
+}
+
+func TestHandleConnection_LineEndings(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request string
+		reply   string
+	}{
+		{"LF", "SET name batman\n", "OK\r\n"},
+		{"CRLF", "SET name batman\r\n", "OK\r\n"},
+		{"GET with CRLF", "GET name\r\n", "batman\r\n"},
+		{"GET with LF", "GET name\n", "batman\r\n"},
+		{"quoted with CRLF", "SET name \"bat man\"\r\n", "OK\r\n"},
+		{"quoted value unchanged", "GET name\r\n", "bat man\r\n"},
+		{"trailing backslash with CRLF", "SET name robin\\\r\n", "OK\r\n"},
+		{"carriage return not kept", "GET name\n", "robin\r\n"},
+		{"lone carriage return separates arguments", "SET\rname\rjoker\r\n", "OK\r\n"},
+		{"GET after a lone carriage return", "GET name\r\n", "joker\r\n"},
+	}
+
+	conn, reader := dialTCP(t, newHandler(store.CreateNewStore(store.NewMemoryStorage(16))))
+	for _, tc := range testCases {
+		conn.Write([]byte(tc.request))
+		if reply, _ := reader.ReadString('\n'); reply != tc.reply {
+			t.Errorf("%s: reply to %q = %q, expected %q", tc.name, tc.request, reply, tc.reply)
+		}
+	}
+
+	conn.Write([]byte("MULTI\r\nINCR a\r\nINCR a\r\nEXEC\r\n"))
+	for _, expected := range []string{"OK\r\n", "QUEUED\r\n", "QUEUED\r\n", "1) 1\r\n", "2) 2\r\n"} {
+		if reply, _ := reader.ReadString('\n'); reply != expected {
+			t.Errorf("reply = %q, expected %q", reply, expected)
+		}
+	}
+}
+
+func TestHandleConnection_HugeInlineLine(t *testing.T) {
+	conn, reader := dialTCP(t, newHandler(store.CreateNewStore(store.NewMemoryStorage(16))))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	// 100MB with no newline until the end, far over the 4MB default limit.
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 64<<10)
+		conn.Write([]byte("SET name "))
+		for range 1600 {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+		conn.Write([]byte("\r\nPING\r\n"))
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if reply, _ := reader.ReadString('\n'); reply != "ERR Protocol error: too big inline request\r\n" {
+		t.Errorf("reply to a 100MB line = %q, expected a protocol error", reply)
+	}
+	if reply, _ := reader.ReadString('\n'); reply != "PONG\r\n" {
+		t.Errorf("reply after the dropped line = %q, expected PONG", reply)
+	}
+
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 32<<20 {
+		t.Errorf("reading a 100MB line allocated %d bytes, expected it to stay near the limit", allocated)
+	}
+}
+
+// TestHandleConnection_LongQuotedValue checks that a quoted value of several
+// megabytes is tokenized as it arrives, rather than read as a line and then
+// split.
+func TestHandleConnection_LongQuotedValue(t *testing.T) {
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	s.Config().Set("max-inline-length", "64mb")
+	conn, reader := dialTCP(t, newHandler(s))
+	value := strings.Repeat("bat man ", 1<<20)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	go conn.Write([]byte("SET name \"" + value + "\"\r\n"))
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if reply, _ := reader.ReadString('\n'); reply != "OK\r\n" {
+		t.Fatalf("reply to SET of a %d byte value = %q, expected OK", len(value), reply)
+	}
+
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 5*uint64(len(value)) {
+		t.Errorf("SET of a %d byte value allocated %d bytes", len(value), allocated)
+	}
+	if stored, _, err := s.Get(0, "name"); err != nil || stored != value {
+		t.Errorf("Get() = %d bytes, %v, expected the %d byte value", len(stored), err, len(value))
+	}
+}
+
+func TestHandleConnection_MaxClients(t *testing.T) {
+	s := newServer(listenConfig{Addresses: []string{"127.0.0.1:0"}}, newHandler(store.CreateNewStore(store.NewMemoryStorage(16))))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	send := func(conn net.Conn, reader *bufio.Reader, command string) string {
+		t.Helper()
+		conn.Write([]byte(command + "\r\n"))
+		reply, _ := reader.ReadString('\n')
+		return reply
+	}
+
+	const limit = 3
+	conns := make([]net.Conn, limit)
+	readers := make([]*bufio.Reader, limit)
+	for i := range limit {
+		conns[i], readers[i] = dial()
+		// A reply means the connection has been registered.
+		if reply := send(conns[i], readers[i], "PING"); reply != "PONG\r\n" {
+			t.Fatalf("PING on connection %d = %q", i, reply)
+		}
+	}
+	if reply := send(conns[0], readers[0], "CONFIG SET maxclients 3"); reply != "OK\r\n" {
+		t.Fatalf("CONFIG SET maxclients = %q", reply)
+	}
+
+	_, rejectedReader := dial()
+	if reply, _ := rejectedReader.ReadString('\n'); reply != ErrMaxClients.Error()+"\r\n" {
+		t.Errorf("reply to connection %d = %q, expected %q", limit+1, reply, ErrMaxClients.Error())
+	}
+	if _, err := rejectedReader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the rejected connection to be closed, got %v", err)
+	}
+
+	info := send(conns[0], readers[0], "INFO clients")
+	for range 3 {
+		line, _ := readers[0].ReadString('\n')
+		info += line
+	}
+	if expected := "# Clients\r\nconnected_clients:3\r\nmaxclients:3\r\nmonitors:0\r\n"; info != expected {
+		t.Errorf("INFO clients = %q, expected %q", info, expected)
+	}
+
+	// Once a client leaves, a new one fits again.
+	conns[limit-1].Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, reader := dial()
+		if reply := send(conn, reader, "PING"); reply == "PONG\r\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no connection was accepted after a client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleConnection_IdleTimeout(t *testing.T) {
+	defer func(unit time.Duration) { idleTimeoutUnit = unit }(idleTimeoutUnit)
+	idleTimeoutUnit = time.Millisecond
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	h.store.Config().Set("timeout", "200")
+	conn, reader := dialTCP(t, h)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	send := func(command string) string {
+		conn.Write([]byte(command + "\r\n"))
+		reply, _ := reader.ReadString('\n')
+		return reply
+	}
+
+	clientId, _ := strconv.ParseInt(strings.TrimSpace(send("CLIENT ID")), 10, 64)
+	send("MULTI")
+	// Commands keep the connection open well past the timeout.
+	for range 5 {
+		time.Sleep(100 * time.Millisecond)
+		if reply := send("SET name batman"); reply != "QUEUED\r\n" {
+			t.Fatalf("SET name batman = %q, expected QUEUED", reply)
+		}
+	}
+
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("read from an idle connection = %v, expected it to be closed", err)
+	}
+	if count := h.clients.count(); count != 0 {
+		t.Errorf("%d clients registered, expected the idle client unregistered", count)
+	}
+	if h.store.InTransaction(clientId) {
+		t.Error("the idle client's transaction was not discarded")
+	}
+}
+
+// failingConn serves requests and then fails every read with err, as a
+// connection reset by the peer does.
+type failingConn struct {
+	net.Conn
+	requests *strings.Reader
+	err      error
+	reads    atomic.Int64
+}
+
+func (c *failingConn) Read(b []byte) (int, error) {
+	if c.requests.Len() > 0 {
+		return c.requests.Read(b)
+	}
+	c.reads.Add(1)
+	return 0, c.err
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestHandleConnection_ReadError(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	conn := &failingConn{
+		Conn:     serverConn,
+		requests: strings.NewReader("MULTI\r\nSET name batman\r\n"),
+		err:      syscall.ECONNRESET,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.handleConnection(conn)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handleConnection() still running after %d failed reads", conn.reads.Load())
+	}
+
+	// Peeking at the protocol and reading the line may each see the error.
+	if reads := conn.reads.Load(); reads > 2 {
+		t.Errorf("%d reads after the connection failed, expected at most 2", reads)
+	}
+	if count := h.clients.count(); count != 0 {
+		t.Errorf("%d clients registered, expected the failed client unregistered", count)
+	}
+	if h.store.InTransaction(1) {
+		t.Error("the failed client's transaction was not discarded")
+	}
+}
+
+// halfClosedConn reads requests until they run out and then sees EOF, as
+// after the client shuts down its write half, while replies still reach the
+// client.
+type halfClosedConn struct {
+	net.Conn
+	requests io.Reader
+}
+
+func (c halfClosedConn) Read(b []byte) (int, error) {
+	return c.requests.Read(b)
+}
+
+func TestHandleConnection_UnterminatedLastCommand(t *testing.T) {
+	testCases := []struct {
+		name     string
+		requests string
+		replies  string
+	}{
+		{"single command", "GET name", "batman\r\n"},
+		{"after pipelined commands", "SET name robin\r\nGET name", "OK\r\nrobin\r\n"},
+		{"trailing whitespace only", "GET name\r\n  ", "batman\r\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := store.CreateNewStore(store.NewMemoryStorage(16))
+			s.Set(0, "name", "batman")
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+			go newHandler(s).handleConnection(halfClosedConn{serverConn, strings.NewReader(tc.requests)})
+
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			replies, err := io.ReadAll(clientConn)
+			if err != nil {
+				t.Fatalf("reading replies: %v", err)
+			}
+			if string(replies) != tc.replies {
+				t.Errorf("replies = %q, expected %q", replies, tc.replies)
 			}
-			clientConn.Close()
 		})
 	}
 }
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"kv-store/errcode"
+	"strconv"
+	"strings"
+)
+
+const (
+	serverName    = "kv-store"
+	serverVersion = "1.0.0"
+)
+
+var ErrNoProto = errcode.New(errcode.NoProto, "unsupported protocol version")
+
+// handleHello switches the connection to RESP2 or RESP3 and replies with the
+// server properties, in the new protocol. With AUTH it authenticates first,
+// so it can be the first command on a connection that requires a password.
+// Nothing changes unless every option is valid.
+func (h *handler) handleHello(c *client, replies *replyWriter, args []string) (any, error) {
+	protocol := replies.protocol
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		if version != 2 && version != 3 {
+			return nil, ErrNoProto
+		}
+		protocol = version
+	}
+
+	var credentials []string
+	var name string
+	setName := false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return nil, ErrSyntax
+			}
+			credentials = args[i+1 : i+3]
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			name, setName = args[i+1], true
+			i++
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if credentials != nil {
+		username, err := authenticate(h.users, credentials)
+		if err != nil {
+			return nil, err
+		}
+		c.setUser(username)
+	}
+	if _, authenticated := c.user(); !authenticated {
+		return nil, ErrNoAuth
+	}
+	if setName {
+		if err := c.setName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	replies.protocol = protocol
+	return mapReply{
+		"server", serverName,
+		"version", serverVersion,
+		"proto", protocol,
+		"id", c.id,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []string{},
+	}, nil
+}
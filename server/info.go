@@ -0,0 +1,69 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+type infoSection struct {
+	name  string
+	lines func(h *handler) []string
+}
+
+var infoSections = []infoSection{
+	{"server", func(h *handler) []string {
+		var addrs []string
+		if h.addrs != nil {
+			for _, addr := range h.addrs() {
+				addrs = append(addrs, addr.String())
+			}
+		}
+		return []string{"listeners:" + strings.Join(addrs, ",")}
+	}},
+	{"clients", func(h *handler) []string {
+		return []string{
+			"connected_clients:" + strconv.Itoa(h.clients.count()),
+			"maxclients:" + strconv.FormatInt(h.store.Config().Get().MaxClients, 10),
+			"monitors:" + strconv.Itoa(h.monitors.len()),
+		}
+	}},
+	{"network", func(h *handler) []string {
+		settings := h.store.Config().Get()
+		noDelay := 0
+		if settings.TCPNoDelay {
+			noDelay = 1
+		}
+		return []string{
+			"tcp_keepalive:" + strconv.FormatInt(settings.TCPKeepAlive, 10),
+			"tcp_nodelay:" + strconv.Itoa(noDelay),
+			"tcp_recv_buffer:" + strconv.FormatInt(settings.TCPRecvBuffer, 10),
+			"tcp_send_buffer:" + strconv.FormatInt(settings.TCPSendBuffer, 10),
+		}
+	}},
+	{"persistence", func(h *handler) []string { return h.store.PersistenceInfo() }},
+	{"replication", (*handler).replicationInfo},
+	{"keyspace", func(h *handler) []string { return h.store.KeyspaceInfo() }},
+}
+
+func (h *handler) handleInfo(args []string) (any, error) {
+	if len(args) > 1 {
+		return nil, ErrSyntax
+	}
+	requested := "default"
+	if len(args) == 1 {
+		requested = strings.ToLower(args[0])
+	}
+
+	var lines []string
+	for _, section := range infoSections {
+		if requested != "default" && requested != "all" && requested != section.name {
+			continue
+		}
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "# "+strings.ToUpper(section.name[:1])+section.name[1:])
+		lines = append(lines, section.lines(h)...)
+	}
+	return multiline(strings.Join(lines, "\n")), nil
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"kv-store/store"
+	"strconv"
+	"strings"
+)
+
+func runPing(_ *commandContext, args []string) (any, error) {
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return ResPong, nil
+}
+
+func setValueLength(args []string) int64 {
+	return int64(len(args[1]))
+}
+
+func runSet(ctx *commandContext, args []string) (any, error) {
+	if err := ctx.keyspace.Set(ctx.dbIndex, args[0], args[1]); err != nil {
+		return nil, err
+	}
+	return ResOk, nil
+}
+
+func runGet(ctx *commandContext, args []string) (any, error) {
+	value, ok, err := ctx.keyspace.Get(ctx.dbIndex, args[0])
+	if err != nil || !ok {
+		return nil, err
+	}
+	return value, nil
+}
+
+func runDel(ctx *commandContext, args []string) (any, error) {
+	return ctx.keyspace.Del(ctx.dbIndex, args[0])
+}
+
+func runIncr(ctx *commandContext, args []string) (any, error) {
+	return ctx.keyspace.IncrBy(ctx.dbIndex, args[0], 1)
+}
+
+// runIncrBy checks its increment as it runs, so inside MULTI a bad one is
+// queued and fails at EXEC, as in Redis.
+func runIncrBy(ctx *commandContext, args []string) (any, error) {
+	increment, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	return ctx.keyspace.IncrBy(ctx.dbIndex, args[0], increment)
+}
+
+func runCompact(ctx *commandContext, _ []string) (any, error) {
+	compacted, err := ctx.keyspace.Compact(ctx.dbIndex)
+	if err != nil {
+		return nil, err
+	}
+	return multiline(compacted), nil
+}
+
+func runFlushDB(ctx *commandContext, _ []string) (any, error) {
+	if err := ctx.keyspace.FlushDB(ctx.dbIndex); err != nil {
+		return nil, err
+	}
+	return ResOk, nil
+}
+
+func runTouch(ctx *commandContext, args []string) (any, error) {
+	return ctx.keyspace.Touch(ctx.dbIndex, args)
+}
+
+func validateObject(args []string) error {
+	subcommand := strings.ToUpper(args[0])
+	switch {
+	case subcommand == "HELP" && len(args) == 1:
+	case (subcommand == "ENCODING" || subcommand == "IDLETIME" || subcommand == "FREQ") && len(args) == 2:
+	default:
+		return ErrUnknownSubcommand("OBJECT", args[0])
+	}
+	return nil
+}
+
+func runObject(ctx *commandContext, args []string) (any, error) {
+	switch strings.ToUpper(args[0]) {
+	case "ENCODING":
+		encoding, ok, err := ctx.keyspace.ObjectEncoding(ctx.dbIndex, args[1])
+		if err != nil || !ok {
+			return nil, err
+		}
+		return encoding, nil
+	case "IDLETIME":
+		idle, ok, err := ctx.keyspace.ObjectIdleTime(ctx.dbIndex, args[1])
+		if err != nil || !ok {
+			return nil, err
+		}
+		return idle, nil
+	case "FREQ":
+		frequency, ok, err := ctx.keyspace.ObjectFreq(ctx.dbIndex, args[1])
+		if err != nil || !ok {
+			return nil, err
+		}
+		return frequency, nil
+	default:
+		return ctx.store.ObjectHelp(), nil
+	}
+}
+
+func validateMemory(args []string) error {
+	if subcommand := strings.ToUpper(args[0]); (subcommand == "HELP" || subcommand == "STATS") && len(args) == 1 {
+		return nil
+	}
+	if strings.ToUpper(args[0]) != "USAGE" || (len(args) != 2 && len(args) != 4) {
+		return ErrUnknownSubcommand("MEMORY", args[0])
+	}
+	if len(args) == 4 {
+		if strings.ToUpper(args[2]) != "SAMPLES" {
+			return ErrSyntax
+		}
+		samples, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || samples < 0 {
+			return ErrNotInteger
+		}
+	}
+	return nil
+}
+
+func runMemory(ctx *commandContext, args []string) (any, error) {
+	switch strings.ToUpper(args[0]) {
+	case "HELP":
+		return ctx.store.MemoryHelp(), nil
+	case "STATS":
+		return ctx.store.MemoryStats(), nil
+	}
+	usage, ok, err := ctx.keyspace.MemoryUsage(ctx.dbIndex, args[1])
+	if err != nil || !ok {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func runDump(ctx *commandContext, args []string) (any, error) {
+	payload, ok, err := ctx.keyspace.Dump(ctx.dbIndex, args[0])
+	if err != nil || !ok {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func runDumpAll(ctx *commandContext, _ []string) (any, error) {
+	return ctx.store.Export()
+}
+
+func validateRestore(args []string) error {
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return ErrNotInteger
+	}
+	if ttl != 0 {
+		return ErrInvalidTTL
+	}
+	if len(args) == 4 && strings.ToUpper(args[3]) != "REPLACE" {
+		return ErrSyntax
+	}
+	return nil
+}
+
+func restoreValueLength(args []string) int64 {
+	return store.DumpValueLength(args[2])
+}
+
+func runRestore(ctx *commandContext, args []string) (any, error) {
+	replace := len(args) == 4
+	if err := ctx.keyspace.Restore(ctx.dbIndex, args[0], args[2], replace); err != nil {
+		return nil, err
+	}
+	return ResOk, nil
+}
+
+func runPFAdd(ctx *commandContext, args []string) (any, error) {
+	return ctx.keyspace.PFAdd(ctx.dbIndex, args[0], args[1:])
+}
+
+func runPFCount(ctx *commandContext, args []string) (any, error) {
+	return ctx.keyspace.PFCount(ctx.dbIndex, args)
+}
+
+func runPFMerge(ctx *commandContext, args []string) (any, error) {
+	if err := ctx.keyspace.PFMerge(ctx.dbIndex, args[0], args[1:]); err != nil {
+		return nil, err
+	}
+	return ResOk, nil
+}
+
+func runSave(ctx *commandContext, _ []string) (any, error) {
+	if err := ctx.store.Save(); err != nil {
+		return nil, err
+	}
+	return ResOk, nil
+}
+
+func runBackgroundSave(ctx *commandContext, _ []string) (any, error) {
+	if err := ctx.store.BackgroundSave(); err != nil {
+		return nil, err
+	}
+	return ResBackgroundSaving, nil
+}
+
+func runLastSave(ctx *commandContext, _ []string) (any, error) {
+	return ctx.store.LastSave(), nil
+}
+
+func runBackgroundRewriteAppendOnly(ctx *commandContext, _ []string) (any, error) {
+	if err := ctx.store.BackgroundRewriteAppendOnly(); err != nil {
+		return nil, err
+	}
+	return ResBackgroundRewriting, nil
+}
+
+// runSelect leaves the range check to the store.
+func runSelect(ctx *commandContext, args []string) (any, error) {
+	dbIndex, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	if err := ctx.store.SetClientDBIndex(ctx.clientId, dbIndex); err != nil {
+		return nil, err
+	}
+	return ResOk, nil
+}
+
+func runWatch(ctx *commandContext, args []string) (any, error) {
+	if err := ctx.store.Watch(ctx.clientId, ctx.dbIndex, args); err != nil {
+		return nil, err
+	}
+	return ResOk, nil
+}
+
+func runUnwatch(ctx *commandContext, _ []string) (any, error) {
+	ctx.store.Unwatch(ctx.clientId)
+	return ResOk, nil
+}
+
+func runACL(ctx *commandContext, args []string) (any, error) {
+	username, _ := ctx.client.user()
+	return handleACL(ctx.handler.users, username, args)
+}
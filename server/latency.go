@@ -0,0 +1,61 @@
+package server
+
+import (
+	"kv-store/store"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var latencyHelp = []string{
+	"LATENCY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"LATEST",
+	"    Return the latest latency samples for all events.",
+	"HISTORY <event>",
+	"    Return time-latency samples for the <event> name.",
+	"RESET [<event> ...]",
+	"    Reset latency data of one or more <event> classes.",
+	"    (default: reset all data for all event classes)",
+	"HELP",
+	"    Print this help.",
+}
+
+// observeCommand is where the time a command took is measured for both the
+// slowlog and the command latency event.
+func (h *handler) observeCommand(c *client, command string, args []string, elapsed time.Duration) {
+	h.slowlog.observe(h.store.Config().Get(), c, command, args, elapsed)
+	h.store.RecordLatency(store.LatencyCommand, elapsed)
+}
+
+func (h *handler) handleLatency(args []string) (any, error) {
+	if len(args) < 1 {
+		return nil, ErrWrongNumberOfArgs("LATENCY")
+	}
+	subcommand := strings.ToUpper(args[0])
+	switch {
+	case subcommand == "LATEST" && len(args) == 1:
+		events := h.store.LatencyLatest()
+		lines := make([]string, len(events))
+		for i, event := range events {
+			lines[i] = "event=" + event.Name +
+				" time=" + strconv.FormatInt(event.Latest.Time.Unix(), 10) +
+				" latest=" + strconv.FormatInt(event.Latest.Latency.Milliseconds(), 10) +
+				" max=" + strconv.FormatInt(event.Max.Milliseconds(), 10)
+		}
+		return lines, nil
+	case subcommand == "HISTORY" && len(args) == 2:
+		samples := h.store.LatencyHistory(args[1])
+		lines := make([]string, len(samples))
+		for i, sample := range samples {
+			lines[i] = "time=" + strconv.FormatInt(sample.Time.Unix(), 10) +
+				" latency=" + strconv.FormatInt(sample.Latency.Milliseconds(), 10)
+		}
+		return lines, nil
+	case subcommand == "RESET":
+		return h.store.ResetLatency(args[1:]...), nil
+	case subcommand == "HELP" && len(args) == 1:
+		return latencyHelp, nil
+	default:
+		return nil, ErrUnknownSubcommand("LATENCY", args[0])
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bufio"
+	"kv-store/store"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHandleConnection_Latency(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	clientConn, serverConn := net.Pipe()
+	go h.handleConnection(serverConn)
+	defer clientConn.Close()
+	reader := bufio.NewReader(clientConn)
+
+	sendCommand(t, clientConn, reader, "CONFIG SET latency-monitor-threshold 10", 1)
+	c := &client{addr: "127.0.0.1:5000"}
+	h.observeCommand(c, "GET", []string{"name"}, 5*time.Millisecond)
+	h.observeCommand(c, "GET", []string{"name"}, 25*time.Millisecond)
+
+	latest := sendCommand(t, clientConn, reader, "LATENCY LATEST", 1)
+	if pattern := regexp.MustCompile(`^event=command time=\d+ latest=25 max=25$`); !pattern.MatchString(latest[0]) {
+		t.Errorf("LATENCY LATEST = %q, expected it to match %s", latest[0], pattern)
+	}
+	history := sendCommand(t, clientConn, reader, "LATENCY HISTORY command", 1)
+	if pattern := regexp.MustCompile(`^time=\d+ latency=25$`); !pattern.MatchString(history[0]) {
+		t.Errorf("LATENCY HISTORY command = %q, expected it to match %s", history[0], pattern)
+	}
+
+	testCases := []struct {
+		command  string
+		expected string
+	}{
+		{"LATENCY HISTORY", ErrUnknownSubcommand("LATENCY", "HISTORY").Error()},
+		{"LATENCY RESET nosuch", "0"},
+		{"LATENCY RESET", "1"},
+		{"LATENCY RESET", "0"},
+	}
+	for _, tc := range testCases {
+		if got := sendCommand(t, clientConn, reader, tc.command, 1); got[0] != tc.expected {
+			t.Errorf("%s = %q, expected %q", tc.command, got[0], tc.expected)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"kv-store/errcode"
+	"kv-store/parser"
+	"kv-store/store"
+	"os"
+	"strings"
+	"time"
+)
+
+// LoadData restores the dataset before the server starts accepting
+// connections: from the append only file when appendonly is enabled, since it
+// is the more complete record, otherwise from the snapshot. A missing file
+// just means starting empty. A file that fails to load is an error unless
+// ignoreErrors is set, in which case whatever loaded before the failure is
+// kept.
+func LoadData(s *store.Store, ignoreErrors bool) error {
+	settings := s.Config().Get()
+	kind, path := "snapshot", settings.SnapshotPath()
+	load := s.LoadSnapshot
+	if settings.AppendOnly {
+		kind, path = "append only file", settings.AppendOnlyPath()
+		load = func() (int, error) { return LoadAppendOnlyFile(s, path) }
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		s.Logger().Info("No data to load, starting with an empty dataset", "kind", kind, "path", path)
+		return nil
+	}
+
+	s.Logger().Info("Loading data", "kind", kind, "path", path)
+	start := time.Now()
+	loaded, err := load()
+	if err != nil {
+		if !ignoreErrors {
+			return err
+		}
+		s.Logger().Warn("Ignoring error loading data", "kind", kind, "path", path, "entries", loaded, "error", err)
+	}
+	s.Logger().Info("Loaded data", "kind", kind, "path", path, "entries", loaded, "duration", time.Since(start))
+	return nil
+}
+
+// LoadResult is what replaying a command file did.
+type LoadResult struct {
+	Executed int
+	// Skipped holds the error of each line that failed and was skipped, which
+	// names the line.
+	Skipped []error
+}
+
+// LoadCommandFile replays a file of commands, one per line, such as saved
+// COMPACT output, before the server starts accepting connections. A line that
+// fails stops the load, unless skipErrors is set.
+func LoadCommandFile(s *store.Store, path string, skipErrors bool) (LoadResult, error) {
+	lines, err := readCommandFile(path)
+	if err != nil {
+		return LoadResult{}, err
+	}
+	defer s.RemoveClient(replayClientId)
+	return replay(path, lines, func(command string, args []string) (any, error) {
+		return executeCommand(s, replayClientId, command, args)
+	}, skipErrors)
+}
+
+// handleLoad replays a command file on the server, as a client of its own
+// that starts in the caller's database, so a file's SELECTs leave the caller
+// where it was. Each write waits out a pause and is checked the way a client's
+// would be.
+func (h *handler) handleLoad(c *client, args []string) (any, error) {
+	skipErrors := false
+	if len(args) > 2 {
+		return nil, ErrSyntax
+	} else if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "ABORT":
+		case "SKIPERRORS":
+			skipErrors = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	lines, err := readCommandFile(args[0])
+	if err != nil {
+		return nil, errcode.Errorf(errcode.Err, "%v", err)
+	}
+
+	clientId := h.clients.nextId()
+	defer h.store.RemoveClient(clientId)
+	if err := h.store.SetClientDBIndex(clientId, h.store.GetClientDBIndex(c.id)); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, err := replay(args[0], lines, func(command string, args []string) (any, error) {
+		if isWriteCommand(command) {
+			h.pause.wait(true)
+			if err := h.store.CheckWrite(); err != nil {
+				return nil, err
+			}
+		}
+		if commandTable[command].hasFlag("denyoom") {
+			if err := h.store.CheckMemory(); err != nil {
+				return nil, err
+			}
+		}
+		return h.executeClientCommand(clientId, command, args)
+	}, skipErrors)
+	h.store.Logger().Info("Loaded command file", "path", args[0], "executed", result.Executed, "skipped", len(result.Skipped), "duration", time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	skipped := make(arrayReply, len(result.Skipped))
+	for i, err := range result.Skipped {
+		skipped[i] = errorReply(err)
+	}
+	return mapReply{"executed", result.Executed, "skipped", skipped}, nil
+}
+
+// readCommandFile returns the lines of a command file. The last line needs no
+// trailing newline.
+func readCommandFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n"), nil
+}
+
+// replay parses each line of a command file with the inline parser, so
+// quoting round-trips, and runs it with execute. Comments, lines starting
+// with '#', and blank lines are skipped and not counted as executed. A
+// line that fails stops the replay with an error naming source and the line,
+// unless skipErrors is set, in which case the error is kept in Skipped and
+// the replay carries on.
+func replay(source string, lines []string, execute func(command string, args []string) (any, error), skipErrors bool) (LoadResult, error) {
+	var result LoadResult
+	for i, line := range lines {
+		parsed, err := parser.Options{Comments: true}.Parse(line)
+		if err == nil && parsed.Name == "" {
+			continue
+		}
+		if err == nil {
+			_, err = execute(parsed.Name, parsed.StringArgs())
+		}
+		if err != nil {
+			err = lineError(source, i+1, err)
+			if !skipErrors {
+				return result, err
+			}
+			result.Skipped = append(result.Skipped, err)
+			continue
+		}
+		result.Executed++
+	}
+	return result, nil
+}
+
+// lineError adds source and the line to err, keeping the code of an error
+// meant for a client.
+func lineError(source string, line int, err error) error {
+	var coded *errcode.Error
+	if !errors.As(err, &coded) {
+		return fmt.Errorf("%s, line %d: %w", source, line, err)
+	}
+	reply, _ := errcode.Reply(err)
+	return errcode.Errorf(coded.Code, "%s, line %d: %s", source, line, strings.TrimPrefix(reply, string(coded.Code)+" "))
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"fmt"
+	"kv-store/config"
+	"kv-store/store"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newLoadStore(t *testing.T, dir string, appendOnly bool) *store.Store {
+	t.Helper()
+	cfg := config.New(config.Default())
+	cfg.Set("dir", dir)
+	if appendOnly {
+		cfg.SetAtStartup("appendonly", "yes")
+	}
+	return store.CreateNewStoreWithConfig(store.NewMemoryStorage(16), cfg)
+}
+
+// dataset returns the sorted SET lines of every database, so two stores can
+// be compared as a whole.
+func dataset(s *store.Store) [][]string {
+	databases := make([][]string, s.GetDatabasesCount())
+	for dbIndex := range databases {
+		if compacted, _ := s.Compact(dbIndex); compacted != "" {
+			databases[dbIndex] = strings.Split(compacted, "\n")
+			slices.Sort(databases[dbIndex])
+		}
+	}
+	return databases
+}
+
+func fillAllDatabases(s *store.Store) {
+	for dbIndex := range s.GetDatabasesCount() {
+		s.Set(dbIndex, "db", fmt.Sprint(dbIndex))
+		s.Set(dbIndex, fmt.Sprintf("key:%d", dbIndex), "value")
+	}
+}
+
+func TestLoadData_SnapshotAllDatabases(t *testing.T) {
+	dir := t.TempDir()
+	original := newLoadStore(t, dir, false)
+	fillAllDatabases(original)
+	if err := original.Save(); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+
+	restored := newLoadStore(t, dir, false)
+	if err := LoadData(restored, false); err != nil {
+		t.Fatalf("LoadData() failed: %v", err)
+	}
+
+	if got, expected := dataset(restored), dataset(original); !reflect.DeepEqual(got, expected) {
+		t.Errorf("restored dataset = %v, expected %v", got, expected)
+	}
+}
+
+func TestLoadData_AppendOnlyAllDatabases(t *testing.T) {
+	dir := t.TempDir()
+	original := newLoadStore(t, dir, true)
+	original.EnableAppendOnly(original.Config().Get().AppendOnlyPath())
+	fillAllDatabases(original)
+	original.CloseAppendOnly()
+
+	// A stale snapshot must not be loaded when appendonly is enabled.
+	stale := newLoadStore(t, dir, false)
+	stale.Set(0, "stale", "value")
+	stale.Save()
+
+	restored := newLoadStore(t, dir, true)
+	if err := LoadData(restored, false); err != nil {
+		t.Fatalf("LoadData() failed: %v", err)
+	}
+
+	if got, expected := dataset(restored), dataset(original); !reflect.DeepEqual(got, expected) {
+		t.Errorf("restored dataset = %v, expected %v", got, expected)
+	}
+}
+
+func TestLoadData_MissingFiles(t *testing.T) {
+	for _, appendOnly := range []bool{false, true} {
+		restored := newLoadStore(t, t.TempDir(), appendOnly)
+
+		if err := LoadData(restored, false); err != nil {
+			t.Errorf("LoadData(appendonly=%t) with no files = %v, expected nil", appendOnly, err)
+		}
+		if restored.UsedMemory() != 0 {
+			t.Errorf("expected an empty dataset when there is nothing to load")
+		}
+	}
+}
+
+func TestLoadData_CorruptFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		appendOnly bool
+		file       string
+		content    string
+		loadedKeys []string
+	}{
+		{"corrupt snapshot", false, "dump.kvs", "SELECT 0\nSET name batman\n", nil},
+		{"corrupt append only file", true, "appendonly.aof", "SET name batman\nSET name\nSET other value\n", []string{"name"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			os.WriteFile(filepath.Join(dir, tt.file), []byte(tt.content), 0o644)
+
+			if err := LoadData(newLoadStore(t, dir, tt.appendOnly), false); err == nil {
+				t.Errorf("LoadData() = nil, expected an error for a corrupt file")
+			}
+
+			restored := newLoadStore(t, dir, tt.appendOnly)
+			if err := LoadData(restored, true); err != nil {
+				t.Errorf("LoadData() ignoring errors = %v, expected nil", err)
+			}
+			for _, key := range tt.loadedKeys {
+				if _, ok, _ := restored.Get(0, key); !ok {
+					t.Errorf("expected key %s loaded before the error to be kept", key)
+				}
+			}
+			if _, ok, _ := restored.Get(0, "other"); ok {
+				t.Errorf("expected loading to stop at the corrupt entry")
+			}
+		})
+	}
+}
+
+func TestLoadCommandFile(t *testing.T) {
+	original := store.CreateNewStore(store.NewMemoryStorage(16))
+	original.Set(0, "plain", "value")
+	original.Set(0, "spaced key", "a \"quoted\" value")
+	original.Set(0, "tab", "a\tb")
+	original.Set(0, "empty", "")
+	compacted, _ := original.Compact(0)
+
+	tests := []struct {
+		name       string
+		content    string
+		skipErrors bool
+		executed   int
+		skipped    []string
+		err        string
+	}{
+		{"compact output", compacted, false, 4, nil, ""},
+		{"databases and blank lines", "SET a 1\n\nSELECT 2\nSET b 2", false, 3, nil, ""},
+		{"abort", "SET a 1\nSET b\nSET c 3\n", false, 1, nil, "line 2: wrong number of arguments for SET command"},
+		{"skip", "SET a 1\nSET b\nSET \"c\n", true, 1, []string{"line 2: wrong number of arguments", "line 3: syntax, mismatched quotes at position 4"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "commands.txt")
+			os.WriteFile(path, []byte(tt.content), 0o644)
+			restored := store.CreateNewStore(store.NewMemoryStorage(16))
+
+			result, err := LoadCommandFile(restored, path, tt.skipErrors)
+
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), "ERR "+path+", "+tt.err)) {
+				t.Errorf("LoadCommandFile() = %v, expected %q", err, tt.err)
+			}
+			if result.Executed != tt.executed || len(result.Skipped) != len(tt.skipped) {
+				t.Fatalf("LoadCommandFile() = %+v, expected %d executed and %d skipped", result, tt.executed, len(tt.skipped))
+			}
+			for i, skipped := range tt.skipped {
+				if !strings.Contains(result.Skipped[i].Error(), skipped) {
+					t.Errorf("skipped %v, expected %q", result.Skipped[i], skipped)
+				}
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "compacted.txt")
+	os.WriteFile(path, []byte(compacted), 0o644)
+	restored := store.CreateNewStore(store.NewMemoryStorage(16))
+	LoadCommandFile(restored, path, false)
+	if got, expected := dataset(restored), dataset(original); !reflect.DeepEqual(got, expected) {
+		t.Errorf("loaded dataset = %v, expected %v", got, expected)
+	}
+}
+
+func TestLoadCommandFile_Comments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "commands.txt")
+	os.WriteFile(path, []byte("# Users, edited by hand\n"+
+		"SET user:1 alice\n"+
+		"\n"+
+		"  # bob left\n"+
+		"SET user:2 \"# not a comment\"\n"+
+		" \t \n"+
+		"SELECT 3\n"+
+		"# SET user:3 carol\n"+
+		"SET \\#tag 1\n"), 0o644)
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+
+	result, err := LoadCommandFile(s, path, false)
+	if err != nil || result.Executed != 4 || len(result.Skipped) != 0 {
+		t.Fatalf("LoadCommandFile() = %+v, %v, expected 4 executed", result, err)
+	}
+
+	expected := make([][]string, 16)
+	expected[0] = []string{`SET user:1 alice`, `SET user:2 "# not a comment"`}
+	expected[3] = []string{`SET #tag 1`}
+	if got := dataset(s); !reflect.DeepEqual(got, expected) {
+		t.Errorf("loaded dataset = %q, expected %q", got, expected)
+	}
+}
+
+func TestHandleConnection_Load(t *testing.T) {
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	conn, reader := dialTCP(t, newHandler(s))
+	path := filepath.Join(t.TempDir(), "commands.txt")
+	os.WriteFile(path, []byte("SET a 1\nSET b\nSELECT 4\nSET c 3\n"), 0o644)
+
+	sendCommand(t, conn, reader, "SELECT 2", 1)
+	if got := sendCommand(t, conn, reader, "LOAD "+path, 1)[0]; got != "ERR "+path+", line 2: wrong number of arguments for SET command" {
+		t.Errorf("LOAD = %q, expected the error of line 2", got)
+	}
+	got := sendCommand(t, conn, reader, "LOAD "+path+" SKIPERRORS", 4)
+	expected := []string{"executed", "3", "skipped", "ERR " + path + ", line 2: wrong number of arguments for SET command"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("LOAD SKIPERRORS = %q, expected %q", got, expected)
+	}
+	if got := sendCommand(t, conn, reader, "GET a", 1)[0]; got != "1" {
+		t.Errorf("GET a = %q, expected the file to start in the caller's database", got)
+	}
+	if value, _, _ := s.Get(4, "c"); value != "3" {
+		t.Errorf("c in database 4 = %q, expected 3", value)
+	}
+	for _, command := range []string{"LOAD " + path + " NOW", "LOAD " + path + ".missing", "LOAD"} {
+		if got := sendCommand(t, conn, reader, command, 1)[0]; !strings.HasPrefix(got, "ERR ") {
+			t.Errorf("%s = %q, expected an error", command, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"kv-store/errcode"
+	"kv-store/parser"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitorBufferSize is how many events a monitor may fall behind by before
+// the next ones are dropped for it. Tests shorten it.
+var monitorBufferSize = 1024
+
+type monitor struct {
+	events  chan string
+	dropped atomic.Int64
+}
+
+// monitorRegistry fans the commands clients send out to the connections in
+// MONITOR mode.
+type monitorRegistry struct {
+	mutex    sync.RWMutex
+	monitors map[*monitor]struct{}
+	// count mirrors len(monitors), so feeding costs one atomic load while
+	// nobody is watching.
+	count atomic.Int64
+}
+
+func newMonitorRegistry() *monitorRegistry {
+	return &monitorRegistry{monitors: make(map[*monitor]struct{})}
+}
+
+func (r *monitorRegistry) add() *monitor {
+	m := &monitor{events: make(chan string, monitorBufferSize)}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.monitors[m] = struct{}{}
+	r.count.Add(1)
+	return m
+}
+
+func (r *monitorRegistry) remove(m *monitor) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.monitors, m)
+	r.count.Add(-1)
+}
+
+func (r *monitorRegistry) len() int {
+	return int(r.count.Load())
+}
+
+// feed passes a command to every monitor without waiting on any of them: a
+// monitor whose buffer is full misses the event and is told how many it
+// missed before its next one.
+func (r *monitorRegistry) feed(dbIndex int, addr, command string, args []string) {
+	if r.count.Load() == 0 {
+		return
+	}
+	event := formatMonitorEvent(time.Now(), dbIndex, addr, command, args)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for m := range r.monitors {
+		select {
+		case m.events <- event:
+		default:
+			m.dropped.Add(1)
+		}
+	}
+}
+
+// formatMonitorEvent renders a command as Redis does:
+// 1339518083.107412 [0 127.0.0.1:60866] "SET" "name" "batman"
+func formatMonitorEvent(now time.Time, dbIndex int, addr, command string, args []string) string {
+	quoted := []string{strconv.Quote(command)}
+	for _, arg := range args {
+		quoted = append(quoted, strconv.Quote(arg))
+	}
+	return fmt.Sprintf("%d.%06d [%d %s] %s", now.Unix(), now.Nanosecond()/1000, dbIndex, addr, strings.Join(quoted, " "))
+}
+
+// runMonitor streams events to c until it disconnects or sends QUIT. Any
+// other request is read and ignored.
+func (h *handler) runMonitor(c *client, reader *bufio.Reader, replies *replyWriter) {
+	m := h.monitors.add()
+	defer h.monitors.remove(m)
+	// A monitor only listens, so it is never idle.
+	c.expectCommandWithin(0)
+
+	quit := make(chan bool, 1)
+	go func() {
+		for {
+			r := readRequest(reader, h.store.Config().Get())
+			if r.err != nil && !errors.Is(r.err, parser.ErrProtocol) && errors.As(r.err, new(*errcode.Error)) {
+				continue
+			}
+			if r.err != nil || r.command == "QUIT" {
+				quit <- r.err == nil
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ok := <-quit:
+			if ok {
+				replies.write(ResOk)
+			}
+			return
+		case event := <-m.events:
+			if dropped := m.dropped.Swap(0); dropped > 0 {
+				replies.write(status(strconv.FormatInt(dropped, 10) + " events dropped, the monitor fell behind"))
+			}
+			replies.write(status(event))
+			if len(m.events) == 0 {
+				replies.flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"kv-store/store"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestFormatMonitorEvent(t *testing.T) {
+	now := time.Unix(1339518083, 107412000)
+	expected := `1339518083.107412 [1 127.0.0.1:60866] "SET" "a b" "\x00"`
+	if got := formatMonitorEvent(now, 1, "127.0.0.1:60866", "SET", []string{"a b", "\x00"}); got != expected {
+		t.Errorf("formatMonitorEvent() = %q, expected %q", got, expected)
+	}
+}
+
+func TestMonitorRegistry_Overflow(t *testing.T) {
+	defer func(size int) { monitorBufferSize = size }(monitorBufferSize)
+	monitorBufferSize = 2
+	r := newMonitorRegistry()
+	r.feed(0, "127.0.0.1:5000", "GET", []string{"unwatched"})
+
+	m := r.add()
+	for range 5 {
+		r.feed(0, "127.0.0.1:5000", "GET", []string{"key"})
+	}
+	if len(m.events) != 2 || m.dropped.Load() != 3 {
+		t.Errorf("monitor has %d events and %d dropped, expected 2 and 3", len(m.events), m.dropped.Load())
+	}
+
+	r.remove(m)
+	if got := r.len(); got != 0 {
+		t.Errorf("len() = %d after remove, expected 0", got)
+	}
+}
+
+func TestHandleConnection_Monitor(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	monitorConn, monitorReader := dialTCP(t, h)
+	monitorConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, reader := dialTCP(t, h)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	monitorConn.Write([]byte(respRequest("MONITOR")))
+	if got, _ := monitorReader.ReadString('\n'); got != "+OK\r\n" {
+		t.Fatalf("MONITOR = %q, expected +OK", got)
+	}
+
+	sendCommand(t, conn, reader, "SET name batman", 1)
+	sendCommand(t, conn, reader, "CONFIG SET timeout 0", 1)
+	sendCommand(t, conn, reader, "SELECT 1", 1)
+	sendCommand(t, conn, reader, "GET name", 1)
+	info := sendCommand(t, conn, reader, "INFO clients", 4)
+	if info[3] != "monitors:1" {
+		t.Errorf("INFO clients = %q, expected monitors:1", info)
+	}
+
+	// CONFIG is an admin command, so it is left out.
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`^\+\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "SET" "name" "batman"\r\n$`),
+		regexp.MustCompile(`^\+\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "SELECT" "1"\r\n$`),
+		regexp.MustCompile(`^\+\d+\.\d{6} \[1 127\.0\.0\.1:\d+\] "GET" "name"\r\n$`),
+		regexp.MustCompile(`^\+\d+\.\d{6} \[1 127\.0\.0\.1:\d+\] "INFO" "clients"\r\n$`),
+	}
+	for _, pattern := range expected {
+		event, err := monitorReader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading monitor event: %v", err)
+		}
+		if !pattern.MatchString(event) {
+			t.Errorf("monitor event = %q, expected it to match %s", event, pattern)
+		}
+	}
+
+	monitorConn.Write([]byte(respRequest("GET", "ignored")))
+	monitorConn.Write([]byte(respRequest("QUIT")))
+	if got, _ := monitorReader.ReadString('\n'); got != "+OK\r\n" {
+		t.Fatalf("QUIT = %q, expected +OK", got)
+	}
+	info = sendCommand(t, conn, reader, "INFO clients", 4)
+	if info[3] != "monitors:0" {
+		t.Errorf("INFO clients after QUIT = %q, expected monitors:0", info)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"kv-store/config"
+	"kv-store/store"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// An Option configures the Server New makes. Options check their arguments
+// as New applies them, so a bad address fails New rather than Start.
+type Option func(*options) error
+
+type options struct {
+	listen       listenConfig
+	store        *store.Store
+	logger       *slog.Logger
+	auth         *string
+	numDatabases int
+}
+
+// WithAddress adds TCP addresses to listen on, IPv4 or IPv6, such as
+// "127.0.0.1:8000" or "[::1]:0".
+func WithAddress(addresses ...string) Option {
+	return func(o *options) error {
+		for _, address := range addresses {
+			if _, port, err := net.SplitHostPort(address); err != nil {
+				return fmt.Errorf("invalid address %q: %w", address, err)
+			} else if _, err := net.LookupPort("tcp", port); err != nil {
+				return fmt.Errorf("invalid address %q: %w", address, err)
+			}
+		}
+		o.listen.Addresses = append(o.listen.Addresses, addresses...)
+		return nil
+	}
+}
+
+// WithUnixSocket also accepts connections on a unix socket at path, created
+// with perm.
+func WithUnixSocket(path string, perm os.FileMode) Option {
+	return func(o *options) error {
+		if path == "" {
+			return errors.New("empty unix socket path")
+		}
+		if perm > os.ModePerm {
+			return fmt.Errorf("invalid unix socket permissions %o", perm)
+		}
+		o.listen.UnixSocket, o.listen.UnixSocketPerm = path, perm
+		return nil
+	}
+}
+
+// WithTLS serves the TCP addresses over TLS.
+func WithTLS(tlsConfig *tls.Config) Option {
+	return func(o *options) error {
+		if tlsConfig == nil {
+			return errors.New("nil TLS config")
+		}
+		o.listen.TLS = tlsConfig
+		return nil
+	}
+}
+
+// WithProxyProtocol expects every TCP connection to start with a PROXY
+// protocol header naming the real client, as sent by a load balancer such as
+// HAProxy.
+func WithProxyProtocol() Option {
+	return func(o *options) error {
+		o.listen.ProxyProtocol = true
+		return nil
+	}
+}
+
+// WithDebugAddress serves pprof profiles and expvar variables over HTTP on
+// address, which must be a loopback address.
+func WithDebugAddress(address string) Option {
+	return func(o *options) error {
+		if err := checkDebugAddress(address); err != nil {
+			return err
+		}
+		o.listen.DebugAddress = address
+		return nil
+	}
+}
+
+// WithReplicaOf starts the server as a replica of the leader at the
+// "host:port" address, as REPLICAOF does.
+func WithReplicaOf(address string) Option {
+	return func(o *options) error {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("invalid replicaof %q, expected host:port", address)
+		}
+		o.listen.ReplicaOf = address
+		return nil
+	}
+}
+
+// WithStore serves s. Without it, New makes an empty in-memory store.
+func WithStore(s *store.Store) Option {
+	return func(o *options) error {
+		if s == nil {
+			return errors.New("nil store")
+		}
+		o.store = s
+		return nil
+	}
+}
+
+// WithLogger sends the log records of the server and its store to logger
+// instead of the default logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) error {
+		if logger == nil {
+			return errors.New("nil logger")
+		}
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithAuth requires clients to AUTH with password, as requirepass does.
+func WithAuth(password string) Option {
+	return func(o *options) error {
+		o.auth = &password
+		return nil
+	}
+}
+
+// WithNumDatabases sets the number of databases of the store New makes. A
+// store passed WithStore already has its own.
+func WithNumDatabases(n int) Option {
+	return func(o *options) error {
+		if n < 1 || n > config.MaxDatabases {
+			return fmt.Errorf("invalid number of databases %d, expected between 1 and %d", n, config.MaxDatabases)
+		}
+		o.numDatabases = n
+		return nil
+	}
+}
+
+// New makes a Server configured by options. It does not listen until Start.
+func New(opts ...Option) (*Server, error) {
+	var o options
+	for _, option := range opts {
+		if err := option(&o); err != nil {
+			return nil, err
+		}
+	}
+	if o.store == nil {
+		numDatabases := o.numDatabases
+		if numDatabases == 0 {
+			numDatabases = config.Default().Databases
+		}
+		o.store = store.CreateNewStore(store.NewMemoryStorage(numDatabases))
+	} else if o.numDatabases != 0 {
+		return nil, errors.New("WithNumDatabases cannot be used with WithStore")
+	}
+	if o.auth != nil {
+		if err := o.store.Config().SetAtStartup("requirepass", *o.auth); err != nil {
+			return nil, err
+		}
+	}
+	if o.logger != nil {
+		o.store.SetLogger(o.logger)
+	}
+	return newServer(o.listen, newHandler(o.store)), nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"kv-store/config"
+	"kv-store/store"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustNew(t testing.TB, options ...Option) *Server {
+	t.Helper()
+	s, err := New(options...)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	return s
+}
+
+func TestNew_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{"address without port", []Option{WithAddress("127.0.0.1")}},
+		{"address with bad port", []Option{WithAddress("127.0.0.1:99999")}},
+		{"one bad address of several", []Option{WithAddress("127.0.0.1:0", "localhost:port")}},
+		{"empty unix socket", []Option{WithUnixSocket("", 0o700)}},
+		{"unix socket permissions", []Option{WithUnixSocket("/tmp/kv.sock", 0o1777)}},
+		{"nil TLS config", []Option{WithTLS(nil)}},
+		{"debug address not loopback", []Option{WithDebugAddress("0.0.0.0:6060")}},
+		{"replicaof without port", []Option{WithReplicaOf("leader")}},
+		{"nil store", []Option{WithStore(nil)}},
+		{"nil logger", []Option{WithLogger(nil)}},
+		{"no databases", []Option{WithNumDatabases(0)}},
+		{"too many databases", []Option{WithNumDatabases(config.MaxDatabases + 1)}},
+		{"databases of a given store", []Option{WithStore(store.CreateNewStore(store.NewMemoryStorage(16))), WithNumDatabases(4)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if s, err := New(tt.options...); err == nil {
+				t.Errorf("New() = %v, expected an error", s)
+			}
+		})
+	}
+}
+
+func TestNew_Options(t *testing.T) {
+	var logs strings.Builder
+	s := mustNew(t,
+		WithAddress("127.0.0.1:0"),
+		WithAuth("secret"),
+		WithNumDatabases(4),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithTLS(&tls.Config{}),
+		WithProxyProtocol(),
+		WithReplicaOf("127.0.0.1:1"),
+	)
+
+	if got := s.handler.store.GetDatabasesCount(); got != 4 {
+		t.Errorf("databases = %d, expected 4", got)
+	}
+	if got := s.handler.store.Config().Get().RequirePass; got != "secret" {
+		t.Errorf("requirepass = %q, expected secret", got)
+	}
+	if s.listen.TLS == nil || !s.listen.ProxyProtocol || s.listen.ReplicaOf != "127.0.0.1:1" {
+		t.Errorf("listen = %+v, expected TLS, the PROXY protocol and a leader", s.listen)
+	}
+	s.handler.store.Logger().Info("hello")
+	if !strings.Contains(logs.String(), "hello") {
+		t.Errorf("expected the store to log to the given logger, got %q", logs.String())
+	}
+}
+
+func TestNew_Auth(t *testing.T) {
+	s := mustNew(t, WithAddress("127.0.0.1:0"), WithAuth("secret"))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer s.Stop(context.Background())
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if got := sendCommand(t, conn, reader, "GET name", 1)[0]; !strings.HasPrefix(got, "NOAUTH") {
+		t.Errorf("GET before AUTH = %q, expected NOAUTH", got)
+	}
+	if got := sendCommand(t, conn, reader, "AUTH secret", 1)[0]; got != "OK" {
+		t.Errorf("AUTH = %q, expected OK", got)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+type pauseState struct {
+	mutex      sync.Mutex
+	until      time.Time
+	writesOnly bool
+	changed    chan struct{}
+}
+
+func newPauseState() *pauseState {
+	return &pauseState{
+		changed: make(chan struct{}),
+	}
+}
+
+func (p *pauseState) pause(timeout time.Duration, writesOnly bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.until = time.Now().Add(timeout)
+	p.writesOnly = writesOnly
+	p.notify()
+}
+
+func (p *pauseState) unpause() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.until = time.Time{}
+	p.notify()
+}
+
+func (p *pauseState) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// paused reports whether a command of the given kind would have to wait.
+func (p *pauseState) paused(write bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return time.Until(p.until) > 0 && (!p.writesOnly || write)
+}
+
+// wait blocks until the server is no longer paused for a command of the given
+// kind, either because the pause timed out or because it was lifted.
+func (p *pauseState) wait(write bool) {
+	for {
+		p.mutex.Lock()
+		remaining := time.Until(p.until)
+		if remaining <= 0 || (p.writesOnly && !write) {
+			p.mutex.Unlock()
+			return
+		}
+		changed := p.changed
+		p.mutex.Unlock()
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a client behind a load balancer may
+// take to send its PROXY header, shortened by tests.
+var proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every binary PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Length is the longest PROXY v1 line the protocol allows,
+// including its CRLF.
+const maxProxyV1Length = 107
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyListener hands out connections that start with a PROXY protocol
+// header. The header is read by readProxyHeader in the connection's own
+// goroutine, so a slow client does not hold up the accept loop.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reports the client address from the PROXY header as its
+// RemoteAddr, and reads what follows the header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads the PROXY header of a connection accepted by a
+// proxyListener, under TLS or not, and does nothing for other connections.
+// A header that is malformed or not sent within proxyHeaderTimeout is an
+// error.
+func readProxyHeader(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	c, ok := conn.(*proxyConn)
+	if !ok {
+		return nil
+	}
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	switch first[0] {
+	case 'P':
+		c.remote, err = readProxyV1(c.reader)
+	case proxyV2Signature[0]:
+		c.remote, err = readProxyV2(c.reader)
+	default:
+		err = errProxyHeader
+	}
+	return err
+}
+
+// readProxyV1 reads a text header such as "PROXY TCP4 192.0.2.1 192.0.2.2
+// 56324 6379\r\n". It returns a nil address for PROXY UNKNOWN, which leaves
+// the connection's own address in place.
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Length {
+			return nil, errProxyHeader
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header. It returns a nil address for a LOCAL
+// command, such as a load balancer's health check, and for address families
+// other than TCP over IPv4 or IPv6.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, errProxyHeader
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", errProxyHeader, versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("%w: command %d", errProxyHeader, versionCommand&0xf)
+	}
+
+	var ipLength int
+	switch family >> 4 {
+	case 1:
+		ipLength = net.IPv4len
+	case 2:
+		ipLength = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*ipLength+4 {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(payload[:ipLength]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLength:])),
+	}, nil
+}
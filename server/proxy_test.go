@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(command, family byte, payload []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return string(append(header, payload...))
+}
+
+func proxyV2Payload(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	payload := append(append([]byte{}, src...), dst...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	return binary.BigEndian.AppendUint16(payload, dstPort)
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	defer func(timeout time.Duration) { proxyHeaderTimeout = timeout }(proxyHeaderTimeout)
+	proxyHeaderTimeout = 200 * time.Millisecond
+
+	s := mustNew(t, WithAddress("127.0.0.1:0"), WithProxyProtocol())
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer s.Stop(context.Background())
+
+	testCases := []struct {
+		name   string
+		header string
+		addr   string // empty when the connection is rejected
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 8000\r\n", "192.0.2.1:56324"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 8000\r\n", "[2001:db8::1]:56324"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "127.0.0.1:"},
+		{"v2 IPv4", proxyV2Header(1, 0x11, proxyV2Payload(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 56324, 8000)), "192.0.2.1:56324"},
+		{"v2 IPv6", proxyV2Header(1, 0x21, proxyV2Payload(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 8000)), "[2001:db8::1]:56324"},
+		{"v2 LOCAL", proxyV2Header(0, 0, nil), "127.0.0.1:"},
+		{"v1 mismatched family", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 8000\r\n", ""},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 99999 8000\r\n", ""},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", maxProxyV1Length) + "\r\n", ""},
+		{"v2 short addresses", proxyV2Header(1, 0x11, []byte{192, 0, 2, 1}), ""},
+		{"v2 unknown command", proxyV2Header(2, 0x11, proxyV2Payload(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 1, 2)), ""},
+		{"no header", "", ""},
+		{"command instead of a header", "PING\r\n", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() failed: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if tc.header != "" && tc.addr == "" {
+				conn.Write([]byte(tc.header))
+			} else if tc.header != "" {
+				conn.Write([]byte(tc.header + "SET name batman\r\nCLIENT INFO\r\n"))
+			}
+			reader := bufio.NewReader(conn)
+
+			if tc.addr == "" {
+				// Closed, with a reset when part of the header went unread.
+				if reply, err := reader.ReadString('\n'); err == nil {
+					t.Errorf("reply %q, expected the connection to be closed", reply)
+				}
+				return
+			}
+			if reply, _ := reader.ReadString('\n'); reply != "OK\r\n" {
+				t.Fatalf("SET after the header = %q, expected OK", reply)
+			}
+			info, _ := reader.ReadString('\n')
+			i := slices.IndexFunc(strings.Fields(info), func(field string) bool {
+				return strings.HasPrefix(field, "addr="+tc.addr)
+			})
+			if i < 0 {
+				t.Errorf("CLIENT INFO = %q, expected addr=%s", info, tc.addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"kv-store/config"
+	"kv-store/errcode"
+	"kv-store/glob"
+	"kv-store/parser"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrSubscriberMode = func(commandName string) error {
+	return errcode.Errorf(errcode.Err, "Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(commandName))
+}
+
+// subscriberCommands can be sent in subscriber mode, besides QUIT.
+var subscriberCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+}
+
+// subscriberBufferSize is how many messages a subscriber may fall behind by
+// before it is disconnected. Tests shorten it.
+var subscriberBufferSize = 1024
+
+type subscriber struct {
+	client   *client
+	messages chan pushReply
+	// overflowed is set when a message found the buffer full. The client is
+	// disconnected then, as it can no longer be sent every message.
+	overflowed atomic.Bool
+	// channels and patterns are only used by the subscriber's own
+	// connection.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// subscriptions counts the channels and patterns s is subscribed to.
+func (s *subscriber) subscriptions() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// writeQueued writes the messages waiting for the subscriber.
+func (s *subscriber) writeQueued(replies *replyWriter) {
+	for len(s.messages) > 0 {
+		replies.write(<-s.messages)
+	}
+}
+
+// pubsubRegistry holds the subscribers of each channel and pattern.
+// Publishing never waits on a subscriber.
+type pubsubRegistry struct {
+	mutex    sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+func newPubsubRegistry() *pubsubRegistry {
+	return &pubsubRegistry{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+func (r *pubsubRegistry) subscribe(s *subscriber, channel string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	addSubscriber(r.channels, channel, s)
+	s.channels[channel] = struct{}{}
+}
+
+func (r *pubsubRegistry) unsubscribe(s *subscriber, channel string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	removeSubscriber(r.channels, channel, s)
+	delete(s.channels, channel)
+}
+
+func (r *pubsubRegistry) psubscribe(s *subscriber, pattern string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	addSubscriber(r.patterns, pattern, s)
+	s.patterns[pattern] = struct{}{}
+}
+
+func (r *pubsubRegistry) punsubscribe(s *subscriber, pattern string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	removeSubscriber(r.patterns, pattern, s)
+	delete(s.patterns, pattern)
+}
+
+func addSubscriber(index map[string]map[*subscriber]struct{}, name string, s *subscriber) {
+	if index[name] == nil {
+		index[name] = make(map[*subscriber]struct{})
+	}
+	index[name][s] = struct{}{}
+}
+
+func removeSubscriber(index map[string]map[*subscriber]struct{}, name string, s *subscriber) {
+	delete(index[name], s)
+	if len(index[name]) == 0 {
+		delete(index, name)
+	}
+}
+
+// publish queues message for every subscriber of channel, and for every
+// subscriber of each pattern channel matches, and returns how many
+// deliveries it made. A client subscribed both ways gets the message once
+// for each, as in Redis. A subscriber whose buffer is full is disconnected
+// instead.
+func (r *pubsubRegistry) publish(channel, message string) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	receivers := 0
+	for s := range r.channels[channel] {
+		if s.deliver(pushReply{"message", channel, message}) {
+			receivers++
+		}
+	}
+	for pattern, subscribers := range r.patterns {
+		if !glob.Match(pattern, channel) {
+			continue
+		}
+		for s := range subscribers {
+			if s.deliver(pushReply{"pmessage", pattern, channel, message}) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+func (s *subscriber) deliver(message pushReply) bool {
+	select {
+	case s.messages <- message:
+		return true
+	default:
+		if !s.overflowed.Swap(true) {
+			s.client.conn.Close()
+		}
+		return false
+	}
+}
+
+func (r *pubsubRegistry) numChannels() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.channels)
+}
+
+// activeChannels returns the channels with subscribers, sorted, keeping
+// those matching pattern when it is not empty.
+func (r *pubsubRegistry) activeChannels(pattern string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	channels := []string{}
+	for channel := range r.channels {
+		if pattern == "" || glob.Match(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// numSub returns the channels with their numbers of subscribers, counted
+// together so they describe one moment.
+func (r *pubsubRegistry) numSub(channels []string) mapReply {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	reply := make(mapReply, 0, 2*len(channels))
+	for _, channel := range channels {
+		reply = append(reply, channel, len(r.channels[channel]))
+	}
+	return reply
+}
+
+func (r *pubsubRegistry) numPatterns() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.patterns)
+}
+
+var pubsubHelp = []string{
+	"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"CHANNELS [<pattern>]",
+	"    Return the currently active channels matching a <pattern> (default: '*').",
+	"NUMPAT",
+	"    Return number of subscriptions to patterns.",
+	"NUMSUB [<channel> ...]",
+	"    Return the number of subscribers for the specified channels, excluding",
+	"    pattern subscriptions (default: no channels).",
+	"HELP",
+	"    Print this help.",
+}
+
+func (h *handler) handlePubsub(args []string) (any, error) {
+	if len(args) < 1 {
+		return nil, ErrWrongNumberOfArgs("PUBSUB")
+	}
+	subcommand := strings.ToUpper(args[0])
+	switch {
+	case subcommand == "CHANNELS" && len(args) <= 2:
+		pattern := ""
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+		return h.pubsub.activeChannels(pattern), nil
+	case subcommand == "NUMSUB":
+		return h.pubsub.numSub(args[1:]), nil
+	case subcommand == "NUMPAT" && len(args) == 1:
+		return h.pubsub.numPatterns(), nil
+	case subcommand == "HELP" && len(args) == 1:
+		return pubsubHelp, nil
+	default:
+		return nil, ErrUnknownSubcommand("PUBSUB", args[0])
+	}
+}
+
+func (h *handler) handlePublish(args []string) (any, error) {
+	if len(args) != 2 {
+		return nil, ErrWrongNumberOfArgs("PUBLISH")
+	}
+	return h.pubsub.publish(args[0], args[1]), nil
+}
+
+// request is a command read from a client outside the main loop of
+// handleConnection.
+type request struct {
+	command string
+	args    []string
+	resp    bool
+	err     error
+}
+
+func readRequest(reader *bufio.Reader, settings config.Settings) request {
+	commands := parser.NewReader(reader)
+	configureReader(commands, settings)
+	parsed, err := commands.ReadCommand()
+	return request{command: parsed.Name, args: parsed.StringArgs(), resp: commands.RESP(), err: err}
+}
+
+// runSubscriber runs one of the subscribe or unsubscribe commands and, while the client has
+// subscriptions, serves it in subscriber mode, interleaving the messages it
+// receives with the replies to its requests. It returns false when the
+// connection is to be closed, and true once the client has unsubscribed from
+// every channel and pattern and is back to normal mode.
+func (h *handler) runSubscriber(c *client, reader *bufio.Reader, replies *replyWriter, command string, args []string) bool {
+	s := &subscriber{
+		client:   c,
+		messages: make(chan pushReply, subscriberBufferSize),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+	defer func() {
+		for channel := range s.channels {
+			h.pubsub.unsubscribe(s, channel)
+		}
+		for pattern := range s.patterns {
+			h.pubsub.punsubscribe(s, pattern)
+		}
+	}()
+	h.subscriberCommand(s, replies, command, args)
+	if s.subscriptions() == 0 {
+		return true
+	}
+	// A subscriber waits on messages, so it is never idle.
+	c.expectCommandWithin(0)
+
+	// Requests are read one at a time, on demand, so none is left half read
+	// when the client goes back to normal mode.
+	next := make(chan struct{})
+	requests := make(chan request)
+	defer close(next)
+	go func() {
+		for range next {
+			requests <- readRequest(reader, h.store.Config().Get())
+		}
+	}()
+	next <- struct{}{}
+
+	for {
+		replies.flush()
+		select {
+		case message := <-s.messages:
+			replies.write(message)
+			s.writeQueued(replies)
+		case r := <-requests:
+			c.touch()
+			replies.resp = r.resp
+			s.writeQueued(replies)
+			if errors.Is(r.err, parser.ErrProtocol) {
+				replies.write(r.err)
+				return false
+			} else if errors.As(r.err, new(*errcode.Error)) {
+				replies.write(r.err)
+			} else if r.err != nil {
+				if s.overflowed.Load() {
+					h.store.Logger().Info("Disconnected subscriber that fell behind", "client", c.id)
+				}
+				return false
+			} else if r.command == "QUIT" {
+				replies.write(ResOk)
+				return false
+			} else if r.command != "" {
+				if err := h.checkSubscriberCommand(s.client, r.command, r.args); err != nil {
+					replies.write(err)
+				} else {
+					h.monitors.feed(h.store.GetClientDBIndex(c.id), c.addr, r.command, r.args)
+					h.subscriberCommand(s, replies, r.command, r.args)
+				}
+			}
+			if s.subscriptions() == 0 {
+				// Messages published before the last UNSUBSCRIBE are
+				// still delivered.
+				s.writeQueued(replies)
+				return true
+			}
+			next <- struct{}{}
+		}
+	}
+}
+
+// checkSubscriberCommand returns why command cannot run in subscriber mode,
+// if it cannot.
+func (h *handler) checkSubscriberCommand(c *client, command string, args []string) error {
+	if !subscriberCommands[command] {
+		return ErrSubscriberMode(command)
+	}
+	if err := commandTable[command].checkArity(args); err != nil {
+		return err
+	}
+	username, _ := c.user()
+	return h.users.checkPermissions(username, command, nil, false)
+}
+
+// subscriberCommand runs a command allowed in subscriber mode, once checked.
+func (h *handler) subscriberCommand(s *subscriber, replies *replyWriter, command string, args []string) {
+	switch command {
+	case "SUBSCRIBE":
+		for _, channel := range args {
+			h.pubsub.subscribe(s, channel)
+			replies.write(pushReply{"subscribe", channel, s.subscriptions()})
+		}
+	case "PSUBSCRIBE":
+		for _, pattern := range args {
+			h.pubsub.psubscribe(s, pattern)
+			replies.write(pushReply{"psubscribe", pattern, s.subscriptions()})
+		}
+	case "UNSUBSCRIBE":
+		channels := orAll(args, s.channels)
+		if len(channels) == 0 {
+			replies.write(pushReply{"unsubscribe", nil, s.subscriptions()})
+		}
+		for _, channel := range channels {
+			h.pubsub.unsubscribe(s, channel)
+			replies.write(pushReply{"unsubscribe", channel, s.subscriptions()})
+		}
+	case "PUNSUBSCRIBE":
+		patterns := orAll(args, s.patterns)
+		if len(patterns) == 0 {
+			replies.write(pushReply{"punsubscribe", nil, s.subscriptions()})
+		}
+		for _, pattern := range patterns {
+			h.pubsub.punsubscribe(s, pattern)
+			replies.write(pushReply{"punsubscribe", pattern, s.subscriptions()})
+		}
+	case "PING":
+		// RESP3 clients can tell replies from messages, so they get the
+		// usual reply.
+		message := ""
+		if len(args) == 1 {
+			message = args[0]
+		}
+		switch {
+		case replies.protocol != 3:
+			replies.write(pushReply{"pong", message})
+		case len(args) == 1:
+			replies.write(message)
+		default:
+			replies.write(ResPong)
+		}
+	}
+}
+
+// orAll returns names, or every subscription in all, sorted, when names is
+// empty, which is what an unsubscribe without arguments applies to.
+func orAll(names []string, all map[string]struct{}) []string {
+	if len(names) > 0 {
+		return names
+	}
+	names = make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bufio"
+	"kv-store/store"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandleConnection_PubSub(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	subscriberConn, subscriberReader := dialTCP(t, h)
+	subscriberConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, reader := dialTCP(t, h)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	subscribe := func(request, expected string) {
+		t.Helper()
+		subscriberConn.Write([]byte(request))
+		var reply string
+		for len(reply) < len(expected) {
+			reply += readRESPReply(t, subscriberReader)
+		}
+		if reply != expected {
+			t.Errorf("reply to %q = %q, expected %q", request, reply, expected)
+		}
+	}
+
+	subscribe(respRequest("UNSUBSCRIBE"), "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n")
+	subscribe(respRequest("SUBSCRIBE", "news", "sports"),
+		"*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$6\r\nsports\r\n:2\r\n")
+
+	if got := sendCommand(t, conn, reader, "PUBLISH news hello", 1); got[0] != "1" {
+		t.Errorf("PUBLISH news = %q, expected 1", got[0])
+	}
+	if got := sendCommand(t, conn, reader, "PUBLISH weather rain", 1); got[0] != "0" {
+		t.Errorf("PUBLISH weather = %q, expected 0", got[0])
+	}
+	if got := readRESPReply(t, subscriberReader); got != "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n" {
+		t.Errorf("message = %q", got)
+	}
+
+	subscribe(respRequest("GET", "name"), "-"+ErrSubscriberMode("GET").Error()+"\r\n")
+	subscribe(respRequest("PING"), "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+	subscribe(respRequest("UNSUBSCRIBE", "news"), "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	if got := sendCommand(t, conn, reader, "PUBLISH news ignored", 1); got[0] != "0" {
+		t.Errorf("PUBLISH news after UNSUBSCRIBE = %q, expected 0", got[0])
+	}
+	subscribe(respRequest("UNSUBSCRIBE"), "*3\r\n$11\r\nunsubscribe\r\n$6\r\nsports\r\n:0\r\n")
+
+	// With no subscriptions left, the connection is back to normal.
+	subscribe(respRequest("SET", "name", "batman"), "+OK\r\n")
+	if channels := h.pubsub.numChannels(); channels != 0 {
+		t.Errorf("numChannels() = %d, expected 0", channels)
+	}
+}
+
+func TestHandleConnection_PatternSubscriptions(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	subscriberConn, subscriberReader := dialTCP(t, h)
+	subscriberConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, reader := dialTCP(t, h)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	subscriberConn.Write([]byte(respRequest("SUBSCRIBE", "news.tech") + respRequest("PSUBSCRIBE", "news.*")))
+	for _, expected := range []string{
+		"*3\r\n$9\r\nsubscribe\r\n$9\r\nnews.tech\r\n:1\r\n",
+		"*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:2\r\n",
+	} {
+		if got := readRESPReply(t, subscriberReader); got != expected {
+			t.Errorf("subscribe reply = %q, expected %q", got, expected)
+		}
+	}
+
+	testCases := []struct {
+		publish  string
+		receives int
+		expected []string
+	}{
+		{"PUBLISH news.tech hi", 2, []string{
+			"*3\r\n$7\r\nmessage\r\n$9\r\nnews.tech\r\n$2\r\nhi\r\n",
+			"*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$9\r\nnews.tech\r\n$2\r\nhi\r\n",
+		}},
+		{"PUBLISH news.art hi", 1, []string{
+			"*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$8\r\nnews.art\r\n$2\r\nhi\r\n",
+		}},
+		{"PUBLISH sports hi", 0, nil},
+	}
+	for _, tc := range testCases {
+		if got := sendCommand(t, conn, reader, tc.publish, 1); got[0] != strconv.Itoa(tc.receives) {
+			t.Errorf("%s = %q, expected %d", tc.publish, got[0], tc.receives)
+		}
+		for _, expected := range tc.expected {
+			if got := readRESPReply(t, subscriberReader); got != expected {
+				t.Errorf("message after %s = %q, expected %q", tc.publish, got, expected)
+			}
+		}
+	}
+
+	// Dropping the pattern leaves the channel subscription alone.
+	subscriberConn.Write([]byte(respRequest("PUNSUBSCRIBE")))
+	if got, expected := readRESPReply(t, subscriberReader), "*3\r\n$12\r\npunsubscribe\r\n$6\r\nnews.*\r\n:1\r\n"; got != expected {
+		t.Errorf("PUNSUBSCRIBE = %q, expected %q", got, expected)
+	}
+	if got := sendCommand(t, conn, reader, "PUBLISH news.tech again", 1); got[0] != "1" {
+		t.Errorf("PUBLISH news.tech after PUNSUBSCRIBE = %q, expected 1", got[0])
+	}
+	if got, expected := readRESPReply(t, subscriberReader), "*3\r\n$7\r\nmessage\r\n$9\r\nnews.tech\r\n$5\r\nagain\r\n"; got != expected {
+		t.Errorf("message after PUNSUBSCRIBE = %q, expected %q", got, expected)
+	}
+}
+
+func TestHandleConnection_SlowSubscriber(t *testing.T) {
+	defer func(size int) { subscriberBufferSize = size }(subscriberBufferSize)
+	subscriberBufferSize = 2
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	clientConn, serverConn := net.Pipe()
+	go h.handleConnection(serverConn)
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(clientConn)
+	sendCommand(t, clientConn, reader, "SUBSCRIBE news", 3)
+
+	// The client reads nothing more, so the handler blocks writing the
+	// first message and the following ones fill the buffer.
+	overflowed := false
+	for range 10 {
+		if h.pubsub.publish("news", "hello") == 0 {
+			overflowed = true
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !overflowed {
+		t.Fatal("expected a publish to find the subscriber's buffer full")
+	}
+	for {
+		if _, err := reader.ReadString('\n'); err != nil {
+			break
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.pubsub.numChannels() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the slow subscriber was not unsubscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleConnection_Pubsub(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	for _, subscription := range []string{"SUBSCRIBE news.tech news.art", "SUBSCRIBE news.tech", "PSUBSCRIBE sports.*"} {
+		conn, reader := dialTCP(t, h)
+		sendCommand(t, conn, reader, subscription, 3*len(strings.Fields(subscription)[1:]))
+	}
+	conn, reader := dialTCP(t, h)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	testCases := []struct {
+		command  string
+		expected []string
+	}{
+		{"PUBSUB CHANNELS", []string{"news.art", "news.tech"}},
+		{"PUBSUB CHANNELS *tech", []string{"news.tech"}},
+		{"PUBSUB NUMSUB news.tech news.art sports.tennis", []string{"news.tech", "2", "news.art", "1", "sports.tennis", "0"}},
+		{"PUBSUB NUMPAT", []string{"1"}},
+		{"PUBSUB NUMPAT extra", []string{ErrUnknownSubcommand("PUBSUB", "NUMPAT").Error()}},
+	}
+	for _, tc := range testCases {
+		if got := sendCommand(t, conn, reader, tc.command, len(tc.expected)); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s = %q, expected %q", tc.command, got, tc.expected)
+		}
+	}
+}
+
+func TestPubsubRegistry_Concurrent(t *testing.T) {
+	r := newPubsubRegistry()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &subscriber{
+				client:   &client{},
+				messages: make(chan pushReply, 1),
+				channels: make(map[string]struct{}),
+				patterns: make(map[string]struct{}),
+			}
+			for range 100 {
+				r.subscribe(s, "news")
+				r.psubscribe(s, "news.*")
+				r.unsubscribe(s, "news")
+				r.punsubscribe(s, "news.*")
+			}
+		}()
+	}
+	for range 100 {
+		numSub := r.numSub([]string{"news"})
+		if count := numSub[1].(int); count < 0 || count > 4 {
+			t.Fatalf("numSub(news) = %d, expected 0 to 4", count)
+		}
+		r.activeChannels("")
+		r.numPatterns()
+	}
+	wg.Wait()
+
+	if channels := r.activeChannels(""); len(channels) != 0 || r.numPatterns() != 0 {
+		t.Errorf("activeChannels() = %q and numPatterns() = %d once everyone left, expected none", channels, r.numPatterns())
+	}
+}
+
+func TestHandleConnection_KeyspaceNotifications(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	subscriberConn, subscriberReader := dialTCP(t, h)
+	subscriberConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, reader := dialTCP(t, h)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	sendCommand(t, conn, reader, "CONFIG SET notify-keyspace-events KEA", 1)
+	sendCommand(t, subscriberConn, subscriberReader, "SUBSCRIBE __keyspace@0__:name __keyevent@0__:del", 6)
+	sendCommand(t, conn, reader, "SET name batman", 1)
+	sendCommand(t, conn, reader, "DEL name", 1)
+
+	expected := []string{
+		"message", "__keyspace@0__:name", "set",
+		"message", "__keyspace@0__:name", "del",
+		"message", "__keyevent@0__:del", "name",
+	}
+	var got []string
+	for range expected {
+		line, err := subscriberReader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading notifications: %v", err)
+		}
+		got = append(got, strings.TrimSuffix(line, "\r\n"))
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("notifications = %q, expected %q", got, expected)
+	}
+}
@@ -0,0 +1,786 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"kv-store/config"
+	"kv-store/errcode"
+	"kv-store/parser"
+	"kv-store/store"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrReadOnlyReplica   = errcode.New(errcode.ReadOnly, "You can't write against a read only replica.")
+	ErrInvalidLeaderPort = errcode.New(errcode.Err, "Invalid master port")
+)
+
+// replicationRetryDelay is how long a replica waits before reconnecting to
+// its leader. Tests shorten it.
+var replicationRetryDelay = time.Second
+
+// replicationAckInterval is how often a replica tells its leader the offset
+// it reached. Tests shorten it.
+var replicationAckInterval = time.Second
+
+const replicationDialTimeout = 5 * time.Second
+
+// replicationClientId is the client a replica applies its leader's writes
+// as. Real clients count up from 1, and 0 replays the append only file.
+const replicationClientId = -1
+
+// replica is a connection that sent SYNC, as seen by its leader.
+type replica struct {
+	client *client
+	// ip and port are where the replica listens, as far as the leader
+	// knows, for ROLE and INFO.
+	ip   string
+	port string
+	// ackOffset is the offset the replica last said it reached.
+	ackOffset atomic.Int64
+	// wake is signalled when writes are queued.
+	wake chan struct{}
+
+	mutex        sync.Mutex
+	pending      [][]byte
+	pendingBytes int64
+	// overflowed is set when the writes waiting for the replica went past
+	// replica-buffer-limit. The replica is disconnected then, and has to
+	// sync again from scratch.
+	overflowed atomic.Bool
+}
+
+// queue buffers part of the stream until the replica's connection takes it,
+// or disconnects the replica if that would take its buffer past limit bytes.
+// A limit of 0 means no limit.
+func (rep *replica) queue(stream []byte, limit int64) {
+	if rep.overflowed.Load() {
+		return
+	}
+	rep.mutex.Lock()
+	rep.pending = append(rep.pending, stream)
+	rep.pendingBytes += int64(len(stream))
+	overflowed := limit > 0 && rep.pendingBytes > limit
+	if overflowed {
+		rep.pending, rep.pendingBytes = nil, 0
+	}
+	rep.mutex.Unlock()
+
+	if overflowed {
+		rep.overflowed.Store(true)
+		rep.client.conn.Close()
+		return
+	}
+	select {
+	case rep.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the stream waiting for the replica and empties its buffer.
+func (rep *replica) take() [][]byte {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	pending := rep.pending
+	rep.pending, rep.pendingBytes = nil, 0
+	return pending
+}
+
+// replication holds both sides of the server's role: the replicas it feeds
+// and, while it is a replica itself, the link to its leader. A replica can
+// have replicas of its own, which get the writes it applies.
+//
+// The writes go out as one stream of RESP commands, the same bytes for every
+// replica, named by replId. The offset of a byte is how many came before
+// it, and the backlog keeps the latest ones, so a replica that reconnects
+// with the offset it reached can continue from there.
+type replication struct {
+	store  *store.Store
+	replId string
+
+	replicasMutex sync.Mutex
+	replicas      map[*replica]struct{}
+	// backlog is created by the first full sync, and the stream only
+	// counts from then.
+	backlog *replicationBacklog
+	// streamDB is the database the stream last selected, or -1 when the next
+	// write has to select one.
+	streamDB int
+
+	// Syncs served, for INFO.
+	fullSyncs         atomic.Int64
+	partialSyncs      atomic.Int64
+	partialSyncErrors atomic.Int64
+
+	// roleMutex is held for reading by client writes and for writing while
+	// the role changes, so no client write lands once the server has become
+	// a read only replica.
+	roleMutex sync.RWMutex
+	linkMutex sync.Mutex
+	link      *replicationLink
+	// listeningPort returns the port a replica tells its leader, if known.
+	listeningPort func() string
+
+	failoverMutex sync.Mutex
+	failover      *failover
+}
+
+// replicationLink is a replica's connection to its leader, reopened until
+// it is stopped.
+type replicationLink struct {
+	address string
+	up      atomic.Bool
+	done    chan struct{}
+	stopped chan struct{}
+	// replId and offset say where in the leader's stream the replica is,
+	// once a full sync set them. Only the link's goroutine writes them.
+	replId string
+	offset atomic.Int64
+	// failover is set on the link a FAILOVER hands over on, until its PSYNC
+	// has told the new leader to promote itself.
+	failover bool
+	// ackNow is signalled when the leader asks for the offset.
+	ackNow chan struct{}
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func newReplication(store *store.Store) *replication {
+	return &replication{
+		store:         store,
+		replId:        newReplId(),
+		replicas:      make(map[*replica]struct{}),
+		streamDB:      -1,
+		listeningPort: func() string { return "" },
+	}
+}
+
+// newReplId returns 40 random hex characters, as Redis names its streams.
+func newReplId() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// propagate is the store's write feed. Writes are added to the stream and
+// queued for every replica without waiting on any.
+func (r *replication) propagate(dbIndex int, commands [][]string) {
+	r.replicasMutex.Lock()
+	defer r.replicasMutex.Unlock()
+	if r.backlog == nil {
+		return
+	}
+	var stream []byte
+	if dbIndex != r.streamDB {
+		stream = appendRESPCommand(stream, "SELECT", strconv.Itoa(dbIndex))
+		r.streamDB = dbIndex
+	}
+	for _, args := range commands {
+		stream = appendRESPCommand(stream, args...)
+	}
+	settings := r.store.Config().Get()
+	r.backlog.write(stream, settings.ReplBacklogSize)
+	for rep := range r.replicas {
+		rep.queue(stream, settings.ReplicaBufferLimit)
+	}
+}
+
+// appendRESPCommand appends args as a RESP array of bulk strings.
+func appendRESPCommand(stream []byte, args ...string) []byte {
+	stream = append(stream, "*"+strconv.Itoa(len(args))+"\r\n"...)
+	for _, arg := range args {
+		stream = append(stream, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		stream = append(stream, arg...)
+		stream = append(stream, "\r\n"...)
+	}
+	return stream
+}
+
+// respCommandLength is the length appendRESPCommand gives a command, which
+// is how far it moves a replica in the stream.
+func respCommandLength(command string, args []string) int64 {
+	length := 0
+	for _, arg := range append([]string{command}, args...) {
+		length += len("$"+strconv.Itoa(len(arg))+"\r\n") + len(arg) + 2
+	}
+	return int64(len("*"+strconv.Itoa(len(args)+1)+"\r\n") + length)
+}
+
+// startFullSync registers rep to get the stream from its current end, which
+// it returns the offset of. It runs inside FreezeAndFollow, so the frozen
+// view holds every write before that point and none after.
+func (r *replication) startFullSync(rep *replica) int64 {
+	r.replicasMutex.Lock()
+	defer r.replicasMutex.Unlock()
+	if r.backlog == nil {
+		r.backlog = newReplicationBacklog(r.store.Config().Get().ReplBacklogSize)
+	}
+	// The replica starts in database 0 whatever the stream last selected.
+	r.streamDB = -1
+	r.replicas[rep] = struct{}{}
+	return r.backlog.offset
+}
+
+// continueSync registers rep to get the stream from offset, queueing what it
+// missed, if replId names the stream and the backlog still holds that part.
+func (r *replication) continueSync(rep *replica, replId string, offset int64) bool {
+	r.replicasMutex.Lock()
+	defer r.replicasMutex.Unlock()
+	if replId != r.replId || r.backlog == nil {
+		return false
+	}
+	missed, ok := r.backlog.since(offset)
+	if !ok {
+		return false
+	}
+	r.replicas[rep] = struct{}{}
+	if len(missed) > 0 {
+		rep.queue(missed, 0)
+	}
+	return true
+}
+
+// streamInfo returns the stream's offset and what the backlog holds, all
+// zero before the first full sync.
+func (r *replication) streamInfo() (offset, firstOffset, backlogSize int64) {
+	r.replicasMutex.Lock()
+	defer r.replicasMutex.Unlock()
+	if r.backlog == nil {
+		return 0, 0, 0
+	}
+	return r.backlog.offset, r.backlog.firstOffset(), int64(len(r.backlog.ring))
+}
+
+func (r *replication) removeReplica(rep *replica) {
+	r.replicasMutex.Lock()
+	defer r.replicasMutex.Unlock()
+	delete(r.replicas, rep)
+}
+
+// replicaState is a connected replica as ROLE and INFO show it.
+type replicaState struct {
+	ip     string
+	port   string
+	offset int64
+}
+
+// connectedReplicas returns the connected replicas, sorted by address.
+func (r *replication) connectedReplicas() []replicaState {
+	r.replicasMutex.Lock()
+	defer r.replicasMutex.Unlock()
+	states := make([]replicaState, 0, len(r.replicas))
+	for rep := range r.replicas {
+		states = append(states, replicaState{rep.ip, rep.port, rep.ackOffset.Load()})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return net.JoinHostPort(states[i].ip, states[i].port) < net.JoinHostPort(states[j].ip, states[j].port)
+	})
+	return states
+}
+
+// currentLink returns the link to the leader, or nil on a leader.
+func (r *replication) currentLink() *replicationLink {
+	r.linkMutex.Lock()
+	defer r.linkMutex.Unlock()
+	return r.link
+}
+
+// checkWrite returns why a client cannot write, if the server is a read
+// only replica.
+func (r *replication) checkWrite(settings config.Settings) error {
+	if settings.ReplicaReadOnly && r.currentLink() != nil {
+		return ErrReadOnlyReplica
+	}
+	return nil
+}
+
+// replicaOf makes the server a replica of the leader at address, dropping
+// any previous link, or a leader again when address is empty. Following the
+// leader it already follows keeps the link as it is. Client writes running
+// meanwhile finish first, and those after see the new role.
+func (r *replication) replicaOf(address string) {
+	r.roleMutex.Lock()
+	defer r.roleMutex.Unlock()
+	r.setLink(address, false)
+}
+
+// setLink does the work of replicaOf with the role locked. failover marks a
+// new link as the one a FAILOVER hands over on.
+func (r *replication) setLink(address string, failover bool) {
+	r.linkMutex.Lock()
+	old := r.link
+	if old != nil && old.address == address {
+		r.linkMutex.Unlock()
+		return
+	}
+	r.link = nil
+	if address != "" {
+		r.link = &replicationLink{
+			address:  address,
+			done:     make(chan struct{}),
+			stopped:  make(chan struct{}),
+			failover: failover,
+			ackNow:   make(chan struct{}, 1),
+		}
+		go r.runLink(r.link)
+	}
+	r.linkMutex.Unlock()
+
+	// The old link is stopped without the lock, as applying a write can
+	// wait on the store.
+	if old != nil {
+		old.stop()
+	}
+	if address == "" {
+		r.store.Logger().Info("Now a leader")
+	} else {
+		r.store.Logger().Info("Now a replica", "leader", address)
+	}
+}
+
+// stop stops the link to the leader, if any, as the server shuts down.
+func (r *replication) stop() {
+	r.linkMutex.Lock()
+	link := r.link
+	r.linkMutex.Unlock()
+	if link != nil {
+		link.stop()
+	}
+}
+
+// stop closes the connection to the leader and waits for the link to end.
+func (link *replicationLink) stop() {
+	link.mutex.Lock()
+	select {
+	case <-link.done:
+	default:
+		close(link.done)
+	}
+	if link.conn != nil {
+		link.conn.Close()
+	}
+	link.mutex.Unlock()
+	<-link.stopped
+}
+
+// setConn records conn so stop can close it. It reports false once the link
+// is stopping.
+func (link *replicationLink) setConn(conn net.Conn) bool {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	select {
+	case <-link.done:
+		return false
+	default:
+		link.conn = conn
+		return true
+	}
+}
+
+// runLink syncs from the leader until the link is stopped, reconnecting
+// after replicationRetryDelay whenever the connection is lost.
+func (r *replication) runLink(link *replicationLink) {
+	defer close(link.stopped)
+	for {
+		err := r.syncFrom(link)
+		link.up.Store(false)
+		select {
+		case <-link.done:
+			return
+		default:
+		}
+		r.store.Logger().Warn("Lost the connection to the leader, retrying", "leader", link.address, "error", err, "delay", replicationRetryDelay)
+		select {
+		case <-link.done:
+			return
+		case <-time.After(replicationRetryDelay):
+		}
+	}
+}
+
+// syncFrom connects to the leader and asks to continue from where the link
+// left the stream. Failing that, the leader sends its dataset as a binary
+// snapshot, which replaces the replica's once it has arrived whole. Then
+// every write follows as commands.
+func (r *replication) syncFrom(link *replicationLink) error {
+	conn, err := net.DialTimeout("tcp", link.address, replicationDialTimeout)
+	if err != nil {
+		return err
+	}
+	if !link.setConn(conn) {
+		conn.Close()
+		return nil
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	requests := newReplyWriter(bufio.NewWriter(conn))
+	requests.resp = true
+	password := r.store.Config().Get().MasterAuth
+	if password != "" {
+		requests.write([]string{"AUTH", password})
+	}
+	port := r.listeningPort()
+	if port != "" {
+		requests.write([]string{"REPLCONF", "listening-port", port})
+	}
+	psync := []string{"PSYNC", "?", "-1"}
+	if link.replId != "" {
+		psync = []string{"PSYNC", link.replId, strconv.FormatInt(link.offset.Load(), 10)}
+	}
+	if link.failover {
+		psync = append(psync, "FAILOVER")
+	}
+	requests.write(psync)
+	requests.flush()
+	if password != "" {
+		if reply, err := readStatus(reader); err != nil {
+			return err
+		} else if reply != string(ResOk) {
+			return fmt.Errorf("unexpected reply %q to AUTH", reply)
+		}
+	}
+	if port != "" {
+		if _, err := readStatus(reader); err != nil {
+			return err
+		}
+	}
+	reply, err := readStatus(reader)
+	if err != nil {
+		return err
+	}
+	switch fields := strings.Fields(reply); {
+	case len(fields) == 2 && fields[0] == "CONTINUE" && fields[1] == link.replId:
+		r.store.Logger().Info("Continuing from the leader", "leader", link.address, "offset", link.offset.Load())
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected reply %q to PSYNC", reply)
+		}
+		snapshot, err := readBulk(reader)
+		if err != nil {
+			return err
+		}
+		loaded, err := r.store.ReplaceWithSnapshot(snapshot)
+		if err != nil {
+			return err
+		}
+		r.store.SetClientDBIndex(replicationClientId, 0)
+		link.replId = fields[1]
+		link.offset.Store(offset)
+		r.store.Logger().Info("Synced with the leader", "leader", link.address, "keys", loaded)
+	default:
+		return fmt.Errorf("unexpected reply %q to PSYNC", reply)
+	}
+	link.failover = false
+	link.up.Store(true)
+	acksDone := make(chan struct{})
+	defer close(acksDone)
+	go link.sendAcks(requests, acksDone)
+
+	for {
+		command, args, err := parser.ReadRESPCommand(reader, 0)
+		if err != nil {
+			return err
+		}
+		if command == "REPLCONF" && len(args) > 0 && strings.EqualFold(args[0], "GETACK") {
+			select {
+			case link.ackNow <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		if _, err := executeCommand(r.store, replicationClientId, command, args); err != nil {
+			r.store.Logger().Error("Failed to apply a write from the leader", "command", command, "error", err)
+		}
+		link.offset.Add(respCommandLength(command, args))
+	}
+}
+
+// sendAcks tells the leader the offset the link reached, at once, every
+// replicationAckInterval and whenever the leader asks, until done is closed.
+func (link *replicationLink) sendAcks(requests *replyWriter, done <-chan struct{}) {
+	ticker := time.NewTicker(replicationAckInterval)
+	defer ticker.Stop()
+	for {
+		requests.write([]string{"REPLCONF", "ACK", strconv.FormatInt(link.offset.Load(), 10)})
+		requests.flush()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-link.ackNow:
+		}
+	}
+}
+
+// readStatus reads a status reply of the leader, returning an error reply
+// as an error.
+func readStatus(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", errors.New(line[1:])
+	}
+	if !strings.HasPrefix(line, "+") {
+		return "", fmt.Errorf("unexpected reply %q", line)
+	}
+	return line[1:], nil
+}
+
+// readBulk reads the bulk string the leader sends its snapshot as.
+func readBulk(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(strings.TrimRight(strings.TrimPrefix(line, "$"), "\r\n"))
+	if !strings.HasPrefix(line, "$") || err != nil || length < 0 {
+		return nil, fmt.Errorf("unexpected reply %q, expected a snapshot", line)
+	}
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data[:length], nil
+}
+
+// serveReplica answers SYNC and PSYNC. A PSYNC naming a part of the stream
+// the backlog still holds gets that part, then the rest of the stream. Any
+// other request gets the dataset as a binary snapshot, then every write from
+// then on. The dataset is frozen as the replica is registered, so no write
+// is sent twice or missed, and writes made while the snapshot is encoded
+// and sent wait in the replica's buffer. Either way the stream goes on until
+// c disconnects or falls too far behind.
+func (h *handler) serveReplica(c *client, reader *bufio.Reader, replies *replyWriter, command string, args []string) {
+	rep := &replica{client: c, wake: make(chan struct{}, 1)}
+	rep.ip, rep.port, _ = net.SplitHostPort(c.addr)
+	if c.listeningPort != "" {
+		rep.port = c.listeningPort
+	}
+	defer h.replication.removeReplica(rep)
+	// A replica only listens, so it is never idle.
+	c.expectCommandWithin(0)
+	logger := h.store.Logger().With("client", c.id)
+	replies.resp = true
+	if command == "PSYNC" && len(args) == 3 {
+		// The leader is failing over to this replica, and syncs from it
+		// next.
+		h.replication.replicaOf("")
+		logger.Info("Promoted by the leader's failover", "addr", c.addr)
+	}
+
+	// A replica only sends the offsets it reached, and reading them also
+	// tells when it leaves.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			command, args, err := parser.ReadRESPCommand(reader, 0)
+			if err != nil {
+				return
+			}
+			if command == "REPLCONF" && len(args) == 2 && strings.EqualFold(args[0], "ACK") {
+				if offset, err := strconv.ParseInt(args[1], 10, 64); err == nil {
+					rep.ackOffset.Store(offset)
+				}
+			}
+		}
+	}()
+
+	continued := false
+	if command == "PSYNC" {
+		offset, err := strconv.ParseInt(args[1], 10, 64)
+		continued = err == nil && h.replication.continueSync(rep, args[0], offset)
+		if continued {
+			h.replication.partialSyncs.Add(1)
+			logger.Info("Replica continuing from the backlog", "addr", c.addr, "offset", offset)
+		} else if args[0] != "?" {
+			h.replication.partialSyncErrors.Add(1)
+		}
+	}
+	if continued {
+		replies.write(status("CONTINUE " + h.replication.replId))
+		replies.flush()
+	} else if !h.sendFullSync(c, rep, replies, logger) {
+		return
+	}
+
+	for {
+		select {
+		case <-gone:
+			if rep.overflowed.Load() {
+				logger.Info("Disconnected replica that fell behind", "addr", c.addr)
+			} else {
+				logger.Info("Replica disconnected", "addr", c.addr)
+			}
+			return
+		case <-rep.wake:
+			for _, stream := range rep.take() {
+				replies.writer.Write(stream)
+			}
+			replies.flush()
+		}
+	}
+}
+
+// sendFullSync registers rep at the current end of the stream and sends it
+// the dataset as of that point. It reports false if the replica was lost
+// meanwhile.
+func (h *handler) sendFullSync(c *client, rep *replica, replies *replyWriter, logger *slog.Logger) bool {
+	var offset int64
+	frozen := h.store.FreezeAndFollow(func() { offset = h.replication.startFullSync(rep) })
+	logger.Info("Replica connected, starting a full sync", "addr", c.addr)
+	snapshot, err := store.EncodeSnapshot(frozen)
+	if err != nil {
+		logger.Error("Failed to encode the snapshot for a replica", "addr", c.addr, "error", err)
+		return false
+	}
+	h.replication.fullSyncs.Add(1)
+	replies.write(status("FULLRESYNC " + h.replication.replId + " " + strconv.FormatInt(offset, 10)))
+	replies.write(string(snapshot))
+	if err := replies.writer.Flush(); err != nil {
+		if rep.overflowed.Load() {
+			logger.Info("Disconnected replica that fell behind during the full sync", "addr", c.addr)
+		} else {
+			logger.Info("Replica disconnected during the full sync", "addr", c.addr, "error", err)
+		}
+		return false
+	}
+	logger.Info("Sent the snapshot to the replica", "addr", c.addr, "bytes", len(snapshot))
+	return true
+}
+
+func (h *handler) handleReplicaOf(args []string) (any, error) {
+	if len(args) != 2 {
+		return nil, ErrWrongNumberOfArgs("REPLICAOF")
+	}
+	if h.replication.failingOver() {
+		return nil, ErrReplicaOfDuringFailover
+	}
+	if strings.EqualFold(args[0], "NO") && strings.EqualFold(args[1], "ONE") {
+		h.replication.replicaOf("")
+		return ResOk, nil
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port < 1 || port > 65535 {
+		return nil, ErrInvalidLeaderPort
+	}
+	h.replication.replicaOf(net.JoinHostPort(args[0], args[1]))
+	return ResOk, nil
+}
+
+// listeningPort returns the port of the first TCP listener, which a replica
+// tells its leader, or "" when there is none.
+func (h *handler) listeningPort() string {
+	if h.addrs == nil {
+		return ""
+	}
+	for _, addr := range h.addrs() {
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+			return strconv.Itoa(tcpAddr.Port)
+		}
+	}
+	return ""
+}
+
+// handleReplconf takes the port a replica is about to sync from, which
+// the leader shows instead of the port of its connection.
+func handleReplconf(c *client, args []string) (any, error) {
+	if len(args) < 2 {
+		return nil, ErrWrongNumberOfArgs("REPLCONF")
+	}
+	if len(args) != 2 || !strings.EqualFold(args[0], "listening-port") {
+		return nil, ErrUnknownSubcommand("REPLCONF", args[0])
+	}
+	if port, err := strconv.Atoi(args[1]); err != nil || port < 1 || port > 65535 {
+		return nil, ErrInvalidLeaderPort
+	}
+	c.listeningPort = args[1]
+	return ResOk, nil
+}
+
+// handleRole replies like Redis: on a leader its offset and each replica's
+// address and acknowledged offset, on a replica its leader's address, the
+// state of the link and the offset it reached.
+func (h *handler) handleRole(args []string) (any, error) {
+	if len(args) != 0 {
+		return nil, ErrWrongNumberOfArgs("ROLE")
+	}
+	if link := h.replication.currentLink(); link != nil {
+		host, port, _ := net.SplitHostPort(link.address)
+		portNumber, _ := strconv.Atoi(port)
+		state := "connecting"
+		if link.up.Load() {
+			state = "connected"
+		}
+		return arrayReply{"slave", host, portNumber, state, link.offset.Load()}, nil
+	}
+	offset, _, _ := h.replication.streamInfo()
+	replicas := arrayReply{}
+	for _, rep := range h.replication.connectedReplicas() {
+		replicas = append(replicas, arrayReply{rep.ip, rep.port, strconv.FormatInt(rep.offset, 10)})
+	}
+	return arrayReply{"master", offset, replicas}, nil
+}
+
+// replicationInfo is the replication section of INFO, named as in Redis.
+func (h *handler) replicationInfo() []string {
+	var lines []string
+	if link := h.replication.currentLink(); link != nil {
+		host, port, _ := net.SplitHostPort(link.address)
+		linkStatus := "down"
+		if link.up.Load() {
+			linkStatus = "up"
+		}
+		lines = append(lines,
+			"role:slave",
+			"master_host:"+host,
+			"master_port:"+port,
+			"master_link_status:"+linkStatus,
+			"slave_repl_offset:"+strconv.FormatInt(link.offset.Load(), 10),
+		)
+	} else {
+		failoverState := "no-failover"
+		if h.replication.failingOver() {
+			failoverState = "waiting-for-sync"
+		}
+		lines = append(lines, "role:master", "master_failover_state:"+failoverState)
+	}
+	replicas := h.replication.connectedReplicas()
+	lines = append(lines, "connected_slaves:"+strconv.Itoa(len(replicas)))
+	for i, rep := range replicas {
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=%d", i, rep.ip, rep.port, rep.offset))
+	}
+	offset, firstOffset, backlogSize := h.replication.streamInfo()
+	backlogActive := 0
+	if backlogSize > 0 {
+		backlogActive = 1
+	}
+	return append(lines,
+		"master_replid:"+h.replication.replId,
+		"master_repl_offset:"+strconv.FormatInt(offset, 10),
+		"repl_backlog_active:"+strconv.Itoa(backlogActive),
+		"repl_backlog_size:"+strconv.FormatInt(backlogSize, 10),
+		"repl_backlog_first_byte_offset:"+strconv.FormatInt(firstOffset, 10),
+		"repl_backlog_histlen:"+strconv.FormatInt(offset-firstOffset, 10),
+		"sync_full:"+strconv.FormatInt(h.replication.fullSyncs.Load(), 10),
+		"sync_partial_ok:"+strconv.FormatInt(h.replication.partialSyncs.Load(), 10),
+		"sync_partial_err:"+strconv.FormatInt(h.replication.partialSyncErrors.Load(), 10),
+	)
+}
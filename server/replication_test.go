@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bufio"
+	"kv-store/store"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForKeys polls s until every key of each database holds the expected
+// value, a missing one expecting "".
+func waitForKeys(t *testing.T, s *store.Store, expected map[int]map[string]string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var mismatch string
+		for dbIndex, keys := range expected {
+			for key, value := range keys {
+				if got, _, _ := s.Get(dbIndex, key); got != value {
+					mismatch = key + " = " + got + ", expected " + value
+				}
+			}
+		}
+		if mismatch == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replica did not converge: %s", mismatch)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// replicationInfo returns the fields of INFO replication.
+func replicationInfo(t *testing.T, conn net.Conn, reader *bufio.Reader) map[string]string {
+	t.Helper()
+	conn.Write([]byte(respRequest("INFO", "replication")))
+	reply := readRESPReply(t, reader)
+	fields := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		if name, value, ok := strings.Cut(strings.TrimSuffix(line, "\r"), ":"); ok {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+func TestReplication(t *testing.T) {
+	leaderStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	leader, leaderReader := dialTCP(t, newHandler(leaderStore))
+	replicaStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	replica, replicaReader := dialTCP(t, newHandler(replicaStore))
+
+	for _, command := range []string{"SET name batman", "SELECT 3", "SET city gotham", "SELECT 0"} {
+		sendCommand(t, leader, leaderReader, command, 1)
+	}
+	sendCommand(t, replica, replicaReader, "SET stale yes", 1)
+
+	_, port, _ := net.SplitHostPort(leader.RemoteAddr().String())
+	if got := sendCommand(t, replica, replicaReader, "REPLICAOF 127.0.0.1 "+port, 1)[0]; got != "OK" {
+		t.Fatalf("REPLICAOF = %q, expected OK", got)
+	}
+	waitForKeys(t, replicaStore, map[int]map[string]string{
+		0: {"name": "batman", "stale": ""},
+		3: {"city": "gotham"},
+	})
+
+	for _, command := range []string{
+		"INCR counter", "SET name robin", "SELECT 5", "SET villain joker",
+		"MULTI", "SET score 1", "INCRBY score 9",
+	} {
+		sendCommand(t, leader, leaderReader, command, 1)
+	}
+	sendCommand(t, leader, leaderReader, "EXEC", 2)
+	sendCommand(t, leader, leaderReader, "SELECT 3", 1)
+	sendCommand(t, leader, leaderReader, "DEL city", 1)
+	waitForKeys(t, replicaStore, map[int]map[string]string{
+		0: {"name": "robin", "counter": "1"},
+		3: {"city": ""},
+		5: {"villain": "joker", "score": "10"},
+	})
+
+	info := replicationInfo(t, replica, replicaReader)
+	for name, expected := range map[string]string{
+		"role": "slave", "master_host": "127.0.0.1", "master_port": port,
+		"master_link_status": "up", "connected_slaves": "0", "sync_full": "0",
+	} {
+		if info[name] != expected {
+			t.Errorf("INFO replication on the replica has %s:%s, expected %s", name, info[name], expected)
+		}
+	}
+	info = replicationInfo(t, leader, leaderReader)
+	for name, expected := range map[string]string{"role": "master", "connected_slaves": "1", "sync_full": "1"} {
+		if info[name] != expected {
+			t.Errorf("INFO replication on the leader has %s:%s, expected %s", name, info[name], expected)
+		}
+	}
+	if !strings.HasPrefix(info["slave0"], "ip=127.0.0.1,port=") {
+		t.Errorf("INFO replication on the leader has slave0:%s, expected the replica's address", info["slave0"])
+	}
+
+	if got := sendCommand(t, replica, replicaReader, "SET name joker", 1)[0]; got != ErrReadOnlyReplica.Error() {
+		t.Errorf("SET on a replica = %q, expected %q", got, ErrReadOnlyReplica.Error())
+	}
+	if got := sendCommand(t, replica, replicaReader, "GET name", 1)[0]; got != "robin" {
+		t.Errorf("GET on a replica = %q, expected robin", got)
+	}
+	sendCommand(t, replica, replicaReader, "CONFIG SET replica-read-only no", 1)
+	if got := sendCommand(t, replica, replicaReader, "SET local yes", 1)[0]; got != "OK" {
+		t.Errorf("SET on a writable replica = %q, expected OK", got)
+	}
+	sendCommand(t, replica, replicaReader, "CONFIG SET replica-read-only yes", 1)
+
+	sendCommand(t, replica, replicaReader, "REPLICAOF no one", 1)
+	if role := replicationInfo(t, replica, replicaReader)["role"]; role != "master" {
+		t.Errorf("INFO replication after REPLICAOF NO ONE has role:%s, expected master", role)
+	}
+	if got := sendCommand(t, replica, replicaReader, "SET name joker", 1)[0]; got != "OK" {
+		t.Errorf("SET after REPLICAOF NO ONE = %q, expected OK", got)
+	}
+}
+
+func TestHandleReplicaOf_InvalidPort(t *testing.T) {
+	h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+	for _, args := range [][]string{{"127.0.0.1", "port"}, {"127.0.0.1", "0"}, {"127.0.0.1", "65536"}} {
+		if _, err := h.handleReplicaOf(args); err != ErrInvalidLeaderPort {
+			t.Errorf("REPLICAOF %q = %v, expected %v", args, err, ErrInvalidLeaderPort)
+		}
+	}
+	if h.replication.currentLink() != nil {
+		t.Error("an invalid REPLICAOF started a link")
+	}
+}
+
+func TestReplication_SlowReplicaDisconnected(t *testing.T) {
+	leaderStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	leaderStore.Config().Set("replica-buffer-limit", "1mb")
+	h := newHandler(leaderStore)
+	conn, reader := dialTCP(t, h)
+	// The replica never reads past the snapshot, so the leader's socket
+	// buffers fill up and the writes back up behind them.
+	conn.Write([]byte(respRequest("SYNC")))
+	if got := readRESPReply(t, reader); !strings.HasPrefix(got, "+FULLRESYNC ") {
+		t.Fatalf("SYNC = %q, expected +FULLRESYNC", got)
+	}
+
+	value := strings.Repeat("x", 64<<10)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.replication.connectedReplicas()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the leader kept a replica that fell behind")
+		}
+		leaderStore.Set(0, "name", value)
+	}
+}
+
+// writeContinuously writes to s until the returned function is called,
+// which waits for the last write.
+func writeContinuously(s *store.Store) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.Set(i%4, "key"+strconv.Itoa(i%1000), strconv.Itoa(i))
+			s.Incr(0, "counter")
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// waitForDataset polls replica until all its databases hold the same keys
+// and values as leader's.
+func waitForDataset(t *testing.T, leader, replica *store.Store) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mismatch := -1
+		for dbIndex := range leader.GetDatabasesCount() {
+			expected, _ := leader.SnapshotDatabase(dbIndex)
+			got, _ := replica.SnapshotDatabase(dbIndex)
+			if !reflect.DeepEqual(got, expected) {
+				mismatch = dbIndex
+				break
+			}
+		}
+		if mismatch < 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("database %d of the replica did not converge", mismatch)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication_SyncWhileWriting(t *testing.T) {
+	leaderStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	for i := range 5000 {
+		leaderStore.Set(i%4, "key"+strconv.Itoa(i), strings.Repeat("v", 100))
+	}
+	leader, _ := dialTCP(t, newHandler(leaderStore))
+	replicaStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	replica, replicaReader := dialTCP(t, newHandler(replicaStore))
+
+	stop := writeContinuously(leaderStore)
+	_, port, _ := net.SplitHostPort(leader.RemoteAddr().String())
+	sendCommand(t, replica, replicaReader, "REPLICAOF 127.0.0.1 "+port, 1)
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	waitForDataset(t, leaderStore, replicaStore)
+}
+
+func TestReplication_BufferLimitForcesResync(t *testing.T) {
+	defer func(delay time.Duration) { replicationRetryDelay = delay }(replicationRetryDelay)
+	replicationRetryDelay = 10 * time.Millisecond
+
+	leaderStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	for i := range 5000 {
+		leaderStore.Set(0, "key"+strconv.Itoa(i), strings.Repeat("v", 100))
+	}
+	leaderStore.Config().Set("replica-buffer-limit", "1")
+	leaderHandler := newHandler(leaderStore)
+	leader, leaderReader := dialTCP(t, leaderHandler)
+	replicaStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	replica, replicaReader := dialTCP(t, newHandler(replicaStore))
+
+	stop := writeContinuously(leaderStore)
+	_, port, _ := net.SplitHostPort(leader.RemoteAddr().String())
+	sendCommand(t, replica, replicaReader, "REPLICAOF 127.0.0.1 "+port, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for leaderHandler.replication.fullSyncs.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the replica was not made to sync again after going past replica-buffer-limit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	// Without a limit the next sync sticks.
+	sendCommand(t, leader, leaderReader, "CONFIG SET replica-buffer-limit 0", 1)
+	waitForDataset(t, leaderStore, replicaStore)
+}
+
+// dropLink closes the replica's connection to its leader, as a network
+// failure would.
+func dropLink(h *handler) {
+	link := h.replication.currentLink()
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	link.conn.Close()
+}
+
+func TestReplication_PartialResync(t *testing.T) {
+	defer func(delay time.Duration) { replicationRetryDelay = delay }(replicationRetryDelay)
+	replicationRetryDelay = 200 * time.Millisecond
+
+	leaderStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	leaderHandler := newHandler(leaderStore)
+	leader, leaderReader := dialTCP(t, leaderHandler)
+	replicaStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	replicaHandler := newHandler(replicaStore)
+	replica, replicaReader := dialTCP(t, replicaHandler)
+
+	leaderStore.Set(0, "name", "batman")
+	_, port, _ := net.SplitHostPort(leader.RemoteAddr().String())
+	sendCommand(t, replica, replicaReader, "REPLICAOF 127.0.0.1 "+port, 1)
+	waitForDataset(t, leaderStore, replicaStore)
+
+	steps := []struct {
+		name        string
+		backlogSize string
+		missed      func()
+		expected    map[string]string
+	}{
+		{"continue from the backlog", "1mb", func() {
+			leaderStore.Set(0, "name", "robin")
+			leaderStore.Set(2, "city", "gotham")
+		}, map[string]string{"sync_full": "1", "sync_partial_ok": "1", "sync_partial_err": "0"}},
+		{"aged out of the backlog", "64", func() {
+			leaderStore.Set(1, "villain", strings.Repeat("joker", 20))
+		}, map[string]string{"sync_full": "2", "sync_partial_ok": "1", "sync_partial_err": "1"}},
+	}
+	for _, step := range steps {
+		sendCommand(t, leader, leaderReader, "CONFIG SET repl-backlog-size "+step.backlogSize, 1)
+		dropLink(replicaHandler)
+		step.missed()
+		waitForDataset(t, leaderStore, replicaStore)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			info := replicationInfo(t, leader, leaderReader)
+			replicaOffset := replicationInfo(t, replica, replicaReader)["slave_repl_offset"]
+			matched := info["master_repl_offset"] == replicaOffset
+			for name, expected := range step.expected {
+				matched = matched && info[name] == expected
+			}
+			if matched {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: INFO replication on the leader = %v and replica offset %s, expected %v", step.name, info, replicaOffset, step.expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// waitForRole polls ROLE on h until it replies with expected.
+func waitForRole(t *testing.T, h *handler, expected arrayReply) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		role, _ := h.handleRole(nil)
+		if reflect.DeepEqual(role, expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ROLE = %v, expected %v", role, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRole(t *testing.T) {
+	defer func(interval time.Duration) { replicationAckInterval = interval }(replicationAckInterval)
+	replicationAckInterval = 10 * time.Millisecond
+
+	leaderStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	leaderHandler := newHandler(leaderStore)
+	leader, leaderReader := dialTCP(t, leaderHandler)
+	replicaStore := store.CreateNewStore(store.NewMemoryStorage(16))
+	replicaHandler := newHandler(replicaStore)
+	replica, replicaReader := dialTCP(t, replicaHandler)
+	_, leaderPort, _ := net.SplitHostPort(leader.RemoteAddr().String())
+	_, replicaPort, _ := net.SplitHostPort(replica.RemoteAddr().String())
+	leaderPortNumber, _ := strconv.Atoi(leaderPort)
+
+	conn, err := net.Dial("tcp", replica.RemoteAddr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if got := sendCommand(t, conn, reader, "ROLE", 3); !reflect.DeepEqual(got, []string{"master", "0", ""}) {
+		t.Errorf("ROLE on a leader = %q, expected master, 0 and no replicas", got)
+	}
+
+	// A transaction queued on a leader cannot write once it is a replica.
+	sendCommand(t, conn, reader, "MULTI", 1)
+	sendCommand(t, conn, reader, "SET name joker", 1)
+	sendCommand(t, replica, replicaReader, "REPLICAOF 127.0.0.1 "+leaderPort, 1)
+	if got := sendCommand(t, conn, reader, "EXEC", 1)[0]; got != ErrReadOnlyReplica.Error() {
+		t.Errorf("EXEC of a write queued before REPLICAOF = %q, expected %q", got, ErrReadOnlyReplica.Error())
+	}
+	if got := sendCommand(t, conn, reader, "GET name", 1)[0]; got != nilText {
+		t.Errorf("GET after the aborted EXEC = %q, expected %s", got, nilText)
+	}
+
+	sendCommand(t, leader, leaderReader, "SET name batman", 1)
+	waitForKeys(t, replicaStore, map[int]map[string]string{0: {"name": "batman"}})
+	offset, _, _ := leaderHandler.replication.streamInfo()
+	waitForRole(t, replicaHandler, arrayReply{"slave", "127.0.0.1", leaderPortNumber, "connected", offset})
+	waitForRole(t, leaderHandler, arrayReply{"master", offset, arrayReply{
+		arrayReply{"127.0.0.1", replicaPort, strconv.FormatInt(offset, 10)},
+	}})
+	if got := replicationInfo(t, leader, leaderReader)["slave0"]; got != "ip=127.0.0.1,port="+replicaPort+",state=online,offset="+strconv.FormatInt(offset, 10) {
+		t.Errorf("INFO replication on the leader has slave0:%s", got)
+	}
+
+	sendCommand(t, replica, replicaReader, "REPLICAOF NO ONE", 1)
+	waitForRole(t, replicaHandler, arrayReply{"master", int64(0), arrayReply{}})
+	waitForRole(t, leaderHandler, arrayReply{"master", offset, arrayReply{}})
+	if got := sendCommand(t, conn, reader, "SET name joker", 1)[0]; got != "OK" {
+		t.Errorf("SET after REPLICAOF NO ONE = %q, expected OK", got)
+	}
+}
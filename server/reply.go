@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"kv-store/errcode"
+	"kv-store/parser"
+	"kv-store/store"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// status is a fixed reply such as OK, as opposed to a string of stored data.
+// RESP sends it as a simple string and a plain string as a bulk string.
+type status string
+
+// multiline is text the server writes on several lines, such as INFO's.
+// RESP sends it as a bulk string, and the text format line by line, where a
+// string of stored data holding a line break is quoted instead.
+type multiline string
+
+// mapReply holds alternating keys and values. RESP3 sends it as a map, and
+// RESP2 and the text format flatten it like an array.
+type mapReply []any
+
+// arrayReply is an array of mixed elements, which may be arrays themselves.
+// The text format shows it like a mapReply.
+type arrayReply []any
+
+// pushReply is a message sent without a request, such as a Pub/Sub message.
+// RESP3 sends it as a push, and RESP2 and the text format like an array.
+type pushReply []any
+
+// nilText is how the text format shows a nil reply, such as GET on a missing
+// key. RESP has a null type of its own.
+const nilText = "(nil)"
+
+// replyWriter writes each reply in the protocol of the request it answers:
+// RESP for a RESP array, in the version the connection chose with HELLO, and
+// the CRLF-terminated text format for an inline command.
+type replyWriter struct {
+	writer   *bufio.Writer
+	resp     bool
+	protocol int
+	// logger logs the errors replied with, adding the client's current
+	// database from dbIndex when it is set.
+	logger  *slog.Logger
+	dbIndex func() int
+	// trace logs every reply, escaped and cut to traceMaxLength bytes.
+	trace          bool
+	traceMaxLength int64
+}
+
+func newReplyWriter(writer *bufio.Writer) *replyWriter {
+	return &replyWriter{writer: writer, protocol: 2, logger: slog.Default()}
+}
+
+// write buffers one reply until the next flush. reply is nil, an error, a
+// status, a string, a multiline, an integer, a float64, a []string of lines, a mapReply, an
+// arrayReply, a pushReply, a store.Result or the []store.Result of an EXEC, whose nil value means the
+// EXEC was aborted.
+func (w *replyWriter) write(reply any) {
+	switch reply := reply.(type) {
+	case error:
+		w.logError(reply)
+	case store.Result:
+		w.logError(reply.Err)
+	case []store.Result:
+		for _, result := range reply {
+			w.logError(result.Err)
+		}
+	}
+	if w.trace {
+		w.writeTraced(reply)
+		return
+	}
+	w.writeUntraced(reply)
+}
+
+func (w *replyWriter) writeUntraced(reply any) {
+	if w.resp {
+		w.writeRESP(reply)
+	} else {
+		// Every line ends in CRLF, which telnet and inline clients expect.
+		text := strings.ReplaceAll(formatText(reply), "\n", "\r\n")
+		w.writer.WriteString(text + "\r\n")
+	}
+}
+
+// flush sends the buffered replies. The handler calls it once it has run
+// every request the client has pipelined, so a batch costs one write.
+func (w *replyWriter) flush() {
+	if err := w.writer.Flush(); err != nil {
+		w.logger.Debug("Error writing response", "error", err)
+	}
+}
+
+func formatText(reply any) string {
+	switch reply := reply.(type) {
+	case nil:
+		return nilText
+	case error:
+		return errorReply(reply)
+	case status:
+		return string(reply)
+	case string:
+		return formatValue(reply)
+	case multiline:
+		return string(reply)
+	case int:
+		return strconv.Itoa(reply)
+	case int64:
+		return strconv.FormatInt(reply, 10)
+	case []string:
+		return strings.Join(reply, "\n")
+	case mapReply:
+		lines := make([]string, len(reply))
+		for i, element := range reply {
+			lines[i] = formatText(element)
+		}
+		return strings.Join(lines, "\n")
+	case arrayReply:
+		return formatText(mapReply(reply))
+	case pushReply:
+		return formatText(mapReply(reply))
+	case store.Result:
+		return formatResult(reply)
+	case []store.Result:
+		if reply == nil {
+			return nilText
+		}
+		lines := make([]string, len(reply))
+		for i, result := range reply {
+			lines[i] = fmt.Sprintf("%d) %s", i+1, formatResult(result))
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return fmt.Sprint(reply)
+	}
+}
+
+// formatResult renders a transaction result the way the same command's reply
+// is rendered outside a transaction, so a missing key reads as nilText in
+// both.
+func formatResult(result store.Result) string {
+	switch result.Kind {
+	case store.ResultNil:
+		return nilText
+	case store.ResultInteger:
+		return strconv.FormatInt(result.Integer, 10)
+	case store.ResultError:
+		return errorReply(result.Err)
+	case store.ResultStatus:
+		return result.Value
+	default:
+		return formatValue(result.Value)
+	}
+}
+
+// formatValue renders stored data on one line. A value holding a line break
+// would otherwise read as several replies, so it is quoted with the escapes
+// ParseCommandLine takes, and so is one that starts with a quote, to tell the
+// two apart. An empty value is quoted too, rather than sent as a blank line,
+// and so is one reading as nilText, so it is not taken for a missing one.
+func formatValue(value string) string {
+	if value == "" || value == nilText || strings.ContainsAny(value, "\r\n") || strings.HasPrefix(value, `"`) {
+		return parser.Quote(value)
+	}
+	return value
+}
+
+func (w *replyWriter) writeRESP(reply any) {
+	switch reply := reply.(type) {
+	case nil:
+		w.writeNull("$-1")
+	case error:
+		w.writer.WriteString("-" + errorReply(reply) + "\r\n")
+	case status:
+		w.writer.WriteString("+" + string(reply) + "\r\n")
+	case string:
+		w.writeBulk(reply)
+	case multiline:
+		w.writeBulk(string(reply))
+	case int:
+		w.writeInteger(int64(reply))
+	case int64:
+		w.writeInteger(reply)
+	case float64:
+		formatted := strconv.FormatFloat(reply, 'g', -1, 64)
+		if w.protocol == 3 {
+			w.writer.WriteString("," + formatted + "\r\n")
+		} else {
+			w.writeBulk(formatted)
+		}
+	case mapReply:
+		if w.protocol == 3 {
+			w.writer.WriteString("%" + strconv.Itoa(len(reply)/2) + "\r\n")
+		} else {
+			w.writer.WriteString("*" + strconv.Itoa(len(reply)) + "\r\n")
+		}
+		for _, element := range reply {
+			w.writeRESP(element)
+		}
+	case arrayReply:
+		w.writer.WriteString("*" + strconv.Itoa(len(reply)) + "\r\n")
+		for _, element := range reply {
+			w.writeRESP(element)
+		}
+	case pushReply:
+		if w.protocol == 3 {
+			w.writer.WriteString(">" + strconv.Itoa(len(reply)) + "\r\n")
+		} else {
+			w.writer.WriteString("*" + strconv.Itoa(len(reply)) + "\r\n")
+		}
+		for _, element := range reply {
+			w.writeRESP(element)
+		}
+	case []string:
+		w.writer.WriteString("*" + strconv.Itoa(len(reply)) + "\r\n")
+		for _, line := range reply {
+			w.writeBulk(line)
+		}
+	case store.Result:
+		switch reply.Kind {
+		case store.ResultNil:
+			w.writeRESP(nil)
+		case store.ResultInteger:
+			w.writeInteger(reply.Integer)
+		case store.ResultStatus:
+			w.writeRESP(status(reply.Value))
+		case store.ResultError:
+			w.writeRESP(reply.Err)
+		default:
+			w.writeBulk(reply.Value)
+		}
+	case []store.Result:
+		if reply == nil {
+			w.writeNull("*-1")
+			return
+		}
+		w.writer.WriteString("*" + strconv.Itoa(len(reply)) + "\r\n")
+		for _, result := range reply {
+			w.writeRESP(result)
+		}
+	default:
+		w.writeBulk(fmt.Sprint(reply))
+	}
+}
+
+// writeNull writes RESP3's null, or legacy, the RESP2 null of the given
+// type.
+func (w *replyWriter) writeNull(legacy string) {
+	if w.protocol == 3 {
+		w.writer.WriteString("_\r\n")
+		return
+	}
+	w.writer.WriteString(legacy + "\r\n")
+}
+
+func (w *replyWriter) writeBulk(value string) {
+	w.writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+func (w *replyWriter) writeInteger(value int64) {
+	w.writer.WriteString(":" + strconv.FormatInt(value, 10) + "\r\n")
+}
+
+// errorReply returns the line sent for err, which starts with an error code.
+// The client only learns that an internal error happened. Line breaks, which
+// an error may quote from a request, become spaces so the reply stays one
+// line.
+func errorReply(err error) string {
+	reply, _ := errcode.Reply(err)
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(reply)
+}
+
+// logError logs a failed command at info, and an internal error, which the
+// client never sees, at error.
+func (w *replyWriter) logError(err error) {
+	if err == nil {
+		return
+	}
+	logger := w.logger
+	if w.dbIndex != nil {
+		logger = logger.With("db", w.dbIndex())
+	}
+	if reply, coded := errcode.Reply(err); coded {
+		logger.Info("Command failed", "error", reply)
+	} else {
+		logger.Error("Internal error", "error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"kv-store/errcode"
+	"kv-store/store"
+	"strings"
+	"testing"
+)
+
+func TestReplyWriter(t *testing.T) {
+	testCases := []struct {
+		name  string
+		reply any
+		text  string
+		resp  string
+	}{
+		{"nil", nil, "(nil)\r\n", "$-1\r\n"},
+		{"error", ErrSyntax, "ERR syntax error\r\n", "-ERR syntax error\r\n"},
+		{"error with its own code", ErrNoAuth, "NOAUTH Authentication required\r\n", "-NOAUTH Authentication required\r\n"},
+		{"internal error", errors.New("open dump.rdb: permission denied"), "ERR internal error\r\n", "-ERR internal error\r\n"},
+		{"status", ResOk, "OK\r\n", "+OK\r\n"},
+		{"string", "OK", "OK\r\n", "$2\r\nOK\r\n"},
+		{"empty string", "", `""` + "\r\n", "$0\r\n\r\n"},
+		{"string reading as nil", "(nil)", "\"(nil)\"\r\n", "$5\r\n(nil)\r\n"},
+		{"string with a line break", "a\r\nb", "\"a\\r\\nb\"\r\n", "$4\r\na\r\nb\r\n"},
+		{"string starting with a quote", `"a" b`, `"\"a\" b"` + "\r\n", "$5\r\n\"a\" b\r\n"},
+		{"multiline", multiline("a\nb"), "a\r\nb\r\n", "$3\r\na\nb\r\n"},
+		{"error with a line break", ErrUnknownCommand("A\r\nB"), "ERR unknown command: A  B\r\n", "-ERR unknown command: A  B\r\n"},
+		{"int", 3, "3\r\n", ":3\r\n"},
+		{"int64", int64(-7), "-7\r\n", ":-7\r\n"},
+		{"lines", []string{"a", "bc"}, "a\r\nbc\r\n", "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+		{"exec results", []store.Result{
+			{Kind: store.ResultStatus, Value: "OK"},
+			{Kind: store.ResultNil},
+			{Kind: store.ResultValue, Value: "nil"},
+			{Kind: store.ResultInteger, Integer: 2},
+			{Kind: store.ResultError, Err: errcode.New(errcode.Err, "boom")},
+			{Kind: store.ResultValue, Value: "x\ny"},
+		}, "1) OK\r\n2) (nil)\r\n3) nil\r\n4) 2\r\n5) ERR boom\r\n6) \"x\\ny\"\r\n", "*6\r\n+OK\r\n$-1\r\n$3\r\nnil\r\n:2\r\n-ERR boom\r\n$3\r\nx\ny\r\n"},
+		{"exec result reading as nil", []store.Result{
+			{Kind: store.ResultValue, Value: "(nil)"},
+			{Kind: store.ResultNil},
+		}, "1) \"(nil)\"\r\n2) (nil)\r\n", "*2\r\n$5\r\n(nil)\r\n$-1\r\n"},
+		{"aborted exec", []store.Result(nil), "(nil)\r\n", "*-1\r\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, resp := range []bool{false, true} {
+				var output strings.Builder
+				writer := newReplyWriter(bufio.NewWriter(&output))
+				writer.resp = resp
+				writer.write(tc.reply)
+				writer.flush()
+
+				expected := tc.text
+				if resp {
+					expected = tc.resp
+				}
+				if output.String() != expected {
+					t.Errorf("write(%v) with resp=%v = %q, expected %q", tc.reply, resp, output.String(), expected)
+				}
+			}
+		})
+	}
+}
+
+func TestReplyWriter_RESP3(t *testing.T) {
+	testCases := []struct {
+		name  string
+		reply any
+		resp2 string
+		resp3 string
+	}{
+		{"nil", nil, "$-1\r\n", "_\r\n"},
+		{"aborted exec", []store.Result(nil), "*-1\r\n", "_\r\n"},
+		{"nil result", store.Result{Kind: store.ResultNil}, "$-1\r\n", "_\r\n"},
+		{"double", 1.5, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"map", mapReply{"a", int64(1)}, "*2\r\n$1\r\na\r\n:1\r\n", "%1\r\n$1\r\na\r\n:1\r\n"},
+		{"status", ResOk, "+OK\r\n", "+OK\r\n"},
+		{"nested array", arrayReply{"master", int64(3), arrayReply{}}, "*3\r\n$6\r\nmaster\r\n:3\r\n*0\r\n", "*3\r\n$6\r\nmaster\r\n:3\r\n*0\r\n"},
+		{"push", pushReply{"message", "ch", "hi"}, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for protocol, expected := range map[int]string{2: tc.resp2, 3: tc.resp3} {
+				var output strings.Builder
+				writer := newReplyWriter(bufio.NewWriter(&output))
+				writer.resp, writer.protocol = true, protocol
+				writer.write(tc.reply)
+				writer.flush()
+				if output.String() != expected {
+					t.Errorf("write(%v) in RESP%d = %q, expected %q", tc.reply, protocol, output.String(), expected)
+				}
+			}
+		})
+	}
+}
@@ -1,26 +1,392 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"kv-store/config"
 	"kv-store/store"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
 )
 
-func Start(address string, store *store.Store) error {
-	listener, err := net.Listen("tcp", address)
+// listenConfig says where a Server accepts connections: TCP addresses, IPv4
+// or IPv6, a unix socket path, or both. An empty UnixSocket leaves the socket
+// out. A non-nil TLS serves the TCP addresses over TLS. ProxyProtocol expects
+// every TCP connection to start with a PROXY protocol header naming the real
+// client, as sent by a load balancer such as HAProxy. A DebugAddress, which
+// must be a loopback address, serves pprof profiles and expvar variables over
+// HTTP. A ReplicaOf "host:port" starts the server as a replica of that
+// leader, as REPLICAOF does.
+type listenConfig struct {
+	Addresses      []string
+	UnixSocket     string
+	UnixSocketPerm os.FileMode
+	TLS            *tls.Config
+	ProxyProtocol  bool
+	DebugAddress   string
+	ReplicaOf      string
+}
+
+// Bounds of the delay before retrying a temporary accept error.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Server serves a store to clients. It can be embedded in another program:
+// Start returns once the listeners are bound, and Stop shuts it down.
+type Server struct {
+	listen  listenConfig
+	handler *handler
+
+	done       chan struct{}
+	background sync.Once
+	accepting  sync.WaitGroup
+	serving    sync.WaitGroup
+
+	mutex       sync.Mutex
+	listeners   []net.Listener
+	connections map[net.Conn]struct{}
+	stopped     bool
+	debug       *http.Server
+	debugAddr   net.Addr
+}
+
+func newServer(listen listenConfig, handler *handler) *Server {
+	s := &Server{
+		listen:      listen,
+		handler:     handler,
+		done:        make(chan struct{}),
+		connections: make(map[net.Conn]struct{}),
+	}
+	handler.addrs = s.Addrs
+	return s
+}
+
+func (s *Server) logger() *slog.Logger {
+	return s.handler.store.Logger()
+}
+
+// Serve runs a server for store on a listener the caller opened, such as one
+// passed in by systemd socket activation, until the listener is closed or
+// fails. Then it closes the connections it accepted and returns as
+// Server.Serve does.
+func Serve(listener net.Listener, store *store.Store) error {
+	s := newServer(listenConfig{}, newHandler(store))
+	err := s.Serve(listener)
+	s.Stop(context.Background())
+	return err
+}
+
+// Start binds the listeners and serves them in the background.
+func (s *Server) Start() error {
+	if len(s.listen.Addresses) == 0 && s.listen.UnixSocket == "" {
+		return errors.New("no address or unix socket to listen on")
+	}
+
+	// A listener that fails to bind closes those bound before it.
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for _, address := range s.listen.Addresses {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			s.logger().Error("Failed to bind to address", "address", address, "error", err)
+			closeAll()
+			return err
+		}
+		if s.listen.ProxyProtocol {
+			listener = proxyListener{listener}
+		}
+		if s.listen.TLS != nil {
+			listener = tls.NewListener(listener, s.listen.TLS)
+			s.logger().Info("Server listening", "address", listener.Addr().String(), "tls", true)
+		} else {
+			s.logger().Info("Server listening", "address", listener.Addr().String())
+		}
+		listeners = append(listeners, listener)
+	}
+	if s.listen.UnixSocket != "" {
+		listener, err := listenUnix(s.listen.UnixSocket, s.listen.UnixSocketPerm)
+		if err != nil {
+			s.logger().Error("Failed to listen on unix socket", "path", s.listen.UnixSocket, "error", err)
+			closeAll()
+			return err
+		}
+		s.logger().Info("Server listening on unix socket", "path", s.listen.UnixSocket)
+		listeners = append(listeners, listener)
+	}
+	if s.listen.DebugAddress != "" {
+		if err := s.startDebug(); err != nil {
+			s.logger().Error("Failed to start the debug server", "address", s.listen.DebugAddress, "error", err)
+			closeAll()
+			return err
+		}
+	}
+
+	for _, listener := range listeners {
+		if !s.addListener(listener) {
+			listener.Close()
+			continue
+		}
+		go func() {
+			if err := s.serve(listener); err != nil {
+				s.logger().Error("Stopped accepting connections", "address", listener.Addr().String(), "error", err)
+			}
+		}()
+	}
+	if s.listen.ReplicaOf != "" {
+		s.handler.replication.replicaOf(s.listen.ReplicaOf)
+	}
+	return nil
+}
+
+// Serve accepts connections on listener until it is closed, by Stop or by
+// the caller. It returns nil once the listener is closed, or the error that
+// made Accept fail. Stop closes listener along with the server's own.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.addListener(listener) {
+		return nil
+	}
+	return s.serve(listener)
+}
+
+// Addr returns the address of the first TCP listener, or of the unix socket
+// when there is no TCP listener, so a server started on port 0 can be dialed.
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// startDebug serves the debug endpoints in the background until Stop.
+func (s *Server) startDebug() error {
+	debug, listener, err := listenDebug(s.listen.DebugAddress, s.handler.store)
 	if err != nil {
-		log.Printf("Failed to bind to address %s: %v", address, err)
 		return err
 	}
-	log.Printf("Server listening on %s", address)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		listener.Close()
+		return nil
+	}
+	s.debug, s.debugAddr = debug, listener.Addr()
+	s.logger().Info("Debug server listening", "address", listener.Addr().String())
+	go debug.Serve(listener)
+	return nil
+}
 
+// DebugAddr returns the address of the debug HTTP server, or nil without
+// one.
+func (s *Server) DebugAddr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.debugAddr
+}
+
+// Addrs returns the addresses of all the listeners.
+func (s *Server) Addrs() []net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, listener := range s.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
+}
+
+// Stop closes the listeners, which removes the unix socket file, every
+// client connection and the link to a leader, then waits for the connections
+// to finish until ctx is done.
+func (s *Server) Stop(ctx context.Context) error {
+	s.handler.replication.stop()
+	s.mutex.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.done)
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+		for conn := range s.connections {
+			conn.Close()
+		}
+	}
+	debug := s.debug
+	s.mutex.Unlock()
+
+	if debug != nil {
+		if err := debug.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		s.accepting.Wait()
+		s.serving.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addListener records listener so Stop closes it, and starts the background
+// work on the first one. It reports false once the server is stopping.
+func (s *Server) addListener(listener net.Listener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.listeners = append(s.listeners, listener)
+	s.accepting.Add(1)
+	s.background.Do(func() {
+		go s.handler.store.DiscardIdleTransactionsPeriodically(s.done)
+	})
+	return true
+}
+
+// serve accepts connections on listener until it is closed. Temporary accept
+// errors, such as running out of file descriptors, are retried after a delay
+// that doubles up to maxAcceptDelay, so they do not spin the loop.
+func (s *Server) serve(listener net.Listener) error {
+	defer s.accepting.Done()
+	var delay time.Duration
 	for {
-		connection, err := listener.Accept()
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Temporary() {
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			s.logger().Warn("Failed to accept a connection, retrying", "address", listener.Addr().String(), "error", err, "delay", delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-s.done:
+				return nil
+			}
+		}
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			return err
+		}
+		delay = 0
+
+		if err := applySocketOptions(conn, s.handler.store.Config().Get()); err != nil {
+			s.logger().Warn("Failed to set socket options", "addr", conn.RemoteAddr().String(), "error", err)
+		}
+		if !s.track(conn) {
+			conn.Close()
 			continue
 		}
 
-		go handleConnection(connection, store)
+		go func() {
+			defer s.untrack(conn)
+			// A panic serving one client closes its connection rather
+			// than the whole server.
+			defer func() {
+				if r := recover(); r != nil {
+					s.logger().Error("Panic serving a connection", "addr", conn.RemoteAddr().String(), "panic", r, "stack", string(debug.Stack()))
+					conn.Close()
+				}
+			}()
+			if err := readProxyHeader(conn); err != nil {
+				s.logger().Info("Rejected connection", "addr", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+				return
+			}
+			s.handler.handleConnection(conn)
+		}()
+	}
+}
+
+// track records a new connection so Stop can close it. It reports false once
+// the server is stopping.
+func (s *Server) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.connections[conn] = struct{}{}
+	s.serving.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.connections, conn)
+	s.serving.Done()
+}
+
+// applySocketOptions sets the keepalive interval, TCP_NODELAY and buffer
+// sizes from settings on a TCP connection, including one under TLS or behind
+// a PROXY header. Other connections, such as those on a unix socket, are left
+// alone.
+func applySocketOptions(conn net.Conn, settings config.Settings) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if proxyConn, ok := conn.(*proxyConn); ok {
+		conn = proxyConn.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	keepAlive := net.KeepAliveConfig{Enable: settings.TCPKeepAlive > 0}
+	if keepAlive.Enable {
+		keepAlive.Idle = time.Duration(settings.TCPKeepAlive) * time.Second
+		keepAlive.Interval = keepAlive.Idle
+	}
+	errs := []error{
+		tcpConn.SetKeepAliveConfig(keepAlive),
+		tcpConn.SetNoDelay(settings.TCPNoDelay),
+	}
+	if settings.TCPRecvBuffer > 0 {
+		errs = append(errs, tcpConn.SetReadBuffer(int(settings.TCPRecvBuffer)))
+	}
+	if settings.TCPSendBuffer > 0 {
+		errs = append(errs, tcpConn.SetWriteBuffer(int(settings.TCPSendBuffer)))
+	}
+	return errors.Join(errs...)
+}
+
+// listenUnix listens on a unix socket at path, replacing a socket file left
+// behind by an earlier run, and sets its permissions to perm.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, err
 	}
+	return listener, nil
 }
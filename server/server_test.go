@@ -0,0 +1,559 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"kv-store/config"
+	"kv-store/store"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.sock")
+	s := mustNew(t, WithUnixSocket(path, 0o600))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket permissions = %o, expected 600", perm)
+	}
+
+	reader := bufio.NewReader(conn)
+	for _, exchange := range []struct{ request, reply string }{
+		{"SET name batman\r\n", "OK\r\n"},
+		{"GET name\r\n", "batman\r\n"},
+	} {
+		conn.Write([]byte(exchange.request))
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reply to %q: %v", exchange.request, err)
+		}
+		if reply != exchange.reply {
+			t.Errorf("reply to %q = %q, expected %q", exchange.request, reply, exchange.reply)
+		}
+	}
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Errorf("Stop() = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after Stop(): %v", err)
+	}
+}
+
+func TestServer_StartAndStop(t *testing.T) {
+	s := mustNew(t, WithAddress("127.0.0.1:0"))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	addr := s.Addr().String()
+	if _, port, _ := net.SplitHostPort(addr); port == "0" {
+		t.Fatalf("Addr() = %s, expected the bound port", addr)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("PING\r\n"))
+	if reply, _ := reader.ReadString('\n'); reply != "PONG\r\n" {
+		t.Fatalf("PING = %q, expected PONG", reply)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop() = %v, expected connections to close", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("read after Stop() = %v, expected the connection to be closed", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Dial() after Stop() succeeded, expected the listener to be closed")
+	}
+}
+
+func TestServer_NoListener(t *testing.T) {
+	if err := mustNew(t).Start(); err == nil {
+		t.Error("Start() with no address or unix socket succeeded")
+	}
+}
+
+func TestServe_CallerListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	served := make(chan error)
+	go func() { served <- Serve(listener, store.CreateNewStore(store.NewMemoryStorage(16))) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PING\r\n"))
+	if reply, _ := bufio.NewReader(conn).ReadString('\n'); reply != "PONG\r\n" {
+		t.Fatalf("PING = %q, expected PONG", reply)
+	}
+
+	listener.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve() = %v, expected nil once the listener was closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() did not return after the listener was closed")
+	}
+}
+
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestServe_AcceptError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer listener.Close()
+
+	acceptErr := errors.New("too many open files")
+	err = Serve(failingListener{listener, acceptErr}, store.CreateNewStore(store.NewMemoryStorage(16)))
+	if err != acceptErr {
+		t.Errorf("Serve() = %v, expected %v", err, acceptErr)
+	}
+}
+
+func TestServer_StopClosesServedListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	s := mustNew(t)
+	served := make(chan error)
+	go func() { served <- s.Serve(listener) }()
+
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve() = %v, expected nil after Stop()", err)
+	}
+}
+
+func TestApplySocketOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer listener.Close()
+	tcpConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer tcpConn.Close()
+	pipeConn, other := net.Pipe()
+	defer pipeConn.Close()
+	defer other.Close()
+
+	settings := config.Default()
+	settings.TCPKeepAlive = 0
+	settings.TCPNoDelay = false
+	settings.TCPRecvBuffer = 64 << 10
+	settings.TCPSendBuffer = 64 << 10
+
+	testCases := []struct {
+		name string
+		conn net.Conn
+	}{
+		{"tcp", tcpConn},
+		{"tls", tls.Server(tcpConn, &tls.Config{})},
+		{"not tcp", pipeConn},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := applySocketOptions(tc.conn, settings); err != nil {
+				t.Errorf("applySocketOptions() = %v", err)
+			}
+			if err := applySocketOptions(tc.conn, config.Default()); err != nil {
+				t.Errorf("applySocketOptions() with the defaults = %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_SocketOptions(t *testing.T) {
+	s := mustNew(t, WithAddress("127.0.0.1:0"))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer s.Stop(context.Background())
+	for _, param := range [][2]string{{"tcp-keepalive", "60"}, {"tcp-nodelay", "no"}, {"tcp-recv-buffer", "128kb"}} {
+		if err := s.handler.store.Config().Set(param[0], param[1]); err != nil {
+			t.Fatalf("Set(%q, %q) failed: %v", param[0], param[1], err)
+		}
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("INFO network\r\n"))
+	reader := bufio.NewReader(conn)
+	var info []string
+	for range 5 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading INFO network: %v", err)
+		}
+		info = append(info, strings.TrimSuffix(line, "\r\n"))
+	}
+
+	expected := []string{"# Network", "tcp_keepalive:60", "tcp_nodelay:0", "tcp_recv_buffer:131072", "tcp_send_buffer:0"}
+	if strings.Join(info, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("INFO network = %q, expected %q", info, expected)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails as many accepts as failures holds with a temporary
+// error, and hands out the connections it accepts through wrap.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int64
+	wrap     func(net.Conn) net.Conn
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil || l.wrap == nil {
+		return conn, err
+	}
+	return l.wrap(conn), nil
+}
+
+func TestServe_TemporaryAcceptErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	flaky := &flakyListener{Listener: listener}
+	flaky.failures.Store(5)
+	s := mustNew(t)
+	served := make(chan error)
+	go func() { served <- s.Serve(flaky) }()
+	defer s.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("PING\r\n"))
+	if reply, _ := bufio.NewReader(conn).ReadString('\n'); reply != "PONG\r\n" {
+		t.Fatalf("PING = %q, expected PONG after the accept errors", reply)
+	}
+	if failures := flaky.failures.Load(); failures >= 0 {
+		t.Errorf("%d accept errors left, expected all of them retried", failures+1)
+	}
+
+	listener.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve() = %v, expected nil once the listener was closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() did not return after the listener was closed")
+	}
+}
+
+type panickingConn struct {
+	net.Conn
+}
+
+func (panickingConn) Read([]byte) (int, error) {
+	panic("bad command")
+}
+
+func TestServe_HandlerPanic(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	var accepted atomic.Int64
+	s := mustNew(t)
+	go s.Serve(&flakyListener{Listener: listener, wrap: func(conn net.Conn) net.Conn {
+		if accepted.Add(1) == 1 {
+			return panickingConn{conn}
+		}
+		return conn
+	}})
+	defer s.Stop(context.Background())
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer first.Close()
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(first).ReadByte(); err != io.EOF {
+		t.Errorf("read from the panicked connection = %v, expected it to be closed", err)
+	}
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() after the panic failed: %v", err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	second.Write([]byte("PING\r\n"))
+	if reply, _ := bufio.NewReader(second).ReadString('\n'); reply != "PONG\r\n" {
+		t.Errorf("PING after the panic = %q, expected PONG", reply)
+	}
+}
+
+func TestServer_MultipleAddresses(t *testing.T) {
+	addresses := []string{"127.0.0.1:0", "127.0.0.1:0"}
+	if probe, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		probe.Close()
+		addresses = append(addresses, "[::1]:0")
+	}
+	s := mustNew(t, WithAddress(addresses...))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	addrs := s.Addrs()
+	if len(addrs) != len(addresses) {
+		t.Fatalf("Addrs() = %v, expected one per address in %v", addrs, addresses)
+	}
+
+	var bound []string
+	for _, addr := range addrs {
+		bound = append(bound, addr.String())
+	}
+	expected := "listeners:" + strings.Join(bound, ",") + "\r\n"
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatalf("Dial(%s) failed: %v", addr, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("INFO server\r\n"))
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		if info, _ := reader.ReadString('\n'); info != expected {
+			t.Errorf("INFO server on %s = %q, expected %q", addr, info, expected)
+		}
+	}
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	for _, addr := range addrs {
+		if _, err := net.Dial("tcp", addr.String()); err == nil {
+			t.Errorf("Dial(%s) after Stop() succeeded, expected the listener to be closed", addr)
+		}
+	}
+}
+
+func TestServer_BindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	defer taken.Close()
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	free := probe.Addr().String()
+	probe.Close()
+
+	s := mustNew(t, WithAddress(free, taken.Addr().String()))
+	if err := s.Start(); err == nil {
+		s.Stop(context.Background())
+		t.Fatal("Start() succeeded with an address already in use")
+	}
+	if addrs := s.Addrs(); len(addrs) != 0 {
+		t.Errorf("Addrs() = %v after a failed Start()", addrs)
+	}
+	// The address bound before the failure was released.
+	listener, err := net.Listen("tcp", free)
+	if err != nil {
+		t.Fatalf("Listen(%s) after a failed Start() = %v, expected it to be free", free, err)
+	}
+	listener.Close()
+}
+
+func TestServer_LogHandler(t *testing.T) {
+	var output bytes.Buffer
+	s := mustNew(t, WithAddress("127.0.0.1:0"), WithLogger(slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, command := range []string{"CLIENT ID", "SELECT 3", "SET counter one", "INCR counter", "QUIT"} {
+		conn.Write([]byte(command + "\r\n"))
+		reader.ReadString('\n')
+	}
+	conn.Close()
+	// Stop waits for the connection to finish, so every record is written.
+	s.Stop(context.Background())
+
+	type record struct {
+		Level  string
+		Msg    string
+		Client int64
+		DB     *int
+	}
+	var records []record
+	decoder := json.NewDecoder(&output)
+	for decoder.More() {
+		var r record
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatalf("decoding log records: %v", err)
+		}
+		records = append(records, r)
+	}
+
+	db := 3
+	for _, expected := range []record{
+		{"INFO", "Server listening", 0, nil},
+		{"DEBUG", "Accepted connection", 1, nil},
+		{"INFO", "Command failed", 1, &db},
+		{"DEBUG", "Client quit", 1, nil},
+	} {
+		if !slices.ContainsFunc(records, func(r record) bool {
+			return r.Level == expected.Level && r.Msg == expected.Msg && r.Client == expected.Client &&
+				(expected.DB == nil || r.DB != nil && *r.DB == *expected.DB)
+		}) {
+			t.Errorf("no %s record %q for client %d in %+v", expected.Level, expected.Msg, expected.Client, records)
+		}
+	}
+}
+
+func TestServer_DebugEndpoint(t *testing.T) {
+	s := mustNew(t, WithAddress("127.0.0.1:0"), WithDebugAddress("127.0.0.1:0"))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer s.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, command := range []string{"SET name batman", "MULTI", "SET name robin", "EXEC"} {
+		conn.Write([]byte(command + "\r\n"))
+		reader.ReadString('\n')
+	}
+
+	base := "http://" + s.DebugAddr().String()
+	response, err := http.Get(base + "/debug/vars")
+	if err != nil {
+		t.Fatalf("GET /debug/vars failed: %v", err)
+	}
+	var vars struct {
+		Memstats map[string]any
+		Kvstore  struct {
+			Keys                 map[string]int64
+			Commands             map[string]int64
+			TransactionsExecuted int64 `json:"transactions_executed"`
+		}
+	}
+	err = json.NewDecoder(response.Body).Decode(&vars)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("decoding /debug/vars: %v", err)
+	}
+	if vars.Memstats == nil {
+		t.Error("/debug/vars is missing the global memstats")
+	}
+	if vars.Kvstore.Keys["db0"] != 1 || vars.Kvstore.Commands["SET"] != 2 || vars.Kvstore.Commands["MULTI"] != 1 || vars.Kvstore.TransactionsExecuted != 1 {
+		t.Errorf("/debug/vars kvstore = %+v, expected 1 key, 2 SETs, 1 MULTI and 1 executed transaction", vars.Kvstore)
+	}
+
+	response, err = http.Get(base + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatalf("GET /debug/pprof/goroutine failed: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("GET /debug/pprof/goroutine = %s", response.Status)
+	}
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	if _, err := http.Get(base + "/debug/vars"); err == nil {
+		t.Error("debug server still answering after Stop()")
+	}
+}
+
+func TestServer_DebugAddressNotLoopback(t *testing.T) {
+	for _, address := range []string{":0", "0.0.0.0:0", "example.com:6060"} {
+		if _, err := New(WithAddress("127.0.0.1:0"), WithDebugAddress(address)); err == nil {
+			t.Errorf("New() with debug address %q succeeded, expected only loopback addresses to be allowed", address)
+		}
+	}
+}
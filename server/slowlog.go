@@ -0,0 +1,170 @@
+package server
+
+import (
+	"kv-store/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var slowlogHelp = []string{
+	"SLOWLOG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"GET [<count>]",
+	"    Return top <count> entries from the slowlog (default: 10, -1 means all).",
+	"    Entries are made of:",
+	"    id, timestamp, time in microseconds, client address, client name,",
+	"    and the command with its arguments.",
+	"LEN",
+	"    Return the length of the slowlog.",
+	"RESET",
+	"    Reset the slowlog.",
+	"HELP",
+	"    Print this help.",
+}
+
+const (
+	// slowlogMaxArgs and slowlogMaxArgLength bound what an entry keeps of a
+	// command, as in Redis.
+	slowlogMaxArgs      = 32
+	slowlogMaxArgLength = 128
+)
+
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	command  string
+	addr     string
+	name     string
+}
+
+func (e slowlogEntry) String() string {
+	return "id=" + strconv.FormatInt(e.id, 10) +
+		" time=" + strconv.FormatInt(e.time.Unix(), 10) +
+		" duration=" + strconv.FormatInt(e.duration.Microseconds(), 10) +
+		" addr=" + e.addr +
+		" name=" + e.name +
+		" command=" + e.command
+}
+
+// formatSlowCommand renders a command for an entry, keeping at most
+// slowlogMaxArgs arguments of at most slowlogMaxArgLength bytes each.
+func formatSlowCommand(command string, args []string) string {
+	all := append([]string{command}, args...)
+	omitted := 0
+	if len(all) > slowlogMaxArgs {
+		omitted = len(all) - slowlogMaxArgs + 1
+		all = all[:slowlogMaxArgs-1]
+	}
+	parts := make([]string, len(all))
+	for i, arg := range all {
+		if len(arg) > slowlogMaxArgLength {
+			parts[i] = quoteArg(arg[:slowlogMaxArgLength]) + "... (" + strconv.Itoa(len(arg)-slowlogMaxArgLength) + " more bytes)"
+		} else {
+			parts[i] = quoteArg(arg)
+		}
+	}
+	if omitted > 0 {
+		parts = append(parts, "... ("+strconv.Itoa(omitted)+" more arguments)")
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteArg quotes an argument that would otherwise blur into its neighbours.
+func quoteArg(arg string) string {
+	if arg == "" || strings.ContainsFunc(arg, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) || r == '"' }) {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
+
+// slowlog keeps the most recent commands that took longer than
+// slowlog-log-slower-than microseconds, at most slowlog-max-len of them.
+type slowlog struct {
+	mutex   sync.Mutex
+	entries []slowlogEntry
+	lastId  int64
+}
+
+// observe records a command that ran for elapsed if that is over the
+// threshold. A negative threshold disables the log, and 0 records every
+// command.
+func (l *slowlog) observe(settings config.Settings, c *client, command string, args []string, elapsed time.Duration) {
+	threshold := settings.SlowlogSlowerThan
+	if threshold < 0 || elapsed < time.Duration(threshold)*time.Microsecond {
+		return
+	}
+
+	formatted := formatSlowCommand(command, args)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lastId++
+	l.entries = append(l.entries, slowlogEntry{
+		id:       l.lastId,
+		time:     time.Now(),
+		duration: elapsed,
+		command:  formatted,
+		addr:     c.addr,
+		name:     c.getName(),
+	})
+	if excess := int64(len(l.entries)) - settings.SlowlogMaxLen; excess > 0 {
+		l.entries = append(l.entries[:0], l.entries[excess:]...)
+	}
+}
+
+// get returns up to count entries, newest first, or all of them when count
+// is negative.
+func (l *slowlog) get(count int) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	lines := make([]string, count)
+	for i := range count {
+		lines[i] = l.entries[len(l.entries)-1-i].String()
+	}
+	return lines
+}
+
+func (l *slowlog) len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.entries)
+}
+
+func (l *slowlog) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = nil
+}
+
+func (h *handler) handleSlowlog(args []string) (any, error) {
+	if len(args) < 1 {
+		return nil, ErrWrongNumberOfArgs("SLOWLOG")
+	}
+	subcommand := strings.ToUpper(args[0])
+	switch {
+	case subcommand == "GET" && len(args) <= 2:
+		count := 10
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < -1 {
+				return nil, ErrNotInteger
+			}
+			count = n
+		}
+		return h.slowlog.get(count), nil
+	case subcommand == "LEN" && len(args) == 1:
+		return h.slowlog.len(), nil
+	case subcommand == "RESET" && len(args) == 1:
+		h.slowlog.reset()
+		return ResOk, nil
+	case subcommand == "HELP" && len(args) == 1:
+		return slowlogHelp, nil
+	default:
+		return nil, ErrUnknownSubcommand("SLOWLOG", args[0])
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"kv-store/config"
+	"kv-store/store"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowlog_Observe(t *testing.T) {
+	settings := config.Default()
+	settings.SlowlogMaxLen = 2
+	c := &client{addr: "127.0.0.1:5000"}
+	log := &slowlog{}
+
+	log.observe(settings, c, "GET", []string{"fast"}, time.Millisecond)
+	settings.SlowlogSlowerThan = 0
+	log.observe(settings, c, "SET", []string{"a b", ""}, time.Millisecond)
+	log.observe(settings, c, "GET", []string{strings.Repeat("k", 130)}, 2*time.Millisecond)
+	log.observe(settings, c, "DEL", make([]string, 40), 3*time.Millisecond)
+	settings.SlowlogSlowerThan = -1
+	log.observe(settings, c, "GET", []string{"disabled"}, time.Second)
+
+	entries := log.get(-1)
+	if len(entries) != 2 {
+		t.Fatalf("get(-1) returned %d entries, expected 2: %q", len(entries), entries)
+	}
+	expectedPrefixes := []string{
+		"id=3 ",
+		"id=2 ",
+	}
+	expectedSuffixes := []string{
+		` duration=3000 addr=127.0.0.1:5000 name= command=DEL` + strings.Repeat(` ""`, 30) + ` ... (10 more arguments)`,
+		` duration=2000 addr=127.0.0.1:5000 name= command=GET ` + strings.Repeat("k", 128) + `... (2 more bytes)`,
+	}
+	for i, entry := range entries {
+		if !strings.HasPrefix(entry, expectedPrefixes[i]) || !strings.HasSuffix(entry, expectedSuffixes[i]) {
+			t.Errorf("entry %d = %q, expected %q...%q", i, entry, expectedPrefixes[i], expectedSuffixes[i])
+		}
+	}
+	if got := log.get(1); !reflect.DeepEqual(got, entries[:1]) {
+		t.Errorf("get(1) = %q, expected %q", got, entries[:1])
+	}
+
+	log.reset()
+	if got := log.len(); got != 0 {
+		t.Errorf("len() after reset = %d, expected 0", got)
+	}
+	settings.SlowlogSlowerThan = 0
+	log.observe(settings, c, "GET", nil, 0)
+	if got := log.get(-1); len(got) != 1 || !strings.HasPrefix(got[0], "id=4 ") {
+		t.Errorf("get(-1) after reset = %q, expected an entry with id 4", got)
+	}
+}
+
+func TestSlowlog_Concurrent(t *testing.T) {
+	settings := config.Default()
+	settings.SlowlogSlowerThan = 0
+	settings.SlowlogMaxLen = 8
+	c := &client{addr: "127.0.0.1:5000"}
+	log := &slowlog{}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				log.observe(settings, c, "GET", []string{"key"}, time.Millisecond)
+				log.get(2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries := log.get(-1)
+	if len(entries) != 8 || !strings.HasPrefix(entries[0], "id=400 ") {
+		t.Errorf("get(-1) = %q, expected 8 entries starting with id 400", entries)
+	}
+}
+
+func TestHandleConnection_Slowlog(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go newHandler(store.CreateNewStore(store.NewMemoryStorage(16))).handleConnection(serverConn)
+	defer clientConn.Close()
+	reader := bufio.NewReader(clientConn)
+
+	sendCommand(t, clientConn, reader, "SET before threshold", 1)
+	sendCommand(t, clientConn, reader, "CONFIG SET slowlog-log-slower-than 0", 1)
+	sendCommand(t, clientConn, reader, "CLIENT SETNAME slow", 1)
+	sendCommand(t, clientConn, reader, "SET name batman", 1)
+	sendCommand(t, clientConn, reader, "MULTI", 1)
+	sendCommand(t, clientConn, reader, "GET name", 1)
+	sendCommand(t, clientConn, reader, "EXEC", 1)
+
+	// Connection commands are not timed, and queued commands are timed as
+	// part of their EXEC.
+	if got := sendCommand(t, clientConn, reader, "SLOWLOG LEN", 1); got[0] != "2" {
+		t.Errorf("SLOWLOG LEN = %q, expected 2", got[0])
+	}
+	got := sendCommand(t, clientConn, reader, "SLOWLOG GET", 2)
+	expected := []string{" name=slow command=EXEC", " name=slow command=SET name batman"}
+	for i := range expected {
+		if !strings.HasPrefix(got[i], "id=") || !strings.HasSuffix(got[i], expected[i]) {
+			t.Errorf("SLOWLOG GET line %d = %q, expected it to end with %q", i, got[i], expected[i])
+		}
+	}
+
+	testCases := []struct {
+		command  string
+		expected string
+	}{
+		{"SLOWLOG GET -2", ErrNotInteger.Error()},
+		{"SLOWLOG LEN extra", ErrUnknownSubcommand("SLOWLOG", "LEN").Error()},
+		{"SLOWLOG RESET", "OK"},
+		{"SLOWLOG LEN", "0"},
+	}
+	for _, tc := range testCases {
+		if got := sendCommand(t, clientConn, reader, tc.command, 1); got[0] != tc.expected {
+			t.Errorf("%s = %q, expected %q", tc.command, got[0], tc.expected)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a TLS client may take to finish its
+// handshake before the connection is dropped.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// NewTLSConfig loads the server certificate and key for a TLS listener.
+// authClients says whether clients must present a certificate signed by a CA
+// in caCertFile: "yes" rejects a client without one at the handshake,
+// "optional" verifies one only if given, and "no" never asks.
+func NewTLSConfig(certFile, keyFile, caCertFile, authClients string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch strings.ToLower(authClients) {
+	case "yes":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		return config, nil
+	default:
+		return nil, fmt.Errorf("invalid tls-auth-clients %q, expected yes, no or optional", authClients)
+	}
+
+	if caCertFile == "" {
+		return nil, errors.New("tls-auth-clients needs a CA certificate to verify clients against")
+	}
+	pem, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caCertFile)
+	}
+	return config, nil
+}
+
+// handshake completes the TLS handshake up front, so a client whose
+// certificate is rejected never gets a client ID. It returns the common name
+// of the client's verified certificate, if it sent one.
+func handshake(conn *tls.Conn) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return "", err
+	}
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return "", nil
+	}
+	return chains[0][0].Subject.CommonName, nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"kv-store/store"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testIssuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testIssuer {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	key, cert, _ := createTestCert(t, template, template, nil)
+	return &testIssuer{cert: cert, key: key}
+}
+
+// issue signs a certificate with the given common name, returning it as a
+// tls.Certificate and its certificate and key as PEM.
+func (ca *testIssuer) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	_, _, pems := createTestCert(t, template, ca.cert, ca.key)
+	certificate, err := tls.X509KeyPair(pems[0], pems[1])
+	if err != nil {
+		t.Fatalf("X509KeyPair() failed: %v", err)
+	}
+	return certificate, pems[0], pems[1]
+}
+
+func createTestCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate, [2][]byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	if parentKey == nil {
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() failed: %v", err)
+	}
+	return key, cert, [2][]byte{
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	return path
+}
+
+func TestHandleConnection_ClientCertificates(t *testing.T) {
+	ca := newTestCA(t, "kv-store test CA")
+	caPath := writeTestFile(t, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	_, serverCert, serverKey := ca.issue(t, "kv-store", x509.ExtKeyUsageServerAuth)
+	certPath := writeTestFile(t, "server.pem", serverCert)
+	keyPath := writeTestFile(t, "server-key.pem", serverKey)
+
+	reporter, _, _ := ca.issue(t, "reporter", x509.ExtKeyUsageClientAuth)
+	stranger, _, _ := ca.issue(t, "stranger", x509.ExtKeyUsageClientAuth)
+	untrusted, _, _ := newTestCA(t, "another CA").issue(t, "reporter", x509.ExtKeyUsageClientAuth)
+
+	testCases := []struct {
+		name        string
+		authClients string
+		client      *tls.Certificate
+		accepted    bool
+		certCN      string
+		user        string
+	}{
+		{"required and given", "yes", &stranger, true, "stranger", "default"},
+		{"required and missing", "yes", nil, false, "", ""},
+		{"required and signed by another CA", "yes", &untrusted, false, "", ""},
+		{"optional and missing", "optional", nil, true, "", "default"},
+		{"optional and signed by another CA", "optional", &untrusted, false, "", ""},
+		{"common name of an ACL user", "optional", &reporter, true, "reporter", "reporter"},
+		{"not asked for", "no", &reporter, true, "", "default"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := NewTLSConfig(certPath, keyPath, caPath, tc.authClients)
+			if err != nil {
+				t.Fatalf("NewTLSConfig() failed: %v", err)
+			}
+			h := newHandler(store.CreateNewStore(store.NewMemoryStorage(16)))
+			h.users.setUser("reporter", []string{"on", ">secret", "allcommands", "allkeys"})
+
+			s := newServer(listenConfig{Addresses: []string{"127.0.0.1:0"}, TLS: config}, h)
+			if err := s.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer s.Stop(context.Background())
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+			clientConfig := &tls.Config{RootCAs: roots}
+			if tc.client != nil {
+				// Sent even when the server would not accept its CA, which
+				// the default selection would skip.
+				clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return tc.client, nil
+				}
+			}
+			conn, err := tls.Dial("tcp", s.Addr().String(), clientConfig)
+			if err == nil {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				_, err = conn.Write([]byte("CLIENT INFO\r\n"))
+			}
+			var info string
+			if err == nil {
+				info, err = bufio.NewReader(conn).ReadString('\n')
+			}
+
+			if !tc.accepted {
+				if err == nil {
+					t.Fatalf("connection accepted with CLIENT INFO %q, expected the handshake to fail", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connection rejected: %v", err)
+			}
+			for _, field := range []string{"cert-cn=" + tc.certCN, "user=" + tc.user} {
+				if !slices.Contains(strings.Fields(info), field) {
+					t.Errorf("CLIENT INFO = %q, expected %s", info, field)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig_Invalid(t *testing.T) {
+	ca := newTestCA(t, "kv-store test CA")
+	_, serverCert, serverKey := ca.issue(t, "kv-store", x509.ExtKeyUsageServerAuth)
+	certPath := writeTestFile(t, "server.pem", serverCert)
+	keyPath := writeTestFile(t, "server-key.pem", serverKey)
+
+	testCases := []struct {
+		name        string
+		caCertFile  string
+		authClients string
+	}{
+		{"client auth without a CA", "", "yes"},
+		{"unknown mode", "", "sometimes"},
+		{"CA file without certificates", writeTestFile(t, "empty.pem", []byte("not a certificate")), "optional"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewTLSConfig(certPath, keyPath, tc.caCertFile, tc.authClients); err == nil {
+				t.Error("NewTLSConfig() succeeded, expected an error")
+			}
+		})
+	}
+}
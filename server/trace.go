@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// traceRequest logs a request read from a client in trace mode, along with
+// the error reading it, if any. RESP arguments are quoted one by one, so
+// their boundaries stay visible.
+func traceRequest(logger *slog.Logger, maxLength int64, resp bool, line, command string, args []string, err error) {
+	request := strconv.Quote(line)
+	if resp {
+		quoted := []string{strconv.Quote(command)}
+		for _, arg := range args {
+			quoted = append(quoted, strconv.Quote(arg))
+		}
+		request = strings.Join(quoted, " ")
+	}
+	attrs := []any{"request", truncateTrace(request, maxLength)}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	logger.Info("Trace: received", attrs...)
+}
+
+// writeTraced writes reply as write does and logs the bytes it produced.
+func (w *replyWriter) writeTraced(reply any) {
+	writer := w.writer
+	var sent bytes.Buffer
+	w.writer = bufio.NewWriter(&sent)
+	w.writeUntraced(reply)
+	w.writer.Flush()
+	w.writer = writer
+
+	w.logger.Info("Trace: sent", "reply", truncateTrace(strconv.Quote(sent.String()), w.traceMaxLength))
+	writer.Write(sent.Bytes())
+}
+
+// truncateTrace cuts an escaped payload down to maxLength bytes, noting how
+// much was left out. A maxLength of 0 keeps all of it.
+func truncateTrace(payload string, maxLength int64) string {
+	if maxLength <= 0 || int64(len(payload)) <= maxLength {
+		return payload
+	}
+	return payload[:maxLength] + "... (" + strconv.Itoa(len(payload)-int(maxLength)) + " more bytes)"
+}
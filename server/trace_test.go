@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"kv-store/store"
+	"log/slog"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncateTrace(t *testing.T) {
+	testCases := []struct {
+		payload   string
+		maxLength int64
+		expected  string
+	}{
+		{`"GET" "name"`, 64, `"GET" "name"`},
+		{`"GET" "name"`, 5, `"GET"... (7 more bytes)`},
+		{`"GET" "name"`, 0, `"GET" "name"`},
+	}
+	for _, tc := range testCases {
+		if got := truncateTrace(tc.payload, tc.maxLength); got != tc.expected {
+			t.Errorf("truncateTrace(%q, %d) = %q, expected %q", tc.payload, tc.maxLength, got, tc.expected)
+		}
+	}
+}
+
+func TestHandleConnection_Trace(t *testing.T) {
+	var output bytes.Buffer
+	s := store.CreateNewStore(store.NewMemoryStorage(16))
+	s.SetLogger(slog.New(slog.NewJSONHandler(&output, nil)))
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		newHandler(s).handleConnection(serverConn)
+		close(done)
+	}()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(clientConn)
+	send := func(request string, replyLines int) {
+		t.Helper()
+		clientConn.Write([]byte(request))
+		for range replyLines {
+			if _, err := reader.ReadString('\n'); err != nil {
+				t.Fatalf("reply to %q: %v", request, err)
+			}
+		}
+	}
+
+	send("GET untraced\r\n", 1)
+	send("CONFIG SET trace yes\r\n", 1)
+	send("CONFIG SET trace-max-length 32\r\n", 1)
+	send(respRequest("SET", "bin", "\x00\xff"), 1)
+	send("GET "+strings.Repeat("k", 40)+"\r\n", 1)
+	send("*1\r\n$4\r\nPINGX\r\n", 1)
+	clientConn.Close()
+	<-done
+
+	type record struct {
+		Msg     string
+		Request string
+		Reply   string
+		Error   string
+	}
+	var records []record
+	decoder := json.NewDecoder(&output)
+	for decoder.More() {
+		var r record
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatalf("decoding log records: %v", err)
+		}
+		if strings.HasPrefix(r.Msg, "Trace: ") {
+			records = append(records, r)
+		}
+	}
+
+	// Tracing starts with the request after CONFIG SET trace yes, and the
+	// new length applies from the request after it.
+	expected := []record{
+		{Msg: "Trace: received", Request: `"CONFIG SET trace-max-length 32\r\n"`},
+		{Msg: "Trace: sent", Reply: `"OK\r\n"`},
+		{Msg: "Trace: received", Request: `"SET" "bin" "\x00\xff"`},
+		{Msg: "Trace: sent", Reply: `"+OK\r\n"`},
+		{Msg: "Trace: received", Request: `"GET kkkkkkkkkkkkkkkkkkkkkkkkkkk... (18 more bytes)`},
+		{Msg: "Trace: sent", Reply: `"(nil)\r\n"`},
+		{Msg: "Trace: received", Request: `""`, Error: "ERR Protocol error: expected CRLF after bulk string"},
+		{Msg: "Trace: sent", Reply: `"-ERR Protocol error: expected C... (26 more bytes)`},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("trace records:\n%+v\nexpected:\n%+v", records, expected)
+	}
+}
@@ -0,0 +1,350 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"kv-store/config"
+	"kv-store/errcode"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrMisconf = func(err error) error {
+		return errcode.Errorf(errcode.Misconf, "Errors writing to the AOF file: %v", err)
+	}
+	ErrAppendOnlyDisabled = errcode.New(errcode.Err, "append only file is not enabled")
+	ErrRewriteInProgress  = errcode.New(errcode.Err, "background append only file rewriting already in progress")
+)
+
+var (
+	aofSyncInterval = time.Second
+	syncFile        = (*os.File).Sync
+)
+
+type appendOnlyFile struct {
+	mutex   sync.Mutex
+	path    string
+	file    atomic.Pointer[os.File]
+	writer  *bufio.Writer
+	dbIndex int
+	done    chan struct{}
+	stopped chan struct{}
+
+	// rewriteBuffer collects everything appended while a rewrite is writing
+	// its snapshot, to be replayed onto the new file before the swap.
+	rewriteBuffer *bytes.Buffer
+}
+
+// EnableAppendOnly opens path for appending and from then on logs every write
+// as a command line the parser can replay.
+func (s *Store) EnableAppendOnly(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	aof := &appendOnlyFile{
+		path:    path,
+		writer:  bufio.NewWriter(file),
+		dbIndex: -1,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	aof.file.Store(file)
+	s.aof.Store(aof)
+	go s.syncAppendOnly(aof)
+	return nil
+}
+
+func (s *Store) CloseAppendOnly() error {
+	aof := s.aof.Swap(nil)
+	if aof == nil {
+		return nil
+	}
+	close(aof.done)
+	<-aof.stopped
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	file := aof.file.Load()
+	if err := aof.writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := syncFile(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (aof *appendOnlyFile) sync() error {
+	err := syncFile(aof.file.Load())
+	if errors.Is(err, os.ErrClosed) {
+		// The file was swapped out by a rewrite, which syncs it first.
+		return nil
+	}
+	return err
+}
+
+// syncAppendOnlyFile fsyncs the file, recording the time it took as a
+// latency event.
+func (s *Store) syncAppendOnlyFile(aof *appendOnlyFile) error {
+	start := time.Now()
+	err := aof.sync()
+	s.RecordLatency(LatencyAOFFsync, time.Since(start))
+	return err
+}
+
+// syncAppendOnly fsyncs once per interval under the everysec policy and, under
+// any policy, retries after a failure so writes are accepted again once the
+// disk recovers. Writes flush to the OS before returning, so the fsync does
+// not need the file's lock and never blocks command handling.
+func (s *Store) syncAppendOnly(aof *appendOnlyFile) {
+	defer close(aof.stopped)
+	ticker := time.NewTicker(aofSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-aof.done:
+			return
+		case <-ticker.C:
+			if s.config.Get().AppendFsync != config.FsyncEverySec && s.aofError.Load() == nil {
+				continue
+			}
+			s.setAppendOnlyError(s.syncAppendOnlyFile(aof))
+		}
+	}
+}
+
+func (s *Store) setAppendOnlyError(err error) {
+	if err == nil {
+		if s.aofError.Swap(nil) != nil {
+			s.logger.Info("Append only file writes recovered")
+		}
+		return
+	}
+	s.logger.Error("Error writing to append only file", "error", err)
+	s.aofError.Store(&err)
+}
+
+// CheckWrite returns an error while the append only file or a disk backed
+// storage is failing, as accepting writes that cannot be persisted would
+// silently lose them.
+func (s *Store) CheckWrite() error {
+	if err := s.aofError.Load(); err != nil {
+		return ErrMisconf(*err)
+	}
+	if persisted, ok := s.storage.(interface{ WriteError() error }); ok {
+		return persisted.WriteError()
+	}
+	return nil
+}
+
+// logWrite runs apply and appends the command it returns, if any. Holding the
+// file's lock across both keeps the log in the order writes were applied.
+func (s *Store) logWrite(dbIndex int, apply func() []string) {
+	s.logWrites(dbIndex, func() [][]string {
+		if args := apply(); args != nil {
+			return [][]string{args}
+		}
+		return nil
+	})
+}
+
+// logWrites is logWrite for a change that is logged as several commands.
+// The commands also go to the write feed, in the same order.
+func (s *Store) logWrites(dbIndex int, apply func() [][]string) {
+	if s.writeFeed == nil {
+		s.appendWrites(dbIndex, apply)
+		return
+	}
+	s.feedMutex.Lock()
+	defer s.feedMutex.Unlock()
+	if commands := s.appendWrites(dbIndex, apply); len(commands) > 0 {
+		s.writeFeed(dbIndex, commands)
+	}
+}
+
+// appendWrites runs apply and appends the commands it returns to the append
+// only file, if enabled, then returns them.
+func (s *Store) appendWrites(dbIndex int, apply func() [][]string) [][]string {
+	aof := s.aof.Load()
+	if aof == nil {
+		return apply()
+	}
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	commands := apply()
+	if len(commands) == 0 {
+		return nil
+	}
+	var err error
+	for _, args := range commands {
+		if err = aof.append(dbIndex, args); err != nil {
+			break
+		}
+	}
+	if err == nil && s.config.Get().AppendFsync == config.FsyncAlways {
+		err = s.syncAppendOnlyFile(aof)
+	}
+	if err != nil {
+		s.setAppendOnlyError(err)
+	}
+	return commands
+}
+
+func (aof *appendOnlyFile) append(dbIndex int, args []string) error {
+	var line strings.Builder
+	if dbIndex != aof.dbIndex {
+		line.WriteString("SELECT " + strconv.Itoa(dbIndex) + "\n")
+		aof.dbIndex = dbIndex
+	}
+	for i, arg := range args {
+		if i > 0 {
+			line.WriteString(" ")
+		}
+		line.WriteString(quoteArg(arg))
+	}
+	line.WriteString("\n")
+
+	if aof.rewriteBuffer != nil {
+		aof.rewriteBuffer.WriteString(line.String())
+	}
+	if _, err := aof.writer.WriteString(line.String()); err != nil {
+		return err
+	}
+	return aof.writer.Flush()
+}
+
+// BackgroundRewriteAppendOnly replaces the append only file with the minimal
+// command stream that rebuilds the current dataset. Writes keep being appended
+// to the old file meanwhile and are buffered, then copied onto the new file
+// right before it is renamed into place.
+func (s *Store) BackgroundRewriteAppendOnly() error {
+	aof := s.aof.Load()
+	if aof == nil {
+		return ErrAppendOnlyDisabled
+	}
+	if !s.rewriting.CompareAndSwap(false, true) {
+		return ErrRewriteInProgress
+	}
+
+	aof.mutex.Lock()
+	frozen := s.storage.Freeze()
+	aof.rewriteBuffer = &bytes.Buffer{}
+	aof.dbIndex = -1
+	aof.mutex.Unlock()
+
+	go func() {
+		defer s.rewriting.Store(false)
+		start := time.Now()
+		entries := frozenEntries(frozen)
+		frozen.Release()
+		err := s.rewriteAppendOnly(aof, entries)
+		s.lastRewriteDuration.Store(int64(time.Since(start)))
+		s.lastRewriteFailed.Store(err != nil)
+		if err != nil {
+			s.logger.Error("Background append only file rewrite failed", "error", err)
+			return
+		}
+		s.logger.Info("Background append only file rewrite completed")
+	}()
+	return nil
+}
+
+func (s *Store) rewriteAppendOnly(aof *appendOnlyFile, entries []snapshotEntry) error {
+	temp, err := os.CreateTemp(filepath.Dir(aof.path), filepath.Base(aof.path)+".rewrite-*")
+	if err != nil {
+		aof.stopRewrite()
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			temp.Close()
+			os.Remove(temp.Name())
+		}
+	}()
+
+	if _, err := temp.Write(encodeSnapshot(entries)); err != nil {
+		aof.stopRewrite()
+		return err
+	}
+	if err := syncFile(temp); err != nil {
+		aof.stopRewrite()
+		return err
+	}
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	tail := aof.rewriteBuffer.Bytes()
+	aof.rewriteBuffer = nil
+
+	if _, err := temp.Write(tail); err != nil {
+		return err
+	}
+	if err := syncFile(temp); err != nil {
+		return err
+	}
+	if info, err := os.Stat(aof.path); err == nil {
+		temp.Chmod(info.Mode().Perm())
+	}
+	if err := os.Rename(temp.Name(), aof.path); err != nil {
+		return err
+	}
+	swapped = true
+
+	old := aof.file.Load()
+	aof.writer.Flush()
+	syncFile(old)
+	aof.file.Store(temp)
+	aof.writer = bufio.NewWriter(temp)
+	old.Close()
+	return nil
+}
+
+func (aof *appendOnlyFile) stopRewrite() {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	aof.rewriteBuffer = nil
+}
+
+func (s *Store) PersistenceInfo() []string {
+	lastRewrite := int64(-1)
+	if duration := s.lastRewriteDuration.Load(); duration > 0 {
+		lastRewrite = int64(time.Duration(duration) / time.Second)
+	}
+
+	return []string{
+		"aof_enabled:" + formatFlag(s.aof.Load() != nil),
+		"aof_rewrite_in_progress:" + formatFlag(s.rewriting.Load()),
+		"aof_last_rewrite_time_sec:" + strconv.FormatInt(lastRewrite, 10),
+		"aof_last_bgrewrite_status:" + formatStatus(!s.lastRewriteFailed.Load()),
+		"aof_last_write_status:" + formatStatus(s.aofError.Load() == nil),
+		"rdb_bgsave_in_progress:" + formatFlag(s.saving.Load()),
+		"rdb_last_save_time:" + strconv.FormatInt(s.lastSave.Load(), 10),
+	}
+}
+
+func formatFlag(flag bool) string {
+	if flag {
+		return "1"
+	}
+	return "0"
+}
+
+func formatStatus(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "err"
+}
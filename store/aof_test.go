@@ -0,0 +1,194 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAppendOnly_LogsSuccessfulWrites(t *testing.T) {
+	store := getInMemoryStore(t)
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := store.EnableAppendOnly(path); err != nil {
+		t.Fatalf("EnableAppendOnly() failed: %v", err)
+	}
+
+	store.Set(0, "wizard", "gandalf the grey")
+	store.Get(0, "wizard")
+	store.Del(0, "missing")
+	store.Incr(0, "counter")
+	store.Set(2, "name", "batman")
+	store.Incr(2, "name")
+	store.Del(2, "name")
+	store.IncrBy(0, "counter", -5)
+
+	if err := store.CloseAppendOnly(); err != nil {
+		t.Fatalf("CloseAppendOnly() failed: %v", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	expected := strings.Join([]string{
+		"SELECT 0",
+		`SET wizard "gandalf the grey"`,
+		"INCRBY counter 1",
+		"SELECT 2",
+		"SET name batman",
+		"DEL name",
+		"SELECT 0",
+		"INCRBY counter -5",
+	}, "\n") + "\n"
+	if string(content) != expected {
+		t.Errorf("append only file =\n%s\nexpected\n%s", content, expected)
+	}
+}
+
+func TestAppendOnly_LogsTransactionRollback(t *testing.T) {
+	store := getInMemoryStore(t)
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	store.Set(0, "name", "batman")
+	store.EnableAppendOnly(path)
+
+	store.StartTransaction(1)
+	store.QueueCommand(1, "SET", []string{"name", "robin"})
+	store.QueueCommand(1, "INCR", []string{"name"})
+	if _, err := store.ExecuteTransaction(1, runCommand); err == nil {
+		t.Fatalf("expected transaction to fail")
+	}
+	store.CloseAppendOnly()
+
+	content, _ := os.ReadFile(path)
+	expected := "SELECT 0\nSET name robin\nSET name batman\n"
+	if string(content) != expected {
+		t.Errorf("append only file = %q, expected %q", content, expected)
+	}
+}
+
+func fakeSyncFile(t *testing.T, interval time.Duration, fail *atomic.Bool) *atomic.Int64 {
+	t.Helper()
+	var syncs atomic.Int64
+	previousSync, previousInterval := syncFile, aofSyncInterval
+	syncFile = func(*os.File) error {
+		syncs.Add(1)
+		if fail.Load() {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+	aofSyncInterval = interval
+	t.Cleanup(func() { syncFile, aofSyncInterval = previousSync, previousInterval })
+	return &syncs
+}
+
+func TestAppendOnly_FsyncPolicies(t *testing.T) {
+	var fail atomic.Bool
+	syncs := fakeSyncFile(t, 10*time.Millisecond, &fail)
+	store := getInMemoryStore(t)
+	store.Config().Set("appendfsync", "always")
+	store.EnableAppendOnly(filepath.Join(t.TempDir(), "appendonly.aof"))
+	defer store.CloseAppendOnly()
+
+	for range 3 {
+		store.Incr(0, "counter")
+	}
+	if got := syncs.Load(); got != 3 {
+		t.Errorf("always: %d fsyncs after 3 writes, expected 3", got)
+	}
+
+	store.Config().Set("appendfsync", "no")
+	for range 3 {
+		store.Incr(0, "counter")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := syncs.Load(); got != 3 {
+		t.Errorf("no: %d fsyncs, expected no more than the 3 from always", got)
+	}
+
+	store.Config().Set("appendfsync", "everysec")
+	store.Incr(0, "counter")
+	deadline := time.Now().Add(time.Second)
+	for syncs.Load() == 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := syncs.Load(); got == 3 {
+		t.Errorf("everysec: expected the background ticker to fsync")
+	}
+}
+
+func TestAppendOnly_FsyncErrorRejectsWrites(t *testing.T) {
+	var fail atomic.Bool
+	fakeSyncFile(t, 10*time.Millisecond, &fail)
+	store := getInMemoryStore(t)
+	store.Config().Set("appendfsync", "always")
+	store.EnableAppendOnly(filepath.Join(t.TempDir(), "appendonly.aof"))
+	defer store.CloseAppendOnly()
+
+	fail.Store(true)
+	store.Set(0, "name", "batman")
+
+	expected := ErrMisconf(errors.New("disk full"))
+	if err := store.CheckWrite(); err == nil || err.Error() != expected.Error() {
+		t.Fatalf("CheckWrite() = %v, expected %v", err, expected)
+	}
+
+	fail.Store(false)
+	deadline := time.Now().Add(time.Second)
+	for store.CheckWrite() != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := store.CheckWrite(); err != nil {
+		t.Errorf("CheckWrite() after the disk recovered = %v, expected nil", err)
+	}
+}
+
+func TestBackgroundRewriteAppendOnly_Errors(t *testing.T) {
+	store := getInMemoryStore(t)
+
+	if err := store.BackgroundRewriteAppendOnly(); err != ErrAppendOnlyDisabled {
+		t.Errorf("BackgroundRewriteAppendOnly() without AOF = %v, expected %v", err, ErrAppendOnlyDisabled)
+	}
+
+	store.EnableAppendOnly(filepath.Join(t.TempDir(), "appendonly.aof"))
+	defer store.CloseAppendOnly()
+	store.rewriting.Store(true)
+	if err := store.BackgroundRewriteAppendOnly(); err != ErrRewriteInProgress {
+		t.Errorf("BackgroundRewriteAppendOnly() during a rewrite = %v, expected %v", err, ErrRewriteInProgress)
+	}
+}
+
+func TestBackgroundRewriteAppendOnly_ShrinksFile(t *testing.T) {
+	store := getInMemoryStore(t)
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	store.EnableAppendOnly(path)
+	defer store.CloseAppendOnly()
+
+	for range 100 {
+		store.Incr(0, "counter")
+	}
+	before, _ := os.Stat(path)
+
+	if err := store.BackgroundRewriteAppendOnly(); err != nil {
+		t.Fatalf("BackgroundRewriteAppendOnly() failed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for store.rewriting.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	store.Incr(0, "counter")
+
+	content, _ := os.ReadFile(path)
+	if int64(len(content)) >= before.Size() {
+		t.Errorf("rewritten file is %d bytes, expected less than %d", len(content), before.Size())
+	}
+	expected := "SELECT 0\nSET counter 100\nSELECT 0\nINCRBY counter 1\n"
+	if string(content) != expected {
+		t.Errorf("rewritten file = %q, expected %q", content, expected)
+	}
+	info := strings.Join(store.PersistenceInfo(), "\n")
+	if !strings.Contains(info, "aof_rewrite_in_progress:0") || !strings.Contains(info, "aof_last_bgrewrite_status:ok") {
+		t.Errorf("PersistenceInfo() = %q, expected a completed rewrite", info)
+	}
+}
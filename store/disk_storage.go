@@ -0,0 +1,562 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/maphash"
+	"kv-store/errcode"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	diskFilename = "kv.db"
+
+	// recordHeaderSize is the access time and LFU counter stored in front
+	// of every value.
+	recordHeaderSize = 9
+
+	// accessResolution bounds how stale a stored access time may get before
+	// a read rewrites it, so reads do not each turn into a disk write. The
+	// LFU counter is bumped on those rewrites only, so it counts at most one
+	// read per key per accessResolution.
+	accessResolution = time.Second
+
+	// versionSlots is how many version counters each database's keys are
+	// hashed into.
+	versionSlots = 1024
+)
+
+var (
+	ErrDiskStorageWrite = func(err error) error {
+		return errcode.Errorf(errcode.Misconf, "disk storage failed to persist a write: %v", err)
+	}
+	ErrDiskDBOutOfRange = func(dbIndex, numDatabases int) error {
+		return errcode.Errorf(errcode.Err, "disk storage holds keys in database %d but only %d databases are configured", dbIndex, numDatabases)
+	}
+)
+
+// DiskStorage keeps every database in a bucket of an embedded bbolt file, so
+// the dataset can outgrow memory. Each value is stored behind its last access
+// time and LFU counter so OBJECT IDLETIME and OBJECT FREQ survive restarts.
+//
+// Key versions live in memory only, as counters shared by the keys hashing
+// to the same slot. A slot is bumped once a write to one of its keys has
+// committed, so a reader never sees a new version before the new value.
+type DiskStorage struct {
+	db         *bolt.DB
+	buckets    [][]byte
+	usedMemory memoryCounter
+	usage      []usageCounter
+	quota      quotaLimits
+	seed       maphash.Seed
+	clock      atomic.Uint64
+	versions   [][]atomic.Uint64
+	writeError atomic.Pointer[error]
+	logger     *slog.Logger
+	wallClock  Clock
+}
+
+// OpenDiskStorage opens or creates the data file in dir, creating a bucket
+// for each database that does not have one yet.
+func OpenDiskStorage(dir string, numDatabases int) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, diskFilename), 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &DiskStorage{
+		db:        db,
+		buckets:   make([][]byte, numDatabases),
+		usage:     make([]usageCounter, numDatabases),
+		seed:      maphash.MakeSeed(),
+		versions:  make([][]atomic.Uint64, numDatabases),
+		logger:    slog.Default(),
+		wallClock: systemClock{},
+	}
+	for i := range numDatabases {
+		ds.buckets[i] = []byte("db" + strconv.Itoa(i))
+		ds.versions[i] = make([]atomic.Uint64, versionSlots)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for dbIndex, name := range ds.buckets {
+			bucket, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			err = bucket.ForEach(func(key, record []byte) error {
+				ds.usage[dbIndex].add(1, recordUsage(key, record))
+				ds.usedMemory.add(recordUsage(key, record))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return checkExtraBuckets(tx, numDatabases)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ds, nil
+}
+
+// checkExtraBuckets fails when the file holds keys in a database numDatabases
+// leaves out, which would otherwise be silently hidden.
+func checkExtraBuckets(tx *bolt.Tx, numDatabases int) error {
+	return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		dbIndex, err := strconv.Atoi(strings.TrimPrefix(string(name), "db"))
+		if err != nil || dbIndex < numDatabases {
+			return nil
+		}
+		if key, _ := bucket.Cursor().First(); key != nil {
+			return ErrDiskDBOutOfRange(dbIndex, numDatabases)
+		}
+		return nil
+	})
+}
+
+func (ds *DiskStorage) Close() error {
+	return ds.db.Close()
+}
+
+func (ds *DiskStorage) numDatabases() int {
+	return len(ds.buckets)
+}
+
+// setQuota must be called before the storage is shared.
+func (ds *DiskStorage) setLogger(logger *slog.Logger) {
+	ds.logger = logger
+}
+
+func (ds *DiskStorage) setQuota(limits quotaLimits) {
+	ds.quota = limits
+}
+
+func (ds *DiskStorage) setClock(clock Clock) {
+	ds.wallClock = clock
+}
+
+func encodeRecord(value string, accessedAt time.Time, frequency uint8) []byte {
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(value))
+	binary.LittleEndian.PutUint64(record, uint64(accessedAt.UnixNano()))
+	record[8] = frequency
+	return append(record, value...)
+}
+
+func recordAccessedAt(record []byte) time.Time {
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(record)))
+}
+
+// recordLFU returns the record's LFU counter, decayed to now.
+func recordLFU(record []byte, now time.Time) uint8 {
+	return lfuDecay(record[8], now.Sub(recordAccessedAt(record)))
+}
+
+func recordValue(record []byte) string {
+	return string(record[recordHeaderSize:])
+}
+
+func recordUsage(key, record []byte) int64 {
+	return int64(len(key)) + int64(len(record))
+}
+
+// update runs fn in a write transaction on the database's bucket.
+func (ds *DiskStorage) update(dbIndex int, fn func(bucket *bolt.Bucket) error) error {
+	return ds.updateTx(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(ds.buckets[dbIndex]))
+	})
+}
+
+// updateTx runs fn in a write transaction. Engine failures are kept so
+// CheckWrite can refuse further writes, since the Storage interface has no
+// way to report them to the caller.
+func (ds *DiskStorage) updateTx(fn func(tx *bolt.Tx) error) error {
+	var callbackErr error
+	err := ds.db.Update(func(tx *bolt.Tx) error {
+		callbackErr = fn(tx)
+		return callbackErr
+	})
+	var failed *diskWriteError
+	if errors.As(callbackErr, &failed) {
+		err = failed.err
+	} else if err == nil || err == callbackErr {
+		return err
+	}
+	ds.logger.Error("Disk storage write failed", "error", err)
+	ds.writeError.Store(&err)
+	return err
+}
+
+func (ds *DiskStorage) view(dbIndex int, fn func(bucket *bolt.Bucket)) {
+	ds.db.View(func(tx *bolt.Tx) error {
+		fn(tx.Bucket(ds.buckets[dbIndex]))
+		return nil
+	})
+}
+
+// diskWriteError separates engine failures from errors returned by Update
+// callbacks, which are part of normal command handling.
+type diskWriteError struct {
+	err error
+}
+
+func (e *diskWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (ds *DiskStorage) versionSlot(dbIndex int, key string) *atomic.Uint64 {
+	return &ds.versions[dbIndex][maphash.String(ds.seed, key)%versionSlots]
+}
+
+// bumpVersion moves key to a new version once tx commits.
+func (ds *DiskStorage) bumpVersion(tx *bolt.Tx, dbIndex int, key string) {
+	tx.OnCommit(func() {
+		ds.versionSlot(dbIndex, key).Store(ds.clock.Add(1))
+	})
+}
+
+func (ds *DiskStorage) Version(dbIndex int, key string) uint64 {
+	return ds.versionSlot(dbIndex, key).Load()
+}
+
+// put and remove must be called inside a write transaction; they keep the
+// usage counters in step with the buckets. put refuses a write that takes
+// the database past its quota when checkQuota is set.
+func (ds *DiskStorage) put(dbIndex int, bucket *bolt.Bucket, key, value string, checkQuota bool) error {
+	now := ds.wallClock.Now()
+	old := bucket.Get([]byte(key))
+	frequency := uint8(lfuInitVal)
+	if old != nil {
+		frequency = lfuIncrement(recordLFU(old, now))
+	}
+	record := encodeRecord(value, now, frequency)
+	keys, bytes := int64(1), recordUsage([]byte(key), record)
+	if old != nil {
+		keys, bytes = 0, bytes-recordUsage([]byte(key), old)
+	}
+	if !checkQuota {
+		ds.usage[dbIndex].add(keys, bytes)
+	} else if !ds.quota.reserve(&ds.usage[dbIndex], keys, bytes) {
+		return ErrQuotaExceeded
+	}
+	if err := bucket.Put([]byte(key), record); err != nil {
+		ds.usage[dbIndex].add(-keys, -bytes)
+		return &diskWriteError{err}
+	}
+	ds.usedMemory.add(bytes)
+	ds.bumpVersion(bucket.Tx(), dbIndex, key)
+	return nil
+}
+
+func (ds *DiskStorage) remove(dbIndex int, bucket *bolt.Bucket, key string) (bool, error) {
+	old := bucket.Get([]byte(key))
+	if old == nil {
+		return false, nil
+	}
+	usage := recordUsage([]byte(key), old)
+	if err := bucket.Delete([]byte(key)); err != nil {
+		return false, &diskWriteError{err}
+	}
+	ds.usage[dbIndex].add(-1, -usage)
+	ds.usedMemory.add(-usage)
+	ds.bumpVersion(bucket.Tx(), dbIndex, key)
+	return true, nil
+}
+
+// WriteError returns the last failed write, if any.
+func (ds *DiskStorage) WriteError() error {
+	if err := ds.writeError.Load(); err != nil {
+		return ErrDiskStorageWrite(*err)
+	}
+	return nil
+}
+
+func (ds *DiskStorage) UsedMemory() int64 {
+	return ds.usedMemory.used.Load()
+}
+
+func (ds *DiskStorage) MemoryStats() MemoryStats {
+	stats := MemoryStats{
+		Used:      ds.usedMemory.used.Load(),
+		Peak:      ds.usedMemory.peak.Load(),
+		Databases: make([]DatabaseStats, len(ds.usage)),
+	}
+	for i := range ds.usage {
+		stats.Databases[i] = DatabaseStats{Keys: ds.usage[i].keys.Load(), Bytes: ds.usage[i].bytes.Load()}
+		stats.Overhead += stats.Databases[i].Keys * recordHeaderSize
+	}
+	return stats
+}
+
+func (ds *DiskStorage) Set(dbIndex int, key, value string) {
+	ds.update(dbIndex, func(bucket *bolt.Bucket) error {
+		return ds.put(dbIndex, bucket, key, value, false)
+	})
+}
+
+func (ds *DiskStorage) SetIfAbsent(dbIndex int, key, value string) (bool, error) {
+	set := false
+	err := ds.update(dbIndex, func(bucket *bolt.Bucket) error {
+		if bucket.Get([]byte(key)) != nil {
+			return nil
+		}
+		if err := ds.put(dbIndex, bucket, key, value, true); err != nil {
+			return err
+		}
+		set = true
+		return nil
+	})
+	if err == ErrQuotaExceeded {
+		return false, err
+	}
+	return set, nil
+}
+
+// Update runs a read-modify-write of key inside a single write transaction.
+// update returns the new value and whether it should be stored.
+func (ds *DiskStorage) Update(dbIndex int, key string, update func(value string, exists bool) (string, bool, error)) error {
+	return ds.update(dbIndex, func(bucket *bolt.Bucket) error {
+		var current string
+		record := bucket.Get([]byte(key))
+		if record != nil {
+			current = recordValue(record)
+		}
+		value, store, err := update(current, record != nil)
+		if err != nil || !store {
+			return err
+		}
+		return ds.put(dbIndex, bucket, key, value, true)
+	})
+}
+
+func (ds *DiskStorage) Get(dbIndex int, key string) (string, bool) {
+	value, accessedAt, ok := ds.read(dbIndex, key)
+	if ok && ds.wallClock.Now().Sub(accessedAt) >= accessResolution {
+		ds.Touch(dbIndex, key)
+	}
+	return value, ok
+}
+
+func (ds *DiskStorage) Peek(dbIndex int, key string) (string, bool) {
+	value, _, ok := ds.read(dbIndex, key)
+	return value, ok
+}
+
+func (ds *DiskStorage) read(dbIndex int, key string) (string, time.Time, bool) {
+	var value string
+	var accessedAt time.Time
+	var ok bool
+	ds.view(dbIndex, func(bucket *bolt.Bucket) {
+		if record := bucket.Get([]byte(key)); record != nil {
+			value, accessedAt, ok = recordValue(record), recordAccessedAt(record), true
+		}
+	})
+	return value, accessedAt, ok
+}
+
+func (ds *DiskStorage) Touch(dbIndex int, key string) bool {
+	touched := false
+	ds.update(dbIndex, func(bucket *bolt.Bucket) error {
+		record := bucket.Get([]byte(key))
+		if record == nil {
+			return nil
+		}
+		touched = true
+		now := ds.wallClock.Now()
+		if err := bucket.Put([]byte(key), encodeRecord(recordValue(record), now, lfuIncrement(recordLFU(record, now)))); err != nil {
+			return &diskWriteError{err}
+		}
+		return nil
+	})
+	return touched
+}
+
+func (ds *DiskStorage) IdleTime(dbIndex int, key string) (time.Duration, bool) {
+	_, accessedAt, ok := ds.read(dbIndex, key)
+	if !ok {
+		return 0, false
+	}
+	return ds.wallClock.Now().Sub(accessedAt), true
+}
+
+func (ds *DiskStorage) Frequency(dbIndex int, key string) (uint8, bool) {
+	var frequency uint8
+	var ok bool
+	ds.view(dbIndex, func(bucket *bolt.Bucket) {
+		if record := bucket.Get([]byte(key)); record != nil {
+			frequency, ok = recordLFU(record, ds.wallClock.Now()), true
+		}
+	})
+	return frequency, ok
+}
+
+// sample returns up to n keys, read from a random position onwards in the
+// databases that follow a random one.
+func (ds *DiskStorage) sample(n int) []keySample {
+	now := ds.wallClock.Now()
+	var samples []keySample
+	ds.db.View(func(tx *bolt.Tx) error {
+		start := rand.IntN(len(ds.buckets))
+		for i := 0; i < len(ds.buckets) && len(samples) < n; i++ {
+			dbIndex := (start + i) % len(ds.buckets)
+			cursor := tx.Bucket(ds.buckets[dbIndex]).Cursor()
+			seek := binary.BigEndian.AppendUint64(nil, rand.Uint64())
+			key, record := cursor.Seek(seek)
+			if key == nil {
+				key, record = cursor.First()
+			}
+			for ; key != nil && len(samples) < n; key, record = cursor.Next() {
+				samples = append(samples, keySample{dbIndex, string(key), recordLFU(record, now)})
+			}
+		}
+		return nil
+	})
+	return samples
+}
+
+func (ds *DiskStorage) MemoryUsage(dbIndex int, key string) (int64, bool) {
+	var usage int64
+	var ok bool
+	ds.view(dbIndex, func(bucket *bolt.Bucket) {
+		if record := bucket.Get([]byte(key)); record != nil {
+			usage, ok = recordUsage([]byte(key), record), true
+		}
+	})
+	return usage, ok
+}
+
+func (ds *DiskStorage) Del(dbIndex int, key string) int {
+	deleted := 0
+	ds.update(dbIndex, func(bucket *bolt.Bucket) error {
+		removed, err := ds.remove(dbIndex, bucket, key)
+		if removed {
+			deleted = 1
+		}
+		return err
+	})
+	return deleted
+}
+
+// IncrBy reads, checks and writes the counter in one transaction, so
+// concurrent increments never lose an update.
+func (ds *DiskStorage) IncrBy(dbIndex int, key string, increment int64) (int64, error) {
+	var currentValue int64
+	err := ds.update(dbIndex, func(bucket *bolt.Bucket) error {
+		if record := bucket.Get([]byte(key)); record != nil {
+			parsed, err := strconv.ParseInt(recordValue(record), 10, 64)
+			if err != nil {
+				return ErrNotInteger
+			}
+			currentValue = parsed
+		}
+		if err := checkIntegerOverflow(currentValue, increment); err != nil {
+			return err
+		}
+		currentValue += increment
+		return ds.put(dbIndex, bucket, key, strconv.FormatInt(currentValue, 10), true)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return currentValue, nil
+}
+
+// Snapshot copies the database inside one read transaction.
+func (ds *DiskStorage) Snapshot(dbIndex int) map[string]string {
+	data := make(map[string]string)
+	ds.view(dbIndex, func(bucket *bolt.Bucket) {
+		bucket.ForEach(func(key, record []byte) error {
+			data[string(key)] = recordValue(record)
+			return nil
+		})
+	})
+	return data
+}
+
+// Restore replaces the database's bucket in one write transaction, so
+// readers see either the old or the new contents.
+func (ds *DiskStorage) Restore(dbIndex int, data map[string]string) {
+	ds.updateTx(func(tx *bolt.Tx) error {
+		name := ds.buckets[dbIndex]
+		if err := tx.DeleteBucket(name); err != nil {
+			return &diskWriteError{err}
+		}
+		bucket, err := tx.CreateBucket(name)
+		if err != nil {
+			return &diskWriteError{err}
+		}
+
+		now := ds.wallClock.Now()
+		var usage int64
+		for key, value := range data {
+			record := encodeRecord(value, now, lfuInitVal)
+			if err := bucket.Put([]byte(key), record); err != nil {
+				return &diskWriteError{err}
+			}
+			usage += recordUsage([]byte(key), record)
+		}
+		ds.usedMemory.add(usage - ds.usage[dbIndex].bytes.Load())
+		ds.usage[dbIndex].keys.Store(int64(len(data)))
+		ds.usage[dbIndex].bytes.Store(usage)
+		tx.OnCommit(func() {
+			for i := range ds.versions[dbIndex] {
+				ds.versions[dbIndex][i].Store(ds.clock.Add(1))
+			}
+		})
+		return nil
+	})
+}
+
+// ForEach calls fn for every key in every database inside one read
+// transaction, so the keys it sees form a consistent snapshot. fn must not
+// write to the storage.
+func (ds *DiskStorage) ForEach(fn func(dbIndex int, key, value string)) {
+	snapshot := ds.Freeze()
+	defer snapshot.Release()
+	snapshot.ForEach(fn)
+}
+
+// Freeze opens a read transaction, which bolt keeps consistent while writers
+// commit alongside it. Writers only wait for it when the file has to grow
+// its memory map. If the transaction cannot be opened the view is empty.
+func (ds *DiskStorage) Freeze() Frozen {
+	tx, _ := ds.db.Begin(false)
+	return &diskSnapshot{buckets: ds.buckets, tx: tx}
+}
+
+type diskSnapshot struct {
+	buckets [][]byte
+	tx      *bolt.Tx
+}
+
+func (snapshot *diskSnapshot) ForEach(fn func(dbIndex int, key, value string)) {
+	if snapshot.tx == nil {
+		return
+	}
+	for dbIndex, name := range snapshot.buckets {
+		snapshot.tx.Bucket(name).ForEach(func(key, record []byte) error {
+			fn(dbIndex, string(key), recordValue(record))
+			return nil
+		})
+	}
+}
+
+func (snapshot *diskSnapshot) Release() {
+	if snapshot.tx != nil {
+		snapshot.tx.Rollback()
+		snapshot.tx = nil
+	}
+}
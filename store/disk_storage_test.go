@@ -0,0 +1,125 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openDiskStorage(t *testing.T, dir string) *DiskStorage {
+	t.Helper()
+	storage, err := OpenDiskStorage(dir, defaultNumDatabases)
+	if err != nil {
+		t.Fatalf("OpenDiskStorage() failed: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestDiskStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return openDiskStorage(t, t.TempDir())
+	})
+}
+
+func TestDiskStorage_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	storage := openDiskStorage(t, dir)
+	storage.Set(0, "name", "batman")
+	storage.IncrBy(5, "counter", 42)
+	used := storage.UsedMemory()
+	storage.Close()
+
+	reopened := openDiskStorage(t, dir)
+
+	if value, _ := reopened.Get(0, "name"); value != "batman" {
+		t.Errorf("Get(0, name) after reopening = %q, expected batman", value)
+	}
+	if value, _ := reopened.Get(5, "counter"); value != "42" {
+		t.Errorf("Get(5, counter) after reopening = %q, expected 42", value)
+	}
+	if reopened.UsedMemory() != used {
+		t.Errorf("UsedMemory() after reopening = %d, expected %d", reopened.UsedMemory(), used)
+	}
+}
+
+func TestDiskStorage_ReopenWithFewerDatabases(t *testing.T) {
+	dir := t.TempDir()
+	storage := openDiskStorage(t, dir)
+	storage.Set(2, "name", "batman")
+	storage.Set(12, "name", "robin")
+	storage.Close()
+
+	if _, err := OpenDiskStorage(dir, 8); err == nil || err.Error() != ErrDiskDBOutOfRange(12, 8).Error() {
+		t.Fatalf("OpenDiskStorage() with 8 databases = %v, expected %v", err, ErrDiskDBOutOfRange(12, 8))
+	}
+	// Empty databases past the configured count hold nothing to lose.
+	reopened := openDiskStorage(t, dir)
+	reopened.Del(12, "name")
+	reopened.Close()
+	shrunk, err := OpenDiskStorage(dir, 8)
+	if err != nil {
+		t.Fatalf("OpenDiskStorage() with the extra databases empty failed: %v", err)
+	}
+	defer shrunk.Close()
+	if value, _ := shrunk.Get(2, "name"); value != "batman" {
+		t.Errorf("Get(2, name) = %q, expected batman", value)
+	}
+
+	grown, err := OpenDiskStorage(t.TempDir(), 32)
+	if err != nil || grown.numDatabases() != 32 {
+		t.Fatalf("OpenDiskStorage() with 32 databases = %v", err)
+	}
+	grown.Close()
+}
+
+func TestDiskStorage_GetRefreshesStaleAccessTime(t *testing.T) {
+	storage := openDiskStorage(t, t.TempDir())
+	storage.Set(0, "key", "value")
+	storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storage.buckets[0]).Put([]byte("key"), encodeRecord("value", time.Now().Add(-10*time.Second), lfuInitVal))
+	})
+	store := CreateNewStore(storage)
+
+	if idle, _, _ := store.ObjectIdleTime(0, "key"); idle != 10 {
+		t.Errorf("ObjectIdleTime() = %d, expected 10", idle)
+	}
+	store.Get(0, "key")
+	if idle, _, _ := store.ObjectIdleTime(0, "key"); idle != 0 {
+		t.Errorf("ObjectIdleTime() = %d after GET, expected 0", idle)
+	}
+}
+
+func TestDiskStorage_WriteErrorRejectsWrites(t *testing.T) {
+	storage := openDiskStorage(t, t.TempDir())
+	store := CreateNewStore(storage)
+	if err := store.CheckWrite(); err != nil {
+		t.Fatalf("CheckWrite() = %v, expected nil", err)
+	}
+
+	storage.db.Close()
+	store.Set(0, "name", "batman")
+
+	if err := store.CheckWrite(); err == nil || err.Error() != ErrDiskStorageWrite(bolt.ErrDatabaseNotOpen).Error() {
+		t.Errorf("CheckWrite() = %v, expected %v", err, ErrDiskStorageWrite(bolt.ErrDatabaseNotOpen))
+	}
+}
+
+func TestDiskStorage_Transaction(t *testing.T) {
+	store := CreateNewStore(openDiskStorage(t, t.TempDir()))
+	store.Set(0, "counter", "1")
+	store.StartTransaction(1)
+	store.QueueCommand(1, "INCR", []string{"counter"})
+	store.QueueCommand(1, "SET", []string{"name", "batman"})
+
+	if _, err := store.ExecuteTransaction(1, runCommand); err != nil {
+		t.Fatalf("ExecuteTransaction() failed: %v", err)
+	}
+	if value, _, _ := store.Get(0, "counter"); value != "2" {
+		t.Errorf("Get(counter) = %q, expected 2", value)
+	}
+	if value, _, _ := store.Get(0, "name"); value != "batman" {
+		t.Errorf("Get(name) = %q, expected batman", value)
+	}
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc64"
+	"kv-store/errcode"
+)
+
+const (
+	dumpVersion    = 1
+	dumpTypeString = 0
+	// dumpOverhead is the type, version and checksum around the value.
+	dumpOverhead = 1 + 2 + 8
+)
+
+var (
+	ErrBadDumpPayload = errcode.New(errcode.Err, "DUMP payload version or checksum are wrong")
+	ErrBusyKey        = errcode.New(errcode.BusyKey, "target key name already exists")
+)
+
+var dumpCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// A dump payload is <type><value><version:2 LE><crc64:8 LE>, hex encoded so it
+// survives the line protocol.
+func encodeDump(value string) string {
+	payload := make([]byte, 0, len(value)+dumpOverhead)
+	payload = append(payload, dumpTypeString)
+	payload = append(payload, value...)
+	payload = binary.LittleEndian.AppendUint16(payload, dumpVersion)
+	payload = binary.LittleEndian.AppendUint64(payload, crc64.Checksum(payload, dumpCRCTable))
+	return hex.EncodeToString(payload)
+}
+
+// DumpValueLength returns the length of the value a DUMP payload holds,
+// without decoding it.
+func DumpValueLength(encoded string) int64 {
+	return max(int64(hex.DecodedLen(len(encoded))-dumpOverhead), 0)
+}
+
+func decodeDump(encoded string) (string, error) {
+	payload, err := hex.DecodeString(encoded)
+	if err != nil || len(payload) < dumpOverhead {
+		return "", ErrBadDumpPayload
+	}
+
+	body, checksum := payload[:len(payload)-8], payload[len(payload)-8:]
+	if crc64.Checksum(body, dumpCRCTable) != binary.LittleEndian.Uint64(checksum) {
+		return "", ErrBadDumpPayload
+	}
+	if binary.LittleEndian.Uint16(body[len(body)-2:]) > dumpVersion {
+		return "", ErrBadDumpPayload
+	}
+	if body[0] != dumpTypeString {
+		return "", ErrBadDumpPayload
+	}
+	return string(body[1 : len(body)-2]), nil
+}
+
+func (s *Store) Dump(dbIndex int, key string) (string, bool, error) {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.dump(dbIndex, key)
+}
+
+func (s *Store) dump(dbIndex int, key string) (string, bool, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return "", false, err
+	}
+	value, exists := s.storage.Get(dbIndex, key)
+	if !exists {
+		return "", false, nil
+	}
+	return encodeDump(value), true, nil
+}
+
+func (s *Store) Restore(dbIndex int, key, payload string, replace bool) error {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.restore(dbIndex, key, payload, replace)
+}
+
+func (s *Store) restore(dbIndex int, key, payload string, replace bool) error {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return err
+	}
+	value, err := decodeDump(payload)
+	if err != nil {
+		return err
+	}
+	if replace {
+		if err := s.setValue(dbIndex, key, value); err != nil {
+			return err
+		}
+		s.notifyKeyspaceEvent(notifyGeneric, "restore", dbIndex, key)
+		return nil
+	}
+	s.logWrite(dbIndex, func() []string {
+		var set bool
+		if set, err = s.storage.SetIfAbsent(dbIndex, key, value); err != nil {
+			return nil
+		}
+		if !set {
+			err = ErrBusyKey
+			return nil
+		}
+		return []string{"SET", key, value}
+	})
+	if err == nil {
+		s.notifyKeyspaceEvent(notifyGeneric, "restore", dbIndex, key)
+	}
+	return err
+}
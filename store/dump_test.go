@@ -0,0 +1,111 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc64"
+	"strings"
+	"testing"
+)
+
+func TestDumpRestore_RoundTrip(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "string", "hello world")
+	store.Set(0, "int", "-12345")
+	store.Set(0, "empty", "")
+	store.Set(0, "binary", "line\nbreak\x00\xff")
+	store.PFAdd(0, "hll", []string{"a", "b", "c"})
+
+	for _, key := range []string{"string", "int", "empty", "binary", "hll"} {
+		payload, ok, _ := store.Dump(0, key)
+		if !ok {
+			t.Fatalf("Dump(%q) failed, expected key to exist", key)
+		}
+		if strings.ContainsAny(payload, " \r\n") {
+			t.Errorf("Dump(%q) = %q, expected a single protocol-safe token", key, payload)
+		}
+
+		if err := store.Restore(1, key, payload, false); err != nil {
+			t.Fatalf("Restore(%q) failed: %v", key, err)
+		}
+		original, _, _ := store.Get(0, key)
+		restored, _, _ := store.Get(1, key)
+		if original != restored {
+			t.Errorf("Restore(%q) = %q, expected %q", key, restored, original)
+		}
+	}
+
+	count, err := store.PFCount(1, []string{"hll"})
+	if err != nil || count != 3 {
+		t.Errorf("PFCount(restored hll) = %d, %v; expected 3", count, err)
+	}
+}
+
+func TestDump_MissingKey(t *testing.T) {
+	store := getInMemoryStore(t)
+
+	if _, ok, _ := store.Dump(0, "missing"); ok {
+		t.Errorf("Dump(missing) succeeded, expected key not to exist")
+	}
+}
+
+func TestRestore_ExistingKey(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "source", "new")
+	store.Set(0, "target", "old")
+	payload, _, _ := store.Dump(0, "source")
+
+	err := store.Restore(0, "target", payload, false)
+
+	if err != ErrBusyKey {
+		t.Errorf("expected: %v, got: %v", ErrBusyKey, err)
+	}
+	if value, _, _ := store.Get(0, "target"); value != "old" {
+		t.Errorf("Get(target) = %q, expected old value to be kept", value)
+	}
+
+	if err := store.Restore(0, "target", payload, true); err != nil {
+		t.Fatalf("Restore with replace failed: %v", err)
+	}
+	if value, _, _ := store.Get(0, "target"); value != "new" {
+		t.Errorf("Get(target) = %q, expected %q", value, "new")
+	}
+}
+
+func TestRestore_CorruptedPayload(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "key", "value")
+	payload, _, _ := store.Dump(0, "key")
+
+	flipped := []byte(payload)
+	if flipped[2] == '0' {
+		flipped[2] = '1'
+	} else {
+		flipped[2] = '0'
+	}
+	newer := append([]byte{dumpTypeString}, "value"...)
+	newer = binary.LittleEndian.AppendUint16(newer, dumpVersion+1)
+	newer = binary.LittleEndian.AppendUint64(newer, crc64.Checksum(newer, dumpCRCTable))
+	newerVersion := hex.EncodeToString(newer)
+
+	for _, corrupted := range []string{string(flipped), payload[:len(payload)-2], "zz", "", newerVersion} {
+		err := store.Restore(0, "restored", corrupted, false)
+		if err != ErrBadDumpPayload {
+			t.Errorf("Restore(%q) = %v, expected %v", corrupted, err, ErrBadDumpPayload)
+		}
+	}
+	if _, ok, _ := store.Get(0, "restored"); ok {
+		t.Errorf("expected: corrupted payloads not to create the key")
+	}
+}
+
+func TestDumpValueLength(t *testing.T) {
+	for _, value := range []string{"", "batman", strings.Repeat("a", 1000)} {
+		if length := DumpValueLength(encodeDump(value)); length != int64(len(value)) {
+			t.Errorf("DumpValueLength() of a %d byte value = %d", len(value), length)
+		}
+	}
+	if length := DumpValueLength("00"); length != 0 {
+		t.Errorf("DumpValueLength() of a short payload = %d, expected 0", length)
+	}
+}
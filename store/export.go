@@ -0,0 +1,19 @@
+package store
+
+import "kv-store/persistence"
+
+// Export renders every key of every database as the lines of an export,
+// sorted by database and key. Writers are not blocked while it runs.
+func (s *Store) Export() ([]string, error) {
+	now := s.clock.Now()
+	entries := s.snapshot()
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		line, err := persistence.EncodeExportLine(persistence.Entry{DB: e.dbIndex, Key: e.key, Value: e.value, Type: persistence.TypeString}, now)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, string(line))
+	}
+	return lines, nil
+}
@@ -0,0 +1,24 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(2, "b", "2")
+	store.Set(0, "name", "batman")
+	store.Set(2, "a", "\xff")
+
+	lines, err := store.Export()
+
+	expected := []string{
+		`{"db":0,"key":"name","type":"string","ttl":-1,"value":"batman"}`,
+		`{"db":2,"key":"YQ==","type":"string","ttl":-1,"value":"/w==","encoding":"base64"}`,
+		`{"db":2,"key":"b","type":"string","ttl":-1,"value":"2"}`,
+	}
+	if err != nil || !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Export() = %q, %v, expected %q", lines, err, expected)
+	}
+}
@@ -0,0 +1,292 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"kv-store/errcode"
+	"math"
+	"strings"
+)
+
+const (
+	hllMagic     = "HYLL"
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+	hllQ         = 64 - hllPrecision
+	hllHashSeed  = 0xadc83b19
+)
+
+var ErrInvalidHLL = errcode.New(errcode.WrongType, "key is not a valid HyperLogLog string value")
+
+// hyperLogLog is the dense representation: one byte per register, stored hex
+// encoded behind a magic tag so it can live in a plain, protocol-safe string
+// value.
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{}
+}
+
+func decodeHyperLogLog(value string) (*hyperLogLog, error) {
+	if len(value) != len(hllMagic)+2*hllRegisters || !strings.HasPrefix(value, hllMagic) {
+		return nil, ErrInvalidHLL
+	}
+	hll := newHyperLogLog()
+	_, err := hex.Decode(hll.registers[:], []byte(value[len(hllMagic):]))
+	if err != nil {
+		return nil, ErrInvalidHLL
+	}
+	for _, register := range hll.registers {
+		if register > hllQ+1 {
+			return nil, ErrInvalidHLL
+		}
+	}
+	return hll, nil
+}
+
+func (hll *hyperLogLog) encode() string {
+	return hllMagic + hex.EncodeToString(hll.registers[:])
+}
+
+func (hll *hyperLogLog) add(element string) bool {
+	hash := murmurHash64A([]byte(element), hllHashSeed)
+	index := hash & (hllRegisters - 1)
+	hash >>= hllPrecision
+	hash |= 1 << hllQ
+
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+
+	if count > hll.registers[index] {
+		hll.registers[index] = count
+		return true
+	}
+	return false
+}
+
+func (hll *hyperLogLog) merge(other *hyperLogLog) {
+	for i, register := range other.registers {
+		if register > hll.registers[i] {
+			hll.registers[i] = register
+		}
+	}
+}
+
+// count uses the estimator from Otmar Ertl's "New cardinality estimation
+// algorithms for HyperLogLog sketches", which needs no bias correction tables.
+func (hll *hyperLogLog) count() int64 {
+	var histogram [hllQ + 2]int
+	for _, register := range hll.registers {
+		histogram[register]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for k := hllQ; k >= 1; k-- {
+		z += float64(histogram[k])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	alphaInf := 0.5 / math.Ln2
+	return int64(math.Round(alphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		previous := z
+		z += x * y
+		y += y
+		if previous == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		previous := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if previous == z {
+			return z / 3
+		}
+	}
+}
+
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ (uint64(len(data)) * m)
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+
+	switch len(data) {
+	case 7:
+		h ^= uint64(data[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(data[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(data[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(data[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(data[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+func (s *Store) loadHyperLogLog(dbIndex int, key string) (*hyperLogLog, error) {
+	value, exists := s.storage.Get(dbIndex, key)
+	if !exists {
+		return newHyperLogLog(), nil
+	}
+	return decodeHyperLogLog(value)
+}
+
+func (s *Store) PFAdd(dbIndex int, key string, elements []string) (int, error) {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.pfAdd(dbIndex, key, elements)
+}
+
+func (s *Store) pfAdd(dbIndex int, key string, elements []string) (int, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return 0, err
+	}
+	changed := false
+	var err error
+	s.logWrite(dbIndex, func() []string {
+		var encoded string
+		err = s.storage.Update(dbIndex, key, func(value string, exists bool) (string, bool, error) {
+			hll := newHyperLogLog()
+			if exists {
+				decoded, err := decodeHyperLogLog(value)
+				if err != nil {
+					return "", false, err
+				}
+				hll = decoded
+			}
+
+			changed = !exists
+			for _, element := range elements {
+				if hll.add(element) {
+					changed = true
+				}
+			}
+			encoded = hll.encode()
+			return encoded, changed, nil
+		})
+		if err != nil || !changed {
+			return nil
+		}
+		return []string{"SET", key, encoded}
+	})
+	if err != nil || !changed {
+		return 0, err
+	}
+	s.notifyKeyspaceEvent(notifyString, "pfadd", dbIndex, key)
+	return 1, nil
+}
+
+func (s *Store) PFCount(dbIndex int, keys []string) (int64, error) {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.pfCount(dbIndex, keys)
+}
+
+func (s *Store) pfCount(dbIndex int, keys []string) (int64, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return 0, err
+	}
+	merged := newHyperLogLog()
+	for _, key := range keys {
+		hll, err := s.loadHyperLogLog(dbIndex, key)
+		if err != nil {
+			return 0, err
+		}
+		merged.merge(hll)
+	}
+	return merged.count(), nil
+}
+
+func (s *Store) PFMerge(dbIndex int, destination string, sources []string) error {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.pfMerge(dbIndex, destination, sources)
+}
+
+func (s *Store) pfMerge(dbIndex int, destination string, sources []string) error {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return err
+	}
+	merged := newHyperLogLog()
+	for _, key := range sources {
+		hll, err := s.loadHyperLogLog(dbIndex, key)
+		if err != nil {
+			return err
+		}
+		merged.merge(hll)
+	}
+
+	var err error
+	s.logWrite(dbIndex, func() []string {
+		err = s.storage.Update(dbIndex, destination, func(value string, exists bool) (string, bool, error) {
+			if exists {
+				current, err := decodeHyperLogLog(value)
+				if err != nil {
+					return "", false, err
+				}
+				merged.merge(current)
+			}
+			return merged.encode(), true, nil
+		})
+		if err != nil {
+			return nil
+		}
+		return []string{"SET", destination, merged.encode()}
+	})
+	if err == nil {
+		s.notifyKeyspaceEvent(notifyString, "pfadd", dbIndex, destination)
+	}
+	return err
+}
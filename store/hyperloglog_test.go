@@ -0,0 +1,216 @@
+package store
+
+import (
+	"fmt"
+	"kv-store/parser"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPFAdd_NewKey(t *testing.T) {
+	store := getInMemoryStore(t)
+
+	changed, err := store.PFAdd(0, "hll", []string{"a", "b", "c"})
+
+	if err != nil {
+		t.Fatalf("expected: should add elements, got: %v", err)
+	}
+	if changed != 1 {
+		t.Errorf("PFAdd() = %d, expected 1", changed)
+	}
+	count, _ := store.PFCount(0, []string{"hll"})
+	if count != 3 {
+		t.Errorf("PFCount() = %d, expected 3", count)
+	}
+}
+
+func TestPFAdd_ExistingElements(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.PFAdd(0, "hll", []string{"a", "b"})
+
+	changed, err := store.PFAdd(0, "hll", []string{"a", "b"})
+
+	if err != nil {
+		t.Fatalf("expected: should add elements, got: %v", err)
+	}
+	if changed != 0 {
+		t.Errorf("PFAdd() = %d, expected 0", changed)
+	}
+}
+
+func TestPFAdd_NoElementsCreatesKey(t *testing.T) {
+	store := getInMemoryStore(t)
+
+	first, _ := store.PFAdd(0, "hll", nil)
+	second, _ := store.PFAdd(0, "hll", nil)
+
+	if first != 1 || second != 0 {
+		t.Errorf("PFAdd() = %d, %d, expected 1, 0", first, second)
+	}
+	if _, ok, _ := store.Get(0, "hll"); !ok {
+		t.Errorf("expected: hll key to exist")
+	}
+}
+
+func TestPFAdd_NonHyperLogLogValue(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+
+	_, err := store.PFAdd(0, "name", []string{"a"})
+
+	if err != ErrInvalidHLL {
+		t.Errorf("expected: %v, got: %v", ErrInvalidHLL, err)
+	}
+}
+
+func TestPFCount_MissingKey(t *testing.T) {
+	store := getInMemoryStore(t)
+
+	count, err := store.PFCount(0, []string{"missing"})
+
+	if err != nil || count != 0 {
+		t.Errorf("PFCount() = %d, %v, expected 0, nil", count, err)
+	}
+}
+
+func TestPFCount_MultipleKeys(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.PFAdd(0, "hll1", []string{"a", "b", "c"})
+	store.PFAdd(0, "hll2", []string{"c", "d"})
+
+	count, err := store.PFCount(0, []string{"hll1", "hll2", "missing"})
+
+	if err != nil || count != 4 {
+		t.Errorf("PFCount() = %d, %v, expected 4, nil", count, err)
+	}
+	if _, ok, _ := store.Get(0, "missing"); ok {
+		t.Errorf("expected: PFCount not to create missing keys")
+	}
+}
+
+func TestPFMerge(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.PFAdd(0, "hll1", []string{"a", "b"})
+	store.PFAdd(0, "hll2", []string{"b", "c"})
+	store.PFAdd(0, "dest", []string{"d"})
+
+	err := store.PFMerge(0, "dest", []string{"hll1", "hll2"})
+
+	if err != nil {
+		t.Fatalf("expected: should merge, got: %v", err)
+	}
+	count, _ := store.PFCount(0, []string{"dest"})
+	if count != 4 {
+		t.Errorf("PFCount(dest) = %d, expected 4", count)
+	}
+}
+
+func TestPFMerge_NonHyperLogLogSource(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+
+	err := store.PFMerge(0, "dest", []string{"name"})
+
+	if err != ErrInvalidHLL {
+		t.Errorf("expected: %v, got: %v", ErrInvalidHLL, err)
+	}
+	if _, ok, _ := store.Get(0, "dest"); ok {
+		t.Errorf("expected: dest not to be created on error")
+	}
+}
+
+func TestDecodeHyperLogLog_RoundTrip(t *testing.T) {
+	hll := newHyperLogLog()
+	for i := range 1000 {
+		hll.add(fmt.Sprintf("element:%d", i))
+	}
+
+	decoded, err := decodeHyperLogLog(hll.encode())
+
+	if err != nil {
+		t.Fatalf("expected: should decode, got: %v", err)
+	}
+	if decoded.registers != hll.registers {
+		t.Errorf("expected: decoded registers to match")
+	}
+}
+
+func TestHyperLogLog_Accuracy(t *testing.T) {
+	// 1.04/sqrt(16384) ~= 0.81% standard error; allow four standard errors.
+	const tolerance = 4 * 1.04 / 128
+
+	random := rand.New(rand.NewSource(1))
+	for _, cardinality := range []int{100, 1000, 10000, 100000, 1000000} {
+		hll := newHyperLogLog()
+		seen := make(map[uint64]struct{}, cardinality)
+		for len(seen) < cardinality {
+			element := random.Uint64()
+			if _, ok := seen[element]; ok {
+				continue
+			}
+			seen[element] = struct{}{}
+			hll.add(fmt.Sprintf("element:%d", element))
+		}
+
+		estimate := hll.count()
+		relativeError := math.Abs(float64(estimate)-float64(cardinality)) / float64(cardinality)
+		if relativeError > tolerance {
+			t.Errorf("cardinality %d: estimate %d, relative error %.4f exceeds %.4f",
+				cardinality, estimate, relativeError, tolerance)
+		}
+	}
+}
+
+func TestPFAdd_CompactOutputIsReplayable(t *testing.T) {
+	store := getInMemoryStore(t)
+	elements := make([]string, 5000)
+	for i := range elements {
+		elements[i] = fmt.Sprintf("element:%d", i)
+	}
+	store.PFAdd(0, "hll", elements)
+	value, _, _ := store.Get(0, "hll")
+
+	output, _ := store.Compact(0)
+
+	if strings.Count(output, "\n") != 0 {
+		t.Fatalf("expected a single COMPACT line, got %d newlines", strings.Count(output, "\n"))
+	}
+	command, args, err := parser.ParseCommandLine(output)
+	if err != nil {
+		t.Fatalf("ParseCommandLine(COMPACT output) failed: %v", err)
+	}
+	if command != "SET" || !reflect.DeepEqual(args, []string{"hll", value}) {
+		t.Errorf("ParseCommandLine(COMPACT output) = %q %d args, expected SET hll <value>", command, len(args))
+	}
+}
+
+func TestPFAdd_ConcurrentWriters(t *testing.T) {
+	store := getInMemoryStore(t)
+	var wg sync.WaitGroup
+
+	for i := range 50 {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for j := range 20 {
+				store.PFAdd(0, "hll", []string{fmt.Sprintf("%d:%d", writer, j)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	expected := newHyperLogLog()
+	for i := range 50 {
+		for j := range 20 {
+			expected.add(fmt.Sprintf("%d:%d", i, j))
+		}
+	}
+	value, _, _ := store.Get(0, "hll")
+	if value != expected.encode() {
+		t.Errorf("expected concurrent PFADDs to produce the same registers as sequential adds")
+	}
+}
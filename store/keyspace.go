@@ -0,0 +1,111 @@
+package store
+
+// Keyspace is what commands read and write keys through: the Store itself,
+// or, while EXEC runs, the transaction, which already holds the store
+// exclusively and keeps the original value of every key it writes so a
+// failure can roll it back.
+type Keyspace interface {
+	Set(dbIndex int, key, value string) error
+	Get(dbIndex int, key string) (string, bool, error)
+	Del(dbIndex int, key string) (int, error)
+	IncrBy(dbIndex int, key string, increment int64) (int64, error)
+	Compact(dbIndex int) (string, error)
+	FlushDB(dbIndex int) error
+	Touch(dbIndex int, keys []string) (int, error)
+	ObjectEncoding(dbIndex int, key string) (string, bool, error)
+	ObjectIdleTime(dbIndex int, key string) (int64, bool, error)
+	ObjectFreq(dbIndex int, key string) (int64, bool, error)
+	MemoryUsage(dbIndex int, key string) (int64, bool, error)
+	Dump(dbIndex int, key string) (string, bool, error)
+	Restore(dbIndex int, key, payload string, replace bool) error
+	PFAdd(dbIndex int, key string, elements []string) (int, error)
+	PFCount(dbIndex int, keys []string) (int64, error)
+	PFMerge(dbIndex int, destination string, sources []string) error
+}
+
+// TransactionFunc runs a command EXEC takes off the queue, reading and
+// writing through keyspace in database dbIndex.
+type TransactionFunc func(keyspace Keyspace, dbIndex int, name string, args []string) (Result, error)
+
+// transactionKeyspace is the Keyspace of a running transaction. It calls the
+// unlocked methods, as EXEC holds the execution mutex.
+type transactionKeyspace struct {
+	s           *Store
+	transaction *transaction
+}
+
+func (k *transactionKeyspace) Set(dbIndex int, key, value string) error {
+	k.s.saveOriginalValue(k.transaction, key)
+	return k.s.set(dbIndex, key, value)
+}
+
+func (k *transactionKeyspace) Get(dbIndex int, key string) (string, bool, error) {
+	return k.s.get(dbIndex, key)
+}
+
+func (k *transactionKeyspace) Del(dbIndex int, key string) (int, error) {
+	k.s.saveOriginalValue(k.transaction, key)
+	return k.s.del(dbIndex, key)
+}
+
+func (k *transactionKeyspace) IncrBy(dbIndex int, key string, increment int64) (int64, error) {
+	k.s.saveOriginalValue(k.transaction, key)
+	return k.s.incrBy(dbIndex, key, increment)
+}
+
+func (k *transactionKeyspace) Compact(dbIndex int) (string, error) {
+	return k.s.compact(dbIndex)
+}
+
+func (k *transactionKeyspace) FlushDB(dbIndex int) error {
+	// Without rollback nothing is kept, so the keys are not listed.
+	if k.transaction.originalValues != nil {
+		for _, key := range sortedKeys(k.s.storage.Snapshot(dbIndex)) {
+			k.s.saveOriginalValue(k.transaction, key)
+		}
+	}
+	return k.s.flushDB(dbIndex)
+}
+
+func (k *transactionKeyspace) Touch(dbIndex int, keys []string) (int, error) {
+	return k.s.Touch(dbIndex, keys)
+}
+
+func (k *transactionKeyspace) ObjectEncoding(dbIndex int, key string) (string, bool, error) {
+	return k.s.ObjectEncoding(dbIndex, key)
+}
+
+func (k *transactionKeyspace) ObjectIdleTime(dbIndex int, key string) (int64, bool, error) {
+	return k.s.ObjectIdleTime(dbIndex, key)
+}
+
+func (k *transactionKeyspace) ObjectFreq(dbIndex int, key string) (int64, bool, error) {
+	return k.s.ObjectFreq(dbIndex, key)
+}
+
+func (k *transactionKeyspace) MemoryUsage(dbIndex int, key string) (int64, bool, error) {
+	return k.s.MemoryUsage(dbIndex, key)
+}
+
+func (k *transactionKeyspace) Dump(dbIndex int, key string) (string, bool, error) {
+	return k.s.dump(dbIndex, key)
+}
+
+func (k *transactionKeyspace) Restore(dbIndex int, key, payload string, replace bool) error {
+	k.s.saveOriginalValue(k.transaction, key)
+	return k.s.restore(dbIndex, key, payload, replace)
+}
+
+func (k *transactionKeyspace) PFAdd(dbIndex int, key string, elements []string) (int, error) {
+	k.s.saveOriginalValue(k.transaction, key)
+	return k.s.pfAdd(dbIndex, key, elements)
+}
+
+func (k *transactionKeyspace) PFCount(dbIndex int, keys []string) (int64, error) {
+	return k.s.pfCount(dbIndex, keys)
+}
+
+func (k *transactionKeyspace) PFMerge(dbIndex int, destination string, sources []string) error {
+	k.s.saveOriginalValue(k.transaction, destination)
+	return k.s.pfMerge(dbIndex, destination, sources)
+}
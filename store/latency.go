@@ -0,0 +1,126 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyHistoryLength bounds the samples kept for each event, as in Redis.
+const latencyHistoryLength = 160
+
+// Latency events recorded by the store and the server.
+const (
+	LatencyCommand  = "command"
+	LatencyAOFFsync = "aof-fsync"
+)
+
+// LatencySample is the worst latency of an event within one second.
+type LatencySample struct {
+	Time    time.Time
+	Latency time.Duration
+}
+
+// LatencyEvent summarises the samples of an event.
+type LatencyEvent struct {
+	Name   string
+	Latest LatencySample
+	Max    time.Duration
+}
+
+type latencySeries struct {
+	samples []LatencySample
+	max     time.Duration
+}
+
+// latencyMonitor keeps the events that took latency-monitor-threshold
+// milliseconds or longer, in a bounded series per event.
+type latencyMonitor struct {
+	mutex  sync.Mutex
+	series map[string]*latencySeries
+}
+
+// RecordLatency adds a sample for event if elapsed reaches the
+// latency-monitor-threshold. A threshold of 0 disables the monitor.
+func (s *Store) RecordLatency(event string, elapsed time.Duration) {
+	s.recordLatency(event, elapsed, s.clock.Now())
+}
+
+func (s *Store) recordLatency(event string, elapsed time.Duration, now time.Time) {
+	threshold := s.config.Get().LatencyMonitorThreshold
+	if threshold == 0 || elapsed < time.Duration(threshold)*time.Millisecond {
+		return
+	}
+
+	m := &s.latency
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.series == nil {
+		m.series = make(map[string]*latencySeries)
+	}
+	series := m.series[event]
+	if series == nil {
+		series = &latencySeries{}
+		m.series[event] = series
+	}
+	series.max = max(series.max, elapsed)
+	// Samples within the same second are merged, keeping the worst.
+	if last := len(series.samples) - 1; last >= 0 && series.samples[last].Time.Unix() == now.Unix() {
+		series.samples[last].Latency = max(series.samples[last].Latency, elapsed)
+		return
+	}
+	series.samples = append(series.samples, LatencySample{Time: now, Latency: elapsed})
+	if len(series.samples) > latencyHistoryLength {
+		series.samples = append(series.samples[:0], series.samples[1:]...)
+	}
+}
+
+// LatencyLatest returns the latest sample and the worst latency of every
+// event with samples, ordered by name.
+func (s *Store) LatencyLatest() []LatencyEvent {
+	m := &s.latency
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var events []LatencyEvent
+	for name, series := range m.series {
+		events = append(events, LatencyEvent{
+			Name:   name,
+			Latest: series.samples[len(series.samples)-1],
+			Max:    series.max,
+		})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// LatencyHistory returns the samples of event, oldest first.
+func (s *Store) LatencyHistory(event string) []LatencySample {
+	m := &s.latency
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if series := m.series[event]; series != nil {
+		return append([]LatencySample(nil), series.samples...)
+	}
+	return nil
+}
+
+// ResetLatency drops the samples of the given events, or of all events when
+// none are given, and returns how many series it dropped.
+func (s *Store) ResetLatency(events ...string) int {
+	m := &s.latency
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(events) == 0 {
+		reset := len(m.series)
+		m.series = nil
+		return reset
+	}
+	reset := 0
+	for _, event := range events {
+		if _, ok := m.series[event]; ok {
+			delete(m.series, event)
+			reset++
+		}
+	}
+	return reset
+}
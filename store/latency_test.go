@@ -0,0 +1,56 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordLatency(t *testing.T) {
+	s := CreateNewStore(NewMemoryStorage(16))
+	start := time.Unix(1700000000, 0)
+	s.recordLatency(LatencyCommand, time.Second, start)
+	if events := s.LatencyLatest(); len(events) != 0 {
+		t.Fatalf("LatencyLatest() = %v with the monitor disabled, expected none", events)
+	}
+
+	s.Config().Set("latency-monitor-threshold", "10")
+	s.recordLatency(LatencyCommand, 5*time.Millisecond, start)
+	s.recordLatency(LatencyCommand, 20*time.Millisecond, start)
+	s.recordLatency(LatencyCommand, 50*time.Millisecond, start.Add(500*time.Millisecond))
+	s.recordLatency(LatencyCommand, 30*time.Millisecond, start.Add(time.Second))
+	s.recordLatency(LatencyAOFFsync, 15*time.Millisecond, start)
+
+	expectedHistory := []LatencySample{
+		{start, 50 * time.Millisecond},
+		{start.Add(time.Second), 30 * time.Millisecond},
+	}
+	if history := s.LatencyHistory(LatencyCommand); !reflect.DeepEqual(history, expectedHistory) {
+		t.Errorf("LatencyHistory() = %v, expected %v", history, expectedHistory)
+	}
+	expectedLatest := []LatencyEvent{
+		{LatencyAOFFsync, LatencySample{start, 15 * time.Millisecond}, 15 * time.Millisecond},
+		{LatencyCommand, LatencySample{start.Add(time.Second), 30 * time.Millisecond}, 50 * time.Millisecond},
+	}
+	if latest := s.LatencyLatest(); !reflect.DeepEqual(latest, expectedLatest) {
+		t.Errorf("LatencyLatest() = %v, expected %v", latest, expectedLatest)
+	}
+
+	for i := range latencyHistoryLength + 10 {
+		s.recordLatency(LatencyCommand, 10*time.Millisecond, start.Add(time.Duration(i+2)*time.Second))
+	}
+	history := s.LatencyHistory(LatencyCommand)
+	if len(history) != latencyHistoryLength || !history[0].Time.Equal(start.Add(12*time.Second)) {
+		t.Errorf("LatencyHistory() has %d samples from %v, expected %d from %v", len(history), history[0].Time, latencyHistoryLength, start.Add(12*time.Second))
+	}
+
+	if reset := s.ResetLatency(LatencyCommand, "nosuch"); reset != 1 {
+		t.Errorf("ResetLatency(command, nosuch) = %d, expected 1", reset)
+	}
+	if reset := s.ResetLatency(); reset != 1 {
+		t.Errorf("ResetLatency() = %d, expected 1", reset)
+	}
+	if latest := s.LatencyLatest(); len(latest) != 0 {
+		t.Errorf("LatencyLatest() after reset = %v, expected none", latest)
+	}
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// The LFU counter of a key is a byte that grows logarithmically with its
+// accesses and loses one point for every lfuDecayTime it goes unaccessed, so
+// keys that were hot once but are idle now become evictable.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+
+	// evictionSamples is how many random keys each eviction compares.
+	evictionSamples = 5
+)
+
+// keySample is a candidate for eviction with its decayed LFU counter.
+type keySample struct {
+	dbIndex   int
+	key       string
+	frequency uint8
+}
+
+// lfuIncrement bumps counter with a probability that shrinks as it grows, so
+// a million accesses still fit in a byte.
+func lfuIncrement(counter uint8) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	base := max(float64(counter)-lfuInitVal, 0)
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// lfuDecay lowers counter by one for every lfuDecayTime in idle.
+func lfuDecay(counter uint8, idle time.Duration) uint8 {
+	periods := idle / lfuDecayTime
+	if periods >= time.Duration(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
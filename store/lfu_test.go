@@ -0,0 +1,111 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLFUIncrement(t *testing.T) {
+	tests := []struct {
+		accesses int
+		min, max uint8
+	}{
+		{0, lfuInitVal, lfuInitVal},
+		{1, lfuInitVal + 1, lfuInitVal + 1},
+		{100, 8, 14},
+		{100000, 100, 180},
+	}
+
+	for _, tt := range tests {
+		counter := uint8(lfuInitVal)
+		for range tt.accesses {
+			counter = lfuIncrement(counter)
+		}
+		if counter < tt.min || counter > tt.max {
+			t.Errorf("counter after %d accesses = %d, expected between %d and %d", tt.accesses, counter, tt.min, tt.max)
+		}
+	}
+	if counter := lfuIncrement(255); counter != 255 {
+		t.Errorf("lfuIncrement(255) = %d, expected the counter to saturate", counter)
+	}
+}
+
+func TestLFUDecay(t *testing.T) {
+	tests := []struct {
+		counter  uint8
+		idle     time.Duration
+		expected uint8
+	}{
+		{20, 0, 20},
+		{20, 59 * time.Second, 20},
+		{20, 3 * lfuDecayTime, 17},
+		{20, 20 * lfuDecayTime, 0},
+		{20, 1000 * lfuDecayTime, 0},
+	}
+
+	for _, tt := range tests {
+		if got := lfuDecay(tt.counter, tt.idle); got != tt.expected {
+			t.Errorf("lfuDecay(%d, %v) = %d, expected %d", tt.counter, tt.idle, got, tt.expected)
+		}
+	}
+}
+
+func TestCheckMemory_EvictsLeastFrequentlyUsed(t *testing.T) {
+	storage := NewMemoryStorage(defaultNumDatabases)
+	store := CreateNewStore(storage)
+	store.Config().Set("maxmemory-policy", "allkeys-lfu")
+	evictOne := func() {
+		t.Helper()
+		store.Config().Set("maxmemory", strconv.FormatInt(store.UsedMemory()-1, 10))
+		if err := store.CheckMemory(); err != nil {
+			t.Fatalf("CheckMemory() = %v, expected eviction to free memory", err)
+		}
+	}
+
+	store.Set(0, "hot", "value")
+	for range 1000 {
+		store.Get(0, "hot")
+	}
+	store.Set(1, "cold", "value")
+	evictOne()
+
+	if _, ok, _ := store.Get(1, "cold"); ok {
+		t.Errorf("expected the rarely used key to be evicted")
+	}
+	if _, ok, _ := store.Get(0, "hot"); !ok {
+		t.Errorf("expected the frequently used key to survive eviction")
+	}
+
+	// The hot key then goes unused for an hour, decaying its counter below
+	// that of a key that was just written.
+	storage.stripe(0, "hot").m["hot"].accessedAt.Add(-int64(time.Hour))
+	store.Set(1, "cold", "value")
+	if hot, _, _ := store.ObjectFreq(0, "hot"); hot != 0 {
+		t.Errorf("ObjectFreq(hot) after an hour idle = %d, expected 0", hot)
+	}
+	evictOne()
+
+	if _, ok, _ := store.Get(0, "hot"); ok {
+		t.Errorf("expected the idle key to be evicted once its counter decayed")
+	}
+	if _, ok, _ := store.Get(1, "cold"); !ok {
+		t.Errorf("expected the recently written key to survive eviction")
+	}
+}
+
+func TestCheckMemory_NoEviction(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+	store.Config().Set("maxmemory", "1")
+
+	if err := store.CheckMemory(); err != ErrOOM {
+		t.Errorf("CheckMemory() = %v, expected %v", err, ErrOOM)
+	}
+	if _, ok, _ := store.Get(0, "name"); !ok {
+		t.Errorf("expected noeviction to keep every key")
+	}
+	if _, _, err := store.ObjectFreq(0, "name"); err != ErrLFUNotSelected {
+		t.Errorf("ObjectFreq() = %v, expected %v", err, ErrLFUNotSelected)
+	}
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// MemoryStats is a storage's own accounting, the numbers maxmemory is checked
+// against. The counters are read without locks, so under concurrent writes
+// they may be a write apart from each other.
+type MemoryStats struct {
+	Used int64
+	Peak int64
+	// Overhead is the part of Used spent on bookkeeping rather than on the
+	// keys and values themselves.
+	Overhead  int64
+	Databases []DatabaseStats
+}
+
+type DatabaseStats struct {
+	Keys  int64
+	Bytes int64
+}
+
+// memoryCounter is a storage's running usage together with its high water
+// mark.
+type memoryCounter struct {
+	used atomic.Int64
+	peak atomic.Int64
+}
+
+func (c *memoryCounter) add(delta int64) {
+	used := c.used.Add(delta)
+	for peak := c.peak.Load(); used > peak && !c.peak.CompareAndSwap(peak, used); peak = c.peak.Load() {
+	}
+}
+
+// usageCounter tracks the keys and bytes held by part of a storage.
+type usageCounter struct {
+	keys  atomic.Int64
+	bytes atomic.Int64
+}
+
+func (c *usageCounter) add(keys, bytes int64) {
+	c.keys.Add(keys)
+	c.bytes.Add(bytes)
+}
+
+// MemoryStats renders the storage accounting as MEMORY STATS name and value
+// pairs, with a db.<index> entry for every database holding keys.
+func (s *Store) MemoryStats() []string {
+	stats := s.storage.MemoryStats()
+	var keys int64
+	for _, db := range stats.Databases {
+		keys += db.Keys
+	}
+	bytesPerKey := int64(0)
+	if keys > 0 {
+		bytesPerKey = stats.Used / keys
+	}
+
+	result := []string{
+		"peak.allocated", strconv.FormatInt(stats.Peak, 10),
+		"total.allocated", strconv.FormatInt(stats.Used, 10),
+		"overhead.total", strconv.FormatInt(stats.Overhead, 10),
+		"keys.count", strconv.FormatInt(keys, 10),
+		"keys.bytes-per-key", strconv.FormatInt(bytesPerKey, 10),
+		"dataset.bytes", strconv.FormatInt(stats.Used-stats.Overhead, 10),
+	}
+	for dbIndex, db := range stats.Databases {
+		if db.Keys == 0 {
+			continue
+		}
+		result = append(result, "db."+strconv.Itoa(dbIndex),
+			"keys="+strconv.FormatInt(db.Keys, 10)+",bytes="+strconv.FormatInt(db.Bytes, 10))
+	}
+	return result
+}
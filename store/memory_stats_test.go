@@ -0,0 +1,59 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMemoryStats(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+	store.Set(0, "counter", "42")
+	store.Set(3, "name", "robin")
+	store.Set(1, "gone", "value")
+	peakBeforeDel := store.UsedMemory()
+	store.Del(1, "gone")
+
+	pairs := store.MemoryStats()
+	if len(pairs)%2 != 0 {
+		t.Fatalf("MemoryStats() = %v, expected name and value pairs", pairs)
+	}
+	stats := make(map[string]string)
+	for i := 0; i < len(pairs); i += 2 {
+		stats[pairs[i]] = pairs[i+1]
+	}
+
+	usage := func(dbIndex int, keys ...string) (total int64) {
+		for _, key := range keys {
+			size, _, _ := store.MemoryUsage(dbIndex, key)
+			total += size
+		}
+		return total
+	}
+	db0, db3 := usage(0, "name", "counter"), usage(3, "name")
+	expected := map[string]string{
+		"total.allocated":    strconv.FormatInt(db0+db3, 10),
+		"keys.count":         "3",
+		"keys.bytes-per-key": strconv.FormatInt((db0+db3)/3, 10),
+		"db.0":               "keys=2,bytes=" + strconv.FormatInt(db0, 10),
+		"db.3":               "keys=1,bytes=" + strconv.FormatInt(db3, 10),
+	}
+	for name, value := range expected {
+		if stats[name] != value {
+			t.Errorf("MemoryStats() %s = %q, expected %q", name, stats[name], value)
+		}
+	}
+	if _, ok := stats["db.1"]; ok {
+		t.Errorf("MemoryStats() reports db.1, expected empty databases to be left out")
+	}
+
+	peak, _ := strconv.ParseInt(stats["peak.allocated"], 10, 64)
+	overhead, _ := strconv.ParseInt(stats["overhead.total"], 10, 64)
+	dataset, _ := strconv.ParseInt(stats["dataset.bytes"], 10, 64)
+	if peak < peakBeforeDel {
+		t.Errorf("peak.allocated = %d, expected at least %d from before the delete", peak, peakBeforeDel)
+	}
+	if overhead+dataset != db0+db3 {
+		t.Errorf("overhead.total + dataset.bytes = %d, expected total.allocated %d", overhead+dataset, db0+db3)
+	}
+}
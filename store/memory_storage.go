@@ -1,65 +1,368 @@
 package store
 
 import (
-	"fmt"
+	"hash/maphash"
+	"maps"
+	"math/rand/v2"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
+// entryOverhead approximates the fixed cost of one key in a database map:
+// the key's string header, the map slot pointer, and the entry struct.
+const entryOverhead = int64(unsafe.Sizeof("")) + int64(unsafe.Sizeof(&entry{})) + int64(unsafe.Sizeof(entry{}))
+
+// defaultStripes is the number of locks each database is split into.
+const defaultStripes = 16
+
+// MemoryStorage splits every database into stripes chosen by key hash, each
+// behind its own lock, so clients working on different keys rarely wait for
+// each other. Operations spanning several stripes lock them in database then
+// stripe index order.
+//
+// Snapshots are copy-on-write: freezing a stripe shares its map with the
+// snapshot, and the next write to the stripe copies the map before changing
+// it.
+//
+// Every stored entry carries a version taken from clock, and every stripe
+// the version of its last delete, which stands in for the version of its
+// missing keys. Access times, unlike versions, come from wallClock.
 type MemoryStorage struct {
-	data      []map[string]string
-	dataMutex sync.RWMutex
+	databases  []database
+	seed       maphash.Seed
+	usedMemory memoryCounter
+	quota      quotaLimits
+	clock      atomic.Uint64
+	wallClock  Clock
+}
+
+type database struct {
+	stripes []stripe
+	usage   usageCounter
+}
+
+type stripe struct {
+	mu sync.RWMutex
+	m  map[string]*entry
+	// frozen counts the snapshots sharing m. It is replaced along with m.
+	frozen  *atomic.Int32
+	deleted uint64
+}
+
+// reset must be called with the stripe's write lock held, or before the
+// stripe is shared.
+func (st *stripe) reset(m map[string]*entry) {
+	st.m = m
+	st.frozen = new(atomic.Int32)
+}
+
+// writable must be called with the stripe's write lock held. It returns m,
+// first replacing it with a private copy if a snapshot shares it.
+func (st *stripe) writable() map[string]*entry {
+	if st.frozen.Load() > 0 {
+		st.reset(maps.Clone(st.m))
+	}
+	return st.m
+}
+
+type entry struct {
+	value      string
+	version    uint64
+	accessedAt atomic.Int64
+	frequency  atomic.Uint32
+}
+
+func newEntry(value string, now time.Time) *entry {
+	e := &entry{value: value}
+	e.accessedAt.Store(now.UnixNano())
+	e.frequency.Store(lfuInitVal)
+	return e
+}
+
+// touch records an access, decaying the LFU counter by the time since the
+// previous one before bumping it.
+func (e *entry) touch(now time.Time) {
+	idle := time.Duration(now.UnixNano() - e.accessedAt.Swap(now.UnixNano()))
+	e.frequency.Store(uint32(lfuIncrement(lfuDecay(uint8(e.frequency.Load()), idle))))
+}
+
+// inherit carries the access history of the entry e replaces over to it, so
+// overwriting a key counts as an access rather than a fresh start.
+func (e *entry) inherit(old *entry, now time.Time) {
+	e.accessedAt.Store(old.accessedAt.Load())
+	e.frequency.Store(old.frequency.Load())
+	e.touch(now)
+}
+
+func (e *entry) lfu(now time.Time) uint8 {
+	return lfuDecay(uint8(e.frequency.Load()), e.idleTime(now))
+}
+
+func (e *entry) idleTime(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, e.accessedAt.Load()))
+}
+
+func (e *entry) memoryUsage(key string) int64 {
+	return int64(len(key)) + int64(len(e.value)) + entryOverhead
 }
 
 func NewMemoryStorage(numDatabases int) *MemoryStorage {
-	data := make([]map[string]string, numDatabases)
-	for i := range numDatabases {
-		data[i] = make(map[string]string)
+	return newStripedMemoryStorage(numDatabases, defaultStripes)
+}
+
+func newStripedMemoryStorage(numDatabases, stripes int) *MemoryStorage {
+	databases := make([]database, numDatabases)
+	for i := range databases {
+		databases[i].stripes = make([]stripe, stripes)
+		for j := range stripes {
+			databases[i].stripes[j].reset(make(map[string]*entry))
+		}
 	}
 	return &MemoryStorage{
-		data: data,
+		databases: databases,
+		seed:      maphash.MakeSeed(),
+		wallClock: systemClock{},
 	}
 }
 
+// stripe returns the stripe owning key.
+func (ms *MemoryStorage) stripe(dbIndex int, key string) *stripe {
+	stripes := ms.databases[dbIndex].stripes
+	return &stripes[ms.stripeIndex(key, len(stripes))]
+}
+
+func (ms *MemoryStorage) stripeIndex(key string, stripes int) uint64 {
+	return maphash.String(ms.seed, key) % uint64(stripes)
+}
+
 func (ms *MemoryStorage) numDatabases() int {
-	return len(ms.data)
+	return len(ms.databases)
+}
+
+// setQuota must be called before the storage is shared.
+func (ms *MemoryStorage) setQuota(limits quotaLimits) {
+	ms.quota = limits
+}
+
+// setClock must be called before the storage is shared.
+func (ms *MemoryStorage) setClock(clock Clock) {
+	ms.wallClock = clock
+}
+
+// put and remove must be called with the stripe's write lock held; they keep
+// the usage counters in step with the maps. put refuses a write that takes
+// the database past its quota when checkQuota is set.
+func (ms *MemoryStorage) put(dbIndex int, st *stripe, key, value string, checkQuota bool) error {
+	now := ms.wallClock.Now()
+	e := newEntry(value, now)
+	keys, bytes := int64(1), e.memoryUsage(key)
+	old, exists := st.m[key]
+	if exists {
+		keys, bytes = 0, bytes-old.memoryUsage(key)
+	}
+	usage := &ms.databases[dbIndex].usage
+	if !checkQuota {
+		usage.add(keys, bytes)
+	} else if !ms.quota.reserve(usage, keys, bytes) {
+		return ErrQuotaExceeded
+	}
+	if exists {
+		e.inherit(old, now)
+	}
+	e.version = ms.clock.Add(1)
+	st.writable()[key] = e
+	ms.usedMemory.add(bytes)
+	return nil
+}
+
+func (ms *MemoryStorage) remove(dbIndex int, st *stripe, key string) bool {
+	old, ok := st.m[key]
+	if !ok {
+		return false
+	}
+	delete(st.writable(), key)
+	st.deleted = ms.clock.Add(1)
+	ms.databases[dbIndex].usage.add(-1, -old.memoryUsage(key))
+	ms.usedMemory.add(-old.memoryUsage(key))
+	return true
+}
+
+// lookup returns the entry for key under the stripe's read lock. The
+// entry's value never changes once stored, only its access time.
+func (ms *MemoryStorage) lookup(dbIndex int, key string) (*entry, bool) {
+	st := ms.stripe(dbIndex, key)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	e, ok := st.m[key]
+	return e, ok
+}
+
+func (ms *MemoryStorage) UsedMemory() int64 {
+	return ms.usedMemory.used.Load()
+}
+
+func (ms *MemoryStorage) MemoryStats() MemoryStats {
+	stats := MemoryStats{
+		Used:      ms.usedMemory.used.Load(),
+		Peak:      ms.usedMemory.peak.Load(),
+		Databases: make([]DatabaseStats, len(ms.databases)),
+	}
+	for i := range ms.databases {
+		usage := &ms.databases[i].usage
+		stats.Databases[i] = DatabaseStats{Keys: usage.keys.Load(), Bytes: usage.bytes.Load()}
+		stats.Overhead += stats.Databases[i].Keys * entryOverhead
+	}
+	return stats
 }
 
 func (ms *MemoryStorage) Set(dbIndex int, key, value string) {
-	ms.dataMutex.Lock()
-	defer ms.dataMutex.Unlock()
-	ms.data[dbIndex][key] = value
+	st := ms.stripe(dbIndex, key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ms.put(dbIndex, st, key, value, false)
+}
+
+func (ms *MemoryStorage) SetIfAbsent(dbIndex int, key, value string) (bool, error) {
+	st := ms.stripe(dbIndex, key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.m[key]; ok {
+		return false, nil
+	}
+	if err := ms.put(dbIndex, st, key, value, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Update runs a read-modify-write of key under the stripe's write lock.
+// update returns the new value and whether it should be stored.
+func (ms *MemoryStorage) Update(dbIndex int, key string, update func(value string, exists bool) (string, bool, error)) error {
+	st := ms.stripe(dbIndex, key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var current string
+	e, exists := st.m[key]
+	if exists {
+		current = e.value
+	}
+	value, store, err := update(current, exists)
+	if err != nil || !store {
+		return err
+	}
+	return ms.put(dbIndex, st, key, value, true)
 }
 
 func (ms *MemoryStorage) Get(dbIndex int, key string) (string, bool) {
-	ms.dataMutex.RLock()
-	defer ms.dataMutex.RUnlock()
-	value, ok := ms.data[dbIndex][key]
-	return value, ok
+	e, ok := ms.lookup(dbIndex, key)
+	if !ok {
+		return "", false
+	}
+	e.touch(ms.wallClock.Now())
+	return e.value, true
 }
 
-func (ms *MemoryStorage) Del(dbIndex int, key string) int {
-	ms.dataMutex.Lock()
-	defer ms.dataMutex.Unlock()
-	_, ok := ms.data[dbIndex][key]
+func (ms *MemoryStorage) Peek(dbIndex int, key string) (string, bool) {
+	e, ok := ms.lookup(dbIndex, key)
+	if !ok {
+		return "", false
+	}
+	return e.value, true
+}
+
+func (ms *MemoryStorage) Touch(dbIndex int, key string) bool {
+	e, ok := ms.lookup(dbIndex, key)
+	if !ok {
+		return false
+	}
+	e.touch(ms.wallClock.Now())
+	return true
+}
+
+func (ms *MemoryStorage) IdleTime(dbIndex int, key string) (time.Duration, bool) {
+	e, ok := ms.lookup(dbIndex, key)
+	if !ok {
+		return 0, false
+	}
+	return e.idleTime(ms.wallClock.Now()), true
+}
+
+func (ms *MemoryStorage) Frequency(dbIndex int, key string) (uint8, bool) {
+	e, ok := ms.lookup(dbIndex, key)
+	if !ok {
+		return 0, false
+	}
+	return e.lfu(ms.wallClock.Now()), true
+}
+
+// sample returns up to n keys, taken from the stripes that follow a random
+// one. Go randomizes where each map iteration starts, so keys are not taken
+// from the front of a stripe every time.
+func (ms *MemoryStorage) sample(n int) []keySample {
+	stripes := len(ms.databases[0].stripes)
+	total := len(ms.databases) * stripes
+	start := rand.IntN(total)
+
+	now := ms.wallClock.Now()
+	var samples []keySample
+	for i := 0; i < total && len(samples) < n; i++ {
+		dbIndex, stripeIndex := (start+i)%total/stripes, (start+i)%stripes
+		st := &ms.databases[dbIndex].stripes[stripeIndex]
+		st.mu.RLock()
+		for key, e := range st.m {
+			if len(samples) == n {
+				break
+			}
+			samples = append(samples, keySample{dbIndex, key, e.lfu(now)})
+		}
+		st.mu.RUnlock()
+	}
+	return samples
+}
+
+func (ms *MemoryStorage) Version(dbIndex int, key string) uint64 {
+	st := ms.stripe(dbIndex, key)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if e, ok := st.m[key]; ok {
+		return e.version
+	}
+	return st.deleted
+}
+
+func (ms *MemoryStorage) MemoryUsage(dbIndex int, key string) (int64, bool) {
+	e, ok := ms.lookup(dbIndex, key)
 	if !ok {
+		return 0, false
+	}
+	return e.memoryUsage(key), true
+}
+
+func (ms *MemoryStorage) Del(dbIndex int, key string) int {
+	st := ms.stripe(dbIndex, key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !ms.remove(dbIndex, st, key) {
 		return 0
 	}
-	delete(ms.data[dbIndex], key)
 	return 1
 }
 
 func (ms *MemoryStorage) IncrBy(dbIndex int, key string, increment int64) (int64, error) {
-	ms.dataMutex.Lock()
-	defer ms.dataMutex.Unlock()
+	st := ms.stripe(dbIndex, key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
 
-	value, ok := ms.data[dbIndex][key]
+	e, ok := st.m[key]
 	var currentValue int64 = 0
 	var err error
 
 	if ok {
-		currentValue, err = strconv.ParseInt(value, 10, 64)
+		currentValue, err = strconv.ParseInt(e.value, 10, 64)
 		if err != nil {
 			return 0, ErrNotInteger
 		}
@@ -68,17 +371,153 @@ func (ms *MemoryStorage) IncrBy(dbIndex int, key string, increment int64) (int64
 		return 0, err
 	}
 	currentValue += increment
-	ms.data[dbIndex][key] = strconv.FormatInt(currentValue, 10)
+	if err := ms.put(dbIndex, st, key, strconv.FormatInt(currentValue, 10), true); err != nil {
+		return 0, err
+	}
 	return currentValue, nil
 }
 
-func (ms *MemoryStorage) Compact(dbIndex int) string {
-	ms.dataMutex.RLock()
-	defer ms.dataMutex.RUnlock()
+// Freeze returns a snapshot of every database as it is at the moment of the
+// call. The stripe locks are only held while the stripes are marked shared.
+func (ms *MemoryStorage) Freeze() Frozen {
+	return ms.freeze(0, len(ms.databases))
+}
+
+// freeze shares the stripes of databases first to last-1 with a new
+// snapshot, holding all their read locks together so the snapshot reflects
+// one moment.
+func (ms *MemoryStorage) freeze(first, last int) *memorySnapshot {
+	databases := ms.databases[first:last]
+	for i := range databases {
+		databases[i].rlock()
+	}
+	defer func() {
+		for i := range databases {
+			databases[i].runlock()
+		}
+	}()
+
+	snapshot := &memorySnapshot{first: first, databases: make([][]frozenStripe, len(databases))}
+	for i := range databases {
+		snapshot.databases[i] = make([]frozenStripe, len(databases[i].stripes))
+		for j := range databases[i].stripes {
+			st := &databases[i].stripes[j]
+			st.frozen.Add(1)
+			snapshot.databases[i][j] = frozenStripe{st.m, st.frozen}
+		}
+	}
+	return snapshot
+}
+
+// memorySnapshot holds the maps frozen by MemoryStorage.freeze. Nothing
+// writes to them until Release, so they are read without locks.
+type memorySnapshot struct {
+	first     int
+	databases [][]frozenStripe
+}
+
+type frozenStripe struct {
+	m      map[string]*entry
+	frozen *atomic.Int32
+}
+
+func (snapshot *memorySnapshot) ForEach(fn func(dbIndex int, key, value string)) {
+	for i, stripes := range snapshot.databases {
+		for _, st := range stripes {
+			for key, e := range st.m {
+				fn(snapshot.first+i, key, e.value)
+			}
+		}
+	}
+}
+
+func (snapshot *memorySnapshot) Release() {
+	for _, stripes := range snapshot.databases {
+		for _, st := range stripes {
+			st.frozen.Add(-1)
+		}
+	}
+	snapshot.databases = nil
+}
+
+// Snapshot copies the database from a frozen view, so writers only wait
+// while it is taken.
+func (ms *MemoryStorage) Snapshot(dbIndex int) map[string]string {
+	snapshot := ms.freeze(dbIndex, dbIndex+1)
+	defer snapshot.Release()
+
+	size := 0
+	for _, st := range snapshot.databases[0] {
+		size += len(st.m)
+	}
+	data := make(map[string]string, size)
+	snapshot.ForEach(func(_ int, key, value string) {
+		data[key] = value
+	})
+	return data
+}
+
+// Restore builds the new stripes before taking the write locks, so the swap
+// itself is all readers wait for.
+func (ms *MemoryStorage) Restore(dbIndex int, data map[string]string) {
+	db := &ms.databases[dbIndex]
+	restored := make([]map[string]*entry, len(db.stripes))
+	for i := range restored {
+		restored[i] = make(map[string]*entry)
+	}
+	now := ms.wallClock.Now()
+	var usage int64
+	for key, value := range data {
+		e := newEntry(value, now)
+		e.version = ms.clock.Add(1)
+		restored[ms.stripeIndex(key, len(restored))][key] = e
+		usage += e.memoryUsage(key)
+	}
+
+	db.lock()
+	defer db.unlock()
+	deleted := ms.clock.Add(1)
+	for i := range db.stripes {
+		db.stripes[i].reset(restored[i])
+		db.stripes[i].deleted = deleted
+	}
+	delta := usage - db.usage.bytes.Load()
+	db.usage.keys.Store(int64(len(data)))
+	db.usage.bytes.Store(usage)
+	ms.usedMemory.add(delta)
+}
+
+// ForEach calls fn for every key in every database of a frozen view, so the
+// keys it sees form a consistent snapshot while writers carry on.
+func (ms *MemoryStorage) ForEach(fn func(dbIndex int, key, value string)) {
+	snapshot := ms.Freeze()
+	defer snapshot.Release()
+	snapshot.ForEach(fn)
+}
+
+// lock and rlock take every stripe lock of the database in index order, the
+// order any operation holding more than one stripe lock must use to avoid
+// deadlocks.
+func (db *database) lock() {
+	for i := range db.stripes {
+		db.stripes[i].mu.Lock()
+	}
+}
+
+func (db *database) unlock() {
+	for i := range db.stripes {
+		db.stripes[i].mu.Unlock()
+	}
+}
+
+func (db *database) rlock() {
+	for i := range db.stripes {
+		db.stripes[i].mu.RLock()
+	}
+}
 
-	var result []string
-	for k, v := range ms.data[dbIndex] {
-		result = append(result, fmt.Sprintf("SET %s %s", k, v))
+func (db *database) runlock() {
+	for i := range db.stripes {
+		db.stripes[i].mu.RUnlock()
 	}
-	return strings.Join(result, "\n")
 }
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMemoryStorage_Stripes(t *testing.T) {
+	for _, stripes := range []int{1, 128} {
+		t.Run(fmt.Sprintf("%d stripes", stripes), func(t *testing.T) {
+			testStorage(t, func(t *testing.T) Storage {
+				return newStripedMemoryStorage(defaultNumDatabases, stripes)
+			})
+		})
+	}
+}
+
+func sequentialKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	return keys
+}
+
+// BenchmarkMemoryStorage_Databases runs a write heavy mix of SET and GET from
+// parallel clients, all in one database or each in its own. Databases use a
+// single stripe, so spread clients only avoid contention through the per
+// database locks.
+func BenchmarkMemoryStorage_Databases(b *testing.B) {
+	keys := sequentialKeys(1024)
+	for _, bm := range []struct {
+		name      string
+		databases int
+	}{
+		{"one database", 1},
+		{"spread across databases", defaultNumDatabases},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			storage := newStripedMemoryStorage(defaultNumDatabases, 1)
+			var clients atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				dbIndex := int(clients.Add(1)) % bm.databases
+				for i := 0; pb.Next(); i++ {
+					key := keys[i%len(keys)]
+					if i%4 == 0 {
+						storage.Get(dbIndex, key)
+					} else {
+						storage.Set(dbIndex, key, "value")
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMemoryStorage_Stripes runs parallel INCRs on distinct keys of a
+// single database.
+func BenchmarkMemoryStorage_Stripes(b *testing.B) {
+	keys := sequentialKeys(4096)
+	for _, stripes := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("%d stripes", stripes), func(b *testing.B) {
+			storage := newStripedMemoryStorage(defaultNumDatabases, stripes)
+			var clients atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				offset := int(clients.Add(1)) * 64
+				for i := 0; pb.Next(); i++ {
+					storage.IncrBy(0, keys[(offset+i%64)%len(keys)], 1)
+				}
+			})
+		})
+	}
+}
+
+func TestMemoryStorage_FreezeCopiesOnWrite(t *testing.T) {
+	storage := NewMemoryStorage(defaultNumDatabases)
+	storage.Set(0, "name", "batman")
+	st := storage.stripe(0, "name")
+	frozen := storage.Freeze()
+	shared := st.m
+
+	storage.Set(0, "name", "robin")
+
+	if shared["name"].value != "batman" {
+		t.Errorf("frozen map value = %q, expected the write to leave it alone", shared["name"].value)
+	}
+	if st.m["name"].value != "robin" {
+		t.Errorf("live value = %q, expected robin", st.m["name"].value)
+	}
+
+	frozen.Release()
+	copied := st.m
+	storage.Set(0, "name", "joker")
+	if len(copied) != 1 || copied["name"].value != "joker" {
+		t.Errorf("expected writes after Release to change the map in place")
+	}
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Keyspace event classes, as letters of notify-keyspace-events.
+const (
+	notifyGeneric = 'g'
+	notifyString  = '$'
+	notifyEvicted = 'e'
+)
+
+type keyspaceEvent struct {
+	flags   string
+	event   string
+	dbIndex int
+	key     string
+}
+
+// SetKeyspaceNotifier makes the store publish keyspace events through
+// publish. It must be called before the store is used.
+func (s *Store) SetKeyspaceNotifier(publish func(channel, message string)) {
+	s.notifier = publish
+}
+
+// notifyKeyspaceEvent passes event for key to the event hook, and publishes
+// it if notify-keyspace-events enables its class, once the change is done.
+// Events of a transaction wait for it to commit, and are dropped if it rolls
+// back.
+func (s *Store) notifyKeyspaceEvent(class byte, event string, dbIndex int, key string) {
+	var flags string
+	if s.notifier != nil {
+		flags = s.config.Get().NotifyKeyspaceEvents
+		if strings.IndexByte(flags, class) < 0 {
+			flags = ""
+		}
+	}
+	if flags == "" && s.eventHook == nil {
+		return
+	}
+	e := keyspaceEvent{flags, event, dbIndex, key}
+	if s.deferringEvents {
+		s.deferredEvents = append(s.deferredEvents, e)
+		return
+	}
+	s.publishKeyspaceEvent(e)
+}
+
+// publishKeyspaceEvent publishes e on the channels its flags select, which
+// are empty when only the event hook wants it.
+func (s *Store) publishKeyspaceEvent(e keyspaceEvent) {
+	if s.eventHook != nil {
+		s.eventHook(Event{Name: e.event, DB: e.dbIndex, Key: e.key})
+	}
+	if e.flags == "" {
+		return
+	}
+	db := strconv.Itoa(e.dbIndex)
+	if strings.Contains(e.flags, "K") {
+		s.notifier("__keyspace@"+db+"__:"+e.key, e.event)
+	}
+	if strings.Contains(e.flags, "E") {
+		s.notifier("__keyevent@"+db+"__:"+e.event, e.key)
+	}
+}
+
+// deferKeyspaceEvents holds back the events of a transaction until the
+// returned function is called with whether it committed. The execution
+// mutex must be held exclusively throughout.
+func (s *Store) deferKeyspaceEvents() func(committed bool) {
+	s.deferringEvents = true
+	return func(committed bool) {
+		events := s.deferredEvents
+		s.deferringEvents, s.deferredEvents = false, nil
+		if committed {
+			for _, e := range events {
+				s.publishKeyspaceEvent(e)
+			}
+		}
+	}
+}
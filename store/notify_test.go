@@ -0,0 +1,76 @@
+package store
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestKeyspaceNotifications(t *testing.T) {
+	testCases := []struct {
+		name     string
+		events   string
+		run      func(s *Store)
+		expected []string
+	}{
+		{"disabled", "", func(s *Store) { s.Set(0, "name", "batman") }, nil},
+		{"set", "KE$", func(s *Store) { s.Set(0, "name", "batman") }, []string{
+			"__keyspace@0__:name set",
+			"__keyevent@0__:set name",
+		}},
+		{"keyevent only", "E$g", func(s *Store) {
+			s.Set(2, "name", "batman")
+			s.Del(2, "name")
+			s.Del(2, "missing")
+		}, []string{
+			"__keyevent@2__:set name",
+			"__keyevent@2__:del name",
+		}},
+		{"class not enabled", "Kg", func(s *Store) {
+			s.Set(0, "name", "batman")
+			s.Incr(0, "counter")
+			s.Del(0, "name")
+		}, []string{
+			"__keyspace@0__:name del",
+		}},
+		{"committed transaction", "K$", func(s *Store) {
+			s.StartTransaction(1)
+			s.QueueCommand(1, "SET", []string{"name", "batman"})
+			s.QueueCommand(1, "INCR", []string{"counter"})
+			s.ExecuteTransaction(1, runCommand)
+		}, []string{
+			"__keyspace@0__:name set",
+			"__keyspace@0__:counter incrby",
+		}},
+		{"rolled back transaction", "K$g", func(s *Store) {
+			s.StartTransaction(1)
+			s.QueueCommand(1, "SET", []string{"name", "batman"})
+			s.QueueCommand(1, "INCR", []string{"name"})
+			s.ExecuteTransaction(1, runCommand)
+		}, nil},
+		{"eviction", "KA", func(s *Store) {
+			s.Set(0, "name", "batman")
+			s.Config().Set("maxmemory-policy", "allkeys-lfu")
+			s.Config().Set("maxmemory", strconv.FormatInt(s.UsedMemory()-1, 10))
+			s.CheckMemory()
+		}, []string{
+			"__keyspace@0__:name set",
+			"__keyspace@0__:name evicted",
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := CreateNewStore(NewMemoryStorage(16))
+			var published []string
+			s.SetKeyspaceNotifier(func(channel, message string) {
+				published = append(published, channel+" "+message)
+			})
+			s.Config().Set("notify-keyspace-events", tc.events)
+			tc.run(s)
+			if !reflect.DeepEqual(published, tc.expected) {
+				t.Errorf("published %q, expected %q", published, tc.expected)
+			}
+		})
+	}
+}
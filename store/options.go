@@ -0,0 +1,62 @@
+package store
+
+import (
+	"kv-store/config"
+	"time"
+)
+
+// Clock tells the store the time. The store uses the system clock unless
+// WithClock replaces it, which lets tests of idle times and timeouts run
+// without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Event is a change to a key, named as keyspace notifications name it, such
+// as "set", "del", "incrby" or "evicted".
+type Event struct {
+	Name string
+	DB   int
+	Key  string
+}
+
+// An Option configures the Store New makes.
+type Option func(*Store)
+
+// WithConfig makes the store use cfg rather than a default configuration.
+func WithConfig(cfg *config.Config) Option {
+	return func(s *Store) {
+		s.config = cfg
+	}
+}
+
+// WithMaxTransactionCommands limits how many commands a transaction can
+// queue, so a client cannot queue millions of them inside MULTI. Queueing one
+// more fails, and makes EXEC abort the transaction. 0, the default, sets no
+// limit.
+func WithMaxTransactionCommands(n int) Option {
+	return func(s *Store) {
+		s.maxTransactionCommands = n
+	}
+}
+
+// WithClock makes the store, and its storage, take the time from clock.
+func WithClock(clock Clock) Option {
+	return func(s *Store) {
+		s.clock = clock
+	}
+}
+
+// WithEventHook calls hook with every change to a key, once it is done,
+// whether or not notify-keyspace-events publishes it. The changes of a
+// transaction are passed once it commits, and dropped if it rolls back. hook
+// is called with the store locked, so it must not call the store back.
+func WithEventHook(hook func(Event)) Option {
+	return func(s *Store) {
+		s.eventHook = hook
+	}
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestWithClock(t *testing.T) {
+	diskStorage, err := OpenDiskStorage(filepath.Join(t.TempDir(), "data"), 16)
+	if err != nil {
+		t.Fatalf("OpenDiskStorage() failed: %v", err)
+	}
+	t.Cleanup(func() { diskStorage.Close() })
+
+	for name, storage := range map[string]Storage{"memory": NewMemoryStorage(16), "disk": diskStorage} {
+		t.Run(name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+			store := New(storage, WithClock(clock))
+			store.Set(0, "name", "batman")
+
+			clock.now = clock.now.Add(90 * time.Second)
+			if idle, ok, err := store.ObjectIdleTime(0, "name"); idle != 90 || !ok || err != nil {
+				t.Errorf("ObjectIdleTime() = %d, %v, %v, expected 90 seconds", idle, ok, err)
+			}
+		})
+	}
+
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	store := New(NewMemoryStorage(16), WithClock(clock))
+	store.Config().Set("transaction-timeout", "10")
+	store.StartTransaction(1)
+	clock.now = clock.now.Add(5 * time.Second)
+	store.QueueCommand(1, "SET", []string{"name", "batman"})
+	clock.now = clock.now.Add(10 * time.Second)
+	if discarded := store.DiscardIdleTransactions(clock.Now()); discarded != 0 {
+		t.Errorf("DiscardIdleTransactions() = %d, expected the queued command to count as activity", discarded)
+	}
+	clock.now = clock.now.Add(time.Second)
+	if discarded := store.DiscardIdleTransactions(clock.Now()); discarded != 1 {
+		t.Errorf("DiscardIdleTransactions() = %d, expected 1", discarded)
+	}
+}
+
+func TestWithMaxTransactionCommands(t *testing.T) {
+	store := New(NewMemoryStorage(16), WithMaxTransactionCommands(2))
+	store.StartTransaction(1)
+	for range 2 {
+		if err := store.QueueCommand(1, "INCR", []string{"counter"}); err != nil {
+			t.Fatalf("QueueCommand() failed: %v", err)
+		}
+	}
+
+	if err := store.QueueCommand(1, "INCR", []string{"counter"}); err == nil || err.Error() != "ERR transaction can not queue more than 2 commands" {
+		t.Errorf("QueueCommand() past the limit = %v", err)
+	}
+	if length, _ := store.TransactionLength(1); length != 2 {
+		t.Errorf("TransactionLength() = %d, expected 2", length)
+	}
+	if _, err := store.ExecuteTransaction(1, runCommand); err != ErrTransactionDiscarded {
+		t.Errorf("ExecuteTransaction() = %v, expected %v", err, ErrTransactionDiscarded)
+	}
+	if _, ok, _ := store.Get(0, "counter"); ok {
+		t.Error("expected the aborted transaction not to run")
+	}
+}
+
+func TestWithEventHook(t *testing.T) {
+	var events []Event
+	store := New(NewMemoryStorage(16), WithEventHook(func(e Event) { events = append(events, e) }))
+
+	store.Set(0, "name", "batman")
+	store.Incr(1, "counter")
+	store.Del(0, "name")
+	store.Del(0, "missing")
+
+	expected := []Event{{"set", 0, "name"}, {"incrby", 1, "counter"}, {"del", 0, "name"}}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("events = %v, expected %v", events, expected)
+	}
+}
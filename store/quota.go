@@ -0,0 +1,44 @@
+package store
+
+import "strconv"
+
+// quotaLimits returns the most keys and bytes a single database may hold, 0
+// meaning no limit. Storages call it on every write that grows a database,
+// so changes to the configuration apply to the next write.
+type quotaLimits func() (maxKeys, maxBytes int64)
+
+// reserve adds keys and bytes to a database's usage unless that takes it past
+// the limits. Writes that do not grow the database are always let through,
+// so a database over a lowered quota can still shrink. Two writers racing
+// for the last of a quota may both be refused, but never both let through.
+func (limits quotaLimits) reserve(usage *usageCounter, keys, bytes int64) bool {
+	if limits == nil || (keys <= 0 && bytes <= 0) {
+		usage.add(keys, bytes)
+		return true
+	}
+	maxKeys, maxBytes := limits()
+	totalKeys, totalBytes := usage.keys.Add(keys), usage.bytes.Add(bytes)
+	if (maxKeys > 0 && keys > 0 && totalKeys > maxKeys) || (maxBytes > 0 && bytes > 0 && totalBytes > maxBytes) {
+		usage.add(-keys, -bytes)
+		return false
+	}
+	return true
+}
+
+// KeyspaceInfo renders the INFO keyspace lines, one for every database
+// holding keys, with the quota each one is held to.
+func (s *Store) KeyspaceInfo() []string {
+	settings := s.config.Get()
+	var lines []string
+	for dbIndex, db := range s.storage.MemoryStats().Databases {
+		if db.Keys == 0 {
+			continue
+		}
+		lines = append(lines, "db"+strconv.Itoa(dbIndex)+
+			":keys="+strconv.FormatInt(db.Keys, 10)+
+			",bytes="+strconv.FormatInt(db.Bytes, 10)+
+			",max_keys="+strconv.FormatInt(settings.DBMaxKeys, 10)+
+			",max_bytes="+strconv.FormatInt(settings.DBMaxMemory, 10))
+	}
+	return lines
+}
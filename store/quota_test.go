@@ -0,0 +1,70 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	store := getInMemoryStore(t)
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	store.EnableAppendOnly(path)
+	defer store.CloseAppendOnly()
+	store.Config().Set("db-max-keys", "1")
+
+	if err := store.Set(0, "name", "batman"); err != nil {
+		t.Fatalf("Set() within the quota = %v, expected nil", err)
+	}
+	if err := store.Set(0, "other", "robin"); err != ErrQuotaExceeded {
+		t.Errorf("Set() past the quota = %v, expected %v", err, ErrQuotaExceeded)
+	}
+	if err := store.Set(1, "other", "robin"); err != nil {
+		t.Errorf("Set() in another database = %v, expected every database to have its own quota", err)
+	}
+	store.Config().Set("db-max-keys", "0")
+	if err := store.Set(0, "other", "robin"); err != nil {
+		t.Errorf("Set() after removing the quota = %v, expected nil", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	expected := "SELECT 0\nSET name batman\nSELECT 1\nSET other robin\nSELECT 0\nSET other robin\n"
+	if string(content) != expected {
+		t.Errorf("append only file = %q, expected %q", content, expected)
+	}
+}
+
+func TestQuota_TransactionRollsBack(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+	store.Config().Set("db-max-keys", "2")
+	store.StartTransaction(1)
+	store.QueueCommand(1, "SET", []string{"name", "bruce wayne"})
+	store.QueueCommand(1, "SET", []string{"first", "1"})
+	store.QueueCommand(1, "SET", []string{"second", "2"})
+
+	if _, err := store.ExecuteTransaction(1, runCommand); err != ErrQuotaExceeded {
+		t.Fatalf("ExecuteTransaction() = %v, expected %v", err, ErrQuotaExceeded)
+	}
+	if got, expected := contents(store.storage), map[int]map[string]string{0: {"name": "batman"}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("data after rollback = %v, expected %v", got, expected)
+	}
+	if err := store.StartTransaction(1); err != nil {
+		t.Errorf("StartTransaction() after a refused EXEC = %v, expected nil", err)
+	}
+}
+
+func TestKeyspaceInfo(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Config().Set("db-max-keys", "10")
+	store.Config().Set("db-max-memory", "1kb")
+	store.Set(2, "name", "batman")
+	usage, _, _ := store.MemoryUsage(2, "name")
+
+	expected := []string{"db2:keys=1,bytes=" + strconv.FormatInt(usage, 10) + ",max_keys=10,max_bytes=1024"}
+	if got := store.KeyspaceInfo(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("KeyspaceInfo() = %q, expected %q", got, expected)
+	}
+}
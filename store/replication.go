@@ -0,0 +1,60 @@
+package store
+
+import "kv-store/persistence"
+
+// SetWriteFeed passes every write to feed, as the commands the append only
+// file logs for it, in the order the writes were applied. It must be called
+// before the store is used.
+func (s *Store) SetWriteFeed(feed func(dbIndex int, commands [][]string)) {
+	s.writeFeed = feed
+}
+
+// FreezeAndFollow freezes the dataset and runs follow with no write fed in
+// between, so whatever follow starts receiving from the write feed is
+// exactly what the frozen view is missing. The caller releases the view,
+// which EncodeSnapshot does.
+func (s *Store) FreezeAndFollow(follow func()) Frozen {
+	s.feedMutex.Lock()
+	defer s.feedMutex.Unlock()
+	frozen := s.storage.Freeze()
+	follow()
+	return frozen
+}
+
+// EncodeSnapshot renders a frozen view in the binary snapshot format and
+// releases it. Writers are not blocked while it runs.
+func EncodeSnapshot(frozen Frozen) ([]byte, error) {
+	entries := frozenEntries(frozen)
+	frozen.Release()
+	return encodeBinarySnapshot(entries)
+}
+
+// ReplaceWithSnapshot replaces every database with the contents of a binary
+// snapshot and returns the number of keys loaded. The snapshot is decoded
+// and verified first, so a damaged one changes nothing. Each database is
+// then replaced as RestoreDatabase does.
+func (s *Store) ReplaceWithSnapshot(data []byte) (int, error) {
+	numDatabases := s.storage.numDatabases()
+	databases := make([]map[string]string, numDatabases)
+	loaded := 0
+	err := persistence.Read(data, func(e persistence.Entry) error {
+		if e.DB >= numDatabases {
+			return ErrSnapshotDBOutOfRange(e.DB, numDatabases)
+		}
+		if databases[e.DB] == nil {
+			databases[e.DB] = make(map[string]string)
+		}
+		databases[e.DB][e.Key] = e.Value
+		loaded++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for dbIndex, data := range databases {
+		if err := s.RestoreDatabase(dbIndex, data); err != nil {
+			return 0, err
+		}
+	}
+	return loaded, nil
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFreezeAndFollow(t *testing.T) {
+	leader := CreateNewStore(NewMemoryStorage(16))
+	leader.Set(0, "name", "batman")
+	leader.Set(3, "city", "gotham")
+
+	var fed [][]string
+	leader.SetWriteFeed(func(dbIndex int, commands [][]string) {
+		fed = append(fed, commands...)
+	})
+	frozen := leader.FreezeAndFollow(func() {})
+	leader.Set(0, "name", "robin")
+	leader.Incr(0, "counter")
+	data, err := EncodeSnapshot(frozen)
+	if err != nil {
+		t.Fatalf("EncodeSnapshot() failed: %v", err)
+	}
+	expectedFed := [][]string{{"SET", "name", "robin"}, {"INCRBY", "counter", "1"}}
+	if !reflect.DeepEqual(fed, expectedFed) {
+		t.Errorf("fed %q, expected %q", fed, expectedFed)
+	}
+
+	replica := CreateNewStore(NewMemoryStorage(16))
+	replica.Set(0, "stale", "yes")
+	replica.Set(5, "stale", "yes")
+	loaded, err := replica.ReplaceWithSnapshot(data)
+	if err != nil || loaded != 2 {
+		t.Fatalf("ReplaceWithSnapshot() = %d, %v, expected 2 keys", loaded, err)
+	}
+	for dbIndex, expected := range map[int]map[string]string{
+		0: {"name": "batman"},
+		3: {"city": "gotham"},
+		5: {},
+	} {
+		if got, _ := replica.SnapshotDatabase(dbIndex); !reflect.DeepEqual(got, expected) {
+			t.Errorf("database %d = %v, expected %v", dbIndex, got, expected)
+		}
+	}
+}
+
+func TestReplaceWithSnapshot_Damaged(t *testing.T) {
+	leader := CreateNewStore(NewMemoryStorage(16))
+	leader.Set(0, "name", "batman")
+	data, _ := EncodeSnapshot(leader.FreezeAndFollow(func() {}))
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-1] ^= 1
+
+	replica := CreateNewStore(NewMemoryStorage(16))
+	replica.Set(0, "name", "joker")
+	for name, damaged := range map[string][]byte{"truncated": data[:len(data)/2], "corrupt": corrupt} {
+		if _, err := replica.ReplaceWithSnapshot(damaged); err == nil {
+			t.Errorf("ReplaceWithSnapshot(%s) succeeded, expected an error", name)
+		}
+		if value, _, _ := replica.Get(0, "name"); value != "joker" {
+			t.Errorf("after ReplaceWithSnapshot(%s), name = %q, expected the dataset unchanged", name, value)
+		}
+	}
+}
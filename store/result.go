@@ -0,0 +1,42 @@
+package store
+
+// ResultKind tells how a transaction result is to be rendered.
+type ResultKind int
+
+const (
+	ResultValue ResultKind = iota
+	ResultNil
+	ResultInteger
+	ResultStatus
+	ResultError
+)
+
+// Result is the typed reply of one command run by EXEC. Value holds the text
+// of a value or status, Integer an integer and Err an error. A missing key
+// is a ResultNil, never the string "nil", so a stored "nil" stays a value.
+type Result struct {
+	Kind    ResultKind
+	Value   string
+	Integer int64
+	Err     error
+}
+
+func valueResult(value string) Result {
+	return Result{Kind: ResultValue, Value: value}
+}
+
+func nilResult() Result {
+	return Result{Kind: ResultNil}
+}
+
+func integerResult(integer int64) Result {
+	return Result{Kind: ResultInteger, Integer: integer}
+}
+
+func statusResult(status string) Result {
+	return Result{Kind: ResultStatus, Value: status}
+}
+
+func errorResult(err error) Result {
+	return Result{Kind: ResultError, Err: err}
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"bytes"
+	"kv-store/atomicfile"
+	"kv-store/errcode"
+	"kv-store/parser"
+	"kv-store/persistence"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrSaveInProgress       = errcode.New(errcode.Err, "background save already in progress")
+	ErrSnapshotDBOutOfRange = func(dbIndex, numDatabases int) error {
+		return errcode.Errorf(errcode.Err, "snapshot uses database %d but only %d databases are configured", dbIndex, numDatabases)
+	}
+)
+
+type snapshotEntry struct {
+	dbIndex int
+	key     string
+	value   string
+}
+
+// snapshot copies every key of every database, sorted.
+func (s *Store) snapshot() []snapshotEntry {
+	frozen := s.storage.Freeze()
+	defer frozen.Release()
+	return frozenEntries(frozen)
+}
+
+// frozenEntries copies every key of a frozen view, sorted. Writers are not
+// blocked while it runs, so background work calls it off the request path.
+func frozenEntries(frozen Frozen) []snapshotEntry {
+	var entries []snapshotEntry
+	frozen.ForEach(func(dbIndex int, key, value string) {
+		entries = append(entries, snapshotEntry{dbIndex, key, value})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].dbIndex != entries[j].dbIndex {
+			return entries[i].dbIndex < entries[j].dbIndex
+		}
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
+
+// encodeSnapshot renders entries as SELECT and SET lines the parser can read
+// back.
+func encodeSnapshot(entries []snapshotEntry) []byte {
+	var builder strings.Builder
+	currentDB := -1
+	for _, e := range entries {
+		if e.dbIndex != currentDB {
+			builder.WriteString("SELECT " + strconv.Itoa(e.dbIndex) + "\n")
+			currentDB = e.dbIndex
+		}
+		builder.WriteString("SET " + quoteArg(e.key) + " " + quoteArg(e.value) + "\n")
+	}
+	return []byte(builder.String())
+}
+
+// quoteArg quotes an argument of a written command line that would not read
+// back as itself unquoted, escaping line breaks so the command stays on one
+// line.
+func quoteArg(arg string) string {
+	if arg == "" || strings.ContainsFunc(arg, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r) || r == utf8.RuneError || r == '"' || r == '\\'
+	}) {
+		return parser.Quote(arg)
+	}
+	return arg
+}
+
+// encodeBinarySnapshot renders entries in the binary snapshot format, which
+// loads much faster than replaying SET lines.
+func encodeBinarySnapshot(entries []snapshotEntry) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := persistence.NewWriter(&buffer)
+	for _, e := range entries {
+		err := writer.Write(persistence.Entry{DB: e.dbIndex, Key: e.key, Value: e.value, Type: persistence.TypeString})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (s *Store) writeSnapshot(entries []snapshotEntry) error {
+	data, err := encodeBinarySnapshot(entries)
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(s.config.Get().SnapshotPath(), data); err != nil {
+		return err
+	}
+	s.lastSave.Store(s.clock.Now().Unix())
+	return nil
+}
+
+func (s *Store) Save() error {
+	if !s.saving.CompareAndSwap(false, true) {
+		return ErrSaveInProgress
+	}
+	defer s.saving.Store(false)
+	return s.writeSnapshot(s.snapshot())
+}
+
+func (s *Store) BackgroundSave() error {
+	if !s.saving.CompareAndSwap(false, true) {
+		return ErrSaveInProgress
+	}
+	frozen := s.storage.Freeze()
+
+	go func() {
+		defer s.saving.Store(false)
+		entries := frozenEntries(frozen)
+		frozen.Release()
+		if err := s.writeSnapshot(entries); err != nil {
+			s.logger.Error("Background save failed", "error", err)
+			return
+		}
+		s.logger.Info("Background save completed")
+	}()
+	return nil
+}
+
+func (s *Store) SaveInProgress() bool {
+	return s.saving.Load()
+}
+
+func (s *Store) LastSave() int64 {
+	return s.lastSave.Load()
+}
+
+// LoadSnapshot fills the storage from the snapshot file and returns the
+// number of keys loaded. It is meant for startup, before clients connect, so
+// the loaded keys are not logged to the append only file.
+func (s *Store) LoadSnapshot() (int, error) {
+	numDatabases := s.storage.numDatabases()
+	loaded := 0
+	err := persistence.ReadFile(s.config.Get().SnapshotPath(), func(e persistence.Entry) error {
+		if e.DB >= numDatabases {
+			return ErrSnapshotDBOutOfRange(e.DB, numDatabases)
+		}
+		s.storage.Set(e.DB, e.Key, e.Value)
+		loaded++
+		return nil
+	})
+	return loaded, err
+}
+
+// SnapshotExists reports whether a snapshot file is present at the configured
+// location.
+func (s *Store) SnapshotExists() (string, bool) {
+	path := s.config.Get().SnapshotPath()
+	info, err := os.Stat(path)
+	return path, err == nil && info.Mode().IsRegular()
+}
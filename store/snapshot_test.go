@@ -0,0 +1,237 @@
+package store
+
+import (
+	"kv-store/parser"
+	"kv-store/persistence"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getSnapshotStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	store := getInMemoryStore(t)
+	dir := t.TempDir()
+	store.Config().Set("dir", dir)
+	return store, filepath.Join(dir, "dump.kvs")
+}
+
+// readSnapshot decodes a snapshot file back into per-database key/values.
+func readSnapshot(t *testing.T, path string) map[int]map[string]string {
+	t.Helper()
+	data := make(map[int]map[string]string)
+	err := persistence.ReadFile(path, func(e persistence.Entry) error {
+		if data[e.DB] == nil {
+			data[e.DB] = make(map[string]string)
+		}
+		data[e.DB][e.Key] = e.Value
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+	return data
+}
+
+func TestSave(t *testing.T) {
+	store, path := getSnapshotStore(t)
+	store.Set(0, "name", "batman")
+	store.Set(0, "quote", `say "hi" \ bye`)
+	store.Set(0, "binary", "line\r\nbreak\x00")
+	store.Set(3, "wizard", "gandalf the grey")
+
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+
+	expected := map[int]map[string]string{
+		0: {"name": "batman", "quote": `say "hi" \ bye`, "binary": "line\r\nbreak\x00"},
+		3: {"wizard": "gandalf the grey"},
+	}
+	if got := readSnapshot(t, path); !reflect.DeepEqual(got, expected) {
+		t.Errorf("snapshot = %v, expected %v", got, expected)
+	}
+	if lastSave := store.LastSave(); time.Since(time.Unix(lastSave, 0)) > time.Minute {
+		t.Errorf("LastSave() = %d, expected a recent time", lastSave)
+	}
+}
+
+func TestSave_Failure(t *testing.T) {
+	store := getInMemoryStore(t)
+	dir := t.TempDir()
+	store.Config().Set("dir", dir)
+	os.RemoveAll(dir)
+
+	if err := store.Save(); err == nil {
+		t.Fatalf("expected Save() into a removed directory to fail")
+	}
+	if lastSave := store.LastSave(); lastSave != 0 {
+		t.Errorf("LastSave() = %d, expected 0 after a failed save", lastSave)
+	}
+	if err := store.Save(); err == ErrSaveInProgress {
+		t.Errorf("expected a failed save to release the in-progress flag")
+	}
+}
+
+func TestBackgroundSave_ConsistentSnapshot(t *testing.T) {
+	store, path := getSnapshotStore(t)
+	store.Set(0, "name", "batman")
+
+	if err := store.BackgroundSave(); err != nil {
+		t.Fatalf("BackgroundSave() failed: %v", err)
+	}
+	store.Set(0, "name", "robin")
+	store.Set(0, "other", "value")
+
+	deadline := time.Now().Add(time.Second)
+	for store.SaveInProgress() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	expected := map[int]map[string]string{0: {"name": "batman"}}
+	if got := readSnapshot(t, path); !reflect.DeepEqual(got, expected) {
+		t.Errorf("snapshot = %v, expected %v", got, expected)
+	}
+}
+
+func TestBackgroundSave_AlreadyInProgress(t *testing.T) {
+	store, _ := getSnapshotStore(t)
+	store.saving.Store(true)
+
+	if err := store.BackgroundSave(); err != ErrSaveInProgress {
+		t.Errorf("BackgroundSave() = %v, expected %v", err, ErrSaveInProgress)
+	}
+	if err := store.Save(); err != ErrSaveInProgress {
+		t.Errorf("Save() = %v, expected %v", err, ErrSaveInProgress)
+	}
+}
+
+func TestSnapshotExists(t *testing.T) {
+	store, _ := getSnapshotStore(t)
+
+	if _, ok := store.SnapshotExists(); ok {
+		t.Errorf("expected no snapshot before saving")
+	}
+	store.Save()
+	if _, ok := store.SnapshotExists(); !ok {
+		t.Errorf("expected snapshot to exist after saving")
+	}
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	store, _ := getSnapshotStore(t)
+	store.Set(0, "name", "batman")
+	store.Set(15, "binary", "line\r\nbreak\x00")
+	store.PFAdd(2, "hll", []string{"a", "b", "c"})
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+
+	restored := CreateNewStoreWithConfig(NewMemoryStorage(16), store.Config())
+	loaded, err := restored.LoadSnapshot()
+
+	if err != nil || loaded != 3 {
+		t.Fatalf("LoadSnapshot() = %d, %v, expected 3, nil", loaded, err)
+	}
+	if !reflect.DeepEqual(restored.snapshot(), store.snapshot()) {
+		t.Errorf("restored dataset differs from the saved one")
+	}
+}
+
+func TestLoadSnapshot_Errors(t *testing.T) {
+	store, path := getSnapshotStore(t)
+	store.Set(5, "name", "batman")
+	store.Save()
+	saved, _ := os.ReadFile(path)
+
+	corrupted := append([]byte(nil), saved...)
+	corrupted[len(corrupted)-12] ^= 0xff
+	newer := append([]byte(nil), saved...)
+	newer[len(persistence.Magic)] = persistence.Version + 1
+
+	tests := []struct {
+		name         string
+		content      []byte
+		numDatabases int
+		expected     error
+	}{
+		{"bad checksum", corrupted, 16, persistence.ErrBadChecksum},
+		{"newer version", newer, 16, persistence.ErrNewerVersion(persistence.Version + 1)},
+		{"text format", []byte("SELECT 0\nSET name batman\n"), 16, persistence.ErrBadMagic},
+		{"too few databases", saved, 4, ErrSnapshotDBOutOfRange(5, 4)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.WriteFile(path, tt.content, 0o644)
+			restored := CreateNewStoreWithConfig(NewMemoryStorage(tt.numDatabases), store.Config())
+
+			_, err := restored.LoadSnapshot()
+
+			if err == nil || err.Error() != tt.expected.Error() {
+				t.Errorf("LoadSnapshot() = %v, expected %v", err, tt.expected)
+			}
+			if restored.UsedMemory() != 0 {
+				t.Errorf("expected a rejected snapshot to load nothing")
+			}
+		})
+	}
+}
+
+// generateDataset builds a store with n keys spread over the databases for
+// the load benchmarks.
+func generateDataset(n int) *Store {
+	store := CreateNewStore(NewMemoryStorage(16))
+	for i := range n {
+		store.Set(i%16, "key:"+strconv.Itoa(i), "value:"+strconv.Itoa(i*7919))
+	}
+	return store
+}
+
+const benchmarkKeys = 1_000_000
+
+func BenchmarkLoadSnapshot_Binary(b *testing.B) {
+	data, err := encodeBinarySnapshot(generateDataset(benchmarkKeys).snapshot())
+	if err != nil {
+		b.Fatalf("encodeBinarySnapshot() failed: %v", err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for range b.N {
+		storage := NewMemoryStorage(16)
+		err := persistence.Read(data, func(e persistence.Entry) error {
+			storage.Set(e.DB, e.Key, e.Value)
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("persistence.Read() failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkLoadSnapshot_Text(b *testing.B) {
+	data := encodeSnapshot(generateDataset(benchmarkKeys).snapshot())
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for range b.N {
+		storage := NewMemoryStorage(16)
+		dbIndex := 0
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			command, args, err := parser.ParseCommandLine(line)
+			if err != nil {
+				b.Fatalf("ParseCommandLine() failed: %v", err)
+			}
+			if command == "SELECT" {
+				dbIndex, _ = strconv.Atoi(args[0])
+				continue
+			}
+			storage.Set(dbIndex, args[0], args[1])
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"expvar"
+	"strconv"
+)
+
+// stats are the counters a store publishes as expvar values. They are not
+// registered with the expvar package, so several stores can coexist in one
+// process; the debug endpoint serves them next to the global variables.
+type stats struct {
+	vars                  *expvar.Map
+	commands              *expvar.Map
+	transactionsStarted   expvar.Int
+	transactionsExecuted  expvar.Int
+	transactionsAborted   expvar.Int
+	transactionsDiscarded expvar.Int
+}
+
+func newStats(s *Store) *stats {
+	st := &stats{vars: new(expvar.Map).Init(), commands: new(expvar.Map).Init()}
+	st.vars.Set("keys", expvar.Func(func() any {
+		keys := map[string]int64{}
+		for dbIndex, db := range s.storage.MemoryStats().Databases {
+			if db.Keys > 0 {
+				keys["db"+strconv.Itoa(dbIndex)] = db.Keys
+			}
+		}
+		return keys
+	}))
+	st.vars.Set("commands", st.commands)
+	st.vars.Set("transactions_started", &st.transactionsStarted)
+	st.vars.Set("transactions_executed", &st.transactionsExecuted)
+	st.vars.Set("transactions_aborted", &st.transactionsAborted)
+	st.vars.Set("transactions_discarded", &st.transactionsDiscarded)
+	return st
+}
+
+// Vars returns the store's expvar values: the keys in each database, the
+// number of calls of each command, and transaction totals.
+func (s *Store) Vars() *expvar.Map {
+	return s.stats.vars
+}
+
+// CountCommand adds a call of command to its total.
+func (s *Store) CountCommand(command string) {
+	s.stats.commands.Add(command, 1)
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVars(t *testing.T) {
+	s := CreateNewStore(NewMemoryStorage(16))
+	s.Set(0, "name", "batman")
+	s.Set(2, "name", "robin")
+	s.CountCommand("SET")
+	s.CountCommand("SET")
+
+	s.StartTransaction(1)
+	s.QueueCommand(1, "SET", []string{"name", "alfred"})
+	s.ExecuteTransaction(1, runCommand)
+	s.StartTransaction(1)
+	s.ReportTransactionError(1)
+	s.ExecuteTransaction(1, runCommand)
+	s.StartTransaction(1)
+	s.DiscardTransaction(1)
+
+	var vars struct {
+		Keys                  map[string]int64
+		Commands              map[string]int64
+		TransactionsStarted   int64 `json:"transactions_started"`
+		TransactionsExecuted  int64 `json:"transactions_executed"`
+		TransactionsAborted   int64 `json:"transactions_aborted"`
+		TransactionsDiscarded int64 `json:"transactions_discarded"`
+	}
+	if err := json.Unmarshal([]byte(s.Vars().String()), &vars); err != nil {
+		t.Fatalf("Vars() is not valid JSON: %v", err)
+	}
+	if len(vars.Keys) != 2 || vars.Keys["db0"] != 1 || vars.Keys["db2"] != 1 {
+		t.Errorf("keys = %v, expected one key in db0 and db2", vars.Keys)
+	}
+	if vars.Commands["SET"] != 2 {
+		t.Errorf("commands = %v, expected 2 SETs", vars.Commands)
+	}
+	if vars.TransactionsStarted != 3 || vars.TransactionsExecuted != 1 || vars.TransactionsAborted != 1 || vars.TransactionsDiscarded != 1 {
+		t.Errorf("transactions = %+v, expected 3 started, 1 executed, 1 aborted and 1 discarded", vars)
+	}
+}
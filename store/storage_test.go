@@ -0,0 +1,457 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStorage is the conformance suite every Storage implementation must
+// pass. newStorage returns an empty storage with defaultNumDatabases
+// databases.
+func testStorage(t *testing.T, newStorage func(t *testing.T) Storage) {
+	t.Run("SetGet", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "name", "batman")
+		storage.Set(0, "name", "bruce wayne")
+		storage.Set(0, "binary", "line\r\nbreak\x00")
+		storage.Set(0, "empty", "")
+
+		if value, ok := storage.Get(0, "name"); !ok || value != "bruce wayne" {
+			t.Errorf("Get(name) = %q, %t, expected %q, true", value, ok, "bruce wayne")
+		}
+		if value, ok := storage.Get(0, "binary"); !ok || value != "line\r\nbreak\x00" {
+			t.Errorf("Get(binary) = %q, %t, expected the binary value", value, ok)
+		}
+		if value, ok := storage.Get(0, "empty"); !ok || value != "" {
+			t.Errorf("Get(empty) = %q, %t, expected an empty value that exists", value, ok)
+		}
+		if _, ok := storage.Get(0, "missing"); ok {
+			t.Errorf("Get(missing) succeeded, expected key not to exist")
+		}
+		if value, ok := storage.Peek(0, "name"); !ok || value != "bruce wayne" {
+			t.Errorf("Peek(name) = %q, %t, expected %q, true", value, ok, "bruce wayne")
+		}
+	})
+
+	t.Run("DatabaseIsolation", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "name", "batman")
+		storage.Set(defaultNumDatabases-1, "name", "robin")
+
+		if value, _ := storage.Get(0, "name"); value != "batman" {
+			t.Errorf("Get(0, name) = %q, expected batman", value)
+		}
+		if value, _ := storage.Get(defaultNumDatabases-1, "name"); value != "robin" {
+			t.Errorf("Get(%d, name) = %q, expected robin", defaultNumDatabases-1, value)
+		}
+		if _, ok := storage.Get(1, "name"); ok {
+			t.Errorf("expected key set in other databases not to exist in database 1")
+		}
+		if storage.numDatabases() != defaultNumDatabases {
+			t.Errorf("numDatabases() = %d, expected %d", storage.numDatabases(), defaultNumDatabases)
+		}
+	})
+
+	t.Run("SetIfAbsent", func(t *testing.T) {
+		storage := newStorage(t)
+
+		if set, _ := storage.SetIfAbsent(0, "name", "batman"); !set {
+			t.Errorf("SetIfAbsent() on a new key = false, expected true")
+		}
+		if set, _ := storage.SetIfAbsent(0, "name", "robin"); set {
+			t.Errorf("SetIfAbsent() on an existing key = true, expected false")
+		}
+		if value, _ := storage.Get(0, "name"); value != "batman" {
+			t.Errorf("Get(name) = %q, expected batman", value)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		storage := newStorage(t)
+		errRejected := errors.New("rejected")
+		storage.Set(0, "name", "bat")
+
+		err := storage.Update(0, "name", func(value string, exists bool) (string, bool, error) {
+			return value + "man", exists, nil
+		})
+		if value, _ := storage.Get(0, "name"); err != nil || value != "batman" {
+			t.Errorf("Update() = %v, value %q, expected nil, batman", err, value)
+		}
+
+		storage.Update(0, "skipped", func(value string, exists bool) (string, bool, error) {
+			return "value", false, nil
+		})
+		if _, ok := storage.Get(0, "skipped"); ok {
+			t.Errorf("expected Update() returning false not to store the key")
+		}
+
+		err = storage.Update(0, "name", func(value string, exists bool) (string, bool, error) {
+			return "robin", true, errRejected
+		})
+		if value, _ := storage.Get(0, "name"); err != errRejected || value != "batman" {
+			t.Errorf("Update() = %v, value %q, expected %v, batman", err, value, errRejected)
+		}
+	})
+
+	t.Run("Del", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "name", "batman")
+
+		if deleted := storage.Del(0, "name"); deleted != 1 {
+			t.Errorf("Del(name) = %d, expected 1", deleted)
+		}
+		if deleted := storage.Del(0, "name"); deleted != 0 {
+			t.Errorf("Del(name) again = %d, expected 0", deleted)
+		}
+		if _, ok := storage.Get(0, "name"); ok {
+			t.Errorf("expected deleted key not to exist")
+		}
+	})
+
+	t.Run("IncrBy", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "name", "batman")
+		storage.Set(0, "max", fmt.Sprint(int64(math.MaxInt64)))
+
+		tests := []struct {
+			key       string
+			increment int64
+			expected  int64
+			err       error
+		}{
+			{"counter", 5, 5, nil},
+			{"counter", -7, -2, nil},
+			{"name", 1, 0, ErrNotInteger},
+			{"max", 1, 0, ErrIntOverflow},
+		}
+		for _, tt := range tests {
+			value, err := storage.IncrBy(0, tt.key, tt.increment)
+			if value != tt.expected || err != tt.err {
+				t.Errorf("IncrBy(%s, %d) = %d, %v, expected %d, %v", tt.key, tt.increment, value, err, tt.expected, tt.err)
+			}
+		}
+		if value, _ := storage.Get(0, "name"); value != "batman" {
+			t.Errorf("expected a failed IncrBy to leave the value alone, got %q", value)
+		}
+	})
+
+	t.Run("ConcurrentIncrBy", func(t *testing.T) {
+		storage := newStorage(t)
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 20 {
+					storage.IncrBy(0, "counter", 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if value, _ := storage.Get(0, "counter"); value != "200" {
+			t.Errorf("counter = %s after 200 concurrent increments, expected 200", value)
+		}
+	})
+
+	t.Run("SnapshotAndRestore", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "a", "1")
+		storage.Set(0, "b", "2")
+		storage.Set(1, "c", "3")
+
+		snapshot := storage.Snapshot(0)
+		storage.Set(0, "a", "changed")
+		if expected := map[string]string{"a": "1", "b": "2"}; !reflect.DeepEqual(snapshot, expected) {
+			t.Errorf("Snapshot(0) = %v, expected %v unaffected by later writes", snapshot, expected)
+		}
+		if empty := storage.Snapshot(2); len(empty) != 0 {
+			t.Errorf("Snapshot() of an empty database = %v, expected empty", empty)
+		}
+
+		storage.Restore(0, map[string]string{"b": "restored", "d": "4"})
+
+		if got, expected := storage.Snapshot(0), map[string]string{"b": "restored", "d": "4"}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Snapshot(0) after Restore = %v, expected %v", got, expected)
+		}
+		if value, _ := storage.Get(1, "c"); value != "3" {
+			t.Errorf("expected Restore to leave other databases alone, got %q", value)
+		}
+		var expectedUsage int64
+		for _, key := range []string{"b", "d"} {
+			usage, _ := storage.MemoryUsage(0, key)
+			expectedUsage += usage
+		}
+		usage, _ := storage.MemoryUsage(1, "c")
+		if used := storage.UsedMemory(); used != expectedUsage+usage {
+			t.Errorf("UsedMemory() after Restore = %d, expected %d", used, expectedUsage+usage)
+		}
+	})
+
+	t.Run("Freeze", func(t *testing.T) {
+		storage := newStorage(t)
+		expected := make(map[int]map[string]string)
+		for dbIndex := range 2 {
+			expected[dbIndex] = make(map[string]string)
+			for i := range 100 {
+				key := fmt.Sprintf("key:%d", i)
+				storage.Set(dbIndex, key, "before")
+				expected[dbIndex][key] = "before"
+			}
+		}
+
+		frozen := storage.Freeze()
+		stop := make(chan struct{})
+		var writes sync.WaitGroup
+		writes.Add(1)
+		go func() {
+			defer writes.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key:%d", i%100)
+				storage.Set(i%2, key, fmt.Sprint("after ", i))
+				storage.Del(i%2, fmt.Sprintf("key:%d", (i+50)%100))
+				storage.Set(i%2, fmt.Sprintf("new:%d", i%100), "value")
+				runtime.Gosched()
+			}
+		}()
+
+		seen := make(map[int]map[string]string)
+		frozen.ForEach(func(dbIndex int, key, value string) {
+			time.Sleep(50 * time.Microsecond)
+			if seen[dbIndex] == nil {
+				seen[dbIndex] = make(map[string]string)
+			}
+			seen[dbIndex][key] = value
+		})
+		frozen.Release()
+		close(stop)
+		writes.Wait()
+
+		if !reflect.DeepEqual(seen, expected) {
+			t.Errorf("frozen view changed while it was read: saw %d keys in database 0 and %d in database 1, expected 100 each set to before", len(seen[0]), len(seen[1]))
+		}
+		if _, ok := storage.Get(0, "new:0"); !ok {
+			t.Errorf("expected writes made while the view was read to reach the storage")
+		}
+	})
+
+	t.Run("ForEach", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "a", "1")
+		storage.Set(3, "b", "2")
+
+		seen := make(map[int]map[string]string)
+		storage.ForEach(func(dbIndex int, key, value string) {
+			if seen[dbIndex] == nil {
+				seen[dbIndex] = make(map[string]string)
+			}
+			seen[dbIndex][key] = value
+		})
+		if expected := map[int]map[string]string{0: {"a": "1"}, 3: {"b": "2"}}; !reflect.DeepEqual(seen, expected) {
+			t.Errorf("ForEach() saw %v, expected %v", seen, expected)
+		}
+	})
+
+	t.Run("TouchAndIdleTime", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "name", "batman")
+
+		if idle, ok := storage.IdleTime(0, "name"); !ok || idle > time.Second {
+			t.Errorf("IdleTime(name) = %v, %t, expected a fresh key", idle, ok)
+		}
+		if _, ok := storage.IdleTime(0, "missing"); ok {
+			t.Errorf("IdleTime(missing) succeeded, expected key not to exist")
+		}
+		if !storage.Touch(0, "name") || storage.Touch(0, "missing") {
+			t.Errorf("Touch() should report whether the key exists")
+		}
+	})
+
+	t.Run("FrequencyAndSample", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "a", "1")
+		storage.Set(3, "b", "2")
+		storage.Set(3, "c", "3")
+
+		if frequency, ok := storage.Frequency(0, "a"); !ok || frequency != lfuInitVal {
+			t.Errorf("Frequency(a) = %d, %t, expected %d for a new key", frequency, ok, lfuInitVal)
+		}
+		if _, ok := storage.Frequency(0, "missing"); ok {
+			t.Errorf("Frequency(missing) succeeded, expected key not to exist")
+		}
+		if samples := newStorage(t).sample(evictionSamples); len(samples) != 0 {
+			t.Errorf("sample() of an empty storage = %v, expected none", samples)
+		}
+
+		// Fewer keys than samples are wanted, so wherever sampling starts it
+		// must find them all.
+		seen := make(map[keySample]bool)
+		for _, s := range storage.sample(evictionSamples) {
+			seen[s] = true
+		}
+		expected := map[keySample]bool{{0, "a", lfuInitVal}: true, {3, "b", lfuInitVal}: true, {3, "c", lfuInitVal}: true}
+		if !reflect.DeepEqual(seen, expected) {
+			t.Errorf("sample() = %v, expected %v", seen, expected)
+		}
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		storage := newStorage(t)
+		storage.Set(0, "name", "batman")
+		storage.Set(0, "counter", "1")
+		keep := func(string, bool) (string, bool, error) { return "", false, nil }
+
+		steps := []struct {
+			name    string
+			key     string
+			write   func()
+			changes bool
+		}{
+			{"Get", "name", func() { storage.Get(0, "name") }, false},
+			{"Touch", "name", func() { storage.Touch(0, "name") }, false},
+			{"Update without storing", "name", func() { storage.Update(0, "name", keep) }, false},
+			{"SetIfAbsent on an existing key", "name", func() { storage.SetIfAbsent(0, "name", "robin") }, false},
+			{"IncrBy of a non integer", "name", func() { storage.IncrBy(0, "name", 1) }, false},
+			{"Set", "name", func() { storage.Set(0, "name", "batman") }, true},
+			{"IncrBy", "counter", func() { storage.IncrBy(0, "counter", 1) }, true},
+			{"Del", "counter", func() { storage.Del(0, "counter") }, true},
+			{"SetIfAbsent", "counter", func() { storage.SetIfAbsent(0, "counter", "1") }, true},
+			{"Restore", "counter", func() { storage.Restore(0, map[string]string{"counter": "1"}) }, true},
+			{"Restore dropping the key", "counter", func() { storage.Restore(0, nil) }, true},
+			{"Set and Del of a missing key", "missing", func() { storage.Set(0, "missing", "1"); storage.Del(0, "missing") }, true},
+		}
+		for _, step := range steps {
+			before := storage.Version(0, step.key)
+			step.write()
+			if changed := storage.Version(0, step.key) != before; changed != step.changes {
+				t.Errorf("after %s: version of %s changed = %t, expected %t", step.name, step.key, changed, step.changes)
+			}
+		}
+	})
+
+	t.Run("Quota", func(t *testing.T) {
+		storage := newStorage(t)
+		maxKeys, maxBytes := int64(2), int64(0)
+		storage.setQuota(func() (int64, int64) { return maxKeys, maxBytes })
+		storage.Set(0, "a", "1")
+		storage.Set(0, "b", "2")
+		grow := func(value string, exists bool) (string, bool, error) { return value + "0", true, nil }
+
+		writes := []struct {
+			name  string
+			write func() error
+		}{
+			{"SetIfAbsent", func() error { _, err := storage.SetIfAbsent(0, "c", "3"); return err }},
+			{"Update", func() error { return storage.Update(0, "c", grow) }},
+			{"IncrBy", func() error { _, err := storage.IncrBy(0, "c", 1); return err }},
+		}
+		for _, w := range writes {
+			if err := w.write(); err != ErrQuotaExceeded {
+				t.Errorf("%s() of a third key = %v, expected %v", w.name, err, ErrQuotaExceeded)
+			}
+		}
+		if _, ok := storage.Peek(0, "c"); ok {
+			t.Errorf("expected refused writes not to store the key")
+		}
+		if err := storage.Update(0, "a", grow); err != nil {
+			t.Errorf("Update() of an existing key = %v, expected keys quota not to apply", err)
+		}
+		if _, err := storage.IncrBy(1, "c", 1); err != nil {
+			t.Errorf("IncrBy() in another database = %v, expected nil", err)
+		}
+
+		stats := storage.MemoryStats()
+		maxKeys, maxBytes = 0, stats.Databases[0].Bytes
+		if _, err := storage.IncrBy(0, "a", 90); err != ErrQuotaExceeded {
+			t.Errorf("IncrBy() growing past the bytes quota = %v, expected %v", err, ErrQuotaExceeded)
+		}
+		maxBytes = 1
+		if _, err := storage.IncrBy(0, "a", -1); err != nil {
+			t.Errorf("IncrBy() shrinking a database over its quota = %v, expected nil", err)
+		}
+		if storage.Del(0, "b") != 1 {
+			t.Errorf("expected deletes to work over the quota")
+		}
+		storage.Set(0, "unchecked", "value")
+		if _, ok := storage.Peek(0, "unchecked"); !ok {
+			t.Errorf("expected Set to ignore the quota")
+		}
+
+		var used int64
+		storage.ForEach(func(dbIndex int, key, value string) {
+			usage, _ := storage.MemoryUsage(dbIndex, key)
+			used += usage
+		})
+		if storage.UsedMemory() != used || storage.MemoryStats().Databases[0].Keys != 2 {
+			t.Errorf("UsedMemory() = %d, keys = %d, expected %d and 2 after refused writes",
+				storage.UsedMemory(), storage.MemoryStats().Databases[0].Keys, used)
+		}
+	})
+
+	t.Run("MemoryAccounting", func(t *testing.T) {
+		storage := newStorage(t)
+		steps := []struct {
+			name  string
+			write func()
+		}{
+			{"set", func() { storage.Set(0, "name", "batman"); storage.Set(1, "name", "robin") }},
+			{"overwrite", func() { storage.Set(0, "name", "bruce wayne") }},
+			{"incr across a digit", func() { storage.IncrBy(0, "counter", 9); storage.IncrBy(0, "counter", 1) }},
+			{"decr across a digit", func() { storage.IncrBy(0, "counter", -1) }},
+			{"set if absent", func() { storage.SetIfAbsent(0, "name", "x"); storage.SetIfAbsent(2, "fresh", "value") }},
+			{"update", func() {
+				storage.Update(2, "fresh", func(value string, exists bool) (string, bool, error) {
+					return value + value, true, nil
+				})
+			}},
+			{"delete", func() { storage.Del(1, "name"); storage.Del(1, "missing") }},
+			{"restore", func() { storage.Restore(3, map[string]string{"a": "1", "b": "22"}) }},
+			{"flush", func() { storage.Restore(0, nil) }},
+		}
+
+		var peak int64
+		for _, step := range steps {
+			step.write()
+			expected := make([]DatabaseStats, storage.numDatabases())
+			var used int64
+			storage.ForEach(func(dbIndex int, key, value string) {
+				usage, _ := storage.MemoryUsage(dbIndex, key)
+				expected[dbIndex].Keys++
+				expected[dbIndex].Bytes += usage
+				used += usage
+			})
+			peak = max(peak, used)
+
+			stats := storage.MemoryStats()
+			if !reflect.DeepEqual(stats.Databases, expected) {
+				t.Errorf("after %s: MemoryStats().Databases = %v, expected %v", step.name, stats.Databases, expected)
+			}
+			if stats.Used != used || storage.UsedMemory() != used {
+				t.Errorf("after %s: Used = %d, UsedMemory() = %d, expected %d", step.name, stats.Used, storage.UsedMemory(), used)
+			}
+			if stats.Peak < peak {
+				t.Errorf("after %s: Peak = %d, expected at least %d", step.name, stats.Peak, peak)
+			}
+			if stats.Overhead < 0 || stats.Overhead > stats.Used {
+				t.Errorf("after %s: Overhead = %d, expected between 0 and %d", step.name, stats.Overhead, stats.Used)
+			}
+		}
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return NewMemoryStorage(defaultNumDatabases)
+	})
+}
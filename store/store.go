@@ -1,38 +1,140 @@
 package store
 
 import (
-	"errors"
-	"fmt"
+	"kv-store/config"
+	"kv-store/errcode"
+	"log/slog"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	ErrIntOverflow             = errors.New("err increment or decrement would overflow")
-	ErrNoTransactionInProgress = errors.New("err no transaction in progress")
-	ErrTransactionInProgress   = errors.New("err transaction already in progress")
-	ErrNotInteger              = errors.New("err value is not an integer or out of range")
-	ErrUnknownCommand          = func(cmdName string) error { return fmt.Errorf("err unknown command: %s", cmdName) }
-	ErrSelectInMulti           = errors.New("err SELECT command cannot be used in a transaction")
-	ErrSelectInTransaction     = errors.New("err SELECT is not allowed in transactions")
+	ErrIntOverflow             = errcode.New(errcode.Err, "increment or decrement would overflow")
+	ErrNoTransactionInProgress = errcode.New(errcode.Err, "no transaction in progress")
+	ErrTransactionInProgress   = errcode.New(errcode.Err, "transaction already in progress")
+	ErrNotInteger              = errcode.New(errcode.Err, "value is not an integer or out of range")
+	ErrUnknownCommand          = func(cmdName string) error { return errcode.Errorf(errcode.Err, "unknown command: %s", cmdName) }
+	ErrSelectInMulti           = errcode.New(errcode.Err, "SELECT command cannot be used in a transaction")
+	ErrSelectInTransaction     = errcode.New(errcode.Err, "SELECT is not allowed in transactions")
+	ErrOOM                     = errcode.New(errcode.OOM, "command not allowed when used memory > 'maxmemory'")
+	ErrDBIndexOutOfRange       = errcode.New(errcode.Err, "DB index is out of range")
+	ErrLFUNotSelected          = errcode.New(errcode.Err, "An LFU maxmemory policy is not selected, access frequency not tracked")
+	ErrQuotaExceeded           = errcode.New(errcode.Err, "quota exceeded for the selected database")
+	ErrExecAbort               = errcode.New(errcode.ExecAbort, "Transaction discarded because of previous errors.")
+	ErrTransactionDiscarded    = errcode.New(errcode.Err, "Transaction discarded because of previous errors")
+	ErrTransactionTimeout      = errcode.New(errcode.Err, "transaction discarded (timeout)")
+	ErrTransactionTooLong      = func(max int) error {
+		return errcode.Errorf(errcode.Err, "transaction can not queue more than %d commands", max)
+	}
 )
 
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"HELP",
+	"    Print this help.",
+}
+
+// SAMPLES is accepted for compatibility; every value is a string whose size is
+// known exactly, so there is nothing to sample.
+var memoryHelp = []string{
+	"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"USAGE <key> [SAMPLES <count>]",
+	"    Return memory in bytes used by <key> and its value. SAMPLES has no",
+	"    effect as all values are strings measured exactly.",
+	"STATS",
+	"    Show memory usage details.",
+	"HELP",
+	"    Print this help.",
+}
+
+const embstrSizeLimit = 44
+
+// Frozen is a read-only view of a storage at one moment, returned by
+// Storage.Freeze. Release must be called once it is no longer needed.
+type Frozen interface {
+	ForEach(fn func(dbIndex int, key, value string))
+	Release()
+}
+
+// The writes that can grow a database return ErrQuotaExceeded instead of
+// taking it past the limits given to setQuota. Set is not checked, since it
+// is used to load data and to roll transactions back.
 type Storage interface {
 	Set(dbIndex int, key, value string)
+	SetIfAbsent(dbIndex int, key, value string) (bool, error)
+	Update(dbIndex int, key string, update func(value string, exists bool) (string, bool, error)) error
 	Get(dbIndex int, key string) (string, bool)
+	Peek(dbIndex int, key string) (string, bool)
+	Touch(dbIndex int, key string) bool
+	IdleTime(dbIndex int, key string) (time.Duration, bool)
+	MemoryUsage(dbIndex int, key string) (int64, bool)
+	// Frequency returns the key's LFU counter, decayed to the present.
+	Frequency(dbIndex int, key string) (uint8, bool)
+	// Version changes every time key is written or deleted. It may also
+	// change on writes to other keys, but never stays the same across a
+	// write to key.
+	Version(dbIndex int, key string) uint64
 	Del(dbIndex int, key string) int
 	IncrBy(dbIndex int, key string, increment int64) (int64, error)
-	Compact(dbIndex int) string
+	Snapshot(dbIndex int) map[string]string
+	Restore(dbIndex int, data map[string]string)
+	ForEach(fn func(dbIndex int, key, value string))
+	// Freeze returns a view of every database as it is at the moment of the
+	// call. Reading it does not block writers.
+	Freeze() Frozen
+	UsedMemory() int64
+	MemoryStats() MemoryStats
 	numDatabases() int
+	setQuota(limits quotaLimits)
+	// sample returns up to n random keys with their LFU counters.
+	sample(n int) []keySample
 }
 
 type Store struct {
-	storage          Storage
-	transactions     map[string]*transaction
-	transactionMutex sync.Mutex
-	clientDBIndices  map[string]int
-	clientMutex      sync.RWMutex
+	storage             Storage
+	config              *config.Config
+	saving              atomic.Bool
+	lastSave            atomic.Int64
+	aof                 atomic.Pointer[appendOnlyFile]
+	aofError            atomic.Pointer[error]
+	rewriting           atomic.Bool
+	lastRewriteDuration atomic.Int64
+	lastRewriteFailed   atomic.Bool
+	transactions        map[int64]*transaction
+	watches             map[int64][]watchedKey
+	timedOut            map[int64]bool
+	transactionMutex    sync.Mutex
+	executionMutex      sync.RWMutex
+	clientDBIndices     map[int64]int
+	clientMutex         sync.RWMutex
+	logger              *slog.Logger
+	stats               *stats
+	latency             latencyMonitor
+	notifier            func(channel, message string)
+	eventHook           func(Event)
+	clock               Clock
+	writeFeed           func(dbIndex int, commands [][]string)
+	feedMutex           sync.Mutex
+	// deferringEvents and deferredEvents hold back the keyspace events of a
+	// transaction. They are guarded by the execution mutex.
+	deferringEvents bool
+	deferredEvents  []keyspaceEvent
+	// maxTransactionCommands caps the commands a transaction queues, or is 0.
+	maxTransactionCommands int
 }
 
 type transaction struct {
@@ -40,6 +142,7 @@ type transaction struct {
 	originalValues map[string]*string
 	hasErrors      bool
 	dbIndex        int
+	lastActivity   time.Time
 }
 
 type command struct {
@@ -47,11 +150,118 @@ type command struct {
 	args []string
 }
 
-func CreateNewStore(storage Storage) *Store {
-	return &Store{
+// New makes a store keeping its keys in storage, configured by options.
+// Without WithConfig it has the default configuration.
+func New(storage Storage, options ...Option) *Store {
+	s := &Store{
 		storage:         storage,
-		transactions:    make(map[string]*transaction),
-		clientDBIndices: make(map[string]int),
+		transactions:    make(map[int64]*transaction),
+		watches:         make(map[int64][]watchedKey),
+		timedOut:        make(map[int64]bool),
+		clientDBIndices: make(map[int64]int),
+		logger:          slog.Default(),
+		clock:           systemClock{},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if s.config == nil {
+		settings := config.Default()
+		settings.Databases = storage.numDatabases()
+		s.config = config.New(settings)
+	}
+	storage.setQuota(func() (int64, int64) {
+		settings := s.config.Get()
+		return settings.DBMaxKeys, settings.DBMaxMemory
+	})
+	if storage, ok := storage.(interface{ setClock(Clock) }); ok {
+		storage.setClock(s.clock)
+	}
+	s.stats = newStats(s)
+	return s
+}
+
+// CreateNewStore is New without options.
+func CreateNewStore(storage Storage) *Store {
+	return New(storage)
+}
+
+// CreateNewStoreWithConfig is New with WithConfig(cfg).
+func CreateNewStoreWithConfig(storage Storage, cfg *config.Config) *Store {
+	return New(storage, WithConfig(cfg))
+}
+
+func (s *Store) Config() *config.Config {
+	return s.config
+}
+
+// Logger returns the logger of the store, which the server logs through too.
+func (s *Store) Logger() *slog.Logger {
+	return s.logger
+}
+
+// SetLogger sends the log records of the store and of its storage to logger
+// instead of the default logger. It must be called before the store is used.
+func (s *Store) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+	if storage, ok := s.storage.(interface{ setLogger(*slog.Logger) }); ok {
+		storage.setLogger(logger)
+	}
+}
+
+func (s *Store) UsedMemory() int64 {
+	return s.storage.UsedMemory()
+}
+
+// CheckMemory reports ErrOOM when a maxmemory limit is configured and the
+// dataset has grown past it. Under the allkeys-lfu policy keys are evicted
+// first, and ErrOOM is only reported if that cannot bring usage back down.
+func (s *Store) CheckMemory() error {
+	settings := s.config.Get()
+	if settings.MaxMemory <= 0 || s.storage.UsedMemory() <= settings.MaxMemory {
+		return nil
+	}
+	if settings.MaxMemoryPolicy == config.PolicyAllKeysLFU {
+		s.evict(settings.MaxMemory)
+	}
+	if s.storage.UsedMemory() > settings.MaxMemory {
+		return ErrOOM
+	}
+	return nil
+}
+
+// evict deletes the least frequently used of evictionSamples random keys
+// until usage fits in maxMemory. Deletes are logged, so they reach the
+// append only file.
+func (s *Store) evict(maxMemory int64) {
+	for s.storage.UsedMemory() > maxMemory {
+		samples := s.storage.sample(evictionSamples)
+		if len(samples) == 0 {
+			return
+		}
+		victim := samples[0]
+		for _, sample := range samples[1:] {
+			if sample.frequency < victim.frequency {
+				victim = sample
+			}
+		}
+		s.evictKey(victim.dbIndex, victim.key)
+	}
+}
+
+func (s *Store) evictKey(dbIndex int, key string) {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	var deleted int
+	s.logWrite(dbIndex, func() []string {
+		deleted = s.storage.Del(dbIndex, key)
+		if deleted == 0 {
+			return nil
+		}
+		return []string{"DEL", key}
+	})
+	if deleted > 0 {
+		s.notifyKeyspaceEvent(notifyEvicted, "evicted", dbIndex, key)
 	}
 }
 
@@ -59,13 +269,26 @@ func (s *Store) GetDatabasesCount() int {
 	return s.storage.numDatabases()
 }
 
-func (s *Store) SetClientDBIndex(clientId string, dbIndex int) {
+// checkDBIndex guards every method that takes a database index, since the
+// storage indexes its databases directly and would panic.
+func (s *Store) checkDBIndex(dbIndex int) error {
+	if dbIndex < 0 || dbIndex >= s.storage.numDatabases() {
+		return ErrDBIndexOutOfRange
+	}
+	return nil
+}
+
+func (s *Store) SetClientDBIndex(clientId int64, dbIndex int) error {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return err
+	}
 	s.clientMutex.Lock()
 	defer s.clientMutex.Unlock()
 	s.clientDBIndices[clientId] = dbIndex
+	return nil
 }
 
-func (s *Store) GetClientDBIndex(clientId string) int {
+func (s *Store) GetClientDBIndex(clientId int64) int {
 	s.clientMutex.RLock()
 	defer s.clientMutex.RUnlock()
 	dbIndex, exists := s.clientDBIndices[clientId]
@@ -75,34 +298,273 @@ func (s *Store) GetClientDBIndex(clientId string) int {
 	return dbIndex
 }
 
-func (s *Store) RemoveClient(clientId string) {
+func (s *Store) RemoveClient(clientId int64) {
+	s.Unwatch(clientId)
+	s.transactionMutex.Lock()
+	delete(s.timedOut, clientId)
+	s.transactionMutex.Unlock()
 	s.clientMutex.Lock()
 	defer s.clientMutex.Unlock()
 	delete(s.clientDBIndices, clientId)
 }
 
-func (s *Store) Set(dbIndex int, key, value string) {
-	s.storage.Set(dbIndex, key, value)
+func (s *Store) Set(dbIndex int, key, value string) error {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.set(dbIndex, key, value)
 }
 
-func (s *Store) Get(dbIndex int, key string) (string, bool) {
-	return s.storage.Get(dbIndex, key)
+func (s *Store) set(dbIndex int, key, value string) error {
+	if err := s.setValue(dbIndex, key, value); err != nil {
+		return err
+	}
+	s.notifyKeyspaceEvent(notifyString, "set", dbIndex, key)
+	return nil
+}
+
+func (s *Store) setValue(dbIndex int, key, value string) error {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return err
+	}
+	var err error
+	s.logWrite(dbIndex, func() []string {
+		err = s.storage.Update(dbIndex, key, func(string, bool) (string, bool, error) {
+			return value, true, nil
+		})
+		if err != nil {
+			return nil
+		}
+		return []string{"SET", key, value}
+	})
+	return err
+}
+
+func (s *Store) Get(dbIndex int, key string) (string, bool, error) {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.get(dbIndex, key)
+}
+
+func (s *Store) get(dbIndex int, key string) (string, bool, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return "", false, err
+	}
+	value, exists := s.storage.Get(dbIndex, key)
+	return value, exists, nil
 }
 
-func (s *Store) Del(dbIndex int, key string) int {
-	return s.storage.Del(dbIndex, key)
+func (s *Store) Del(dbIndex int, key string) (int, error) {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.del(dbIndex, key)
+}
+
+func (s *Store) del(dbIndex int, key string) (int, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return 0, err
+	}
+	var deleted int
+	s.logWrite(dbIndex, func() []string {
+		deleted = s.storage.Del(dbIndex, key)
+		if deleted == 0 {
+			return nil
+		}
+		return []string{"DEL", key}
+	})
+	if deleted > 0 {
+		s.notifyKeyspaceEvent(notifyGeneric, "del", dbIndex, key)
+	}
+	return deleted, nil
 }
 
 func (s *Store) Incr(dbIndex int, key string) (int64, error) {
-	return s.storage.IncrBy(dbIndex, key, 1)
+	return s.IncrBy(dbIndex, key, 1)
 }
 
 func (s *Store) IncrBy(dbIndex int, key string, increment int64) (int64, error) {
-	return s.storage.IncrBy(dbIndex, key, increment)
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.incrBy(dbIndex, key, increment)
+}
+
+func (s *Store) incrBy(dbIndex int, key string, increment int64) (int64, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return 0, err
+	}
+	var result int64
+	var err error
+	s.logWrite(dbIndex, func() []string {
+		result, err = s.storage.IncrBy(dbIndex, key, increment)
+		if err != nil {
+			return nil
+		}
+		return []string{"INCRBY", key, strconv.FormatInt(increment, 10)}
+	})
+	if err == nil {
+		s.notifyKeyspaceEvent(notifyString, "incrby", dbIndex, key)
+	}
+	return result, err
+}
+
+func (s *Store) Touch(dbIndex int, keys []string) (int, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return 0, err
+	}
+	touched := 0
+	for _, key := range keys {
+		if s.storage.Touch(dbIndex, key) {
+			touched++
+		}
+	}
+	return touched, nil
+}
+
+func (s *Store) ObjectEncoding(dbIndex int, key string) (string, bool, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return "", false, err
+	}
+	value, exists := s.storage.Peek(dbIndex, key)
+	if !exists {
+		return "", false, nil
+	}
+	return stringEncoding(value), true, nil
 }
 
-func (s *Store) Compact(dbIndex int) string {
-	return s.storage.Compact(dbIndex)
+func (s *Store) ObjectIdleTime(dbIndex int, key string) (int64, bool, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return 0, false, err
+	}
+	idle, exists := s.storage.IdleTime(dbIndex, key)
+	if !exists {
+		return 0, false, nil
+	}
+	return int64(idle / time.Second), true, nil
+}
+
+// ObjectFreq returns the key's LFU counter. It is only meaningful, and so only
+// allowed, under the allkeys-lfu policy.
+func (s *Store) ObjectFreq(dbIndex int, key string) (int64, bool, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return 0, false, err
+	}
+	if s.config.Get().MaxMemoryPolicy != config.PolicyAllKeysLFU {
+		return 0, false, ErrLFUNotSelected
+	}
+	frequency, exists := s.storage.Frequency(dbIndex, key)
+	return int64(frequency), exists, nil
+}
+
+func (s *Store) MemoryUsage(dbIndex int, key string) (int64, bool, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return 0, false, err
+	}
+	usage, exists := s.storage.MemoryUsage(dbIndex, key)
+	return usage, exists, nil
+}
+
+func (s *Store) MemoryHelp() []string {
+	return memoryHelp
+}
+
+func (s *Store) ObjectHelp() []string {
+	return objectHelp
+}
+
+// FlushDB deletes every key of the database.
+func (s *Store) FlushDB(dbIndex int) error {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.flushDB(dbIndex)
+}
+
+func (s *Store) flushDB(dbIndex int) error {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return err
+	}
+	s.logWrite(dbIndex, func() []string {
+		s.storage.Restore(dbIndex, nil)
+		return []string{"FLUSHDB"}
+	})
+	return nil
+}
+
+// Compact renders the database as SET lines. It works from a snapshot, so
+// the storage is not locked while the output is built.
+func (s *Store) Compact(dbIndex int) (string, error) {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	return s.compact(dbIndex)
+}
+
+func (s *Store) compact(dbIndex int) (string, error) {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return "", err
+	}
+	data := s.storage.Snapshot(dbIndex)
+	keys := sortedKeys(data)
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, "SET "+quoteArg(key)+" "+quoteArg(data[key]))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// SnapshotDatabase returns a point-in-time copy of the database.
+func (s *Store) SnapshotDatabase(dbIndex int) (map[string]string, error) {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return nil, err
+	}
+	return s.storage.Snapshot(dbIndex), nil
+}
+
+// RestoreDatabase replaces the contents of the database with data in one
+// step. It is logged as the DELs and SETs that turn the old contents into
+// the new ones.
+func (s *Store) RestoreDatabase(dbIndex int, data map[string]string) error {
+	s.executionMutex.RLock()
+	defer s.executionMutex.RUnlock()
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return err
+	}
+	s.logWrites(dbIndex, func() [][]string {
+		old := s.storage.Snapshot(dbIndex)
+		s.storage.Restore(dbIndex, data)
+
+		var commands [][]string
+		for _, key := range sortedKeys(old) {
+			if _, kept := data[key]; !kept {
+				commands = append(commands, []string{"DEL", key})
+			}
+		}
+		for _, key := range sortedKeys(data) {
+			commands = append(commands, []string{"SET", key, data[key]})
+		}
+		return commands
+	})
+	return nil
+}
+
+func sortedKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringEncoding(value string) string {
+	if len(value) <= 20 {
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return "int"
+		}
+	}
+	if len(value) <= embstrSizeLimit {
+		return "embstr"
+	}
+	return "raw"
 }
 
 func checkIntegerOverflow(currentValue, increment int64) error {
@@ -115,11 +577,11 @@ func checkIntegerOverflow(currentValue, increment int64) error {
 	return nil
 }
 
-func (s *Store) StartTransaction(transactionId string) error {
+func (s *Store) StartTransaction(transactionId int64) error {
 	s.transactionMutex.Lock()
 	defer s.transactionMutex.Unlock()
 
-	if s.InTransaction(transactionId) {
+	if _, exists := s.lookupTransaction(transactionId); exists {
 		return ErrTransactionInProgress
 	}
 
@@ -127,23 +589,51 @@ func (s *Store) StartTransaction(transactionId string) error {
 		commands:       make([]command, 0),
 		originalValues: make(map[string]*string),
 		dbIndex:        s.GetClientDBIndex(transactionId),
+		lastActivity:   s.clock.Now(),
 	}
+	s.stats.transactionsStarted.Add(1)
 	return nil
 }
 
-func (s *Store) InTransaction(transactionId string) bool {
-	_, exists := s.transactions[transactionId]
+func (s *Store) InTransaction(transactionId int64) bool {
+	s.transactionMutex.Lock()
+	defer s.transactionMutex.Unlock()
+	_, exists := s.lookupTransaction(transactionId)
 	return exists
 }
 
-func (s *Store) QueueCommand(transactionId, name string, args []string) error {
+// lookupTransaction treats a nil entry as no transaction, so a stale entry
+// can never be dereferenced. It must be called with the transaction mutex
+// held.
+func (s *Store) lookupTransaction(transactionId int64) (*transaction, bool) {
+	transaction := s.transactions[transactionId]
+	return transaction, transaction != nil
+}
+
+func (s *Store) TransactionLength(transactionId int64) (int, bool) {
 	s.transactionMutex.Lock()
 	defer s.transactionMutex.Unlock()
 
-	transaction, exists := s.transactions[transactionId]
+	transaction, exists := s.lookupTransaction(transactionId)
+	if !exists {
+		return 0, false
+	}
+	return len(transaction.commands), true
+}
+
+func (s *Store) QueueCommand(transactionId int64, name string, args []string) error {
+	s.transactionMutex.Lock()
+	defer s.transactionMutex.Unlock()
+
+	transaction, exists := s.lookupTransaction(transactionId)
 	if !exists {
 		return ErrNoTransactionInProgress
 	}
+	transaction.lastActivity = s.clock.Now()
+	if s.maxTransactionCommands > 0 && len(transaction.commands) >= s.maxTransactionCommands {
+		transaction.hasErrors = true
+		return ErrTransactionTooLong(s.maxTransactionCommands)
+	}
 	transaction.commands = append(transaction.commands,
 		command{
 			name: name,
@@ -152,103 +642,94 @@ func (s *Store) QueueCommand(transactionId, name string, args []string) error {
 	return nil
 }
 
-func (s *Store) DiscardTransaction(transactionId string) error {
+func (s *Store) DiscardTransaction(transactionId int64) error {
 	s.transactionMutex.Lock()
 	defer s.transactionMutex.Unlock()
 
-	if !s.InTransaction(transactionId) {
+	if _, exists := s.lookupTransaction(transactionId); !exists {
 		return ErrNoTransactionInProgress
 	}
 
 	delete(s.transactions, transactionId)
+	delete(s.watches, transactionId)
+	s.stats.transactionsDiscarded.Add(1)
 	return nil
 }
 
-func (s *Store) ExecuteTransaction(transactionId string) ([]string, error) {
+// ExecuteTransaction runs each queued command with run. It returns nil
+// results and no error, without running anything, when a key the client
+// watched has changed since WATCH.
+//
+// The transaction holds the execution mutex exclusively while it runs, and
+// the commands that read or write values hold it shared, so no other client
+// sees or changes the keys halfway through. It is always taken before the
+// transaction mutex.
+func (s *Store) ExecuteTransaction(transactionId int64, run TransactionFunc) ([]Result, error) {
+	s.executionMutex.Lock()
+	defer s.executionMutex.Unlock()
 	s.transactionMutex.Lock()
-	transaction, exists := s.transactions[transactionId]
+	transaction, exists := s.lookupTransaction(transactionId)
 	if !exists {
 		s.transactionMutex.Unlock()
 		return nil, ErrNoTransactionInProgress
 	}
+	// EXEC ends the transaction whatever its outcome, so it is removed before
+	// anything runs.
+	watched := s.watches[transactionId]
+	delete(s.transactions, transactionId)
+	delete(s.watches, transactionId)
+	s.transactionMutex.Unlock()
+
+	rollback := s.config.Get().TxRollback
 	if transaction.hasErrors {
-		return nil, fmt.Errorf("err Transaction discarded because of previous errors")
+		s.stats.transactionsAborted.Add(1)
+		if !rollback {
+			return nil, ErrExecAbort
+		}
+		return nil, ErrTransactionDiscarded
 	}
-
-	commands := make([]command, len(transaction.commands))
-	copy(commands, transaction.commands)
+	commands := transaction.commands
 	dbIndex := transaction.dbIndex
-	s.transactionMutex.Unlock()
-
-	results := make([]string, 0, len(commands))
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return nil, err
+	}
+	if s.watchedKeysChanged(watched) {
+		s.stats.transactionsAborted.Add(1)
+		return nil, nil
+	}
+	s.stats.transactionsExecuted.Add(1)
+	publishEvents := s.deferKeyspaceEvents()
+	committed := false
+	defer func() { publishEvents(committed) }()
+
+	// Without rollback a failing command only fails its own position in the
+	// results, as in Redis, so no original values are kept.
+	if !rollback {
+		transaction.originalValues = nil
+	}
+	results := make([]Result, 0, len(commands))
 
+	keyspace := &transactionKeyspace{s: s, transaction: transaction}
 	for _, cmd := range commands {
-		var result string
-		var err error
-
-		switch cmd.name {
-		case "SET":
-			s.saveOriginalValue(transaction, cmd.args[0])
-			s.Set(dbIndex, cmd.args[0], cmd.args[1])
-			result = "OK"
-
-		case "GET":
-			val, ok := s.Get(dbIndex, cmd.args[0])
-			if !ok {
-				result = "nil"
-			} else {
-				result = val
-			}
-
-		case "DEL":
-			s.saveOriginalValue(transaction, cmd.args[0])
-			result = strconv.FormatInt(int64(s.Del(dbIndex, cmd.args[0])), 10)
-
-		case "INCR":
-			s.saveOriginalValue(transaction, cmd.args[0])
-
-			var intResult int64
-			intResult, err = s.Incr(dbIndex, cmd.args[0])
-			if err != nil {
-				s.rollback(transactionId, transaction.originalValues, dbIndex)
-				return nil, err
-			}
-			result = strconv.FormatInt(int64(intResult), 10)
-
-		case "INCRBY":
-			var increment int64
-			increment, err = strconv.ParseInt(cmd.args[1], 10, 64)
-			if err != nil {
-				s.rollback(transactionId, transaction.originalValues, dbIndex)
-				return nil, ErrNotInteger
+		result, err := run(keyspace, dbIndex, cmd.name, cmd.args)
+		if err != nil {
+			if !rollback {
+				results = append(results, errorResult(err))
+				continue
 			}
-
-			s.saveOriginalValue(transaction, cmd.args[0])
-			var intResult int64
-			intResult, err = s.IncrBy(dbIndex, cmd.args[0], increment)
-			if err != nil {
-				s.rollback(transactionId, transaction.originalValues, dbIndex)
-				return nil, err
-			}
-			result = strconv.FormatInt(int64(intResult), 10)
-		case "COMPACT":
-			result = s.Compact(dbIndex)
-		case "SELECT":
-			s.rollback(transactionId, transaction.originalValues, dbIndex)
-			return nil, ErrSelectInTransaction
-		default:
-			s.rollback(transactionId, transaction.originalValues, dbIndex)
-			return nil, ErrUnknownCommand(cmd.name)
+			s.rollback(transaction.originalValues, dbIndex)
+			return nil, err
 		}
-
 		results = append(results, result)
 	}
-
-	delete(s.transactions, transactionId)
+	committed = true
 	return results, nil
 }
 
 func (s *Store) saveOriginalValue(transaction *transaction, key string) {
+	if transaction.originalValues == nil {
+		return
+	}
 	if _, exists := transaction.originalValues[key]; !exists {
 		value, exists := s.storage.Get(transaction.dbIndex, key)
 		if exists {
@@ -260,24 +741,26 @@ func (s *Store) saveOriginalValue(transaction *transaction, key string) {
 	}
 }
 
-func (s *Store) rollback(transactionId string, originalValues map[string]*string, dbIndex int) {
+// rollback writes the original values back without checking quotas, as it
+// only returns the database to a state it already held.
+func (s *Store) rollback(originalValues map[string]*string, dbIndex int) {
 	for key, originalValuePtr := range originalValues {
 		if originalValuePtr == nil {
-			s.Del(dbIndex, key)
+			s.del(dbIndex, key)
 		} else {
-			s.storage.Set(dbIndex, key, *originalValuePtr)
+			s.logWrite(dbIndex, func() []string {
+				s.storage.Set(dbIndex, key, *originalValuePtr)
+				return []string{"SET", key, *originalValuePtr}
+			})
 		}
 	}
-
-	s.transactionMutex.Lock()
-	delete(s.transactions, transactionId)
-	s.transactionMutex.Unlock()
 }
 
-func (s *Store) ReportTransactionError(transactionId string) {
+func (s *Store) ReportTransactionError(transactionId int64) {
 	s.transactionMutex.Lock()
 	defer s.transactionMutex.Unlock()
-	if transaction, exists := s.transactions[transactionId]; exists {
+	if transaction, exists := s.lookupTransaction(transactionId); exists {
 		transaction.hasErrors = true
+		transaction.lastActivity = s.clock.Now()
 	}
 }
@@ -3,11 +3,14 @@ package store
 import (
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 const defaultNumDatabases = 16
@@ -18,6 +21,46 @@ func getInMemoryStore(t *testing.T) *Store {
 	return CreateNewStore(inMemoryStorage)
 }
 
+// runCommand runs the commands the transaction tests queue, standing in for
+// the server's command table.
+func runCommand(keyspace Keyspace, dbIndex int, name string, args []string) (Result, error) {
+	switch name {
+	case "SET":
+		return statusResult("OK"), keyspace.Set(dbIndex, args[0], args[1])
+	case "GET":
+		value, ok, err := keyspace.Get(dbIndex, args[0])
+		if err != nil || !ok {
+			return nilResult(), err
+		}
+		return valueResult(value), nil
+	case "DEL":
+		deleted, err := keyspace.Del(dbIndex, args[0])
+		return integerResult(int64(deleted)), err
+	case "INCR", "INCRBY":
+		increment := int64(1)
+		if name == "INCRBY" {
+			increment, _ = strconv.ParseInt(args[1], 10, 64)
+		}
+		result, err := keyspace.IncrBy(dbIndex, args[0], increment)
+		return integerResult(result), err
+	case "FLUSHDB":
+		return statusResult("OK"), keyspace.FlushDB(dbIndex)
+	case "DUMP":
+		payload, ok, err := keyspace.Dump(dbIndex, args[0])
+		if err != nil || !ok {
+			return nilResult(), err
+		}
+		return valueResult(payload), nil
+	case "OBJECT":
+		encoding, ok, err := keyspace.ObjectEncoding(dbIndex, args[1])
+		if err != nil || !ok {
+			return nilResult(), err
+		}
+		return valueResult(encoding), nil
+	}
+	return Result{}, ErrUnknownCommand(name)
+}
+
 func TestCreateNewStore(t *testing.T) {
 	store := getInMemoryStore(t)
 
@@ -35,7 +78,7 @@ func TestSetGet(t *testing.T) {
 	store := getInMemoryStore(t)
 
 	store.Set(0, key, value)
-	retrievedValue, ok := store.Get(0, key)
+	retrievedValue, ok, _ := store.Get(0, key)
 
 	if !ok {
 		t.Errorf("Get(%q) failed, expected key to exist", key)
@@ -53,7 +96,7 @@ func TestSetGet_OverwriteValue(t *testing.T) {
 
 	store.Set(0, key, value)
 	store.Set(0, key, valueToOverwrite)
-	retrievedValue, ok := store.Get(0, key)
+	retrievedValue, ok, _ := store.Get(0, key)
 
 	if !ok {
 		t.Errorf("Get(%q) failed, expected key to exist", key)
@@ -67,7 +110,7 @@ func TestStoreGet_NotFound(t *testing.T) {
 	store := getInMemoryStore(t)
 	key := "non-existent"
 
-	_, ok := store.Get(0, key)
+	_, ok, _ := store.Get(0, key)
 	if ok {
 		t.Errorf("Get(%q) succeeded, expected key not to exist", key)
 	}
@@ -78,9 +121,9 @@ func TestDel(t *testing.T) {
 	key := "name"
 	store.Set(0, key, "superman")
 
-	result := store.Del(0, key)
+	result, _ := store.Del(0, key)
 
-	_, ok := store.Get(0, key)
+	_, ok, _ := store.Get(0, key)
 	if result != 1 {
 		t.Errorf("Del(%q) = %q, expected 1", key, result)
 	}
@@ -93,7 +136,7 @@ func TestDel_ForNonExistentKey(t *testing.T) {
 	store := getInMemoryStore(t)
 	key := "surname"
 
-	result := store.Del(0, key)
+	result, _ := store.Del(0, key)
 
 	if result != 0 {
 		t.Errorf("Del(%q) = %q, expected 0", key, result)
@@ -230,7 +273,7 @@ func TestIncrBy_ForOverflow(t *testing.T) {
 
 func TestStartTransaction_NoOnGoingTransaction(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 	err := store.StartTransaction(transactionId)
 
 	if err != nil {
@@ -240,7 +283,7 @@ func TestStartTransaction_NoOnGoingTransaction(t *testing.T) {
 
 func TestStartTransaction_OnGoingTransactionPresent(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 	store.transactions[transactionId] = &transaction{}
 
 	err := store.StartTransaction(transactionId)
@@ -253,7 +296,7 @@ func TestStartTransaction_OnGoingTransactionPresent(t *testing.T) {
 
 func TestQueueCommand_OnGoingTransactionPresent(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 	store.transactions[transactionId] = &transaction{}
 	commandName := "SET"
 	args := []string{"a", "2"}
@@ -272,7 +315,7 @@ func TestQueueCommand_OnGoingTransactionPresent(t *testing.T) {
 
 func TestQueueCommand_NoOnGoingTransactionPresent(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 	commandName := "SET"
 	args := []string{"a", "2"}
 
@@ -286,7 +329,7 @@ func TestQueueCommand_NoOnGoingTransactionPresent(t *testing.T) {
 
 func TestDiscardTransaction_OnGoingTransactionPresent(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 	store.transactions[transactionId] = &transaction{}
 
 	err := store.DiscardTransaction(transactionId)
@@ -301,7 +344,7 @@ func TestDiscardTransaction_OnGoingTransactionPresent(t *testing.T) {
 
 func TestDiscardTransaction_NoOnGoingTransactionPresent(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 
 	err := store.DiscardTransaction(transactionId)
 
@@ -313,7 +356,7 @@ func TestDiscardTransaction_NoOnGoingTransactionPresent(t *testing.T) {
 
 func TestExecuteTransaction_OnGoingTransactionPresent(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 	store.transactions[transactionId] = &transaction{
 		commands: []command{
 			{name: "GET", args: []string{"a"}},
@@ -326,9 +369,9 @@ func TestExecuteTransaction_OnGoingTransactionPresent(t *testing.T) {
 		originalValues: make(map[string]*string),
 	}
 
-	result, err := store.ExecuteTransaction(transactionId)
+	result, err := store.ExecuteTransaction(transactionId, runCommand)
 
-	expectedResult := []string{"nil", "OK", "1", "1", "1", "10"}
+	expectedResult := []Result{nilResult(), statusResult("OK"), valueResult("1"), integerResult(1), integerResult(1), integerResult(10)}
 	if err != nil {
 		t.Errorf("expected: should execute transaction, got: %v", err)
 	}
@@ -337,11 +380,31 @@ func TestExecuteTransaction_OnGoingTransactionPresent(t *testing.T) {
 	}
 }
 
+func TestExecuteTransaction_NilResultIsNotTheStringNil(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "stored", "nil")
+	store.StartTransaction(1)
+	store.QueueCommand(1, "GET", []string{"stored"})
+	store.QueueCommand(1, "GET", []string{"missing"})
+	store.QueueCommand(1, "DUMP", []string{"missing"})
+	store.QueueCommand(1, "OBJECT", []string{"ENCODING", "missing"})
+
+	results, err := store.ExecuteTransaction(1, runCommand)
+
+	if err != nil {
+		t.Fatalf("ExecuteTransaction() failed: %v", err)
+	}
+	expected := []Result{valueResult("nil"), nilResult(), nilResult(), nilResult()}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("ExecuteTransaction() = %v, expected %v", results, expected)
+	}
+}
+
 func TestExecuteTransaction_NoOnGoingTransactionPresent(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 
-	_, err := store.ExecuteTransaction(transactionId)
+	_, err := store.ExecuteTransaction(transactionId, runCommand)
 
 	expectedError := ErrNoTransactionInProgress
 	if err.Error() != expectedError.Error() {
@@ -352,7 +415,7 @@ func TestExecuteTransaction_NoOnGoingTransactionPresent(t *testing.T) {
 func TestExecuteTransaction_ShouldRollbackOnError(t *testing.T) {
 	store := getInMemoryStore(t)
 	store.Set(0, "a", "1")
-	transactionId := "1"
+	transactionId := int64(1)
 	store.transactions[transactionId] = &transaction{
 		commands: []command{
 			{name: "GET", args: []string{"a"}},
@@ -363,7 +426,7 @@ func TestExecuteTransaction_ShouldRollbackOnError(t *testing.T) {
 		originalValues: make(map[string]*string),
 	}
 
-	result, err := store.ExecuteTransaction(transactionId)
+	result, err := store.ExecuteTransaction(transactionId, runCommand)
 
 	if err == nil {
 		t.Errorf("expected: should execute transaction, got: %v", err)
@@ -371,7 +434,7 @@ func TestExecuteTransaction_ShouldRollbackOnError(t *testing.T) {
 	if result != nil {
 		t.Errorf("expected: nil, got: %v", result)
 	}
-	value, _ := store.Get(0, "a")
+	value, _, _ := store.Get(0, "a")
 	if value != "1" {
 		t.Errorf("expected: Get('a') = 1, got: %v", 1)
 	}
@@ -379,7 +442,7 @@ func TestExecuteTransaction_ShouldRollbackOnError(t *testing.T) {
 
 func TestExecuteTransaction_ShouldRollbackForUnknownCommand(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 	unknownCommand := "UNKNOWN"
 	store.transactions[transactionId] = &transaction{
 		commands: []command{
@@ -388,7 +451,7 @@ func TestExecuteTransaction_ShouldRollbackForUnknownCommand(t *testing.T) {
 		originalValues: make(map[string]*string),
 	}
 
-	result, err := store.ExecuteTransaction(transactionId)
+	result, err := store.ExecuteTransaction(transactionId, runCommand)
 
 	if result != nil {
 		t.Errorf("expected: %v, got: %v", nil, result)
@@ -398,9 +461,124 @@ func TestExecuteTransaction_ShouldRollbackForUnknownCommand(t *testing.T) {
 	}
 }
 
+func TestExecuteTransaction_WithoutRollback(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Config().Set("transaction-rollback", "no")
+	store.Set(0, "a", "1")
+	store.Set(0, "name", "batman")
+	store.StartTransaction(1)
+	store.QueueCommand(1, "INCR", []string{"a"})
+	store.QueueCommand(1, "INCR", []string{"name"})
+	store.QueueCommand(1, "SET", []string{"b", "2"})
+	store.QueueCommand(1, "UNKNOWN", nil)
+	store.QueueCommand(1, "GET", []string{"a"})
+
+	results, err := store.ExecuteTransaction(1, runCommand)
+
+	if err != nil {
+		t.Fatalf("ExecuteTransaction() failed: %v", err)
+	}
+	expected := []Result{integerResult(2), errorResult(ErrNotInteger), statusResult("OK"), errorResult(ErrUnknownCommand("UNKNOWN")), valueResult("2")}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("ExecuteTransaction() = %v, expected %v", results, expected)
+	}
+	for key, value := range map[string]string{"a": "2", "name": "batman", "b": "2"} {
+		if got, _, _ := store.Get(0, key); got != value {
+			t.Errorf("Get(%s) = %q, expected %q with nothing rolled back", key, got, value)
+		}
+	}
+	if store.InTransaction(1) {
+		t.Errorf("expected the transaction to end")
+	}
+}
+
+func TestExecuteTransaction_WithoutRollbackAbortsOnQueueErrors(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Config().Set("transaction-rollback", "no")
+	store.StartTransaction(1)
+	store.QueueCommand(1, "SET", []string{"a", "1"})
+	store.ReportTransactionError(1)
+
+	if results, err := store.ExecuteTransaction(1, runCommand); err != ErrExecAbort || results != nil {
+		t.Errorf("ExecuteTransaction() = %v, %v, expected %v", results, err, ErrExecAbort)
+	}
+	if _, ok := store.storage.Peek(0, "a"); ok {
+		t.Errorf("expected nothing queued to run")
+	}
+}
+
+func TestExecuteTransaction_DiscardsAfterQueueErrors(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.StartTransaction(1)
+	store.QueueCommand(1, "SET", []string{"name", "batman"})
+	store.ReportTransactionError(1)
+
+	if _, err := store.ExecuteTransaction(1, runCommand); err != ErrTransactionDiscarded {
+		t.Errorf("ExecuteTransaction() error = %v, expected %v", err, ErrTransactionDiscarded)
+	}
+	if store.InTransaction(1) {
+		t.Errorf("expected the transaction to be discarded")
+	}
+	if _, ok, _ := store.Get(0, "name"); ok {
+		t.Errorf("expected nothing from the discarded transaction to run")
+	}
+
+	if err := store.StartTransaction(1); err != nil {
+		t.Fatalf("StartTransaction() after the discard failed: %v", err)
+	}
+	store.QueueCommand(1, "SET", []string{"name", "batman"})
+	if results, err := store.ExecuteTransaction(1, runCommand); err != nil || !reflect.DeepEqual(results, []Result{statusResult("OK")}) {
+		t.Errorf("ExecuteTransaction() = %v, %v, expected [OK]", results, err)
+	}
+}
+
+func TestExecuteTransaction_IsolatedFromConcurrentWriters(t *testing.T) {
+	store := getInMemoryStore(t)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					store.Set(0, "a", "writer")
+					store.Del(0, "b")
+					store.Incr(0, "b")
+				}
+			}
+		}()
+	}
+
+	for i := range 2000 {
+		value := strconv.Itoa(i)
+		store.StartTransaction(1)
+		store.QueueCommand(1, "SET", []string{"a", value})
+		store.QueueCommand(1, "SET", []string{"b", value})
+		for range 10 {
+			store.QueueCommand(1, "GET", []string{"a"})
+			store.QueueCommand(1, "GET", []string{"b"})
+		}
+		results, err := store.ExecuteTransaction(1, runCommand)
+		if err != nil {
+			t.Fatalf("ExecuteTransaction() failed: %v", err)
+		}
+		for _, result := range results[2:] {
+			if result != valueResult(value) {
+				t.Fatalf("transaction %d read %v, expected only its own writes %q", i, result, value)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
 func TestInTransaction(t *testing.T) {
 	store := getInMemoryStore(t)
-	transactionId := "1"
+	transactionId := int64(1)
 	store.StartTransaction(transactionId)
 
 	result := store.InTransaction(transactionId)
@@ -410,10 +588,48 @@ func TestInTransaction(t *testing.T) {
 	}
 }
 
+func TestInTransaction_AfterExec(t *testing.T) {
+	store := getInMemoryStore(t)
+	for i := range 2 {
+		if err := store.StartTransaction(1); err != nil {
+			t.Fatalf("StartTransaction() #%d failed: %v", i+1, err)
+		}
+		store.QueueCommand(1, "SET", []string{"name", "batman"})
+		if results, err := store.ExecuteTransaction(1, runCommand); err != nil || !reflect.DeepEqual(results, []Result{statusResult("OK")}) {
+			t.Errorf("ExecuteTransaction() #%d = %v, %v, expected [OK]", i+1, results, err)
+		}
+		if store.InTransaction(1) {
+			t.Errorf("InTransaction() after EXEC #%d = true, expected false", i+1)
+		}
+	}
+}
+
+func TestInTransaction_NilEntry(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.transactions[1] = nil
+
+	if store.InTransaction(1) {
+		t.Errorf("InTransaction() = true for a nil entry, expected false")
+	}
+	if err := store.QueueCommand(1, "SET", []string{"name", "batman"}); err != ErrNoTransactionInProgress {
+		t.Errorf("QueueCommand() = %v, expected %v", err, ErrNoTransactionInProgress)
+	}
+	if _, err := store.ExecuteTransaction(1, runCommand); err != ErrNoTransactionInProgress {
+		t.Errorf("ExecuteTransaction() = %v, expected %v", err, ErrNoTransactionInProgress)
+	}
+	if _, ok := store.TransactionLength(1); ok {
+		t.Errorf("TransactionLength() reported a transaction for a nil entry")
+	}
+	store.ReportTransactionError(1)
+	if err := store.StartTransaction(1); err != nil {
+		t.Errorf("StartTransaction() = %v, expected the nil entry to be replaced", err)
+	}
+}
+
 func TestCompact_EmptyStore(t *testing.T) {
 	s := getInMemoryStore(t)
 
-	output := s.Compact(0)
+	output, _ := s.Compact(0)
 	if output != "" {
 		t.Errorf("Expected empty string for empty store, got: %q", output)
 	}
@@ -425,7 +641,7 @@ func TestCompact_WithMultipleKeys(t *testing.T) {
 	s.Incr(0, "counter")
 	s.Set(0, "foo", "bar")
 
-	output := s.Compact(0)
+	output, _ := s.Compact(0)
 
 	expectedLines := []string{
 		"SET counter 14",
@@ -444,7 +660,7 @@ func TestCompact_AfterDelete(t *testing.T) {
 	s.Set(0, "key2", "val2")
 	s.Del(0, "key1")
 
-	output := s.Compact(0)
+	output, _ := s.Compact(0)
 
 	if strings.Contains(output, "key1") {
 		t.Errorf("Expected key1 to be deleted, but found in output: %q", output)
@@ -459,7 +675,7 @@ func TestCompact_HandlesOverwrites(t *testing.T) {
 	s.Set(0, "x", "1")
 	s.Set(0, "x", "2")
 
-	output := s.Compact(0)
+	output, _ := s.Compact(0)
 
 	if !strings.Contains(output, "SET x 2") {
 		t.Errorf("Expected latest value of x to be 2, got: %q", output)
@@ -471,7 +687,7 @@ func TestCompact_HandlesOverwrites(t *testing.T) {
 
 func TestStore_SetClientDBIndex(t *testing.T) {
 	store := getInMemoryStore(t)
-	clientId := "client1"
+	clientId := int64(1)
 
 	store.SetClientDBIndex(clientId, 5)
 	if dbIndex := store.GetClientDBIndex(clientId); dbIndex != 5 {
@@ -483,7 +699,7 @@ func TestStore_SetClientDBIndex(t *testing.T) {
 		t.Errorf("Expected DB index 0, got %d", dbIndex)
 	}
 
-	clientId2 := "client2"
+	clientId2 := int64(2)
 	if dbIndex := store.GetClientDBIndex(clientId2); dbIndex != 0 {
 		t.Errorf("Expected default DB index 0 for new client, got %d", dbIndex)
 	}
@@ -491,30 +707,30 @@ func TestStore_SetClientDBIndex(t *testing.T) {
 
 func TestStore_DatabaseIsolation(t *testing.T) {
 	store := getInMemoryStore(t)
-	clientId := "client1"
+	clientId := int64(1)
 
 	store.SetClientDBIndex(clientId, 1)
 	store.Set(1, "key1", "value1")
-	if value, ok := store.Get(1, "key1"); !ok || value != "value1" {
+	if value, ok, _ := store.Get(1, "key1"); !ok || value != "value1" {
 		t.Errorf("Expected key1=value1 in DB 1, got ok=%v, value=%s", ok, value)
 	}
-	if value, ok := store.Get(2, "key1"); ok {
+	if value, ok, _ := store.Get(2, "key1"); ok {
 		t.Errorf("Expected key1 to be absent in DB 2, got value=%s", value)
 	}
 
 	store.SetClientDBIndex(clientId, 2)
 	store.Set(2, "key1", "value2")
-	if value, ok := store.Get(2, "key1"); !ok || value != "value2" {
+	if value, ok, _ := store.Get(2, "key1"); !ok || value != "value2" {
 		t.Errorf("Expected key1=value2 in DB 2, got ok=%v, value=%s", ok, value)
 	}
-	if value, ok := store.Get(1, "key1"); !ok || value != "value1" {
+	if value, ok, _ := store.Get(1, "key1"); !ok || value != "value1" {
 		t.Errorf("Expected key1=value1 in DB 1, got ok=%v, value=%s", ok, value)
 	}
 }
 
 func TestStore_TransactionOnSetDBIndex(t *testing.T) {
 	store := getInMemoryStore(t)
-	clientId := "client1"
+	clientId := int64(1)
 
 	store.SetClientDBIndex(clientId, 1)
 	if err := store.StartTransaction(clientId); err != nil {
@@ -525,19 +741,19 @@ func TestStore_TransactionOnSetDBIndex(t *testing.T) {
 		t.Fatalf("Failed to queue SET: %v", err)
 	}
 
-	results, err := store.ExecuteTransaction(clientId)
+	results, err := store.ExecuteTransaction(clientId, runCommand)
 	if err != nil {
 		t.Fatalf("Transaction execution failed: %v", err)
 	}
-	if len(results) != 1 || results[0] != "OK" {
+	if len(results) != 1 || results[0] != statusResult("OK") {
 		t.Errorf("Expected results=[OK], got %v", results)
 	}
 
-	if value, ok := store.Get(1, "key1"); !ok || value != "value1" {
+	if value, ok, _ := store.Get(1, "key1"); !ok || value != "value1" {
 		t.Errorf("Expected key1=value1 in DB 1, got ok=%v, value=%s", ok, value)
 	}
 
-	if value, ok := store.Get(0, "key1"); ok {
+	if value, ok, _ := store.Get(0, "key1"); ok {
 		t.Errorf("Expected key1 to be absent in DB 0, got value=%s", value)
 	}
 }
@@ -551,13 +767,13 @@ func TestStore_ConcurrentDBAccess(t *testing.T) {
 		wg.Add(1)
 		go func(clientNum, dbIndex int) {
 			defer wg.Done()
-			clientId := fmt.Sprintf("client%d", clientNum)
+			clientId := int64(clientNum)
 			store.SetClientDBIndex(clientId, dbIndex)
 			key := fmt.Sprintf("key%d", clientNum)
 			value := fmt.Sprintf("value%d", clientNum)
 
 			store.Set(dbIndex, key, value)
-			if v, ok := store.Get(dbIndex, key); !ok || v != value {
+			if v, ok, _ := store.Get(dbIndex, key); !ok || v != value {
 				t.Errorf("Client %d: Expected %s=%s in DB %d, got ok=%v, value=%s", clientNum, key, value, dbIndex, ok, v)
 			}
 		}(i, i%defaultNumDatabases)
@@ -569,8 +785,269 @@ func TestStore_ConcurrentDBAccess(t *testing.T) {
 		dbIndex := i % defaultNumDatabases
 		key := fmt.Sprintf("key%d", i)
 		value := fmt.Sprintf("value%d", i)
-		if v, ok := store.Get(dbIndex, key); !ok || v != value {
+		if v, ok, _ := store.Get(dbIndex, key); !ok || v != value {
 			t.Errorf("Verification: Expected %s=%s in DB %d, got ok=%v, value=%s", key, value, dbIndex, ok, v)
 		}
 	}
 }
+
+func TestObjectEncoding(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "int", "12345")
+	store.Set(0, "embstr", "hello")
+	store.Set(0, "raw", strings.Repeat("a", embstrSizeLimit+1))
+
+	for key, expected := range map[string]string{"int": "int", "embstr": "embstr", "raw": "raw"} {
+		encoding, ok, _ := store.ObjectEncoding(0, key)
+		if !ok || encoding != expected {
+			t.Errorf("ObjectEncoding(%q) = %q, %v; expected %q", key, encoding, ok, expected)
+		}
+	}
+	if _, ok, _ := store.ObjectEncoding(0, "missing"); ok {
+		t.Errorf("ObjectEncoding(missing) succeeded, expected key not to exist")
+	}
+}
+
+func TestObjectIdleTime(t *testing.T) {
+	storage := NewMemoryStorage(defaultNumDatabases)
+	store := CreateNewStore(storage)
+	store.Set(0, "key", "value")
+	storage.stripe(0, "key").m["key"].accessedAt.Add(-int64(10 * time.Second))
+
+	idle, ok, _ := store.ObjectIdleTime(0, "key")
+	if !ok || idle != 10 {
+		t.Errorf("ObjectIdleTime() = %d, %v; expected 10", idle, ok)
+	}
+
+	if _, ok, _ := store.ObjectEncoding(0, "key"); !ok {
+		t.Fatalf("expected key to exist")
+	}
+	if idle, _, _ := store.ObjectIdleTime(0, "key"); idle != 10 {
+		t.Errorf("ObjectIdleTime() = %d after OBJECT ENCODING, expected 10", idle)
+	}
+
+	store.Get(0, "key")
+	if idle, _, _ := store.ObjectIdleTime(0, "key"); idle != 0 {
+		t.Errorf("ObjectIdleTime() = %d after GET, expected 0", idle)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	storage := NewMemoryStorage(defaultNumDatabases)
+	store := CreateNewStore(storage)
+	store.Set(0, "a", "1")
+	store.Set(0, "b", "2")
+	storage.stripe(0, "a").m["a"].accessedAt.Add(-int64(10 * time.Second))
+
+	touched, _ := store.Touch(0, []string{"a", "b", "missing"})
+
+	if touched != 2 {
+		t.Errorf("Touch() = %d, expected 2", touched)
+	}
+	if idle, _, _ := store.ObjectIdleTime(0, "a"); idle != 0 {
+		t.Errorf("ObjectIdleTime(a) = %d after TOUCH, expected 0", idle)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "small", strings.Repeat("a", 10))
+	store.Set(0, "large", strings.Repeat("a", 10010))
+
+	small, ok, _ := store.MemoryUsage(0, "small")
+	if !ok {
+		t.Fatalf("MemoryUsage(small) failed, expected key to exist")
+	}
+	large, _, _ := store.MemoryUsage(0, "large")
+
+	if small < int64(len("small")+10) {
+		t.Errorf("MemoryUsage(small) = %d, expected at least key and value size", small)
+	}
+	growth := large - small
+	if growth < 10000 || growth > 10100 {
+		t.Errorf("MemoryUsage grew by %d for 10000 extra bytes, expected ~10000", growth)
+	}
+	if _, ok, _ := store.MemoryUsage(0, "missing"); ok {
+		t.Errorf("MemoryUsage(missing) succeeded, expected key not to exist")
+	}
+}
+
+func TestUsedMemory(t *testing.T) {
+	store := getInMemoryStore(t)
+
+	store.Set(0, "name", "batman")
+	store.Set(1, "name", "robin")
+	store.Incr(0, "counter")
+	store.Set(0, "name", "bruce wayne")
+	store.Del(1, "name")
+
+	var expected int64
+	for _, key := range []string{"name", "counter"} {
+		usage, _, _ := store.MemoryUsage(0, key)
+		expected += usage
+	}
+	if used := store.UsedMemory(); used != expected {
+		t.Errorf("UsedMemory() = %d, expected %d", used, expected)
+	}
+
+	store.Del(0, "name")
+	store.Del(0, "counter")
+	if used := store.UsedMemory(); used != 0 {
+		t.Errorf("UsedMemory() after deleting everything = %d, expected 0", used)
+	}
+}
+
+func TestCheckMemory(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+
+	if err := store.CheckMemory(); err != nil {
+		t.Errorf("CheckMemory() without maxmemory = %v, expected nil", err)
+	}
+	store.Config().Set("maxmemory", "1")
+	if err := store.CheckMemory(); err != ErrOOM {
+		t.Errorf("CheckMemory() over maxmemory = %v, expected %v", err, ErrOOM)
+	}
+	store.Config().Set("maxmemory", "1mb")
+	if err := store.CheckMemory(); err != nil {
+		t.Errorf("CheckMemory() under maxmemory = %v, expected nil", err)
+	}
+}
+
+func TestSnapshotDatabase(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+	store.Set(1, "name", "robin")
+
+	snapshot, _ := store.SnapshotDatabase(0)
+	store.Set(0, "name", "bruce wayne")
+
+	if expected := map[string]string{"name": "batman"}; !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("SnapshotDatabase(0) = %v, expected %v", snapshot, expected)
+	}
+}
+
+func TestRestoreDatabase(t *testing.T) {
+	store := getInMemoryStore(t)
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	store.EnableAppendOnly(path)
+	defer store.CloseAppendOnly()
+	store.Set(2, "old", "value")
+	store.Set(2, "kept", "before")
+
+	store.RestoreDatabase(2, map[string]string{"kept": "after", "new": "value"})
+
+	if got, _ := store.SnapshotDatabase(2); !reflect.DeepEqual(got, map[string]string{"kept": "after", "new": "value"}) {
+		t.Errorf("SnapshotDatabase(2) = %v, expected %v", got, map[string]string{"kept": "after", "new": "value"})
+	}
+	content, _ := os.ReadFile(path)
+	expected := "SELECT 2\nSET old value\nSET kept before\nDEL old\nSET kept after\nSET new value\n"
+	if string(content) != expected {
+		t.Errorf("append only file = %q, expected %q", content, expected)
+	}
+}
+
+func TestFlushDB(t *testing.T) {
+	store := getInMemoryStore(t)
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	store.EnableAppendOnly(path)
+	defer store.CloseAppendOnly()
+	store.Set(2, "name", "batman")
+	store.Set(3, "name", "robin")
+	kept, _, _ := store.MemoryUsage(3, "name")
+
+	store.FlushDB(2)
+
+	if got, _ := store.SnapshotDatabase(2); len(got) != 0 {
+		t.Errorf("SnapshotDatabase(2) = %v, expected an empty database", got)
+	}
+	if used := store.UsedMemory(); used != kept {
+		t.Errorf("UsedMemory() = %d, expected only the other database's %d", used, kept)
+	}
+	content, _ := os.ReadFile(path)
+	expected := "SELECT 2\nSET name batman\nSELECT 3\nSET name robin\nSELECT 2\nFLUSHDB\n"
+	if string(content) != expected {
+		t.Errorf("append only file = %q, expected %q", content, expected)
+	}
+}
+
+func TestExecuteTransaction_FlushDBRollsBack(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+	store.Set(0, "counter", "1")
+	store.StartTransaction(1)
+	store.QueueCommand(1, "FLUSHDB", nil)
+	store.QueueCommand(1, "SET", []string{"fresh", "value"})
+	store.QueueCommand(1, "INCR", []string{"fresh"})
+
+	if _, err := store.ExecuteTransaction(1, runCommand); err == nil {
+		t.Fatalf("ExecuteTransaction() succeeded, expected INCR of a non integer to fail")
+	}
+	expected := map[string]string{"name": "batman", "counter": "1"}
+	if got, _ := store.SnapshotDatabase(0); !reflect.DeepEqual(got, expected) {
+		t.Errorf("SnapshotDatabase(0) after rollback = %v, expected %v", got, expected)
+	}
+}
+
+func TestStore_DBIndexOutOfRange(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "name", "batman")
+
+	calls := []struct {
+		name string
+		call func(dbIndex int) error
+	}{
+		{"SetClientDBIndex", func(dbIndex int) error { return store.SetClientDBIndex(1, dbIndex) }},
+		{"Set", func(dbIndex int) error { return store.Set(dbIndex, "name", "robin") }},
+		{"Get", func(dbIndex int) error { _, _, err := store.Get(dbIndex, "name"); return err }},
+		{"Del", func(dbIndex int) error { _, err := store.Del(dbIndex, "name"); return err }},
+		{"Incr", func(dbIndex int) error { _, err := store.Incr(dbIndex, "counter"); return err }},
+		{"IncrBy", func(dbIndex int) error { _, err := store.IncrBy(dbIndex, "counter", 5); return err }},
+		{"Touch", func(dbIndex int) error { _, err := store.Touch(dbIndex, []string{"name"}); return err }},
+		{"ObjectEncoding", func(dbIndex int) error { _, _, err := store.ObjectEncoding(dbIndex, "name"); return err }},
+		{"ObjectIdleTime", func(dbIndex int) error { _, _, err := store.ObjectIdleTime(dbIndex, "name"); return err }},
+		{"MemoryUsage", func(dbIndex int) error { _, _, err := store.MemoryUsage(dbIndex, "name"); return err }},
+		{"Compact", func(dbIndex int) error { _, err := store.Compact(dbIndex); return err }},
+		{"SnapshotDatabase", func(dbIndex int) error { _, err := store.SnapshotDatabase(dbIndex); return err }},
+		{"RestoreDatabase", func(dbIndex int) error { return store.RestoreDatabase(dbIndex, map[string]string{"a": "1"}) }},
+		{"FlushDB", func(dbIndex int) error { return store.FlushDB(dbIndex) }},
+		{"Dump", func(dbIndex int) error { _, _, err := store.Dump(dbIndex, "name"); return err }},
+		{"Restore", func(dbIndex int) error {
+			payload, _, _ := store.Dump(0, "name")
+			return store.Restore(dbIndex, "copy", payload, true)
+		}},
+		{"PFAdd", func(dbIndex int) error { _, err := store.PFAdd(dbIndex, "hll", []string{"a"}); return err }},
+		{"PFCount", func(dbIndex int) error { _, err := store.PFCount(dbIndex, []string{"hll"}); return err }},
+		{"PFMerge", func(dbIndex int) error { return store.PFMerge(dbIndex, "hll", []string{"other"}) }},
+	}
+
+	for _, dbIndex := range []int{-1, defaultNumDatabases, math.MaxInt} {
+		for _, tt := range calls {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, dbIndex), func(t *testing.T) {
+				if err := tt.call(dbIndex); err != ErrDBIndexOutOfRange {
+					t.Errorf("%s(%d) = %v, expected %v", tt.name, dbIndex, err, ErrDBIndexOutOfRange)
+				}
+			})
+		}
+	}
+	if value, _, _ := store.Get(0, "name"); value != "batman" {
+		t.Errorf("Get(name) = %q, expected out of range calls to leave database 0 alone", value)
+	}
+}
+
+func TestExecuteTransaction_DBIndexOutOfRange(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.StartTransaction(1)
+	store.QueueCommand(1, "SET", []string{"name", "batman"})
+	store.transactions[1].dbIndex = defaultNumDatabases
+
+	if _, err := store.ExecuteTransaction(1, runCommand); err != ErrDBIndexOutOfRange {
+		t.Errorf("ExecuteTransaction() = %v, expected %v", err, ErrDBIndexOutOfRange)
+	}
+	if store.InTransaction(1) {
+		t.Errorf("expected the transaction to be discarded")
+	}
+	if err := store.StartTransaction(1); err != nil {
+		t.Errorf("StartTransaction() after a failed EXEC = %v, expected the transaction lock to be released", err)
+	}
+}
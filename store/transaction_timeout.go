@@ -0,0 +1,59 @@
+package store
+
+import "time"
+
+var idleTransactionCheckInterval = time.Second
+
+// DiscardIdleTransactions discards every transaction that has had no
+// activity for longer than transaction-timeout seconds as of now, and
+// returns how many it discarded. The owning client's next command is told
+// through CheckTransactionTimeout. A timeout of 0 disables it.
+func (s *Store) DiscardIdleTransactions(now time.Time) int {
+	timeout := time.Duration(s.config.Get().TxTimeout) * time.Second
+	if timeout <= 0 {
+		return 0
+	}
+	s.transactionMutex.Lock()
+	defer s.transactionMutex.Unlock()
+
+	discarded := 0
+	for transactionId, transaction := range s.transactions {
+		if transaction == nil || now.Sub(transaction.lastActivity) <= timeout {
+			continue
+		}
+		delete(s.transactions, transactionId)
+		delete(s.watches, transactionId)
+		s.timedOut[transactionId] = true
+		discarded++
+	}
+	s.stats.transactionsDiscarded.Add(int64(discarded))
+	return discarded
+}
+
+// DiscardIdleTransactionsPeriodically runs DiscardIdleTransactions until done
+// is closed.
+func (s *Store) DiscardIdleTransactionsPeriodically(done <-chan struct{}) {
+	ticker := time.NewTicker(idleTransactionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.DiscardIdleTransactions(s.clock.Now())
+		}
+	}
+}
+
+// CheckTransactionTimeout returns ErrTransactionTimeout, once, when the
+// client's transaction was discarded for being idle, so the command that
+// follows is not mistaken for one outside a transaction.
+func (s *Store) CheckTransactionTimeout(clientId int64) error {
+	s.transactionMutex.Lock()
+	defer s.transactionMutex.Unlock()
+	if !s.timedOut[clientId] {
+		return nil
+	}
+	delete(s.timedOut, clientId)
+	return ErrTransactionTimeout
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiscardIdleTransactions(t *testing.T) {
+	testCases := []struct {
+		name          string
+		timeout       string
+		idle          time.Duration
+		wantDiscarded bool
+	}{
+		{"disabled", "0", time.Hour, false},
+		{"within the timeout", "10", 5 * time.Second, false},
+		{"idle past the timeout", "10", 11 * time.Second, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := getInMemoryStore(t)
+			store.Config().Set("transaction-timeout", tc.timeout)
+			store.StartTransaction(1)
+			store.Watch(1, 0, []string{"name"})
+
+			discarded := store.DiscardIdleTransactions(time.Now().Add(tc.idle))
+
+			if (discarded == 1) != tc.wantDiscarded {
+				t.Errorf("DiscardIdleTransactions() = %d, expected discarded: %v", discarded, tc.wantDiscarded)
+			}
+			if store.InTransaction(1) == tc.wantDiscarded {
+				t.Errorf("InTransaction() = %v, expected %v", store.InTransaction(1), !tc.wantDiscarded)
+			}
+			err := store.CheckTransactionTimeout(1)
+			if tc.wantDiscarded && err != ErrTransactionTimeout || !tc.wantDiscarded && err != nil {
+				t.Errorf("CheckTransactionTimeout() = %v, expected discarded: %v", err, tc.wantDiscarded)
+			}
+			if err := store.CheckTransactionTimeout(1); err != nil {
+				t.Errorf("second CheckTransactionTimeout() = %v, expected the timeout reported once", err)
+			}
+			if tc.wantDiscarded && len(store.watches[1]) != 0 {
+				t.Errorf("expected the discarded transaction's watches to be dropped")
+			}
+		})
+	}
+}
+
+func TestDiscardIdleTransactions_QueueingKeepsTransactionAlive(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Config().Set("transaction-timeout", "10")
+	store.StartTransaction(1)
+	store.transactions[1].lastActivity = time.Now().Add(-time.Minute)
+
+	store.QueueCommand(1, "SET", []string{"name", "batman"})
+
+	if discarded := store.DiscardIdleTransactions(time.Now()); discarded != 0 {
+		t.Errorf("DiscardIdleTransactions() = %d, expected a transaction that just queued a command to stay", discarded)
+	}
+}
+
+func TestDiscardIdleTransactions_ConcurrentQueueing(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Config().Set("transaction-timeout", "1")
+	var wg sync.WaitGroup
+	for clientId := range int64(8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				store.StartTransaction(clientId)
+				store.QueueCommand(clientId, "SET", []string{"name", "batman"})
+				store.CheckTransactionTimeout(clientId)
+				store.ExecuteTransaction(clientId, runCommand)
+			}
+		}()
+	}
+	for range 200 {
+		store.DiscardIdleTransactions(time.Now().Add(2 * time.Second))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,479 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"kv-store/atomicfile"
+	"kv-store/persistence"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A write-ahead log record is framed as a 4 byte payload length and a 4 byte
+// CRC32 (Castagnoli) of the payload, both little endian. The payload is an 8
+// byte sequence number, an op byte, the uvarint database index, and the
+// uvarint length prefixed arguments.
+const (
+	walOpSet     = 1
+	walOpDel     = 2
+	walOpIncrBy  = 3
+	walOpRestore = 4
+
+	walFrameSize = 8
+
+	walSequenceAux = "wal-sequence"
+)
+
+var (
+	walCheckpointInterval = 5 * time.Minute
+	walCRCTable           = crc32.MakeTable(crc32.Castagnoli)
+)
+
+var ErrWALCorrupt = func(offset int64, reason string) error {
+	return fmt.Errorf("err corrupt write-ahead log record at offset %d: %s", offset, reason)
+}
+
+type walRecord struct {
+	sequence uint64
+	op       byte
+	dbIndex  int
+	args     []string
+}
+
+// WALStorage wraps another Storage and records every mutation to a log
+// before applying it, so an in-memory storage can be rebuilt after a crash
+// with RecoverWAL. A periodic checkpoint snapshots the inner storage and cuts
+// the log down to the records written since.
+type WALStorage struct {
+	Storage
+
+	mutex     sync.Mutex
+	path      string
+	file      *os.File
+	sequence  uint64
+	size      int64
+	err       error
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   sync.WaitGroup
+	logger    *slog.Logger
+}
+
+func checkpointPath(path string) string {
+	return path + ".checkpoint"
+}
+
+// NewWALStorage opens the log at path for appending. inner should already
+// hold the state recovered with RecoverWAL. A corrupt tail left by a crash is
+// cut off so new records follow the last valid one.
+func NewWALStorage(inner Storage, path string) (*WALStorage, error) {
+	checkpointSequence, _, err := readCheckpointSequence(path)
+	if err != nil {
+		return nil, err
+	}
+	lastSequence, validSize, err := readWAL(path, func(walRecord) {})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(validSize); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w := &WALStorage{
+		Storage:  inner,
+		path:     path,
+		file:     file,
+		sequence: max(lastSequence, checkpointSequence),
+		size:     validSize,
+		done:     make(chan struct{}),
+		logger:   slog.Default(),
+	}
+	w.stopped.Add(1)
+	go w.checkpointPeriodically()
+	return w, nil
+}
+
+// RecoverWAL loads the latest checkpoint of the log at path into inner, which
+// should be empty, then replays the records written after it. Replay stops at
+// the first corrupt record, since nothing after it can be trusted to be in
+// order. It returns the number of records replayed.
+func RecoverWAL(inner Storage, path string) (int, error) {
+	checkpointSequence, exists, err := readCheckpointSequence(path)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		err := persistence.ReadFile(checkpointPath(path), func(e persistence.Entry) error {
+			if e.DB >= inner.numDatabases() {
+				return ErrSnapshotDBOutOfRange(e.DB, inner.numDatabases())
+			}
+			inner.Set(e.DB, e.Key, e.Value)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	replayed := 0
+	var replayErr error
+	_, _, err = readWAL(path, func(record walRecord) {
+		if record.sequence <= checkpointSequence || replayErr != nil {
+			return
+		}
+		if record.dbIndex >= inner.numDatabases() {
+			replayErr = ErrSnapshotDBOutOfRange(record.dbIndex, inner.numDatabases())
+			return
+		}
+		switch record.op {
+		case walOpSet:
+			inner.Set(record.dbIndex, record.args[0], record.args[1])
+		case walOpDel:
+			inner.Del(record.dbIndex, record.args[0])
+		case walOpIncrBy:
+			increment, _ := strconv.ParseInt(record.args[1], 10, 64)
+			// A failed increment failed the same way when it was logged.
+			inner.IncrBy(record.dbIndex, record.args[0], increment)
+		case walOpRestore:
+			data := make(map[string]string, len(record.args)/2)
+			for i := 0; i < len(record.args); i += 2 {
+				data[record.args[i]] = record.args[i+1]
+			}
+			inner.Restore(record.dbIndex, data)
+		}
+		replayed++
+	})
+	if err == nil {
+		err = replayErr
+	}
+	return replayed, err
+}
+
+// readCheckpointSequence returns the sequence number of the last record the
+// checkpoint covers, and whether there is a checkpoint at all.
+func readCheckpointSequence(path string) (uint64, bool, error) {
+	data, err := os.ReadFile(checkpointPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	aux, err := persistence.Aux(data)
+	if err != nil {
+		return 0, false, err
+	}
+	sequence, err := strconv.ParseUint(aux[walSequenceAux], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("err checkpoint %s has no valid %s field", checkpointPath(path), walSequenceAux)
+	}
+	return sequence, true, nil
+}
+
+// readWAL calls fn for each valid record of the log at path and returns the
+// last sequence number and the size of the valid prefix. A missing log is
+// empty.
+func readWAL(path string, fn func(walRecord)) (uint64, int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var lastSequence uint64
+	offset := int64(0)
+	for offset < int64(len(data)) {
+		record, size, err := decodeWALRecord(data[offset:])
+		if err == nil && record.sequence <= lastSequence {
+			err = errors.New("sequence number went backwards")
+		}
+		if err != nil {
+			slog.Warn("Stopping write-ahead log replay", "error", ErrWALCorrupt(offset, err.Error()))
+			break
+		}
+		fn(record)
+		lastSequence = record.sequence
+		offset += size
+	}
+	return lastSequence, offset, nil
+}
+
+func encodeWALRecord(record walRecord) []byte {
+	payload := binary.LittleEndian.AppendUint64(nil, record.sequence)
+	payload = append(payload, record.op)
+	payload = binary.AppendUvarint(payload, uint64(record.dbIndex))
+	payload = binary.AppendUvarint(payload, uint64(len(record.args)))
+	for _, arg := range record.args {
+		payload = binary.AppendUvarint(payload, uint64(len(arg)))
+		payload = append(payload, arg...)
+	}
+
+	frame := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	frame = binary.LittleEndian.AppendUint32(frame, crc32.Checksum(payload, walCRCTable))
+	return append(frame, payload...)
+}
+
+func decodeWALRecord(data []byte) (walRecord, int64, error) {
+	if len(data) < walFrameSize {
+		return walRecord{}, 0, errors.New("truncated frame")
+	}
+	length := int64(binary.LittleEndian.Uint32(data))
+	if length > int64(len(data)-walFrameSize) {
+		return walRecord{}, 0, errors.New("truncated payload")
+	}
+	payload := data[walFrameSize : walFrameSize+length]
+	if crc32.Checksum(payload, walCRCTable) != binary.LittleEndian.Uint32(data[4:]) {
+		return walRecord{}, 0, errors.New("checksum mismatch")
+	}
+
+	if len(payload) < 9 {
+		return walRecord{}, 0, errors.New("payload too short")
+	}
+	record := walRecord{sequence: binary.LittleEndian.Uint64(payload), op: payload[8]}
+	payload = payload[9:]
+	next := func() (uint64, bool) {
+		value, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return 0, false
+		}
+		payload = payload[n:]
+		return value, true
+	}
+	dbIndex, ok := next()
+	if !ok {
+		return walRecord{}, 0, errors.New("invalid database index")
+	}
+	record.dbIndex = int(dbIndex)
+	count, ok := next()
+	if !ok {
+		return walRecord{}, 0, errors.New("invalid argument count")
+	}
+	for range count {
+		length, ok := next()
+		if !ok || length > uint64(len(payload)) {
+			return walRecord{}, 0, errors.New("invalid argument length")
+		}
+		record.args = append(record.args, string(payload[:length]))
+		payload = payload[length:]
+	}
+
+	var valid bool
+	switch record.op {
+	case walOpSet, walOpIncrBy:
+		valid = len(record.args) == 2
+	case walOpDel:
+		valid = len(record.args) == 1
+	case walOpRestore:
+		// A restore carries the database's new contents as key, value pairs.
+		valid = len(record.args)%2 == 0
+	}
+	if !valid {
+		return walRecord{}, 0, fmt.Errorf("invalid op %d with %d arguments", record.op, len(record.args))
+	}
+	return record, walFrameSize + length, nil
+}
+
+// log appends and syncs one record. It must be called with the mutex held,
+// and the mutation applied under the same lock, so the log order is the
+// order mutations reached the inner storage. Mutations that can fail are
+// logged once they succeed, so a refused write never replays.
+func (w *WALStorage) log(op byte, dbIndex int, args ...string) {
+	if w.err != nil {
+		return
+	}
+	w.sequence++
+	frame := encodeWALRecord(walRecord{sequence: w.sequence, op: op, dbIndex: dbIndex, args: args})
+	if _, err := w.file.Write(frame); err != nil {
+		w.setError(err)
+		return
+	}
+	if err := w.file.Sync(); err != nil {
+		w.setError(err)
+		return
+	}
+	w.size += int64(len(frame))
+}
+
+func (w *WALStorage) setError(err error) {
+	w.logger.Error("Write-ahead log write failed", "error", err)
+	w.err = err
+}
+
+func (w *WALStorage) setLogger(logger *slog.Logger) {
+	w.logger = logger
+	if inner, ok := w.Storage.(interface{ setLogger(*slog.Logger) }); ok {
+		inner.setLogger(logger)
+	}
+}
+
+// WriteError returns the first failed log write. Writes after it are not
+// logged, so the store rejects them through CheckWrite.
+func (w *WALStorage) WriteError() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return ErrMisconf(w.err)
+	}
+	return nil
+}
+
+func (w *WALStorage) Set(dbIndex int, key, value string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.log(walOpSet, dbIndex, key, value)
+	w.Storage.Set(dbIndex, key, value)
+}
+
+func (w *WALStorage) SetIfAbsent(dbIndex int, key, value string) (bool, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	set, err := w.Storage.SetIfAbsent(dbIndex, key, value)
+	if set {
+		w.log(walOpSet, dbIndex, key, value)
+	}
+	return set, err
+}
+
+// Update logs the value update decides to store, as a SET, once the inner
+// storage has stored it.
+func (w *WALStorage) Update(dbIndex int, key string, update func(value string, exists bool) (string, bool, error)) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var stored *string
+	err := w.Storage.Update(dbIndex, key, func(current string, exists bool) (string, bool, error) {
+		value, store, err := update(current, exists)
+		if err == nil && store {
+			stored = &value
+		}
+		return value, store, err
+	})
+	if err == nil && stored != nil {
+		w.log(walOpSet, dbIndex, key, *stored)
+	}
+	return err
+}
+
+func (w *WALStorage) Del(dbIndex int, key string) int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, exists := w.Storage.Peek(dbIndex, key); !exists {
+		return 0
+	}
+	w.log(walOpDel, dbIndex, key)
+	return w.Storage.Del(dbIndex, key)
+}
+
+func (w *WALStorage) IncrBy(dbIndex int, key string, increment int64) (int64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	result, err := w.Storage.IncrBy(dbIndex, key, increment)
+	if err == nil {
+		w.log(walOpIncrBy, dbIndex, key, strconv.FormatInt(increment, 10))
+	}
+	return result, err
+}
+
+// Restore is logged as a single record holding the new contents, so
+// recovery never sees half of it.
+func (w *WALStorage) Restore(dbIndex int, data map[string]string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	args := make([]string, 0, 2*len(data))
+	for _, key := range sortedKeys(data) {
+		args = append(args, key, data[key])
+	}
+	w.log(walOpRestore, dbIndex, args...)
+	w.Storage.Restore(dbIndex, data)
+}
+
+// Checkpoint snapshots the inner storage and drops the log records it
+// covers. Writes are only blocked while the storage is frozen and while the
+// records logged during the snapshot are moved to the new log.
+func (w *WALStorage) Checkpoint() error {
+	w.mutex.Lock()
+	sequence, cutOffset := w.sequence, w.size
+	frozen := w.Storage.Freeze()
+	w.mutex.Unlock()
+
+	entries := frozenEntries(frozen)
+	frozen.Release()
+	var buffer bytes.Buffer
+	writer := persistence.NewWriter(&buffer)
+	writer.WriteAux(walSequenceAux, strconv.FormatUint(sequence, 10))
+	for _, e := range entries {
+		if err := writer.Write(persistence.Entry{DB: e.dbIndex, Key: e.key, Value: e.value}); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(checkpointPath(w.path), buffer.Bytes()); err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	tail := make([]byte, w.size-cutOffset)
+	if _, err := w.file.ReadAt(tail, cutOffset); err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(w.path, tail); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		w.setError(err)
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.size = int64(len(tail))
+	return nil
+}
+
+func (w *WALStorage) checkpointPeriodically() {
+	defer w.stopped.Done()
+	ticker := time.NewTicker(walCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.Checkpoint(); err != nil {
+				w.logger.Error("Write-ahead log checkpoint failed", "error", err)
+			}
+		}
+	}
+}
+
+// Close stops the periodic checkpoints and closes the log. It does not close
+// the inner storage.
+func (w *WALStorage) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	w.stopped.Wait()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
+}
+
+func (w *WALStorage) setClock(clock Clock) {
+	if inner, ok := w.Storage.(interface{ setClock(Clock) }); ok {
+		inner.setClock(clock)
+	}
+}
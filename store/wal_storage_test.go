@@ -0,0 +1,240 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openWALStorage(t *testing.T, path string) (*WALStorage, int) {
+	t.Helper()
+	inner := NewMemoryStorage(defaultNumDatabases)
+	recovered, err := RecoverWAL(inner, path)
+	if err != nil {
+		t.Fatalf("RecoverWAL() failed: %v", err)
+	}
+	storage, err := NewWALStorage(inner, path)
+	if err != nil {
+		t.Fatalf("NewWALStorage() failed: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage, recovered
+}
+
+// contents returns every key of storage, per database.
+func contents(storage Storage) map[int]map[string]string {
+	data := make(map[int]map[string]string)
+	storage.ForEach(func(dbIndex int, key, value string) {
+		if data[dbIndex] == nil {
+			data[dbIndex] = make(map[string]string)
+		}
+		data[dbIndex][key] = value
+	})
+	return data
+}
+
+func writeSampleData(storage Storage) {
+	storage.Set(0, "name", "batman")
+	storage.Set(0, "binary", "line\r\nbreak\x00")
+	storage.IncrBy(3, "counter", 40)
+	storage.IncrBy(3, "counter", 2)
+	storage.IncrBy(0, "name", 1)
+	storage.SetIfAbsent(0, "name", "robin")
+	storage.SetIfAbsent(5, "fresh", "value")
+	storage.Update(0, "name", func(value string, exists bool) (string, bool, error) {
+		return value + " begins", true, nil
+	})
+	storage.Set(1, "temporary", "value")
+	storage.Del(1, "temporary")
+	storage.Del(1, "missing")
+}
+
+func TestWALStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		storage, _ := openWALStorage(t, filepath.Join(t.TempDir(), "wal.log"))
+		return storage
+	})
+}
+
+func TestWALStorage_Recover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	storage, _ := openWALStorage(t, path)
+	writeSampleData(storage)
+	storage.Close()
+
+	recovered, replayed := openWALStorage(t, path)
+
+	if replayed != 8 {
+		t.Errorf("RecoverWAL() replayed %d records, expected 8", replayed)
+	}
+	expected := map[int]map[string]string{
+		0: {"name": "batman begins", "binary": "line\r\nbreak\x00"},
+		3: {"counter": "42"},
+		5: {"fresh": "value"},
+	}
+	if got := contents(recovered); !reflect.DeepEqual(got, expected) {
+		t.Errorf("recovered data = %v, expected %v", got, expected)
+	}
+
+	// New records continue the sequence after the recovered ones.
+	recovered.Set(0, "after", "recovery")
+	recovered.Close()
+	again, _ := openWALStorage(t, path)
+	if value, _ := again.Get(0, "after"); value != "recovery" {
+		t.Errorf("Get(after) = %q, expected a record written after recovery to replay", value)
+	}
+}
+
+func TestWALStorage_RecoverStopsAtCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	storage, _ := openWALStorage(t, path)
+	storage.Set(0, "first", "1")
+	sizeAfterFirst := storage.size
+	storage.Set(0, "second", "2")
+	storage.Set(0, "third", "3")
+	storage.Close()
+
+	content, _ := os.ReadFile(path)
+	content[sizeAfterFirst+walFrameSize+2] ^= 0xff
+	os.WriteFile(path, content, 0o644)
+
+	recovered, replayed := openWALStorage(t, path)
+
+	if replayed != 1 {
+		t.Errorf("RecoverWAL() replayed %d records, expected 1", replayed)
+	}
+	if got, expected := contents(recovered), map[int]map[string]string{0: {"first": "1"}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("recovered data = %v, expected %v", got, expected)
+	}
+
+	// The corrupt tail is cut off so new records are not lost behind it.
+	recovered.Set(0, "fourth", "4")
+	recovered.Close()
+	again, _ := openWALStorage(t, path)
+	if _, ok := again.Get(0, "fourth"); !ok {
+		t.Errorf("expected a record written after the corrupt tail was cut to replay")
+	}
+}
+
+func TestWALStorage_RecoverTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	storage, _ := openWALStorage(t, path)
+	storage.Set(0, "first", "1")
+	storage.Set(0, "second", "2")
+	storage.Close()
+
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-3)
+
+	recovered, replayed := openWALStorage(t, path)
+
+	if replayed != 1 {
+		t.Errorf("RecoverWAL() replayed %d records, expected 1", replayed)
+	}
+	if _, ok := recovered.Get(0, "second"); ok {
+		t.Errorf("expected the truncated record not to be applied")
+	}
+}
+
+func TestWALStorage_Checkpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	storage, _ := openWALStorage(t, path)
+	writeSampleData(storage)
+	before, _ := os.Stat(path)
+
+	if err := storage.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+
+	after, _ := os.Stat(path)
+	if after.Size() != 0 {
+		t.Errorf("log is %d bytes after a checkpoint, expected it truncated from %d", after.Size(), before.Size())
+	}
+	storage.IncrBy(3, "counter", 1)
+	storage.Del(0, "binary")
+	expected := contents(storage)
+	storage.Close()
+
+	recovered, replayed := openWALStorage(t, path)
+
+	if replayed != 2 {
+		t.Errorf("RecoverWAL() replayed %d records after the checkpoint, expected 2", replayed)
+	}
+	if got := contents(recovered); !reflect.DeepEqual(got, expected) {
+		t.Errorf("recovered data = %v, expected %v", got, expected)
+	}
+}
+
+func TestWALStorage_RecoverSkipsRecordsCoveredByCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	storage, _ := openWALStorage(t, path)
+	storage.IncrBy(0, "counter", 1)
+	storage.IncrBy(0, "counter", 1)
+	log, _ := os.ReadFile(path)
+	storage.Checkpoint()
+	storage.Close()
+
+	// A crash between writing the checkpoint and cutting the log leaves
+	// records the checkpoint already covers.
+	os.WriteFile(path, log, 0o644)
+
+	recovered, replayed := openWALStorage(t, path)
+
+	if replayed != 0 {
+		t.Errorf("RecoverWAL() replayed %d records, expected 0", replayed)
+	}
+	if value, _ := recovered.Get(0, "counter"); value != "2" {
+		t.Errorf("Get(counter) = %q, expected 2", value)
+	}
+}
+
+func TestWALStorage_WriteErrorRejectsWrites(t *testing.T) {
+	storage, _ := openWALStorage(t, filepath.Join(t.TempDir(), "wal.log"))
+	store := CreateNewStore(storage)
+	storage.file.Close()
+
+	store.Set(0, "name", "batman")
+
+	if err := store.CheckWrite(); err == nil {
+		t.Errorf("CheckWrite() = nil, expected an error after a failed log write")
+	}
+}
+
+func TestWALStorage_RecoverRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	storage, _ := openWALStorage(t, path)
+	storage.Set(0, "old", "value")
+	storage.Restore(0, map[string]string{"a": "1", "b": "2"})
+	storage.Set(0, "c", "3")
+	storage.Close()
+
+	recovered, replayed := openWALStorage(t, path)
+
+	if replayed != 3 {
+		t.Errorf("RecoverWAL() replayed %d records, expected 3", replayed)
+	}
+	if got, expected := recovered.Snapshot(0), map[string]string{"a": "1", "b": "2", "c": "3"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("recovered database = %v, expected %v", got, expected)
+	}
+}
+
+func TestWALStorage_RefusedWritesAreNotLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	storage, _ := openWALStorage(t, path)
+	storage.setQuota(func() (int64, int64) { return 1, 0 })
+	storage.Set(0, "name", "batman")
+	storage.SetIfAbsent(0, "fresh", "value")
+	storage.IncrBy(0, "counter", 1)
+	storage.Update(0, "other", func(string, bool) (string, bool, error) { return "value", true, nil })
+	storage.Close()
+
+	recovered, replayed := openWALStorage(t, path)
+
+	if replayed != 1 {
+		t.Errorf("RecoverWAL() replayed %d records, expected only the accepted write", replayed)
+	}
+	if got, expected := contents(recovered), map[int]map[string]string{0: {"name": "batman"}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("recovered data = %v, expected %v", got, expected)
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+// watchedKey is a key a client WATCHed, with its version at the time.
+type watchedKey struct {
+	dbIndex int
+	key     string
+	version uint64
+}
+
+// Watch records the current version of keys for the client's next EXEC,
+// which is aborted if any of them has changed by then. Watching a key twice
+// keeps the first version.
+func (s *Store) Watch(clientId int64, dbIndex int, keys []string) error {
+	if err := s.checkDBIndex(dbIndex); err != nil {
+		return err
+	}
+	s.transactionMutex.Lock()
+	defer s.transactionMutex.Unlock()
+
+	watched := s.watches[clientId]
+	for _, key := range keys {
+		if !isWatched(watched, dbIndex, key) {
+			watched = append(watched, watchedKey{dbIndex, key, s.storage.Version(dbIndex, key)})
+		}
+	}
+	s.watches[clientId] = watched
+	return nil
+}
+
+func isWatched(watched []watchedKey, dbIndex int, key string) bool {
+	for _, w := range watched {
+		if w.dbIndex == dbIndex && w.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwatch forgets every key the client watched.
+func (s *Store) Unwatch(clientId int64) {
+	s.transactionMutex.Lock()
+	defer s.transactionMutex.Unlock()
+	delete(s.watches, clientId)
+}
+
+// watchedKeysChanged must be called with the execution mutex held, so no
+// write can land between the check and the transaction.
+func (s *Store) watchedKeysChanged(watched []watchedKey) bool {
+	for _, w := range watched {
+		if s.storage.Version(w.dbIndex, w.key) != w.version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		watch   func(s *Store)
+		between func(s *Store)
+		aborted bool
+	}{
+		{"unchanged", func(s *Store) { s.Watch(1, 0, []string{"name"}) }, func(s *Store) { s.Get(0, "name") }, false},
+		{"overwritten", func(s *Store) { s.Watch(1, 0, []string{"name"}) }, func(s *Store) { s.Set(0, "name", "batman") }, true},
+		{"deleted", func(s *Store) { s.Watch(1, 0, []string{"name"}) }, func(s *Store) { s.Del(0, "name") }, true},
+		{"missing key created", func(s *Store) { s.Watch(1, 0, []string{"missing"}) }, func(s *Store) { s.Set(0, "missing", "1") }, true},
+		{"flushed", func(s *Store) { s.Watch(1, 0, []string{"name"}) }, func(s *Store) { s.FlushDB(0) }, true},
+		{"other database", func(s *Store) { s.Watch(1, 0, []string{"name"}) }, func(s *Store) { s.Set(1, "name", "robin") }, false},
+		{"watched in another database", func(s *Store) { s.Watch(1, 1, []string{"name"}) }, func(s *Store) { s.Set(1, "name", "robin") }, true},
+		{"watched twice", func(s *Store) {
+			s.Watch(1, 0, []string{"name"})
+			s.Set(0, "name", "robin")
+			s.Watch(1, 0, []string{"name"})
+		}, func(s *Store) {}, true},
+		{"unwatched", func(s *Store) {
+			s.Watch(1, 0, []string{"name"})
+			s.Unwatch(1)
+		}, func(s *Store) { s.Set(0, "name", "robin") }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := getInMemoryStore(t)
+			store.Set(0, "name", "batman")
+			tt.watch(store)
+			store.StartTransaction(1)
+			store.QueueCommand(1, "SET", []string{"result", "ran"})
+			tt.between(store)
+
+			results, err := store.ExecuteTransaction(1, runCommand)
+
+			if err != nil {
+				t.Fatalf("ExecuteTransaction() failed: %v", err)
+			}
+			if aborted := results == nil; aborted != tt.aborted {
+				t.Errorf("ExecuteTransaction() aborted = %t, expected %t", aborted, tt.aborted)
+			}
+			if _, ran, _ := store.Get(0, "result"); ran == tt.aborted {
+				t.Errorf("queued SET ran = %t, expected %t", ran, !tt.aborted)
+			}
+			if store.InTransaction(1) {
+				t.Errorf("expected the transaction to end")
+			}
+		})
+	}
+}
+
+func TestWatch_ClearedAfterTransaction(t *testing.T) {
+	ends := map[string]func(s *Store){
+		"EXEC":       func(s *Store) { s.ExecuteTransaction(1, runCommand) },
+		"DISCARD":    func(s *Store) { s.DiscardTransaction(1) },
+		"disconnect": func(s *Store) { s.DiscardTransaction(1); s.RemoveClient(1) },
+	}
+	for name, end := range ends {
+		t.Run(name, func(t *testing.T) {
+			store := getInMemoryStore(t)
+			store.Watch(1, 0, []string{"name"})
+			store.StartTransaction(1)
+			end(store)
+
+			store.Set(0, "name", "batman")
+			store.StartTransaction(1)
+			store.QueueCommand(1, "GET", []string{"name"})
+			if results, _ := store.ExecuteTransaction(1, runCommand); !reflect.DeepEqual(results, []Result{valueResult("batman")}) {
+				t.Errorf("ExecuteTransaction() = %v, expected the earlier WATCH to be forgotten", results)
+			}
+		})
+	}
+}
+
+func TestWatch_ConcurrentWriterAbortsExec(t *testing.T) {
+	store := getInMemoryStore(t)
+	store.Set(0, "counter", "10")
+
+	// Check and set: read the counter, then write it back doubled unless
+	// another client got there first.
+	store.Watch(1, 0, []string{"counter"})
+	value, _, _ := store.Get(0, "counter")
+	written := make(chan struct{})
+	go func() {
+		store.Incr(0, "counter")
+		close(written)
+	}()
+	<-written
+	store.StartTransaction(1)
+	store.QueueCommand(1, "SET", []string{"counter", value + "0"})
+
+	if results, err := store.ExecuteTransaction(1, runCommand); results != nil || err != nil {
+		t.Fatalf("ExecuteTransaction() = %v, %v, expected an aborted EXEC", results, err)
+	}
+	if value, _, _ := store.Get(0, "counter"); value != "11" {
+		t.Errorf("Get(counter) = %q, expected the concurrent increment to survive", value)
+	}
+}